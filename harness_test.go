@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"unicode/utf8"
+)
+
+/*
+ * in-memory vt100 terminal
+ */
+
+type cell struct {
+	r       rune // 0 for the right half of the full width character
+	fg      int
+	bg      int
+	inverse bool
+}
+
+// vt100screen is an in-memory terminal which interprets the escape sequences
+// written by unixVT100term into a cell grid.
+type vt100screen struct {
+	width  int
+	height int
+	cells  [][]cell
+
+	x       int
+	y       int
+	fg      int
+	bg      int
+	inverse bool
+
+	cursorvisible bool
+	clipboard     string // the content set by OSC 52
+	// the number of times the clipboard content is asked by OSC 52
+	clipboardqueries int
+	modes            map[string]bool
+
+	// incomplete escape sequence or utf8 bytes carried over to the next write
+	pending []byte
+}
+
+func newvt100screen(width, height int) *vt100screen {
+	s := &vt100screen{width: width, height: height, fg: -1, bg: -1, cursorvisible: true, modes: map[string]bool{}}
+	s.clear()
+	return s
+}
+
+func (s *vt100screen) clear() {
+	s.cells = make([][]cell, s.height)
+	for y := range s.cells {
+		s.cells[y] = slices.Repeat([]cell{{r: ' ', fg: -1, bg: -1}}, s.width)
+	}
+}
+
+func (s *vt100screen) Write(b []byte) (int, error) {
+	s.pending = append(s.pending, b...)
+	for len(s.pending) != 0 {
+		n := s.consume(s.pending)
+		if n == 0 {
+			// wait for the rest
+			break
+		}
+		s.pending = s.pending[n:]
+	}
+	return len(b), nil
+}
+
+// interpret the head of b. It returns the number of bytes consumed, or 0 if b is incomplete.
+func (s *vt100screen) consume(b []byte) int {
+	if b[0] != 0x1b {
+		if !utf8.FullRune(b) {
+			return 0
+		}
+		r, n := utf8.DecodeRune(b)
+		s.put(r)
+		return n
+	}
+
+	if len(b) < 2 {
+		return 0
+	}
+
+	switch b[1] {
+	case '[':
+		// CSI: parameters then a final byte
+		for i := 2; i < len(b); i++ {
+			if 0x40 <= b[i] && b[i] <= 0x7e {
+				s.csi(string(b[2:i]), b[i])
+				return i + 1
+			}
+		}
+		return 0
+
+	case ']':
+		// OSC: terminated by BEL or ST
+		for i := 2; i < len(b); i++ {
+			if b[i] == 0x07 {
+				s.osc(string(b[2:i]))
+				return i + 1
+			}
+			if b[i] == 0x1b && i+1 < len(b) && b[i+1] == '\\' {
+				s.osc(string(b[2:i]))
+				return i + 2
+			}
+		}
+		return 0
+
+	default:
+		return 2
+	}
+}
+
+func (s *vt100screen) csi(params string, final byte) {
+	if strings.HasPrefix(params, "?") {
+		switch final {
+		case 'h':
+			s.modes[params] = true
+		case 'l':
+			s.modes[params] = false
+		}
+		if params == "?25" {
+			s.cursorvisible = final == 'h'
+		}
+		return
+	}
+
+	nums := []int{}
+	for p := range strings.SplitSeq(params, ";") {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			n = 0
+		}
+		nums = append(nums, n)
+	}
+
+	switch final {
+	case 'H':
+		y, x := 1, 1
+		if 1 <= len(nums) && nums[0] != 0 {
+			y = nums[0]
+		}
+		if 2 <= len(nums) && nums[1] != 0 {
+			x = nums[1]
+		}
+		s.x, s.y = x-1, y-1
+
+	case 'J':
+		if nums[0] == 2 {
+			s.clear()
+		}
+
+	case 'm':
+		for i := 0; i < len(nums); i++ {
+			switch nums[i] {
+			case 0:
+				s.fg, s.bg, s.inverse = -1, -1, false
+			case 7:
+				s.inverse = true
+			case 27:
+				s.inverse = false
+			case 39:
+				s.fg = -1
+			case 49:
+				s.bg = -1
+			case 38, 48:
+				target := nums[i]
+				color := -1
+				switch {
+				case i+2 < len(nums) && nums[i+1] == 5:
+					color = nums[i+2]
+					i += 2
+				case i+4 < len(nums) && nums[i+1] == 2:
+					// truecolor is recorded as 0xrrggbb with the highest bit
+					color = 1<<24 | nums[i+2]<<16 | nums[i+3]<<8 | nums[i+4]
+					i += 4
+				}
+				if target == 38 {
+					s.fg = color
+				} else {
+					s.bg = color
+				}
+			}
+		}
+	}
+}
+
+func (s *vt100screen) osc(body string) {
+	parts := strings.SplitN(body, ";", 3)
+	if len(parts) != 3 || parts[0] != "52" {
+		return
+	}
+
+	if parts[2] == "?" {
+		s.clipboardqueries++
+		return
+	}
+	decoded, _ := base64.StdEncoding.DecodeString(parts[2])
+	s.clipboard = string(decoded)
+}
+
+func (s *vt100screen) put(r rune) {
+	w := 1
+	if fullwidth(r) {
+		w = 2
+	}
+
+	if s.y < 0 || s.height <= s.y || s.x < 0 || s.width < s.x+w {
+		s.x += w
+		return
+	}
+
+	s.cells[s.y][s.x] = cell{r: r, fg: s.fg, bg: s.bg, inverse: s.inverse}
+	if w == 2 {
+		s.cells[s.y][s.x+1] = cell{r: 0, fg: s.fg, bg: s.bg, inverse: s.inverse}
+	}
+	s.x += w
+}
+
+// return the text on the row y without trailing spaces.
+func (s *vt100screen) row(y int) string {
+	var sb strings.Builder
+	for _, c := range s.cells[y] {
+		if c.r != 0 {
+			sb.WriteRune(c.r)
+		}
+	}
+	return strings.TrimRight(sb.String(), " ")
+}
+
+func (s *vt100screen) rows() []string {
+	rows := make([]string, s.height)
+	for y := range rows {
+		rows[y] = s.row(y)
+	}
+	return rows
+}
+
+// return the x positions of inverted cells on the row y, which are rendered as cursors.
+func (s *vt100screen) inverted(y int) []int {
+	xs := []int{}
+	for x, c := range s.cells[y] {
+		if c.inverse {
+			xs = append(xs, x)
+		}
+	}
+	return xs
+}
+
+// testterm is a terminal which writes the VT100 sequences into vt100screen
+// instead of the real terminal.
+type testterm struct {
+	*unixVT100term
+	screen *vt100screen
+
+	// the number of times the terminal is initialized and restored
+	inits int
+	fins  int
+	// notified on every initialization if not nil
+	initialized chan struct{}
+	// the window size cannot be got if true
+	nosize atomic.Bool
+}
+
+func newtestterm(width, height int) *testterm {
+	screen := newvt100screen(width, height)
+	return &testterm{unixVT100term: &unixVT100term{w: screen}, screen: screen}
+}
+
+func (t *testterm) init() (func(), error) {
+	t.inits++
+	if t.initialized != nil {
+		t.initialized <- struct{}{}
+	}
+	return func() { t.fins++ }, nil
+}
+
+// resume immediately as if "fg" is typed on the shell.
+func (t *testterm) suspend() {
+	syscall.Kill(os.Getpid(), syscall.SIGCONT)
+}
+
+func (t *testterm) windowsize() (int, int, error) {
+	if t.nosize.Load() {
+		return 0, 0, fmt.Errorf("window size is not available")
+	}
+	return t.screen.width, t.screen.height, nil
+}
+
+/*
+ * key script
+ */
+
+var keynames = map[string]string{
+	"lt":       "<",
+	"Esc":      "\x1b",
+	"CR":       "\r",
+	"BS":       "\x7f",
+	"Tab":      "\t",
+	"Up":       "\x1b[A",
+	"Down":     "\x1b[B",
+	"Right":    "\x1b[C",
+	"Left":     "\x1b[D",
+	"Home":     "\x1b[H",
+	"End":      "\x1b[F",
+	"Del":      "\x1b[3~",
+	"PageUp":   "\x1b[5~",
+	"PageDown": "\x1b[6~",
+	"S-Tab":    "\x1b[Z",
+	"C-Right":  "\x1b[1;5C",
+	"C-Left":   "\x1b[1;5D",
+	"F1":       "\x1bOP",
+	"F5":       "\x1b[15~",
+}
+
+func init() {
+	for c := 'a'; c <= 'z'; c++ {
+		keynames["C-"+string(c)] = string(rune(c - 'a' + 1))
+	}
+}
+
+// split the key script into the bytes of each keypress.
+// Special keys are written like <Esc>, <CR> or <C-r>, and "<" itself is <lt>.
+func keyseqs(script string) [][]byte {
+	seqs := [][]byte{}
+	for len(script) != 0 {
+		if script[0] == '<' {
+			if end := strings.Index(script, ">"); end != -1 {
+				if seq, ok := keynames[script[1:end]]; ok {
+					seqs = append(seqs, []byte(seq))
+					script = script[end+1:]
+					continue
+				}
+			}
+		}
+
+		_, n := utf8.DecodeRuneInString(script)
+		seqs = append(seqs, []byte(script[:n]))
+		script = script[n:]
+	}
+	return seqs
+}
+
+// decode the key script into the inputs through the reader.
+func keys(script string) []*input {
+	inputs := []*input{}
+	for _, seq := range keyseqs(script) {
+		r := newreader(bytes.NewReader(seq), defaultescdelay)
+		inputs = append(inputs, r.read())
+	}
+	return inputs
+}
+
+/*
+ * test editor
+ */
+
+type testeditor struct {
+	t    *testing.T
+	e    *editor
+	term *testterm
+	file *os.File
+	quit bool
+}
+
+func newtesteditor(t *testing.T, content string) *testeditor {
+	return newtesteditorfile(t, "test.txt", content, 40, 10)
+}
+
+// create the editor opening the file which has the given name and content.
+func newtesteditorfile(t *testing.T, name, content string, width, height int) *testeditor {
+	t.Helper()
+
+	filename := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return opentesteditor(t, filename, width, height)
+}
+
+// create the editor opening the existing file.
+func opentesteditor(t *testing.T, filename string, width, height int) *testeditor {
+	t.Helper()
+	return opentesteditoropts(t, filename, width, height, &options{theme: theme_doraemon})
+}
+
+// create the editor opening the existing file with the options.
+func opentesteditoropts(t *testing.T, filename string, width, height int, opts *options) *testeditor {
+	t.Helper()
+
+	file, err := os.OpenFile(filename, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+
+	term := newtestterm(width, height)
+	e := neweditor(term, file, opts, width, height)
+	e.render(true)
+
+	return &testeditor{t: t, e: e, term: term, file: file}
+}
+
+func (te *testeditor) screen() *screen {
+	return te.e.activewin.screen
+}
+
+// type the key script. Every key is processed synchronously.
+func (te *testeditor) typ(script string) {
+	te.t.Helper()
+
+	inputs := keys(script)
+	ch := make(chan *input, len(inputs))
+	for _, in := range inputs {
+		ch <- in
+	}
+	// the command lacking the following keys is cancelled instead of blocking
+	close(ch)
+
+	for len(ch) != 0 {
+		if te.quit {
+			te.t.Fatalf("keys are typed after the editor finished: %q", script)
+		}
+		if !te.e.handleinput(<-ch, ch) {
+			te.quit = true
+		}
+	}
+}
+
+// send the input which cannot be written in the key script like the paste.
+func (te *testeditor) send(in *input) {
+	te.t.Helper()
+
+	ch := make(chan *input)
+	close(ch)
+	if !te.e.handleinput(in, ch) {
+		te.quit = true
+	}
+}
+
+// wait for parsing Go in the background for the semantic highlighting and apply the results.
+func (te *testeditor) waitsemantic() {
+	for _, b := range te.e.buffers {
+		for b.semantic != nil && b.semantic.running {
+			res := <-te.e.semanticresults
+			res.buffer.applysemantic(res.lines)
+		}
+	}
+}
+
+func (te *testeditor) assertlines(want ...string) {
+	te.t.Helper()
+
+	got := []string{}
+	for _, l := range te.screen().lines {
+		got = append(got, l.text())
+	}
+
+	if !slices.Equal(got, want) {
+		te.t.Errorf("lines mismatch\n  want: %q\n  got:  %q", want, got)
+	}
+}
+
+// assert the cursor positions. Each position is {line, character index}.
+func (te *testeditor) assertcursors(want ...[2]int) {
+	te.t.Helper()
+
+	got := [][2]int{}
+	for _, c := range te.screen().cursors {
+		got = append(got, [2]int{c.y, te.screen().xidx(c)})
+	}
+
+	if !slices.Equal(got, want) {
+		te.t.Errorf("cursors mismatch\n  want: %v\n  got:  %v", want, got)
+	}
+}
+
+func (te *testeditor) assertmode(want mode) {
+	te.t.Helper()
+
+	if te.e.mode != want {
+		te.t.Errorf("mode mismatch\n  want: %v\n  got:  %v", want, te.e.mode)
+	}
+}
+
+// assert the rendered rows from the top. Rows after want are not checked.
+func (te *testeditor) assertscreen(want ...string) {
+	te.t.Helper()
+
+	got := te.term.screen.rows()[:len(want)]
+	if !slices.Equal(got, want) {
+		te.t.Errorf("screen mismatch\n  want:\n%v\n  got:\n%v", fmtrows(want), fmtrows(got))
+	}
+}
+
+// assert the message shown on the bottom row.
+func (te *testeditor) assertmsg(want string) {
+	te.t.Helper()
+
+	got := te.term.screen.row(te.term.screen.height - 1)
+	if got != want {
+		te.t.Errorf("message mismatch\n  want: %q\n  got:  %q", want, got)
+	}
+}
+
+func (te *testeditor) assertfile(want string) {
+	te.t.Helper()
+
+	got, err := os.ReadFile(te.file.Name())
+	if err != nil {
+		te.t.Fatal(err)
+	}
+
+	if string(got) != want {
+		te.t.Errorf("file content mismatch\n  want: %q\n  got:  %q", want, string(got))
+	}
+}
+
+func fmtrows(rows []string) string {
+	var sb strings.Builder
+	for _, r := range rows {
+		sb.WriteString(fmt.Sprintf("    |%v|\n", r))
+	}
+	return sb.String()
+}
@@ -1,17 +1,28 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/scanner"
+	gotoken "go/token"
 	"io"
+	"maps"
 	"os"
 	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	runtimedebug "runtime/debug"
 	"slices"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 	"unicode"
 	"unicode/utf8"
 
@@ -50,6 +61,8 @@ const (
 	insert
 	command
 	lineselect
+	charselect
+	search
 )
 
 func (m mode) String() string {
@@ -62,6 +75,10 @@ func (m mode) String() string {
 		return "CMND"
 	case lineselect:
 		return "LSEL"
+	case charselect:
+		return "CSEL"
+	case search:
+		return "SRCH"
 	default:
 		panic("unknown mode")
 	}
@@ -95,13 +112,42 @@ func newcharacter(r rune) *character {
 		return &character{r: r, width: 2, disp: string(r)}
 	}
 
+	// control characters like a carriage return in a file with mixed line endings are rendered as "^M".
+	if iscontrol(r) {
+		return &character{r: r, width: 2, disp: "^" + string(r^0x40)}
+	}
+
 	return &character{r: r, width: 1, disp: string(r)}
 }
 
+func newcharacters(s string) []*character {
+	chars := []*character{}
+	for _, r := range s {
+		chars = append(chars, newcharacter(r))
+	}
+	return chars
+}
+
+func iscontrol(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
+
 func (c *character) copy() *character {
 	return &character{c.r, c.tab, c.nl, c.width, c.disp}
 }
 
+// return the rune which the character represents in the file.
+func (c *character) raw() rune {
+	switch {
+	case c.tab:
+		return '\t'
+	case c.nl:
+		return '\n'
+	default:
+		return c.r
+	}
+}
+
 func (c *character) isspace() bool {
 	return c.r == ' ' || c.tab
 }
@@ -157,6 +203,45 @@ func (l *line) String() string {
 	return sb.String()
 }
 
+// return the raw text of the line without newline.
+func (l *line) text() string {
+	var sb strings.Builder
+	for _, c := range l.buffer[:len(l.buffer)-1] {
+		sb.WriteRune(c.raw())
+	}
+	return sb.String()
+}
+
+// return the character index ranges [start, end) matching to re.
+// Empty matches are ignored.
+func (l *line) matches(re *regexp.Regexp) [][2]int {
+	return slices.DeleteFunc(l.allmatches(re), func(r [2]int) bool { return r[0] == r[1] })
+}
+
+// return the character index ranges [start, end) matching to re including the empty matches like "^".
+func (l *line) allmatches(re *regexp.Regexp) [][2]int {
+	text := l.text()
+	locs := re.FindAllStringIndex(text, -1)
+	if len(locs) == 0 {
+		return nil
+	}
+
+	// convert byte offsets to character indices
+	idxs := make([]int, len(text)+1)
+	i := 0
+	for off := range text {
+		idxs[off] = i
+		i++
+	}
+	idxs[len(text)] = i
+
+	ranges := [][2]int{}
+	for _, loc := range locs {
+		ranges = append(ranges, [2]int{idxs[loc[0]], idxs[loc[1]]})
+	}
+	return ranges
+}
+
 func (l *line) charidx(cursor, offset int) int {
 	x := -offset
 	for i, c := range l.buffer {
@@ -258,20 +343,6 @@ func (l *line) substring(start, end int) string {
 }
 
 func (l *line) cutandcolorize(from, width int, colors []int, bgcolors []int, inverts []int) string {
-	colorize := func(s string, color int) string {
-		if color == -1 {
-			return s
-		}
-		return fmt.Sprintf("\x1b[38;5;%dm%v\x1b[0m", color, s)
-	}
-
-	colorizebg := func(s string, color int) string {
-		if color == -1 {
-			return s
-		}
-		return fmt.Sprintf("\x1b[48;5;%dm%v\x1b[0m", color, s)
-	}
-
 	invert := func(s string) string {
 		return fmt.Sprintf("\x1b[7m%v\x1b[27m", s)
 	}
@@ -303,6 +374,25 @@ func (l *line) cutandcolorize(from, width int, colors []int, bgcolors []int, inv
 				_inverts = append(_inverts, length-4, length-3, length-2, length-1)
 			}
 
+		case !l.buffer[i].nl && iscontrol(l.buffer[i].r):
+			runes = append(runes, []rune(l.buffer[i].disp)...)
+			if len(colors) != 0 {
+				_colors = append(_colors, colors[i], colors[i])
+			} else {
+				_colors = append(_colors, -1, -1)
+			}
+			if len(bgcolors) != 0 {
+				_bgcolors = append(_bgcolors, bgcolors[i], bgcolors[i])
+			} else {
+				_bgcolors = append(_bgcolors, -1, -1)
+			}
+			widths = append(widths, 1, 1)
+
+			if slices.Contains(inverts, i) {
+				length := len(runes)
+				_inverts = append(_inverts, length-2, length-1)
+			}
+
 		case l.buffer[i].nl:
 			runes = append(runes, ' ')
 			widths = append(widths, 1)
@@ -392,6 +482,26 @@ type theme struct {
 	colornumber          int
 	colorlinecomment     int
 	colorblockcomment    int
+
+	// identifiers found by parsing Go (see --semantic)
+	colorpackage  int
+	colortype     int
+	colorfunction int
+	colorfield    int
+
+	// markdown
+	colorheading    int
+	coloremphasis   int
+	colorcode       int // inline code and fenced code blocks
+	colorlink       int
+	colorlistmarker int // also block quote marker
+
+	// user interface
+	colorstatusline int // file name of the focused window
+	colorlinenumber int
+	colorselection  int // background
+	colorsearch     int // background of the search matches
+	colorerror      int // error message
 }
 
 var (
@@ -405,6 +515,23 @@ var (
 		colornumber:          202,
 		colorlinecomment:     240,
 		colorblockcomment:    240,
+
+		colorpackage:  172,
+		colortype:     37,
+		colorfunction: 75,
+		colorfield:    110,
+
+		colorheading:    220,
+		coloremphasis:   202,
+		colorcode:       160,
+		colorlink:       32,
+		colorlistmarker: 220,
+
+		colorstatusline: 51,
+		colorlinenumber: 243,
+		colorselection:  3,
+		colorsearch:     24,
+		colorerror:      1,
 	}
 
 	theme_nobita = &theme{
@@ -417,6 +544,23 @@ var (
 		colornumber:          38,
 		colorlinecomment:     240,
 		colorblockcomment:    240,
+
+		colorpackage:  214,
+		colortype:     45,
+		colorfunction: 81,
+		colorfield:    229,
+
+		colorheading:    27,
+		coloremphasis:   38,
+		colorcode:       180,
+		colorlink:       11,
+		colorlistmarker: 27,
+
+		colorstatusline: 51,
+		colorlinenumber: 243,
+		colorselection:  3,
+		colorsearch:     24,
+		colorerror:      1,
 	}
 
 	theme_shizuka = &theme{
@@ -429,6 +573,23 @@ var (
 		colornumber:          11,
 		colorlinecomment:     240,
 		colorblockcomment:    240,
+
+		colorpackage:  139,
+		colortype:     168,
+		colorfunction: 211,
+		colorfield:    182,
+
+		colorheading:    217,
+		coloremphasis:   11,
+		colorcode:       125,
+		colorlink:       176,
+		colorlistmarker: 125,
+
+		colorstatusline: 51,
+		colorlinenumber: 243,
+		colorselection:  3,
+		colorsearch:     24,
+		colorerror:      1,
 	}
 
 	theme_suneo = &theme{
@@ -441,6 +602,23 @@ var (
 		colornumber:          -1,
 		colorlinecomment:     240,
 		colorblockcomment:    240,
+
+		colorpackage:  173,
+		colortype:     36,
+		colorfunction: 71,
+		colorfield:    114,
+
+		colorheading:    217,
+		coloremphasis:   130,
+		colorcode:       220,
+		colorlink:       34,
+		colorlistmarker: 130,
+
+		colorstatusline: 51,
+		colorlinenumber: 243,
+		colorselection:  3,
+		colorsearch:     24,
+		colorerror:      1,
 	}
 
 	theme_gian = &theme{
@@ -453,9 +631,276 @@ var (
 		colornumber:          172,
 		colorlinecomment:     240,
 		colorblockcomment:    240,
+
+		colorpackage:  130,
+		colortype:     33,
+		colorfunction: 179,
+		colorfield:    223,
+
+		colorheading:    186,
+		coloremphasis:   172,
+		colorcode:       216,
+		colorlink:       208,
+		colorlistmarker: 21,
+
+		colorstatusline: 51,
+		colorlinenumber: 243,
+		colorselection:  3,
+		colorsearch:     24,
+		colorerror:      1,
 	}
 )
 
+// themes are selectable by the name via --theme. The themes in the config file are added on startup.
+var themes = map[string]*theme{
+	"doraemon": theme_doraemon,
+	"nobita":   theme_nobita,
+	"shizuka":  theme_shizuka,
+	"suneo":    theme_suneo,
+	"gian":     theme_gian,
+}
+
+// the color is a 256-color index, or the 24-bit color which has truecolorflag.
+// -1 means the default color of the terminal.
+const truecolorflag = 1 << 24
+
+func rgbcolor(r, g, b int) int {
+	return truecolorflag | r<<16 | g<<8 | b
+}
+
+// return the SGR parameters to set the color. base is 38 for the foreground, 48 for the background.
+func sgrcolor(base, color int) string {
+	if color&truecolorflag != 0 {
+		return fmt.Sprintf("%d;2;%d;%d;%d", base, color>>16&0xff, color>>8&0xff, color&0xff)
+	}
+	return fmt.Sprintf("%d;5;%d", base, color)
+}
+
+func colorize(s string, color int) string {
+	if color == -1 {
+		return s
+	}
+	return fmt.Sprintf("\x1b[%vm%v\x1b[0m", sgrcolor(38, color), s)
+}
+
+func colorizebg(s string, color int) string {
+	if color == -1 {
+		return s
+	}
+	return fmt.Sprintf("\x1b[%vm%v\x1b[0m", sgrcolor(48, color), s)
+}
+
+// return the closest color in the 6x6x6 color cube or the grayscale ramp of the 256 colors.
+func to256color(r, g, b int) int {
+	// the levels of the color cube
+	levels := []int{0, 95, 135, 175, 215, 255}
+	closest := func(v int) int {
+		idx := 0
+		for i, l := range levels {
+			if abs(v-l) < abs(v-levels[idx]) {
+				idx = i
+			}
+		}
+		return idx
+	}
+
+	distance := func(r2, g2, b2 int) int {
+		return (r-r2)*(r-r2) + (g-g2)*(g-g2) + (b-b2)*(b-b2)
+	}
+
+	cr, cg, cb := closest(r), closest(g), closest(b)
+	cube := 16 + 36*cr + 6*cg + cb
+	cubedist := distance(levels[cr], levels[cg], levels[cb])
+
+	// the grayscale ramp is 8, 18, ..., 238
+	gray := min(23, max(0, ((r+g+b)/3-3)/10))
+	graylevel := 8 + gray*10
+	if distance(graylevel, graylevel, graylevel) < cubedist {
+		return 232 + gray
+	}
+	return cube
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// return whether the terminal supports the 24-bit colors, which is told by $COLORTERM.
+func truecolorsupported() bool {
+	colorterm := os.Getenv("COLORTERM")
+	return colorterm == "truecolor" || colorterm == "24bit"
+}
+
+// parse the color in the theme file. It is a 256-color index (-1 is the default color), or "#rrggbb".
+// "#rrggbb" is converted to the closest 256-color if truecolor is false.
+func parsecolor(v any, truecolor bool) (int, error) {
+	switch v := v.(type) {
+	case float64:
+		if v != float64(int(v)) || v < -1 || 255 < v {
+			return 0, fmt.Errorf("color must be -1 to 255: %v", v)
+		}
+		return int(v), nil
+
+	case string:
+		if len(v) != 7 || v[0] != '#' {
+			return 0, fmt.Errorf("color must be like \"#rrggbb\": %q", v)
+		}
+		rgb, err := strconv.ParseUint(v[1:], 16, 32)
+		if err != nil {
+			return 0, fmt.Errorf("color must be like \"#rrggbb\": %q", v)
+		}
+
+		r, g, b := int(rgb>>16&0xff), int(rgb>>8&0xff), int(rgb&0xff)
+		if !truecolor {
+			return to256color(r, g, b), nil
+		}
+		return rgbcolor(r, g, b), nil
+
+	default:
+		return 0, fmt.Errorf("color must be a number or \"#rrggbb\": %v", v)
+	}
+}
+
+// return the colors of the theme by the keys in the theme file.
+func (t *theme) colorfields() map[string]*int {
+	return map[string]*int{
+		"ident":           &t.colorident,
+		"keyword":         &t.colorkeyword,
+		"operator":        &t.coloroperator,
+		"symbol":          &t.colorsymbol,
+		"string":          &t.colorstring,
+		"multilinestring": &t.colormultilinestring,
+		"number":          &t.colornumber,
+		"linecomment":     &t.colorlinecomment,
+		"blockcomment":    &t.colorblockcomment,
+		"package":         &t.colorpackage,
+		"type":            &t.colortype,
+		"function":        &t.colorfunction,
+		"field":           &t.colorfield,
+		"heading":         &t.colorheading,
+		"emphasis":        &t.coloremphasis,
+		"code":            &t.colorcode,
+		"link":            &t.colorlink,
+		"listmarker":      &t.colorlistmarker,
+		"statusline":      &t.colorstatusline,
+		"linenumber":      &t.colorlinenumber,
+		"selection":       &t.colorselection,
+		"search":          &t.colorsearch,
+		"error":           &t.colorerror,
+	}
+}
+
+// load the themes from themes.toml or themes.json in the directory and add them to themes.
+// Each table in the file is a theme named by the table name. It is based on the theme given by "base"
+// (doraemon if omitted), and the colors not written in the file are taken from the base.
+// A missing file is not an error.
+func loadthemes(dir string, truecolor bool) []error {
+	var errs []error
+	for _, name := range []string{"themes.toml", "themes.json"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				errs = append(errs, fmt.Errorf("theme file %v: %w", name, err))
+			}
+			continue
+		}
+
+		if err := readthemes(name, data, truecolor); err != nil {
+			errs = append(errs, fmt.Errorf("theme file %v: %w", name, err))
+		}
+	}
+	return errs
+}
+
+// read the themes written in the file and add them to themes. The format is chosen by the extension of the name.
+func readthemes(name string, data []byte, truecolor bool) error {
+	if filepath.Ext(name) == ".toml" {
+		values, err := parsetoml(string(data))
+		if err != nil {
+			return err
+		}
+
+		// the values are decoded through JSON to handle both formats in the same way
+		data, err = json.Marshal(values)
+		if err != nil {
+			return err
+		}
+	}
+
+	var defs map[string]map[string]any
+	if err := json.Unmarshal(data, &defs); err != nil {
+		return err
+	}
+
+	// the themes are added after all of them are valid
+	loaded := map[string]*theme{}
+	resolving := map[string]bool{}
+
+	var resolve func(themename string) (*theme, error)
+	resolve = func(themename string) (*theme, error) {
+		if t, ok := loaded[themename]; ok {
+			return t, nil
+		}
+		if resolving[themename] {
+			return nil, fmt.Errorf("%v: base theme loops", themename)
+		}
+		resolving[themename] = true
+		def := defs[themename]
+
+		basename := "doraemon"
+		if b, ok := def["base"]; ok {
+			if basename, ok = b.(string); !ok {
+				return nil, fmt.Errorf("%v: base must be a theme name: %v", themename, b)
+			}
+		}
+
+		// the base is searched in the file first, except the theme overriding the built-in one of the same name
+		var base *theme
+		if _, ok := defs[basename]; ok && basename != themename {
+			var err error
+			if base, err = resolve(basename); err != nil {
+				return nil, err
+			}
+		} else if base, ok = themes[basename]; !ok {
+			return nil, fmt.Errorf("%v: unknown base theme: %v", themename, basename)
+		}
+
+		t := *base
+		fields := t.colorfields()
+		for _, key := range slices.Sorted(maps.Keys(def)) {
+			if key == "base" {
+				continue
+			}
+
+			field, ok := fields[key]
+			if !ok {
+				return nil, fmt.Errorf("%v: unknown color: %v", themename, key)
+			}
+
+			color, err := parsecolor(def[key], truecolor)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v: %w", themename, key, err)
+			}
+			*field = color
+		}
+
+		loaded[themename] = &t
+		return &t, nil
+	}
+
+	for _, themename := range slices.Sorted(maps.Keys(defs)) {
+		if _, err := resolve(themename); err != nil {
+			return err
+		}
+	}
+
+	maps.Copy(themes, loaded)
+	return nil
+}
+
 type nophighlighter struct{}
 
 func (h nophighlighter) highlightline(l *line, _ *lineattribute) *lineattribute {
@@ -467,66 +912,28 @@ type clikelangbasichighlighter struct {
 	theme         *theme
 }
 
-func newgolanghighlighter(theme *theme) *clikelangbasichighlighter {
-	return &clikelangbasichighlighter{
-		theme: theme,
-		linetokenizer: &clikelanglinetokenizer{
-			linecommentstart:      []rune{'/', '/'},
-			blockcommentstart:     []rune{'/', '*'},
-			blockcommentend:       []rune{'*', '/'},
-			stringstarts:          [][]rune{{'"'}, {'\''}},
-			stringends:            [][]rune{{'"'}, {'\''}},
-			multilinestringstarts: [][]rune{{'`'}},
-			multilinestringends:   [][]rune{{'`'}},
-			keywords: []string{
-				"append", "copy", "delete", "len", "cap", "make", "max", "min", "new", "complex", "real", "imag", "clear", "close", "panic", "recover", "print", "println",
-				"package", "import", "func", "defer", "return", "for", "range", "for", "if", "else", "var", "const", "switch", "case", "goto", "fallthrough", "default",
-				"type", "struct", "interface", "map", "select", "go", "chan", "iota", "nil", "true", "false",
-				"bool", "uint8", "uint16", "uint32", "uint64", "int8", "int16", "int32", "int64", "float32", "float64", "complex64", "complex128",
-				"string", "int", "uint", "uintptr", "byte", "rune", "any", "error", "comparable",
-				"archive", "tar", "zip", "bufio", "builtin", "bytes", "cmp", "compress", "bzip2", "flate", "gzip", "lzw", "zlib", "container", "heap",
-				"list", "ring", "context", "crypto", "aes", "cipher", "des", "dsa", "ecdh", "ecdsa", "ed25519", "elliptic", "fips140", "hkdf", "hmac", "md5", "mlkem", "pbkdf2", "rand", "rc4",
-				"rsa", "sha1", "sha256", "sha3", "sha512", "subtle", "tls", "x509", "pkix", "database", "sql", "driver", "debug", "buildinfo", "dwarf", "elf", "gosym", "macho", "pe", "plan9obj", "embed",
-				"encoding", "ascii85", "asn1", "base32", "base64", "binary", "csv", "gob", "hex", "json", "pem", "xml", "errors", "expvar", "flag", "fmt", "go", "ast", "build", "constraint", "constant",
-				"doc", "comment", "format", "importer", "parser", "printer", "scanner", "token", "types", "version", "hash", "adler32", "crc32", "crc64", "fnv", "maphash", "html", "template", "image", "color",
-				"palette", "draw", "gif", "jpeg", "png", "index", "suffixarray", "io", "fs", "ioutil", "iter", "log", "slog", "syslog", "maps", "math", "big", "bits", "cmplx", "rand", "mime",
-				"multipart", "quotedprintable", "net", "http", "cgi", "cookiejar", "fcgi", "httptest", "httptrace", "httputil", "pprof", "mail", "netip", "rpc", "jsonrpc", "smtp", "textproto", "url", "os", "exec",
-				"signal", "user", "path", "filepath", "plugin", "reflect", "regexp", "syntax", "runtime", "cgo", "coverage", "debug", "metrics", "pprof", "race", "trace",
-				"slices", "sort", "strconv", "strings", "structs", "sync", "atomic", "syscall", "js", "testing", "fstest", "iotest", "quick", "slogtest", "synctest",
-				"text", "scanner", "tabwriter", "template", "parse", "time", "tzdata", "unicode", "utf16", "utf8", "unique", "unsafe", "weak",
-			},
-			symbols:    []string{"[", "]", "(", ")", "{", "}", ":", ";", ",", "."},
-			operators:  []string{"!", "+", "-", "*", "/", "%", "&", "|", "=", "<", ">", "~"},
-			operators2: []string{"++", "--", ":=", "==", "<=", ">=", "!=", "+=", "-=", "*=", "/=", "|=", "&=", "%=", "&&", "||", "<<", ">>"},
-			operators3: []string{">>=", "<<=", "&^="},
-		},
+// newclikelanghighlighter returns the highlighter tokenizing the lines by the syntax of the language.
+func newclikelanghighlighter(lang *language, theme *theme) *clikelangbasichighlighter {
+	// the tokenizer has the state while tokenizing a line, so it is copied per highlighter
+	tokenizer := *lang.syntax
+	return &clikelangbasichighlighter{theme: theme, linetokenizer: &tokenizer}
+}
+
+// return the highlighter for the file. The language is found by the file name, or the shebang on the first line.
+func newhighlighter(filename string, firstline *line, theme *theme) highlighter {
+	lang := detectlanguage(filename, firstline.text())
+	if lang == nil {
+		return nophighlighter{}
 	}
+	return newlanghighlighter(lang, theme)
 }
 
-func newpythonhighlighter(theme *theme) *clikelangbasichighlighter {
-	return &clikelangbasichighlighter{
-		theme: theme,
-		linetokenizer: &clikelanglinetokenizer{
-			linecommentstart:      []rune{'#'},
-			stringstarts:          [][]rune{{'"'}, {'\''}, {'b', '"'}, {'f', '"'}},
-			stringends:            [][]rune{{'"'}, {'\''}, {'"'}, {'"'}},
-			multilinestringstarts: [][]rune{{'"', '"', '"'}, {'\'', '\'', '\''}},
-			multilinestringends:   [][]rune{{'"', '"', '"'}, {'\'', '\'', '\''}},
-			keywords: []string{
-				"False", "None", "True", "and", "as", "assert", "async", "await", "break", "class", "continue", "def", "del", "elif", "else", "except", "finally", "for",
-				"from", "global", "if", "import", "in", "is", "lambda", "nonlocal", "not", "or", "pass", "raise", "return", "try", "while", "with", "yield",
-				"abs", "aiter", "all", "anext", "any", "ascii", "bin", "bool", "breakpoint", "bytearray", "bytes", "callable", "chr", "classmethod", "compile", "complex",
-				"delattr", "dict", "dir", "divmod", "enumerate", "eval", "exec", "filter", "float", "format", "frozenset", "getattr", "globals",
-				"hasattr", "hash", "help", "hex", "id", "input", "int", "isinstance", "issubclass", "iter", "len", "list", "locals",
-				"map", "max", "memoryview", "min", "next", "object", "oct", "open", "ord", "pow", "print", "property",
-				"range", "repr", "reversed", "round", "set", "setattr", "slice", "sorted", "staticmethod", "str", "sum", "super", "tuple", "type", "vars", "zip", "__import__",
-			},
-			symbols:    []string{"[", "]", "(", ")", "{", "}", ":", ";", ",", "."},
-			operators:  []string{"+", "-", "*", "/", "%", "~", "&", "|", "^", "=", "<", ">", "@"},
-			operators2: []string{"**", "//", "+=", "-=", "*=", "/=", "%=", "&=", "|=", "^=", "==", "!=", "<=", ">=", ":=", "is", "in", "or"},
-			operators3: []string{"**=", "//=", ">>=", "<<=", "and", "not"},
-		},
+// return the highlighter of the language.
+func newlanghighlighter(lang *language, theme *theme) highlighter {
+	if lang.highlighter != nil {
+		return lang.highlighter(theme)
 	}
+	return newclikelanghighlighter(lang, theme)
 }
 
 func (h clikelangbasichighlighter) highlightline(l *line, prevlineattr *lineattribute) *lineattribute {
@@ -563,2095 +970,7158 @@ func (h clikelangbasichighlighter) highlightline(l *line, prevlineattr *lineattr
 	return curlineattr
 }
 
-/* tokenizer */
+/* markdown */
 
-type tokentype int
+// markdownhighlighter highlights the headings, emphasis, inline code, links and list markers.
+// The code in the fenced code block is highlighted by the highlighter of the language written after the fence.
+type markdownhighlighter struct {
+	theme *theme
+	// highlighters for the code blocks, created when the language appears first
+	codehighlighters map[*language]highlighter
+}
 
-const (
-	tk_unknown tokentype = iota
-	tk_ident
-	tk_keyword
-	tk_string
-	tk_multilinestring
-	tk_number
-	tk_operator
-	tk_symbol
-	tk_linecomment
-	tk_blockcomment
-	tk_whitespace
-	tk_nl
-)
+func newmarkdownhighlighter(theme *theme) highlighter {
+	return &markdownhighlighter{theme: theme, codehighlighters: map[*language]highlighter{}}
+}
 
-func (t tokentype) String() string {
-	switch t {
-	case tk_unknown:
-		return "unknown"
-	case tk_ident:
-		return "ident"
-	case tk_keyword:
-		return "keyword"
-	case tk_string:
-		return "string"
-	case tk_multilinestring:
-		return "multilinestring"
-	case tk_number:
-		return "number"
-	case tk_operator:
-		return "operator"
-	case tk_symbol:
-		return "symbol"
-	case tk_linecomment:
-		return "linecomment"
-	case tk_blockcomment:
-		return "blockcomment"
-	case tk_whitespace:
-		return "whitespace"
-	case tk_nl:
-		return "nl"
-	default:
-		panic("unknown tokentype")
+func (h *markdownhighlighter) highlightline(l *line, prevlineattr *lineattribute) *lineattribute {
+	text := []rune(l.text())
+	colors := slices.Repeat([]int{-1}, l.length())
+	paint := func(from, to, color int) {
+		for i := from; i < to; i++ {
+			colors[i] = color
+		}
 	}
-}
 
-type token struct {
-	typ        tokentype
-	start, end int
+	// up to 3 spaces are allowed before the fence and the heading
+	indent := 0
+	for indent < len(text) && indent < 3 && text[indent] == ' ' {
+		indent++
+	}
 
-	blockcommentterminated bool
+	if prevlineattr.fence != "" {
+		fence := prevlineattr.fence
 
-	multilinestrterminated bool
-	multilinestrstart      []rune
-	multilinestrend        []rune
-}
+		// the closing fence is the same character at least as long as the opening one
+		rest := string(text[indent:])
+		n := len(rest) - len(strings.TrimLeft(rest, fence[:1]))
+		if len(fence) <= n && strings.TrimSpace(rest[n:]) == "" {
+			paint(0, len(text), h.theme.colorcode)
+			return &lineattribute{colors: colors}
+		}
 
-func (t *token) String() string {
-	switch t.typ {
-	case tk_blockcomment:
-		return fmt.Sprintf("{%v (%v-%v) (terminated: %v)}", t.typ, t.start, t.end, t.blockcommentterminated)
-	case tk_multilinestring:
-		return fmt.Sprintf("{%v (%v-%v) (terminated: %v, quote: %v%v)}", t.typ, t.start, t.end, t.multilinestrterminated, t.multilinestrstart, t.multilinestrend)
-	default:
-		return fmt.Sprintf("{%v (%v-%v)}", t.typ, t.start, t.end)
+		attr := &lineattribute{colors: colors, fence: fence, fencelang: prevlineattr.fencelang}
+		if code := h.codehighlighter(prevlineattr.fencelang); code != nil {
+			codeattr := prevlineattr.codeattr
+			if codeattr == nil {
+				codeattr = &lineattribute{}
+			}
+			attr.codeattr = code.highlightline(l, codeattr)
+			attr.colors = attr.codeattr.colors
+		} else {
+			paint(0, len(text), h.theme.colorcode)
+		}
+		return attr
 	}
-}
 
-type clikelanglinetokenizer struct {
-	line *line
-	pos  int
+	if fence := markdownfence(text[indent:]); fence != "" {
+		info := strings.TrimSpace(string(text[indent+len(fence):]))
+		// the info string of the backtick fence cannot contain backticks, otherwise it is the inline code
+		if fence[0] == '~' || !strings.Contains(info, "`") {
+			name, _, _ := strings.Cut(info, " ")
+			paint(0, len(text), h.theme.colorcode)
+			return &lineattribute{colors: colors, fence: fence, fencelang: findlanguage(name)}
+		}
+	}
 
-	// language setting
+	if n := runlength(text[indent:], '#'); 1 <= n && n <= 6 && (indent+n == len(text) || unicode.IsSpace(text[indent+n])) {
+		paint(0, len(text), h.theme.colorheading)
+		return &lineattribute{colors: colors}
+	}
 
-	linecommentstart  []rune
-	blockcommentstart []rune
-	blockcommentend   []rune
+	// block quote and list markers
+	pos := 0
+	for pos < len(text) && (text[pos] == ' ' || text[pos] == '\t') {
+		pos++
+	}
+	for pos < len(text) && text[pos] == '>' {
+		colors[pos] = h.theme.colorlistmarker
+		pos++
+		for pos < len(text) && text[pos] == ' ' {
+			pos++
+		}
+	}
+	if n := markdownlistmarker(text[pos:]); n != 0 {
+		paint(pos, pos+n, h.theme.colorlistmarker)
+		pos += n
+	}
 
-	stringstarts          [][]rune
-	stringends            [][]rune
-	rawstringstarts       [][]rune
-	rawstringends         [][]rune
-	multilinestringstarts [][]rune
-	multilinestringends   [][]rune
+	h.highlightinline(text, pos, paint)
+	return &lineattribute{colors: colors}
+}
 
-	keywords   []string
-	symbols    []string
-	operators  []string // single character
-	operators2 []string // 2 characters
-	operators3 []string // 3 characters
+// return the highlighter for the code block of the language. nil is returned for the unknown language.
+func (h *markdownhighlighter) codehighlighter(lang *language) highlighter {
+	if lang == nil {
+		return nil
+	}
+
+	if _, ok := h.codehighlighters[lang]; !ok {
+		h.codehighlighters[lang] = newlanghighlighter(lang, h.theme)
+	}
+	return h.codehighlighters[lang]
 }
 
-func (t *clikelanglinetokenizer) tokenizeline(l *line, prevlinestate *lineattribute) ([]*token, *lineattribute) {
-	t.line = l
-	t.pos = 0
+// highlight the inline code, emphasis and links in text[from:].
+func (h *markdownhighlighter) highlightinline(text []rune, from int, paint func(from, to, color int)) {
+	for i := from; i < len(text); {
+		switch c := text[i]; {
+		case c == '\\':
+			// escaped character
+			i += 2
 
-	var tokens []*token
-	inmultilinecomment, inmultilinestring := prevlinestate.inblockcomment, prevlinestate.inmultilinestr
-	multilinestrstart, multilinestrend := prevlinestate.multilinestrstart, prevlinestate.multilinestrend
-	for t.pos < t.line.length()-1 {
-		var tk *token
+		case c == '`':
+			n := runlength(text[i:], '`')
+			end := findrun(text, i+n, '`', n)
+			if end == -1 {
+				i += n
+				continue
+			}
+			paint(i, end+n, h.theme.colorcode)
+			i = end + n
+
+		case c == '*' || c == '_':
+			n := runlength(text[i:], c)
+			end := emphasisend(text, i, n)
+			if end == -1 {
+				i += n
+				continue
+			}
+			paint(i, end, h.theme.coloremphasis)
+			i = end
 
-		switch {
-		case inmultilinecomment:
-			tk = t.readblockcomment(0, false)
-			inmultilinecomment = !tk.blockcommentterminated
-		case inmultilinestring:
-			tk = t.readmultilinestring(0, false, multilinestrstart, multilinestrend)
-			inmultilinestring = !tk.multilinestrterminated
-			multilinestrstart = tk.multilinestrstart
-			multilinestrend = tk.multilinestrend
-		default:
-			tk = t.nexttoken()
-			if tk.typ == tk_blockcomment {
-				inmultilinecomment = !tk.blockcommentterminated
-			} else if tk.typ == tk_multilinestring {
-				inmultilinestring = !tk.multilinestrterminated
-				multilinestrstart = tk.multilinestrstart
-				multilinestrend = tk.multilinestrend
+		case c == '[' || (c == '!' && i+1 < len(text) && text[i+1] == '['):
+			end := linkend(text, i)
+			if end == -1 {
+				i++
+				continue
 			}
-		}
+			paint(i, end, h.theme.colorlink)
+			i = end
+
+		case c == '<':
+			// autolink like <https://example.com> or <foo@example.com>
+			end := slices.IndexFunc(text[i:], func(r rune) bool { return r == '>' || unicode.IsSpace(r) })
+			if end == -1 || text[i+end] != '>' {
+				i++
+				continue
+			}
+			if s := string(text[i+1 : i+end]); !strings.Contains(s, "://") && !strings.Contains(s, "@") {
+				i++
+				continue
+			}
+			paint(i, i+end+1, h.theme.colorlink)
+			i += end + 1
 
-		tokens = append(tokens, tk)
+		default:
+			i++
+		}
 	}
+}
 
-	tokens = append(tokens, &token{typ: tk_nl, start: t.line.length(), end: t.line.length() - 1})
+// return the fence like "```" or "~~~~" if the text starts with it, otherwise empty string.
+func markdownfence(text []rune) string {
+	if len(text) == 0 || (text[0] != '`' && text[0] != '~') {
+		return ""
+	}
 
-	return tokens, &lineattribute{nil, inmultilinecomment, inmultilinestring, multilinestrstart, multilinestrend}
+	n := runlength(text, text[0])
+	if n < 3 {
+		return ""
+	}
+	return string(text[:n])
 }
 
-func (t *clikelanglinetokenizer) nexttoken() *token {
-	start := t.pos
-	c := t.line.buffer[start]
+// return the length of the list marker like "-", "*", "+", "1." or "1)" at the text head, or 0 if it is not a list item.
+func markdownlistmarker(text []rune) int {
+	n := 0
+	switch {
+	case len(text) != 0 && (text[0] == '-' || text[0] == '*' || text[0] == '+'):
+		n = 1
+	default:
+		digits := runlengthfunc(text, unicode.IsDigit)
+		if digits == 0 || 9 < digits || len(text) <= digits || (text[digits] != '.' && text[digits] != ')') {
+			return 0
+		}
+		n = digits + 1
+	}
 
-	if c.tab || unicode.IsSpace(c.r) {
-		return t.readwhitespace(start)
+	// the marker must be followed by a space or nothing
+	if n < len(text) && !unicode.IsSpace(text[n]) {
+		return 0
 	}
+	return n
+}
 
-	// comment
-	switch len(t.linecommentstart) {
-	case 1:
-		if c.r == t.linecommentstart[0] {
-			return t.readlinecomment(start)
-		}
-	case 2:
-		if c.r == t.linecommentstart[0] && t.peek().r == t.linecommentstart[1] {
-			return t.readlinecomment(start)
-		}
+// return the index after the emphasis like *a* or __a__ starting at text[start] with n markers, or -1 if it is not closed.
+func emphasisend(text []rune, start, n int) int {
+	marker := text[start]
+	alnum := func(i int) bool {
+		return 0 <= i && i < len(text) && (unicode.IsLetter(text[i]) || unicode.IsDigit(text[i]))
 	}
 
-	switch len(t.blockcommentstart) {
-	case 2:
-		if c.r == t.blockcommentstart[0] && t.peek().r == t.blockcommentstart[1] {
-			return t.readblockcomment(start, true)
-		}
+	// the opening markers must be followed by a non-space, and "_" must not be in a word
+	if len(text) <= start+n || unicode.IsSpace(text[start+n]) || (marker == '_' && alnum(start-1)) {
+		return -1
 	}
 
-	for i, multilinestringstart := range t.multilinestringstarts {
-		switch len(multilinestringstart) {
-		case 1:
-			if c.r == multilinestringstart[0] {
-				return t.readmultilinestring(start, true, multilinestringstart, t.multilinestringends[i])
-			}
-		case 2:
-			if c.r == multilinestringstart[0] && t.peek().r == multilinestringstart[1] {
-				return t.readmultilinestring(start, true, multilinestringstart, t.multilinestringends[i])
-			}
-		case 3:
-			if c.r == multilinestringstart[0] && t.peek().r == multilinestringstart[1] && t.peek2().r == multilinestringstart[2] {
-				return t.readmultilinestring(start, true, multilinestringstart, t.multilinestringends[i])
-			}
+	for i := start + n + 1; i < len(text); {
+		if text[i] == '\\' {
+			i += 2
+			continue
 		}
-	}
 
-	for i, stringstart := range t.stringstarts {
-		switch len(stringstart) {
-		case 1:
-			if c.r == stringstart[0] {
-				return t.readstring(start, stringstart, t.stringends[i], true)
-			}
-		case 2:
-			if c.r == stringstart[0] && t.peek().r == stringstart[1] {
-				return t.readstring(start, stringstart, t.stringends[i], true)
-			}
-		case 3:
-			if c.r == stringstart[0] && t.peek().r == stringstart[1] && t.peek2().r == stringstart[2] {
-				return t.readstring(start, stringstart, t.stringends[i], true)
-			}
+		m := runlength(text[i:], marker)
+		if m == 0 {
+			i++
+			continue
 		}
-	}
 
-	for i, rawstringstart := range t.rawstringstarts {
-		switch len(rawstringstart) {
-		case 1:
-			if c.r == rawstringstart[0] {
-				return t.readstring(start, rawstringstart, t.rawstringends[i], false)
-			}
-		case 2:
-			if c.r == rawstringstart[0] && t.peek().r == rawstringstart[1] {
-				return t.readstring(start, rawstringstart, t.rawstringends[i], false)
-			}
-		case 3:
-			if c.r == rawstringstart[0] && t.peek().r == rawstringstart[1] && t.peek2().r == rawstringstart[2] {
-				return t.readstring(start, rawstringstart, t.rawstringends[i], false)
-			}
+		if m == n && !unicode.IsSpace(text[i-1]) && !(marker == '_' && alnum(i+m)) {
+			return i + m
 		}
+		i += m
 	}
+	return -1
+}
 
-	if unicode.IsDigit(c.r) || (c.r == '.' && unicode.IsDigit(t.peek().r)) {
-		return t.readnumber(start)
+// return the index after the link like [text](url), [text][ref] or ![alt](url) starting at text[start],
+// or -1 if it is not a link.
+func linkend(text []rune, start int) int {
+	i := start
+	if text[i] == '!' {
+		i++
 	}
 
-	if unicode.IsLetter(c.r) || c.r == '_' {
-		return t.readident(start)
+	closing := matchingbracket(text, i, '[', ']')
+	if closing == -1 || len(text) <= closing+1 {
+		return -1
 	}
 
-	return t.readsymbol(start)
-}
-
-func (t *clikelanglinetokenizer) peek() *character {
-	if t.line.length() <= t.pos+1 {
-		return &character{}
+	switch text[closing+1] {
+	case '(':
+		if end := matchingbracket(text, closing+1, '(', ')'); end != -1 {
+			return end + 1
+		}
+	case '[':
+		if end := matchingbracket(text, closing+1, '[', ']'); end != -1 {
+			return end + 1
+		}
 	}
-	return t.line.buffer[t.pos+1]
+	return -1
 }
 
-func (t *clikelanglinetokenizer) peek2() *character {
-	if t.line.length() <= t.pos+2 {
-		return &character{}
+// return the index of the bracket closing the one at text[start], or -1 if it is not closed.
+func matchingbracket(text []rune, start int, left, right rune) int {
+	depth := 0
+	for i := start; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case left:
+			depth++
+		case right:
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
 	}
-	return t.line.buffer[t.pos+2]
+	return -1
 }
 
-func (t *clikelanglinetokenizer) readwhitespace(start int) *token {
-	for t.pos < t.line.length()-1 && (unicode.IsSpace(t.line.buffer[t.pos].r) || t.line.buffer[t.pos].tab) {
-		t.pos++
+// return the index of the run of exactly n r from text[from:], or -1 if not found.
+func findrun(text []rune, from int, r rune, n int) int {
+	for i := from; i < len(text); {
+		m := runlength(text[i:], r)
+		if m == n {
+			return i
+		}
+		i += max(m, 1)
 	}
-	return &token{typ: tk_whitespace, start: start, end: t.pos}
+	return -1
 }
 
-func (t *clikelanglinetokenizer) readlinecomment(start int) *token {
-	t.pos += len(t.linecommentstart)
+// return how many r continue at the text head.
+func runlength(text []rune, r rune) int {
+	return runlengthfunc(text, func(c rune) bool { return c == r })
+}
 
-	for t.pos < t.line.length()-1 { // skip nl
-		t.pos++
+func runlengthfunc(text []rune, f func(rune) bool) int {
+	n := 0
+	for n < len(text) && f(text[n]) {
+		n++
 	}
+	return n
+}
 
-	return &token{typ: tk_linecomment, start: start, end: t.pos}
+/* go */
+
+// gohighlighter highlights Go by go/scanner, which knows the exact syntax of the runes, raw strings and numbers.
+// The identifiers are colored later by the semantic tokens found by parsing the whole buffer (see gosemantic).
+type gohighlighter struct {
+	theme *theme
 }
 
-func (t *clikelanglinetokenizer) readblockcomment(start int, firstline bool) *token {
-	if firstline {
-		t.pos += len(t.blockcommentstart)
+func (h gohighlighter) highlightline(l *line, prevlineattr *lineattribute) *lineattribute {
+	text := l.text()
+	colors := slices.Repeat([]int{-1}, l.length())
+	attr := &lineattribute{colors: colors}
+
+	// convert byte offsets to character indices
+	idxs := make([]int, len(text)+1)
+	i := 0
+	for off := range text {
+		idxs[off] = i
+		i++
 	}
+	idxs[len(text)] = i
 
-	terminated := false
-	for t.pos < t.line.length()-1 { // skip nl
-		if t.line.length()-1 < t.pos+len(t.blockcommentend) {
-			t.pos++
-			continue
+	paint := func(from, to, color int) {
+		for i := idxs[from]; i < idxs[to]; i++ {
+			colors[i] = color
 		}
+	}
 
-		found := true
-		for i, commentchar := range t.blockcommentend {
-			if t.line.buffer[t.pos+i].r != commentchar {
-				found = false
-				break
-			}
+	// continue the block comment or the raw string from the previous line
+	pos := 0
+	switch {
+	case prevlineattr.inblockcomment:
+		end := strings.Index(text, "*/")
+		if end == -1 {
+			paint(0, len(text), h.theme.colorblockcomment)
+			attr.inblockcomment = true
+			return attr
 		}
-
-		if found {
-			t.pos += len(t.blockcommentend)
-			terminated = true
-			break
+		pos = end + 2
+		paint(0, pos, h.theme.colorblockcomment)
+
+	case prevlineattr.inmultilinestr:
+		end := strings.IndexByte(text, '`')
+		if end == -1 {
+			paint(0, len(text), h.theme.colormultilinestring)
+			attr.inmultilinestr = true
+			return attr
 		}
-
-		t.pos++
+		pos = end + 1
+		paint(0, pos, h.theme.colormultilinestring)
 	}
 
-	return &token{typ: tk_blockcomment, start: start, end: t.pos, blockcommentterminated: terminated}
-}
-
-func (t *clikelanglinetokenizer) readstring(start int, startquote, endquote []rune, considerescape bool) *token {
-	t.pos += len(startquote)
+	src := []byte(text[pos:])
+	file := gotoken.NewFileSet().AddFile("", 1, len(src))
+	var sc scanner.Scanner
+	sc.Init(file, src, nil, scanner.ScanComments)
 
-	for t.pos < t.line.length()-1 { // skip nl
-		if t.line.length()-1 < t.pos+len(endquote) {
-			t.pos++
+	for {
+		p, tok, lit := sc.Scan()
+		if tok == gotoken.EOF {
+			break
+		}
+		if tok == gotoken.SEMICOLON && lit == "\n" {
+			// inserted automatically
 			continue
 		}
 
-		found := true
-		for i, quotechar := range endquote {
-			if t.line.buffer[t.pos+i].r != quotechar {
-				found = false
-				break
-			}
-		}
-		if found {
-			t.pos += len(endquote)
-			break
+		start := file.Offset(p) + pos
+		end := start + len(tok.String())
+		if lit != "" {
+			end = start + len(lit)
 		}
 
-		if considerescape {
-			if t.line.buffer[t.pos].r == '\\' && t.pos+1 < t.line.length()-1 {
-				t.pos += 2
-			} else {
-				t.pos++
-			}
-		} else {
-			t.pos++
+		switch {
+		case tok.IsKeyword():
+			paint(start, end, h.theme.colorkeyword)
+		case tok == gotoken.IDENT:
+			paint(start, end, h.theme.colorident)
+		case tok == gotoken.INT || tok == gotoken.FLOAT || tok == gotoken.IMAG:
+			paint(start, end, h.theme.colornumber)
+		case tok == gotoken.CHAR:
+			paint(start, end, h.theme.colorstring)
+		case tok == gotoken.STRING && lit[0] == '`' && (len(lit) == 1 || lit[len(lit)-1] != '`'):
+			// the raw string continues to the next line
+			paint(start, end, h.theme.colormultilinestring)
+			attr.inmultilinestr = true
+		case tok == gotoken.STRING:
+			paint(start, end, h.theme.colorstring)
+		case tok == gotoken.COMMENT && strings.HasPrefix(lit, "//"):
+			paint(start, end, h.theme.colorlinecomment)
+		case tok == gotoken.COMMENT:
+			paint(start, end, h.theme.colorblockcomment)
+			attr.inblockcomment = len(lit) < 4 || !strings.HasSuffix(lit, "*/")
+		case tok == gotoken.LPAREN, tok == gotoken.RPAREN, tok == gotoken.LBRACK, tok == gotoken.RBRACK, tok == gotoken.LBRACE, tok == gotoken.RBRACE,
+			tok == gotoken.COMMA, tok == gotoken.SEMICOLON, tok == gotoken.PERIOD, tok == gotoken.COLON:
+			paint(start, end, h.theme.colorsymbol)
+		case tok.IsOperator():
+			paint(start, end, h.theme.coloroperator)
 		}
 	}
 
-	return &token{typ: tk_string, start: start, end: t.pos}
+	return attr
 }
 
-func (t *clikelanglinetokenizer) readmultilinestring(start int, firstline bool, startquote, endquote []rune) *token {
-	if firstline {
-		t.pos += len(startquote)
-	}
+type semanticclass int
 
-	terminated := false
-	for t.pos < t.line.length()-1 { // skip nl
-		if t.line.length()-1 < t.pos+len(endquote) {
-			t.pos++
-			continue
-		}
+const (
+	sc_package semanticclass = iota + 1
+	sc_type
+	sc_function
+	sc_field
+)
 
-		found := true
-		for i, quotechar := range endquote {
-			if t.line.buffer[t.pos+i].r != quotechar {
-				found = false
-				break
-			}
-		}
-
-		if found {
-			t.pos += len(endquote)
-			terminated = true
-			break
-		}
-
-		t.pos++
+func (c semanticclass) color(theme *theme) int {
+	switch c {
+	case sc_package:
+		return theme.colorpackage
+	case sc_type:
+		return theme.colortype
+	case sc_function:
+		return theme.colorfunction
+	case sc_field:
+		return theme.colorfield
+	default:
+		panic("unknown semanticclass")
 	}
+}
 
-	return &token{typ: tk_multilinestring, start: start, end: t.pos, multilinestrterminated: terminated, multilinestrstart: startquote, multilinestrend: endquote}
+// semantictoken is the identifier on the line. start and end are the character indices.
+type semantictoken struct {
+	start, end int
+	class      semanticclass
 }
 
-func (t *clikelanglinetokenizer) readnumber(start int) *token {
-	for t.pos < t.line.length() && (unicode.IsDigit(t.line.buffer[t.pos].r) || t.line.buffer[t.pos].r == '_') {
-		t.pos++
-	}
+// semanticline is the semantic tokens on the line, with the text they are found in.
+// The tokens are applied only while the line has the same text.
+type semanticline struct {
+	text   string
+	tokens []semantictoken
+}
 
-	if t.pos < t.line.length() && t.line.buffer[t.pos].r == '.' {
-		t.pos++
-		for t.pos < t.line.length() && (unicode.IsDigit(t.line.buffer[t.pos].r) || t.line.buffer[t.pos].r == '_') {
-			t.pos++
-		}
-	}
+// gosemantic parses the buffer in the background to find the semantic tokens.
+// Only one parse runs at a time per buffer, and the result is sent to results to be applied on the main routine.
+// The result is dropped once the buffer is closed, so the parse does not wait for the receiver forever.
+type gosemantic struct {
+	results chan<- *semanticresult
+	closed  chan struct{}  // closed when the buffer is closed
+	lines   []semanticline // result of the last parse
+	parsed  int            // the changes of the buffer given to the last parse, -1 before parsing
+	running bool
+	pending bool // the buffer is changed while parsing
+}
 
-	if t.pos < t.line.length() && (t.line.buffer[t.pos].r == 'e' || t.line.buffer[t.pos].r == 'E') {
-		t.pos++
-		if t.pos < t.line.length() && (t.line.buffer[t.pos].r == '+' || t.line.buffer[t.pos].r == '-') {
-			t.pos++
-		}
-		for t.pos < t.line.length() && (unicode.IsDigit(t.line.buffer[t.pos].r) || t.line.buffer[t.pos].r == '_') {
-			t.pos++
-		}
+func newgosemantic(results chan<- *semanticresult) *gosemantic {
+	return &gosemantic{results: results, closed: make(chan struct{}), parsed: -1}
+}
+
+// stop sending the results of the running parse.
+func (g *gosemantic) close() {
+	select {
+	case <-g.closed:
+	default:
+		close(g.closed)
 	}
+}
 
-	return &token{typ: tk_number, start: start, end: t.pos}
+type semanticresult struct {
+	buffer *buffer
+	lines  []semanticline
 }
 
-func (t *clikelanglinetokenizer) readident(start int) *token {
-	for t.pos < t.line.length() && (unicode.IsLetter(t.line.buffer[t.pos].r) || unicode.IsDigit(t.line.buffer[t.pos].r) || t.line.buffer[t.pos].r == '_') {
-		t.pos++
+// start parsing the buffer in the background if it is changed since the last parse.
+func (b *buffer) requestsemantic() {
+	if b.semantic == nil {
+		return
 	}
 
-	typ := tk_ident
+	if b.semantic.running {
+		b.semantic.pending = true
+		return
+	}
 
-	s := t.line.substring(start, t.pos)
-	if slices.Contains(t.keywords, s) {
-		typ = tk_keyword
+	if b.changes == b.semantic.parsed {
+		return
 	}
 
-	return &token{typ: typ, start: start, end: t.pos}
+	texts := make([]string, len(b.lines))
+	for i, l := range b.lines {
+		texts[i] = l.text()
+	}
+	src := strings.Join(texts, "\n")
+
+	b.semantic.parsed = b.changes
+	b.semantic.running = true
+	go func(g *gosemantic) {
+		res := &semanticresult{buffer: b, lines: parsegosemantic(src)}
+		select {
+		case g.results <- res:
+		case <-g.closed:
+		}
+	}(b.semantic)
 }
 
-func (t *clikelanglinetokenizer) readsymbol(start int) *token {
-	if t.pos+3 < t.line.length()-1 {
-		threechars := t.line.substring(t.pos, t.pos+3)
-		if slices.Contains(t.operators3, threechars) {
-			t.pos += 3
-			return &token{typ: tk_operator, start: start, end: t.pos}
+// apply the semantic tokens to the lines, and parse again if the buffer is changed while parsing.
+func (b *buffer) applysemantic(lines []semanticline) {
+	prev := b.semantic.lines
+	b.semantic.lines = lines
+	b.semantic.running = false
+
+	for y := range b.lines {
+		var before, after semanticline
+		if y < len(prev) {
+			before = prev[y]
+		}
+		if y < len(lines) {
+			after = lines[y]
+		}
+		if before.text == after.text && slices.Equal(before.tokens, after.tokens) {
+			continue
 		}
-	}
 
-	if t.pos+2 < t.line.length()-1 {
-		twochars := t.line.substring(t.pos, t.pos+2)
-		if slices.Contains(t.operators2, twochars) {
-			t.pos += 2
-			return &token{typ: tk_operator, start: start, end: t.pos}
+		prevlinestate := &lineattribute{}
+		if y != 0 {
+			prevlinestate = b.lineattrs[y-1]
+		}
+		b.lineattrs[y] = b.highlightline(y, prevlinestate)
+		for _, v := range b.views {
+			v.highlightupdatedlines = append(v.highlightupdatedlines, y)
 		}
 	}
 
-	char := string(t.line.buffer[t.pos].r)
-	if slices.Contains(t.operators, char) {
-		t.pos++
-		return &token{typ: tk_operator, start: start, end: t.pos}
+	if b.semantic.pending {
+		b.semantic.pending = false
+		b.requestsemantic()
 	}
+}
 
-	if slices.Contains(t.symbols, char) {
-		t.pos++
-		return &token{typ: tk_symbol, start: start, end: t.pos}
+// highlight the line y, coloring the identifiers by the semantic tokens if they are found on the same text.
+func (b *buffer) highlightline(y int, prevlinestate *lineattribute) *lineattribute {
+	attr := b.highlighter.highlightline(b.lines[y], prevlinestate)
+	if b.semantic == nil || len(b.semantic.lines) <= y || b.semantic.lines[y].text != b.lines[y].text() {
+		return attr
 	}
 
-	t.pos++
-	return &token{typ: tk_unknown, start: start, end: t.pos}
+	for _, tk := range b.semantic.lines[y].tokens {
+		for i := tk.start; i < tk.end; i++ {
+			attr.colors[i] = tk.class.color(b.theme)
+		}
+	}
+	return attr
 }
 
-/*
- * screen
- */
-
-type file interface {
-	io.ReadWriteCloser
-	Name() string
-	Truncate(size int64) error
-	Seek(offset int64, whence int) (int64, error)
+var predeclaredtypes = []string{
+	"any", "bool", "byte", "comparable", "complex64", "complex128", "error", "float32", "float64",
+	"int", "int8", "int16", "int32", "int64", "rune", "string", "uint", "uint8", "uint16", "uint32", "uint64", "uintptr",
 }
 
-type lineattribute struct {
-	colors            []int
-	inblockcomment    bool
-	inmultilinestr    bool
-	multilinestrstart []rune
-	multilinestrend   []rune
-}
+// parse the Go source and return the semantic tokens per line.
+// Even if the source has syntax errors, the tokens are found in the part which could be parsed.
+func parsegosemantic(src string) []semanticline {
+	fset := gotoken.NewFileSet()
+	f, _ := parser.ParseFile(fset, "", src, parser.AllErrors)
 
-func (s *lineattribute) String() string {
-	switch {
-	case s.inblockcomment:
-		return fmt.Sprintf("{block comment line, colors: %v}", s.colors)
-	case s.inmultilinestr:
-		return fmt.Sprintf("{multi-line string line (quote: %v%v), colors: %v}", string(s.multilinestrstart), string(s.multilinestrend), s.colors)
-	default:
-		return fmt.Sprintf("{normal line: colors: %v}", s.colors)
+	texts := strings.Split(src, "\n")
+	lines := make([]semanticline, len(texts))
+	for i := range texts {
+		lines[i].text = texts[i]
+	}
+	if f == nil {
+		return lines
 	}
-}
-
-type cursor struct {
-	x         int
-	y         int
-	actualx   int
-	selection selection
-}
 
-func (c *cursor) String() string {
-	return fmt.Sprintf("{x: %v, y: %v, actualx: %v}", c.x, c.y, c.actualx)
-}
+	classes := map[*ast.Ident]semanticclass{}
+	// the parent node is visited first and knows better, so the class set first is kept
+	mark := func(id *ast.Ident, class semanticclass) {
+		if _, ok := classes[id]; !ok && id.Name != "_" {
+			classes[id] = class
+		}
+	}
 
-type selection interface {
-	isselection()
-}
+	imports := map[string]bool{}
+	for _, spec := range f.Imports {
+		if spec.Name != nil {
+			mark(spec.Name, sc_package)
+		}
+		if name := importname(spec); name != "" {
+			imports[name] = true
+		}
+	}
 
-type lineselection struct {
-	selection
-	lines []int
-}
+	ispackage := func(e ast.Expr) bool {
+		id, ok := e.(*ast.Ident)
+		return ok && id.Obj == nil && imports[id.Name]
+	}
 
-type charsselection struct {
-	selection
-	startx int
-	starty int
-	endx   int
-	endy   int
-}
+	var marktype func(e ast.Expr)
+	marktype = func(e ast.Expr) {
+		switch e := e.(type) {
+		case *ast.Ident:
+			mark(e, sc_type)
+		case *ast.SelectorExpr:
+			if ispackage(e.X) {
+				mark(e.X.(*ast.Ident), sc_package)
+			}
+			mark(e.Sel, sc_type)
+		case *ast.StarExpr:
+			marktype(e.X)
+		case *ast.ParenExpr:
+			marktype(e.X)
+		case *ast.ArrayType:
+			marktype(e.Elt)
+		case *ast.Ellipsis:
+			marktype(e.Elt)
+		case *ast.MapType:
+			marktype(e.Key)
+			marktype(e.Value)
+		case *ast.ChanType:
+			marktype(e.Value)
+		case *ast.IndexExpr:
+			// generic type
+			marktype(e.X)
+			marktype(e.Index)
+		case *ast.IndexListExpr:
+			marktype(e.X)
+			for _, idx := range e.Indices {
+				marktype(idx)
+			}
+		}
+	}
 
-type regtexttype int
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.TypeSpec:
+			mark(n.Name, sc_type)
+			marktype(n.Type)
 
-const (
-	regtext_lines regtexttype = iota + 1
-	regtext_chars
-)
+		case *ast.FuncDecl:
+			mark(n.Name, sc_function)
 
-type regtext struct {
-	typ   regtexttype
-	lines []*line
-	chars []*character
-}
+		case *ast.StructType:
+			for _, field := range n.Fields.List {
+				for _, name := range field.Names {
+					mark(name, sc_field)
+				}
+			}
 
-type register struct {
-	regs []map[string]*regtext
-}
+		case *ast.InterfaceType:
+			for _, method := range n.Methods.List {
+				for _, name := range method.Names {
+					mark(name, sc_function)
+				}
+			}
 
-func (r *register) get(idx int, key string) (*regtext, bool) {
-	if len(r.regs) <= idx {
-		return nil, false
-	}
+		case *ast.Field:
+			marktype(n.Type)
 
-	return r.regs[idx][key], true
-}
+		case *ast.ValueSpec:
+			marktype(n.Type)
 
-func (r *register) set(idx int, key string, txt *regtext) {
-	if len(r.regs) <= idx {
-		r.regs = append(r.regs, make(map[string]*regtext))
-	}
+		case *ast.CompositeLit:
+			marktype(n.Type)
+			for _, elt := range n.Elts {
+				// the key which is not declared in the file is the struct field
+				if kv, ok := elt.(*ast.KeyValueExpr); ok {
+					if key, ok := kv.Key.(*ast.Ident); ok && key.Obj == nil {
+						mark(key, sc_field)
+					}
+				}
+			}
 
-	r.regs[idx][key] = txt
-}
+		case *ast.TypeAssertExpr:
+			marktype(n.Type)
 
-type screen struct {
-	focused         bool
-	term            *screenterm
-	highlighter     highlighter
-	width           int
-	height          int
-	lines           []*line
-	lineattrs       []*lineattribute
-	file            file
-	linenumberwidth int
+		case *ast.CallExpr:
+			fun := n.Fun
+			if idx, ok := fun.(*ast.IndexExpr); ok {
+				// generic function
+				fun = idx.X
+			}
+			switch fun := fun.(type) {
+			case *ast.Ident:
+				if fun.Obj == nil || fun.Obj.Kind == ast.Fun {
+					if slices.Contains(predeclaredtypes, fun.Name) {
+						mark(fun, sc_type)
+					} else {
+						mark(fun, sc_function)
+					}
+				}
+			case *ast.SelectorExpr:
+				mark(fun.Sel, sc_function)
+			}
 
-	register *register
+		case *ast.SelectorExpr:
+			if ispackage(n.X) {
+				mark(n.X.(*ast.Ident), sc_package)
+			}
+			mark(n.Sel, sc_field)
 
-	cursors []*cursor
+		case *ast.Ident:
+			switch {
+			case n.Obj != nil && n.Obj.Kind == ast.Typ:
+				mark(n, sc_type)
+			case n.Obj != nil && n.Obj.Kind == ast.Fun:
+				mark(n, sc_function)
+			case n.Obj == nil && slices.Contains(predeclaredtypes, n.Name):
+				mark(n, sc_type)
+			}
+		}
+		return true
+	})
 
-	xoffset int
-	yoffset int
+	for id, class := range classes {
+		pos := fset.Position(id.Pos())
+		y := pos.Line - 1
+		if y < 0 || len(lines) <= y || len(texts[y]) < pos.Column-1 {
+			continue
+		}
 
-	scrolled              bool
-	linestoberendered     []int
-	highlightupdatedlines []int
+		start := utf8.RuneCountInString(texts[y][:pos.Column-1])
+		lines[y].tokens = append(lines[y].tokens, semantictoken{start: start, end: start + utf8.RuneCountInString(id.Name), class: class})
+	}
 
-	dirty bool
+	for i := range lines {
+		slices.SortFunc(lines[i].tokens, func(a, b semantictoken) int { return a.start - b.start })
+	}
+	return lines
 }
 
-func newscreen(term terminal, x, y, width, height int, file file, theme *theme, focused bool) *screen {
-	s := &screen{
-		focused:  focused,
-		term:     &screenterm{term: term, width: width, x: x, y: y},
-		width:    width,
-		height:   height,
-		file:     file,
-		register: &register{},
-		cursors:  []*cursor{{0, 0, 0, nil}},
-		xoffset:  0,
-		yoffset:  0,
-		lines:    []*line{},
-	}
+var majorversion = regexp.MustCompile(`^v[0-9]+$`)
 
-	// read file and initialize s.lines
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		s.lines = append(s.lines, newline(line))
+// return the name of the imported package, which is the last element of the path without the version like "yaml" for
+// "gopkg.in/yaml.v3". Empty string is returned for the blank and dot imports.
+func importname(spec *ast.ImportSpec) string {
+	if spec.Name != nil {
+		if spec.Name.Name == "_" || spec.Name.Name == "." {
+			return ""
+		}
+		return spec.Name.Name
 	}
 
-	if len(s.lines) == 0 {
-		s.lines = []*line{newemptyline()}
+	p, err := strconv.Unquote(spec.Path.Value)
+	if err != nil {
+		return ""
+	}
+
+	name := path.Base(p)
+	if dir := path.Dir(p); majorversion.MatchString(name) && dir != "." {
+		// major version suffix like "github.com/a/b/v2"
+		name = path.Base(dir)
+	}
+	name, _, _ = strings.Cut(name, ".")
+	name = strings.TrimPrefix(name, "go-")
+	return strings.ReplaceAll(name, "-", "_")
+}
+
+/* languages */
+
+// language tells which files are written in it and how the lines are tokenized.
+type language struct {
+	name      string
+	exts      []string // file extensions without the dot
+	filenames []string // file names like "Makefile"
+	shebangs  []string // interpreters in the shebang line like "python". The trailing version like "3.12" is ignored.
+	syntax    *clikelanglinetokenizer
+
+	// the highlighter used instead of tokenizing by the syntax, for the language which is not C-like
+	highlighter func(theme *theme) highlighter
+}
+
+// languages are searched in this order to find the language of the file.
+var languages = []*language{
+	lang_go,
+	lang_python,
+	lang_c,
+	lang_cpp,
+	lang_javascript,
+	lang_typescript,
+	lang_rust,
+	lang_java,
+	lang_shell,
+	lang_json,
+	lang_make,
+	lang_dockerfile,
+	lang_markdown,
+}
+
+// return the language of the file. The exact file name is checked first, then the extension and the shebang.
+// nil is returned if the language is unknown.
+func detectlanguage(filename, firstline string) *language {
+	base := filepath.Base(filename)
+	for _, lang := range languages {
+		if slices.Contains(lang.filenames, base) {
+			return lang
+		}
 	}
 
-	// initialize line attribute
-	s.lineattrs = make([]*lineattribute, len(s.lines))
-
-	golangexts := []string{"go", "go_"} // for test
-	pythonexts := []string{"py", "pyi"}
+	if ext := strings.TrimPrefix(filepath.Ext(base), "."); ext != "" {
+		for _, lang := range languages {
+			if slices.Contains(lang.exts, ext) {
+				return lang
+			}
+		}
+	}
 
-	ext := strings.TrimPrefix(filepath.Ext(file.Name()), ".")
-	switch {
-	case slices.Contains(golangexts, ext):
-		s.highlighter = newgolanghighlighter(theme)
+	if interpreter := shebanginterpreter(firstline); interpreter != "" {
+		for _, lang := range languages {
+			if slices.Contains(lang.shebangs, interpreter) {
+				return lang
+			}
+		}
+	}
 
-	case slices.Contains(pythonexts, ext):
-		s.highlighter = newpythonhighlighter(theme)
+	return nil
+}
 
-	default:
-		s.highlighter = nophighlighter{}
+// return the language by the name or the extension like "python" or "py", which is written after the fence of
+// the code block in markdown. The interpreter name like "bash" is also accepted. nil is returned if it is unknown.
+func findlanguage(name string) *language {
+	name = strings.ToLower(name)
+	if name == "" {
+		return nil
 	}
 
-	for i := range s.lines {
-		prevlinestate := &lineattribute{}
-		if i != 0 {
-			prevlinestate = s.lineattrs[i-1]
+	for _, lang := range languages {
+		if lang.name == name {
+			return lang
 		}
-		s.lineattrs[i] = s.highlighter.highlightline(s.lines[i], prevlinestate)
 	}
 
-	// calculate line number area width
-	s.updatelinenumberwidth()
+	for _, lang := range languages {
+		if slices.Contains(lang.exts, name) || slices.Contains(lang.shebangs, name) {
+			return lang
+		}
+	}
 
-	return s
+	return nil
 }
 
-func (s *screen) focus() {
-	s.focused = true
-}
+// return the interpreter name in the shebang line without the version, like "python" for "#!/usr/bin/env python3".
+// Empty string is returned if the line is not a shebang.
+func shebanginterpreter(firstline string) string {
+	if !strings.HasPrefix(firstline, "#!") {
+		return ""
+	}
 
-func (s *screen) unfocus() {
-	s.focused = false
-}
+	fields := strings.Fields(firstline[2:])
+	if len(fields) == 0 {
+		return ""
+	}
 
-func (s *screen) updatelinenumberwidth() {
-	if len(s.lines) < 10000 {
-		s.linenumberwidth = 4
-		return
+	name := filepath.Base(fields[0])
+	if name == "env" {
+		// skip the options of env like "-S"
+		fields = fields[1:]
+		for len(fields) != 0 && strings.HasPrefix(fields[0], "-") {
+			fields = fields[1:]
+		}
+		if len(fields) == 0 {
+			return ""
+		}
+		name = filepath.Base(fields[0])
 	}
 
-	s.linenumberwidth = calcdigit(len(s.lines))
+	return strings.TrimRight(name, "0123456789.")
 }
 
-func calcdigit(n int) int {
-	digit := 0
-	for {
-		n /= 10
-		digit++
-		if n == 0 {
-			break
-		}
+var (
+	lang_go = &language{
+		name: "go",
+		exts: []string{"go", "go_"}, // go_ is for test
+		syntax: &clikelanglinetokenizer{
+			linecommentstart:      []rune{'/', '/'},
+			blockcommentstart:     []rune{'/', '*'},
+			blockcommentend:       []rune{'*', '/'},
+			stringstarts:          [][]rune{{'"'}, {'\''}},
+			stringends:            [][]rune{{'"'}, {'\''}},
+			multilinestringstarts: [][]rune{{'`'}},
+			multilinestringends:   [][]rune{{'`'}},
+			keywords: []string{
+				"append", "copy", "delete", "len", "cap", "make", "max", "min", "new", "complex", "real", "imag", "clear", "close", "panic", "recover", "print", "println",
+				"package", "import", "func", "defer", "return", "for", "range", "for", "if", "else", "var", "const", "switch", "case", "goto", "fallthrough", "default",
+				"type", "struct", "interface", "map", "select", "go", "chan", "iota", "nil", "true", "false",
+				"bool", "uint8", "uint16", "uint32", "uint64", "int8", "int16", "int32", "int64", "float32", "float64", "complex64", "complex128",
+				"string", "int", "uint", "uintptr", "byte", "rune", "any", "error", "comparable",
+				"archive", "tar", "zip", "bufio", "builtin", "bytes", "cmp", "compress", "bzip2", "flate", "gzip", "lzw", "zlib", "container", "heap",
+				"list", "ring", "context", "crypto", "aes", "cipher", "des", "dsa", "ecdh", "ecdsa", "ed25519", "elliptic", "fips140", "hkdf", "hmac", "md5", "mlkem", "pbkdf2", "rand", "rc4",
+				"rsa", "sha1", "sha256", "sha3", "sha512", "subtle", "tls", "x509", "pkix", "database", "sql", "driver", "debug", "buildinfo", "dwarf", "elf", "gosym", "macho", "pe", "plan9obj", "embed",
+				"encoding", "ascii85", "asn1", "base32", "base64", "binary", "csv", "gob", "hex", "json", "pem", "xml", "errors", "expvar", "flag", "fmt", "go", "ast", "build", "constraint", "constant",
+				"doc", "comment", "format", "importer", "parser", "printer", "scanner", "token", "types", "version", "hash", "adler32", "crc32", "crc64", "fnv", "maphash", "html", "template", "image", "color",
+				"palette", "draw", "gif", "jpeg", "png", "index", "suffixarray", "io", "fs", "ioutil", "iter", "log", "slog", "syslog", "maps", "math", "big", "bits", "cmplx", "rand", "mime",
+				"multipart", "quotedprintable", "net", "http", "cgi", "cookiejar", "fcgi", "httptest", "httptrace", "httputil", "pprof", "mail", "netip", "rpc", "jsonrpc", "smtp", "textproto", "url", "os", "exec",
+				"signal", "user", "path", "filepath", "plugin", "reflect", "regexp", "syntax", "runtime", "cgo", "coverage", "debug", "metrics", "pprof", "race", "trace",
+				"slices", "sort", "strconv", "strings", "structs", "sync", "atomic", "syscall", "js", "testing", "fstest", "iotest", "quick", "slogtest", "synctest",
+				"text", "scanner", "tabwriter", "template", "parse", "time", "tzdata", "unicode", "utf16", "utf8", "unique", "unsafe", "weak",
+			},
+			symbols:    []string{"[", "]", "(", ")", "{", "}", ":", ";", ",", "."},
+			operators:  []string{"!", "+", "-", "*", "/", "%", "&", "|", "=", "<", ">", "~"},
+			operators2: []string{"++", "--", ":=", "==", "<=", ">=", "!=", "+=", "-=", "*=", "/=", "|=", "&=", "%=", "&&", "||", "<<", ">>"},
+			operators3: []string{">>=", "<<=", "&^="},
+		},
 	}
-	return digit
-}
 
-func (s *screen) statusline() []byte {
-	l := newline(fmt.Sprintf(" %v", s.file.Name()))
+	lang_python = &language{
+		name:     "python",
+		exts:     []string{"py", "pyi"},
+		shebangs: []string{"python"},
+		syntax: &clikelanglinetokenizer{
+			linecommentstart:      []rune{'#'},
+			stringstarts:          [][]rune{{'"'}, {'\''}, {'b', '"'}, {'f', '"'}},
+			stringends:            [][]rune{{'"'}, {'\''}, {'"'}, {'"'}},
+			multilinestringstarts: [][]rune{{'"', '"', '"'}, {'\'', '\'', '\''}},
+			multilinestringends:   [][]rune{{'"', '"', '"'}, {'\'', '\'', '\''}},
+			keywords: []string{
+				"False", "None", "True", "and", "as", "assert", "async", "await", "break", "class", "continue", "def", "del", "elif", "else", "except", "finally", "for",
+				"from", "global", "if", "import", "in", "is", "lambda", "nonlocal", "not", "or", "pass", "raise", "return", "try", "while", "with", "yield",
+				"abs", "aiter", "all", "anext", "any", "ascii", "bin", "bool", "breakpoint", "bytearray", "bytes", "callable", "chr", "classmethod", "compile", "complex",
+				"delattr", "dict", "dir", "divmod", "enumerate", "eval", "exec", "filter", "float", "format", "frozenset", "getattr", "globals",
+				"hasattr", "hash", "help", "hex", "id", "input", "int", "isinstance", "issubclass", "iter", "len", "list", "locals",
+				"map", "max", "memoryview", "min", "next", "object", "oct", "open", "ord", "pow", "print", "property",
+				"range", "repr", "reversed", "round", "set", "setattr", "slice", "sorted", "staticmethod", "str", "sum", "super", "tuple", "type", "vars", "zip", "__import__",
+			},
+			symbols:    []string{"[", "]", "(", ")", "{", "}", ":", ";", ",", "."},
+			operators:  []string{"+", "-", "*", "/", "%", "~", "&", "|", "^", "=", "<", ">", "@"},
+			operators2: []string{"**", "//", "+=", "-=", "*=", "/=", "%=", "&=", "|=", "^=", "==", "!=", "<=", ">=", ":=", "is", "in", "or"},
+			operators3: []string{"**=", "//=", ">>=", "<<=", "and", "not"},
+		},
+	}
 
-	var color []int
-	if s.focused {
-		color = slices.Repeat([]int{51}, len(l.buffer))
+	ckeywords = []string{
+		"auto", "break", "case", "char", "const", "continue", "default", "do", "double", "else", "enum", "extern", "float", "for", "goto", "if", "inline", "int", "long",
+		"register", "restrict", "return", "short", "signed", "sizeof", "static", "struct", "switch", "typedef", "union", "unsigned", "void", "volatile", "while",
+		"_Alignas", "_Alignof", "_Atomic", "_Bool", "_Complex", "_Generic", "_Imaginary", "_Noreturn", "_Static_assert", "_Thread_local",
+		"bool", "true", "false", "NULL", "size_t", "ssize_t", "int8_t", "int16_t", "int32_t", "int64_t", "uint8_t", "uint16_t", "uint32_t", "uint64_t", "uintptr_t",
+		"include", "define", "undef", "ifdef", "ifndef", "elif", "endif", "pragma", "error", "defined",
+	}
+	coperators  = []string{"!", "+", "-", "*", "/", "%", "&", "|", "^", "=", "<", ">", "~", "?", "#"}
+	coperators2 = []string{"++", "--", "->", "==", "!=", "<=", ">=", "&&", "||", "<<", ">>", "+=", "-=", "*=", "/=", "%=", "&=", "|=", "^=", "##"}
+	coperators3 = []string{"<<=", ">>=", "..."}
+
+	lang_c = &language{
+		name: "c",
+		exts: []string{"c", "h"},
+		syntax: &clikelanglinetokenizer{
+			linecommentstart:  []rune{'/', '/'},
+			blockcommentstart: []rune{'/', '*'},
+			blockcommentend:   []rune{'*', '/'},
+			stringstarts:      [][]rune{{'"'}, {'\''}},
+			stringends:        [][]rune{{'"'}, {'\''}},
+			keywords:          ckeywords,
+			symbols:           []string{"[", "]", "(", ")", "{", "}", ":", ";", ",", "."},
+			operators:         coperators,
+			operators2:        coperators2,
+			operators3:        coperators3,
+		},
 	}
 
-	return []byte(l.cutandcolorize(0, s.width-(s.linenumberwidth+1), color, []int{}, []int{}))
-}
+	lang_cpp = &language{
+		name: "cpp",
+		exts: []string{"cc", "cpp", "cxx", "c++", "hh", "hpp", "hxx", "h++", "ipp", "tpp"},
+		syntax: &clikelanglinetokenizer{
+			linecommentstart:  []rune{'/', '/'},
+			blockcommentstart: []rune{'/', '*'},
+			blockcommentend:   []rune{'*', '/'},
+			stringstarts:      [][]rune{{'"'}, {'\''}},
+			stringends:        [][]rune{{'"'}, {'\''}},
+			rawstringstarts:   [][]rune{{'R', '"', '('}},
+			rawstringends:     [][]rune{{')', '"'}},
+			keywords: slices.Concat(ckeywords, []string{
+				"alignas", "alignof", "asm", "catch", "char8_t", "char16_t", "char32_t", "class", "concept", "consteval", "constexpr", "constinit", "const_cast",
+				"co_await", "co_return", "co_yield", "decltype", "delete", "dynamic_cast", "explicit", "export", "final", "friend", "import", "module", "mutable",
+				"namespace", "new", "noexcept", "nullptr", "operator", "override", "private", "protected", "public", "reinterpret_cast", "requires",
+				"static_assert", "static_cast", "template", "this", "thread_local", "throw", "try", "typeid", "typename", "using", "virtual", "wchar_t",
+			}),
+			symbols:    []string{"[", "]", "(", ")", "{", "}", ":", ";", ",", "."},
+			operators:  coperators,
+			operators2: append(slices.Clone(coperators2), "::", ".*"),
+			operators3: append(slices.Clone(coperators3), "<=>", "->*"),
+		},
+	}
 
-func (s *screen) curline(c *cursor) *line {
-	return s.lines[c.y]
-}
+	jskeywords = []string{
+		"async", "await", "break", "case", "catch", "class", "const", "continue", "debugger", "default", "delete", "do", "else", "export", "extends",
+		"false", "finally", "for", "from", "function", "get", "if", "import", "in", "instanceof", "let", "new", "null", "of", "return", "set", "static",
+		"super", "switch", "this", "throw", "true", "try", "typeof", "undefined", "var", "void", "while", "with", "yield", "NaN", "Infinity",
+	}
+	jsoperators  = []string{"!", "+", "-", "*", "/", "%", "&", "|", "^", "=", "<", ">", "~", "?"}
+	jsoperators2 = []string{"=>", "==", "!=", "<=", ">=", "&&", "||", "??", "?.", "++", "--", "+=", "-=", "*=", "/=", "%=", "**", "<<", ">>", "&=", "|=", "^="}
+	jsoperators3 = []string{"===", "!==", "**=", "<<=", ">>=", ">>>", "&&=", "||=", "??=", "..."}
 
-func (s *screen) render(force bool) {
-	maincursor := s.cursors[len(s.cursors)-1]
+	lang_javascript = &language{
+		name:     "javascript",
+		exts:     []string{"js", "mjs", "cjs", "jsx"},
+		shebangs: []string{"node", "deno", "bun"},
+		syntax: &clikelanglinetokenizer{
+			linecommentstart:      []rune{'/', '/'},
+			blockcommentstart:     []rune{'/', '*'},
+			blockcommentend:       []rune{'*', '/'},
+			stringstarts:          [][]rune{{'"'}, {'\''}},
+			stringends:            [][]rune{{'"'}, {'\''}},
+			multilinestringstarts: [][]rune{{'`'}},
+			multilinestringends:   [][]rune{{'`'}},
+			keywords:              jskeywords,
+			symbols:               []string{"[", "]", "(", ")", "{", "}", ":", ";", ",", "."},
+			operators:             jsoperators,
+			operators2:            jsoperators2,
+			operators3:            jsoperators3,
+		},
+	}
 
-	// when the x is too right, set x to the line tail.
-	// This must not change s.x because s.x should be kept when moving to another long line.
-	x := min(maincursor.x, s.curline(maincursor).width()-1)
+	lang_typescript = &language{
+		name: "typescript",
+		exts: []string{"ts", "mts", "cts", "tsx"},
+		syntax: &clikelanglinetokenizer{
+			linecommentstart:      []rune{'/', '/'},
+			blockcommentstart:     []rune{'/', '*'},
+			blockcommentend:       []rune{'*', '/'},
+			stringstarts:          [][]rune{{'"'}, {'\''}},
+			stringends:            [][]rune{{'"'}, {'\''}},
+			multilinestringstarts: [][]rune{{'`'}},
+			multilinestringends:   [][]rune{{'`'}},
+			keywords: slices.Concat(jskeywords, []string{
+				"abstract", "any", "as", "asserts", "bigint", "boolean", "declare", "enum", "implements", "infer", "interface", "is", "keyof", "module", "namespace",
+				"never", "number", "object", "private", "protected", "public", "readonly", "satisfies", "string", "symbol", "type", "unique", "unknown",
+			}),
+			symbols:    []string{"[", "]", "(", ")", "{", "}", ":", ";", ",", "."},
+			operators:  jsoperators,
+			operators2: jsoperators2,
+			operators3: jsoperators3,
+		},
+	}
 
-	/* scroll x */
+	lang_rust = &language{
+		name: "rust",
+		exts: []string{"rs"},
+		syntax: &clikelanglinetokenizer{
+			linecommentstart:  []rune{'/', '/'},
+			blockcommentstart: []rune{'/', '*'},
+			blockcommentend:   []rune{'*', '/'},
+			// single quote is not a string start because it is also used for the lifetime like 'a
+			stringstarts:    [][]rune{{'"'}, {'b', '"'}},
+			stringends:      [][]rune{{'"'}, {'"'}},
+			rawstringstarts: [][]rune{{'r', '"'}, {'r', '#', '"'}},
+			rawstringends:   [][]rune{{'"'}, {'"', '#'}},
+			keywords: []string{
+				"as", "async", "await", "break", "const", "continue", "crate", "dyn", "else", "enum", "extern", "false", "fn", "for", "if", "impl", "in", "let", "loop",
+				"match", "mod", "move", "mut", "pub", "ref", "return", "self", "Self", "static", "struct", "super", "trait", "true", "type", "union", "unsafe", "use",
+				"where", "while", "macro_rules",
+				"i8", "i16", "i32", "i64", "i128", "isize", "u8", "u16", "u32", "u64", "u128", "usize", "f32", "f64", "bool", "char", "str",
+				"String", "Vec", "Box", "Option", "Some", "None", "Result", "Ok", "Err",
+			},
+			symbols:    []string{"[", "]", "(", ")", "{", "}", ":", ";", ",", ".", "#"},
+			operators:  []string{"!", "+", "-", "*", "/", "%", "&", "|", "^", "=", "<", ">", "?", "@"},
+			operators2: []string{"::", "->", "=>", "==", "!=", "<=", ">=", "&&", "||", "<<", ">>", "+=", "-=", "*=", "/=", "%=", "&=", "|=", "^=", ".."},
+			operators3: []string{"..=", "...", "<<=", ">>="},
+		},
+	}
 
-	var scrolled bool
+	lang_java = &language{
+		name: "java",
+		exts: []string{"java"},
+		syntax: &clikelanglinetokenizer{
+			linecommentstart:      []rune{'/', '/'},
+			blockcommentstart:     []rune{'/', '*'},
+			blockcommentend:       []rune{'*', '/'},
+			stringstarts:          [][]rune{{'"'}, {'\''}},
+			stringends:            [][]rune{{'"'}, {'\''}},
+			multilinestringstarts: [][]rune{{'"', '"', '"'}},
+			multilinestringends:   [][]rune{{'"', '"', '"'}},
+			keywords: []string{
+				"abstract", "assert", "boolean", "break", "byte", "case", "catch", "char", "class", "const", "continue", "default", "do", "double", "else", "enum",
+				"extends", "final", "finally", "float", "for", "goto", "if", "implements", "import", "instanceof", "int", "interface", "long", "native", "new",
+				"package", "private", "protected", "public", "return", "short", "static", "strictfp", "super", "switch", "synchronized", "this", "throw", "throws",
+				"transient", "try", "void", "volatile", "while", "var", "record", "sealed", "permits", "yield", "true", "false", "null", "String", "Object",
+			},
+			symbols:    []string{"[", "]", "(", ")", "{", "}", ":", ";", ",", ".", "@"},
+			operators:  []string{"!", "+", "-", "*", "/", "%", "&", "|", "^", "=", "<", ">", "~", "?"},
+			operators2: []string{"->", "::", "==", "!=", "<=", ">=", "&&", "||", "++", "--", "<<", ">>", "+=", "-=", "*=", "/=", "%=", "&=", "|=", "^="},
+			operators3: []string{">>>", "<<=", ">>="},
+		},
+	}
 
-	xpad := 4
-	xok := func() direction {
-		// too left, scroll left
-		if x-xpad < s.xoffset {
-			if x < xpad && s.xoffset <= x {
-				// too left but no enough space left
-				return 0
-			}
-			return left
-		}
+	lang_shell = &language{
+		name:      "shell",
+		exts:      []string{"sh", "bash", "zsh", "ksh"},
+		filenames: []string{".bashrc", ".bash_profile", ".bash_logout", ".profile", ".zshrc", ".zprofile", ".zshenv"},
+		shebangs:  []string{"sh", "bash", "zsh", "ksh", "dash"},
+		syntax: &clikelanglinetokenizer{
+			linecommentstart: []rune{'#'},
+			stringstarts:     [][]rune{{'"'}},
+			stringends:       [][]rune{{'"'}},
+			rawstringstarts:  [][]rune{{'\''}},
+			rawstringends:    [][]rune{{'\''}},
+			keywords: []string{
+				"if", "then", "else", "elif", "fi", "case", "esac", "for", "while", "until", "do", "done", "in", "function", "select", "time",
+				"return", "exit", "break", "continue", "local", "export", "readonly", "declare", "typeset", "unset", "shift", "source", "alias",
+				"echo", "printf", "read", "set", "test", "eval", "exec", "trap", "cd", "true", "false",
+			},
+			symbols:    []string{"[", "]", "(", ")", "{", "}", ";", ","},
+			operators:  []string{"|", "&", "<", ">", "=", "!", "$", "*", "?"},
+			operators2: []string{"&&", "||", ">>", "<<", "==", "!=", "=~", "|&", ";;", "$(", "${", "[[", "]]", "&>"},
+			operators3: []string{"<<<", "<<-", "&>>"},
+		},
+	}
 
-		// too right, scroll right
-		if s.xoffset+s.width-(s.linenumberwidth+1)-1 < x+xpad {
-			if s.curline(maincursor).width()-1 < x+xpad && x <= s.xoffset+s.width-(s.linenumberwidth+1)-1 {
-				// too right but no enough space right
-				return 0
-			}
-			return right
-		}
+	lang_json = &language{
+		name: "json",
+		exts: []string{"json", "jsonl", "geojson"},
+		syntax: &clikelanglinetokenizer{
+			stringstarts: [][]rune{{'"'}},
+			stringends:   [][]rune{{'"'}},
+			keywords:     []string{"true", "false", "null"},
+			symbols:      []string{"[", "]", "{", "}", ":", ","},
+			operators:    []string{"-"},
+		},
+	}
 
-		return 0
+	lang_make = &language{
+		name:      "make",
+		exts:      []string{"mk", "mak"},
+		filenames: []string{"Makefile", "makefile", "GNUmakefile"},
+		shebangs:  []string{"make"},
+		syntax: &clikelanglinetokenizer{
+			linecommentstart: []rune{'#'},
+			stringstarts:     [][]rune{{'"'}, {'\''}},
+			stringends:       [][]rune{{'"'}, {'\''}},
+			keywords: []string{
+				"include", "define", "endef", "ifdef", "ifndef", "ifeq", "ifneq", "else", "endif", "export", "unexport", "override", "vpath", "PHONY",
+			},
+			symbols:    []string{"(", ")", "{", "}", ";", ","},
+			operators:  []string{"$", "@", "<", "^", "%", "=", ":", "|", "?", "+", "*"},
+			operators2: []string{":=", "?=", "+=", "!=", "::", "$(", "${", "$@", "$<", "$^"},
+			operators3: []string{"::="},
+		},
 	}
 
-	for {
-		dir := xok()
-		if dir == 0 {
-			break
+	lang_markdown = &language{
+		name:        "markdown",
+		exts:        []string{"md", "markdown", "mkd"},
+		highlighter: newmarkdownhighlighter,
+	}
+
+	lang_dockerfile = &language{
+		name:      "dockerfile",
+		exts:      []string{"dockerfile", "containerfile"},
+		filenames: []string{"Dockerfile", "Containerfile"},
+		syntax: &clikelanglinetokenizer{
+			linecommentstart: []rune{'#'},
+			stringstarts:     [][]rune{{'"'}, {'\''}},
+			stringends:       [][]rune{{'"'}, {'\''}},
+			keywords: []string{
+				"FROM", "AS", "RUN", "CMD", "LABEL", "EXPOSE", "ENV", "ADD", "COPY", "ENTRYPOINT", "VOLUME", "USER", "WORKDIR", "ARG", "ONBUILD",
+				"STOPSIGNAL", "HEALTHCHECK", "SHELL", "MAINTAINER",
+			},
+			symbols:    []string{"[", "]", "(", ")", "{", "}", ",", ";"},
+			operators:  []string{"$", "=", "&", "|", "\\"},
+			operators2: []string{"&&", "||", "${"},
+		},
+	}
+)
+
+/* syntax files */
+
+// syntaxdef is the language definition written in a syntax file (TOML or JSON).
+// Each *_ends is paired with *_starts by the index. If it is omitted, the starts are also used as the ends.
+// The operators are sorted into the tokenizer by their length.
+type syntaxdef struct {
+	Name                  string   `json:"name"`
+	Extensions            []string `json:"extensions"`
+	Filenames             []string `json:"filenames"`
+	Shebangs              []string `json:"shebangs"`
+	LineComment           string   `json:"line_comment"`
+	BlockCommentStart     string   `json:"block_comment_start"`
+	BlockCommentEnd       string   `json:"block_comment_end"`
+	StringStarts          []string `json:"string_starts"`
+	StringEnds            []string `json:"string_ends"`
+	RawStringStarts       []string `json:"raw_string_starts"`
+	RawStringEnds         []string `json:"raw_string_ends"`
+	MultilineStringStarts []string `json:"multiline_string_starts"`
+	MultilineStringEnds   []string `json:"multiline_string_ends"`
+	Keywords              []string `json:"keywords"`
+	Symbols               []string `json:"symbols"`
+	Operators             []string `json:"operators"`
+}
+
+// return the directory of the config files, $XDG_CONFIG_HOME/turtle or ~/.config/turtle.
+// Empty string is returned if the home directory is unknown.
+func configdir() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "turtle")
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "turtle")
+}
+
+// load the syntax files (*.toml and *.json) in the directory and register the languages.
+// The files are loaded in the name order, and the language loaded later takes priority.
+// An invalid file is skipped and reported in the returned errors. A missing directory is not an error.
+func loadsyntaxfiles(dir string) []error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
 		}
+		return []error{fmt.Errorf("cannot read syntax directory: %w", err)}
+	}
 
-		if dir == left {
-			s.xoffset -= 1
-		} else {
-			s.xoffset += 1
+	var errs []error
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".toml" && ext != ".json") {
+			continue
 		}
-		scrolled = true
+
+		lang, err := readsyntaxfile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("syntax file %v: %w", entry.Name(), err))
+			continue
+		}
+
+		registerlanguage(lang)
 	}
+	return errs
+}
 
-	/* scroll y */
+// read the syntax file and build the language from it. The format is chosen by the extension.
+func readsyntaxfile(filename string) (*language, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
 
-	ypad := 4
-	yok := func() direction {
-		padup := maincursor.y - s.yoffset
-		paddown := (s.yoffset + s.height - 2) - maincursor.y
+	if filepath.Ext(filename) == ".toml" {
+		values, err := parsetoml(string(data))
+		if err != nil {
+			return nil, err
+		}
 
-		// cursor has up and down padding, it's ok
-		if padup >= ypad && paddown >= ypad {
-			return 0
+		// the values are decoded through JSON to share the validation of the field types
+		data, err = json.Marshal(values)
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		// up scroll needed
-		if padup < ypad {
-			// if y cursor is not shown, scroll up. This happens after some goto cmd.
-			if padup < 0 {
-				return up
-			}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
 
-			// no enough pad above but cannot scroll up more, stop.
-			if s.yoffset == 0 {
-				return 0
-			}
+	var def syntaxdef
+	if err := dec.Decode(&def); err != nil {
+		return nil, err
+	}
 
-			return up
-		}
+	return def.language()
+}
 
-		if paddown < ypad {
-			if paddown < 0 {
-				return down
-			}
+// register the language. It takes priority over the languages registered before.
+func registerlanguage(lang *language) {
+	languages = slices.Insert(languages, 0, lang)
+}
 
-			if s.yoffset+s.height-1 == len(s.lines) {
-				return 0
-			}
+// build the language from the definition.
+// The lengths of the delimiters are checked because the tokenizer supports only the limited ones.
+func (d *syntaxdef) language() (*language, error) {
+	if d.Name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
 
-			return down
-		}
+	syntax := &clikelanglinetokenizer{
+		keywords: d.Keywords,
+	}
 
-		return 0
+	if d.LineComment != "" {
+		if n := utf8.RuneCountInString(d.LineComment); 2 < n {
+			return nil, fmt.Errorf("line_comment must be 1 or 2 characters: %q", d.LineComment)
+		}
+		syntax.linecommentstart = []rune(d.LineComment)
 	}
 
-	for {
-		dir := yok()
-		if dir == 0 {
-			break
+	if (d.BlockCommentStart == "") != (d.BlockCommentEnd == "") {
+		return nil, fmt.Errorf("block_comment_start and block_comment_end must be given together")
+	}
+	if d.BlockCommentStart != "" {
+		if n := utf8.RuneCountInString(d.BlockCommentStart); n != 2 {
+			return nil, fmt.Errorf("block_comment_start must be 2 characters: %q", d.BlockCommentStart)
 		}
+		syntax.blockcommentstart = []rune(d.BlockCommentStart)
+		syntax.blockcommentend = []rune(d.BlockCommentEnd)
+	}
 
-		if dir == up {
-			s.yoffset -= 1
-		} else {
-			s.yoffset += 1
+	var err error
+	if syntax.stringstarts, syntax.stringends, err = quotepairs("string", d.StringStarts, d.StringEnds); err != nil {
+		return nil, err
+	}
+	if syntax.rawstringstarts, syntax.rawstringends, err = quotepairs("raw_string", d.RawStringStarts, d.RawStringEnds); err != nil {
+		return nil, err
+	}
+	if syntax.multilinestringstarts, syntax.multilinestringends, err = quotepairs("multiline_string", d.MultilineStringStarts, d.MultilineStringEnds); err != nil {
+		return nil, err
+	}
+
+	for _, sym := range d.Symbols {
+		if utf8.RuneCountInString(sym) != 1 {
+			return nil, fmt.Errorf("symbol must be 1 character: %q", sym)
 		}
-		scrolled = true
+		syntax.symbols = append(syntax.symbols, sym)
 	}
 
-	type _cursor struct {
-		c       *cursor
-		charidx int
+	for _, op := range d.Operators {
+		switch utf8.RuneCountInString(op) {
+		case 1:
+			syntax.operators = append(syntax.operators, op)
+		case 2:
+			syntax.operators2 = append(syntax.operators2, op)
+		case 3:
+			syntax.operators3 = append(syntax.operators3, op)
+		default:
+			return nil, fmt.Errorf("operator must be 1 to 3 characters: %q", op)
+		}
 	}
 
-	_cursors := make([]*_cursor, len(s.cursors))
+	return &language{
+		name:      d.Name,
+		exts:      d.Extensions,
+		filenames: d.Filenames,
+		shebangs:  d.Shebangs,
+		syntax:    syntax,
+	}, nil
+}
 
-	for i := range s.cursors {
-		x := min(s.cursors[i].x, s.curline(s.cursors[i]).width()-1)
-		s.cursors[i].actualx = x - s.xoffset + s.linenumberwidth + 1
-		_cursors[i] = &_cursor{c: s.cursors[i], charidx: s.curline(s.cursors[i]).charidx(x, s.xoffset)}
+// convert the quotes into the tokenizer form. The starts are used as the ends if the ends are omitted.
+func quotepairs(field string, starts, ends []string) ([][]rune, [][]rune, error) {
+	if ends == nil {
+		ends = starts
+	}
+	if len(starts) != len(ends) {
+		return nil, nil, fmt.Errorf("%v_starts and %v_ends must have the same number of quotes", field, field)
 	}
 
-	/* update texts */
+	var runestarts, runeends [][]rune
+	for i := range starts {
+		if n := utf8.RuneCountInString(starts[i]); n < 1 || 3 < n {
+			return nil, nil, fmt.Errorf("%v_starts must be 1 to 3 characters: %q", field, starts[i])
+		}
+		if ends[i] == "" {
+			return nil, nil, fmt.Errorf("%v_ends must not be empty", field)
+		}
+		runestarts = append(runestarts, []rune(starts[i]))
+		runeends = append(runeends, []rune(ends[i]))
+	}
+	return runestarts, runeends, nil
+}
 
-	displayline := func(y int) []byte {
-		line := s.lines[y]
-		linenumber := fmt.Sprintf("%v\x1b[38;5;243m%v\x1b[0m", strings.Repeat(" ", s.linenumberwidth-calcdigit(y+1)), y+1)
+/* toml */
 
-		colors := s.lineattrs[y].colors
-		cursor := []int{}
-		selections := []int{}
-		if s.focused {
-			for _, c := range _cursors {
-				// configure cursor line
-				if c.c.y == y {
-					cursor = append(cursor, c.charidx)
+// tomlparser parses the subset of TOML used in the config files.
+// Supported are "key = value" pairs, [table] headers (also dotted like [a.b]), comments,
+// and the values of basic and literal strings, integers, booleans and arrays which can span multiple lines.
+// The other features (floats, inline tables, multi-line strings, dotted keys, dates) are reported as not supported.
+type tomlparser struct {
+	src  []rune
+	pos  int
+	line int
+}
+
+// parse the TOML text into the map. Tables become the nested maps.
+// The error tells the line where parsing failed.
+func parsetoml(src string) (map[string]any, error) {
+	p := &tomlparser{src: []rune(src), line: 1}
+	root := map[string]any{}
+	table := root
+
+	for {
+		p.skipspaces(true)
+		if p.eof() {
+			return root, nil
+		}
+
+		if p.consume('[') {
+			t := root
+			for {
+				p.skipspaces(false)
+				key, err := p.key()
+				if err != nil {
+					return nil, err
 				}
 
-				// configure selected chars
-				switch sl := c.c.selection.(type) {
-				case *lineselection:
-					if slices.Contains(sl.lines, y) {
-						selections = make([]int, len(s.lineattrs[y].colors))
-						for i := range selections {
-							selections[i] = 3
-						}
+				next, ok := t[key].(map[string]any)
+				if !ok {
+					if _, exists := t[key]; exists {
+						return nil, p.errorf("%v is already defined", key)
 					}
-				case *charsselection:
-					// todo: implement
+					next = map[string]any{}
+					t[key] = next
 				}
+				t = next
+
+				p.skipspaces(false)
+				if p.consume('.') {
+					continue
+				}
+				if p.consume(']') {
+					break
+				}
+				return nil, p.errorf("] is expected after the table name")
+			}
+			table = t
+		} else {
+			key, err := p.key()
+			if err != nil {
+				return nil, err
 			}
-		}
-		debug(0, "selections: %v", selections)
-		return []byte(linenumber + " " + line.cutandcolorize(s.xoffset, s.width-1-(s.linenumberwidth+1), colors, selections, cursor))
-	}
 
-	if scrolled || s.scrolled || force {
-		// update all lines
-		for i := range s.height - 1 {
-			s.term.clearline(i)
-			if s.yoffset+i < len(s.lines) {
-				s.term.write(displayline(s.yoffset + i))
+			p.skipspaces(false)
+			if p.consume('.') {
+				dotted := key
+				for {
+					p.skipspaces(false)
+					k, err := p.key()
+					if err != nil {
+						return nil, err
+					}
+					dotted += "." + k
+					p.skipspaces(false)
+					if !p.consume('.') {
+						break
+					}
+				}
+				return nil, p.errorf("dotted key %v is not supported", dotted)
 			}
-		}
-	} else if len(s.linestoberendered) != 0 || len(s.highlightupdatedlines) != 0 {
-		// udpate only changed lines
-		lines := slices.Concat(s.linestoberendered, s.highlightupdatedlines)
-		slices.Sort(lines)
-		lines = slices.Compact(lines)
-		for _, l := range lines {
-			// if changed line is not shown on the screen, skip
-			if l < s.yoffset || s.height-2 < l-s.yoffset {
-				continue
+			if !p.consume('=') {
+				return nil, p.errorf("= is expected after %v", key)
 			}
 
-			s.term.clearline(l - s.yoffset)
+			p.skipspaces(false)
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
 
-			if l <= len(s.lines)-1 {
-				s.term.write(displayline(l))
+			if _, exists := table[key]; exists {
+				return nil, p.errorf("%v is already defined", key)
 			}
+			table[key] = v
+		}
+
+		// only a comment can follow on the line
+		p.skipspaces(false)
+		if !p.eof() && p.src[p.pos] != '\n' {
+			return nil, p.errorf("unexpected character %q", p.src[p.pos])
 		}
 	}
+}
 
-	// render status line
-	s.term.clearline(s.height - 1)
-	s.term.write(s.statusline())
-	s.term.flush()
-	s.linestoberendered = []int{}
-	s.highlightupdatedlines = []int{}
-	s.scrolled = false
+func (p *tomlparser) eof() bool {
+	return len(p.src) <= p.pos
 }
 
-func (s *screen) highlightchangedlines() {
-	if len(s.linestoberendered) == 0 {
-		return
+func (p *tomlparser) consume(r rune) bool {
+	if !p.eof() && p.src[p.pos] == r {
+		p.pos++
+		return true
 	}
+	return false
+}
 
-	slices.Sort(s.linestoberendered)
-	s.linestoberendered = slices.Compact(s.linestoberendered)
+func (p *tomlparser) hasprefix(s string) bool {
+	return strings.HasPrefix(string(p.src[p.pos:]), s)
+}
 
-	for i := s.linestoberendered[0]; i < len(s.lines); i++ {
-		prevlinestate := &lineattribute{}
-		if i != 0 {
-			prevlinestate = s.lineattrs[i-1]
+func (p *tomlparser) errorf(format string, a ...any) error {
+	return fmt.Errorf("line %v: %v", p.line, fmt.Sprintf(format, a...))
+}
+
+// skip the spaces and the comments. Newlines are also skipped if newline is true.
+func (p *tomlparser) skipspaces(newline bool) {
+	for !p.eof() {
+		switch r := p.src[p.pos]; {
+		case r == ' ' || r == '\t' || r == '\r':
+			p.pos++
+		case r == '\n' && newline:
+			p.pos++
+			p.line++
+		case r == '#':
+			for !p.eof() && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
 		}
+	}
+}
 
-		newlineattr := s.highlighter.highlightline(s.lines[i], prevlinestate)
-		curlineattr := s.lineattrs[i]
-		s.highlightupdatedlines = append(s.highlightupdatedlines, i)
+// read the bare key like "name" or the quoted key like "\"a b\"".
+func (p *tomlparser) key() (string, error) {
+	if !p.eof() && (p.src[p.pos] == '"' || p.src[p.pos] == '\'') {
+		return p.str()
+	}
 
-		// when the line state is not changed, the rest lines must not be changed also, so break the loop
-		if s.linestoberendered[len(s.linestoberendered)-1] < i && curlineattr.inblockcomment == newlineattr.inblockcomment && curlineattr.inmultilinestr == newlineattr.inmultilinestr {
-			s.lineattrs[i] = newlineattr
+	start := p.pos
+	for !p.eof() {
+		r := p.src[p.pos]
+		if !(r == '_' || r == '-' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9')) {
 			break
 		}
+		p.pos++
+	}
 
-		s.lineattrs[i] = newlineattr
+	if start == p.pos {
+		return "", p.errorf("key is expected")
 	}
+	return string(p.src[start:p.pos]), nil
 }
 
-// unify the cursors at the same position
-func (s *screen) cleanupcursors() {
-	slices.SortFunc(s.cursors, func(c1, c2 *cursor) int {
-		if c1.x == c2.x && c1.y == c2.y {
-			return 0
-		}
+func (p *tomlparser) value() (any, error) {
+	if p.eof() {
+		return nil, p.errorf("value is expected")
+	}
 
-		if c1.y != c2.y {
-			if c1.y > c2.y {
-				return 1
-			} else {
-				return -1
-			}
-		}
+	switch r := p.src[p.pos]; {
+	case p.hasprefix(`"""`) || p.hasprefix("'''"):
+		return nil, p.errorf("multi-line string is not supported")
 
-		if c1.x > c2.x {
-			return 1
-		}
+	case r == '"' || r == '\'':
+		return p.str()
 
-		return -1
-	})
-	s.cursors = slices.CompactFunc(s.cursors, func(c1, c2 *cursor) bool {
-		return c1.x == c2.x && c1.y == c2.y
-	})
-}
+	case r == '[':
+		return p.array()
 
-func (s *screen) handle(curmode mode, buff *input, buffchan <-chan *input) mode {
-	numinput := false
-	num := 1
-	isnum, n := buff.isnumber()
-	if curmode == normal && isnum {
-		numinput = true
-		num = n
-		for {
-			next := <-buffchan
-			isnum2, n2 := next.isnumber()
-			if !isnum2 {
-				buff = next
-				break
+	case r == '{':
+		return nil, p.errorf("inline table is not supported")
+
+	case r == '+' || r == '-' || ('0' <= r && r <= '9'):
+		start := p.pos
+		p.pos++
+		for !p.eof() && (('0' <= p.src[p.pos] && p.src[p.pos] <= '9') || p.src[p.pos] == '_') {
+			p.pos++
+		}
+
+		if !p.eof() {
+			switch p.src[p.pos] {
+			case '.', 'e', 'E':
+				return nil, p.errorf("float is not supported")
+			case '-', ':':
+				return nil, p.errorf("date and time is not supported")
 			}
+		}
 
-			num *= 10
-			num += n2
+		s := string(p.src[start:p.pos])
+		n, err := strconv.ParseInt(strings.ReplaceAll(s, "_", ""), 10, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %v", s)
 		}
+		return n, nil
 	}
 
-	if num == 0 {
-		num = 1
+	for _, b := range []string{"true", "false"} {
+		if p.hasprefix(b) {
+			p.pos += len(b)
+			return b == "true", nil
+		}
 	}
 
-	newmode := curmode
+	if p.hasprefix("inf") || p.hasprefix("nan") {
+		return nil, p.errorf("float is not supported")
+	}
 
-	switch curmode {
-	case normal:
-		switch buff.special {
-		case _left:
-			s.movecursors(left, num)
+	return nil, p.errorf("invalid value")
+}
 
-		case _down:
-			s.movecursors(down, num)
+// read the array. Newlines and comments are allowed between the values, and the trailing comma is allowed.
+func (p *tomlparser) array() ([]any, error) {
+	p.pos++ // [
 
-		case _up:
-			s.movecursors(up, num)
+	values := []any{}
+	for {
+		p.skipspaces(true)
+		if p.consume(']') {
+			return values, nil
+		}
 
-		case _right:
-			s.movecursors(right, num)
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
 
-		case _ctrl_u:
-			s.scrollhalf(up)
+		p.skipspaces(true)
+		if p.consume(']') {
+			return values, nil
+		}
+		if !p.consume(',') {
+			return nil, p.errorf(", or ] is expected in the array")
+		}
+	}
+}
 
-		case _ctrl_d:
-			s.scrollhalf(down)
+// read the basic string "..." which can contain the escapes, or the literal string '...'.
+func (p *tomlparser) str() (string, error) {
+	quote := p.src[p.pos]
+	p.pos++
 
-		case _not_special_key:
-			switch buff.r {
-			// case '\\':
-			// 	debug(0, "debug line (%v): '%v', attr: %v\n", s.y, s.curline(), s.lineattrs[s.y])
-			case 'C':
-				s.addcursorbelow()
+	var sb strings.Builder
+	for {
+		if p.eof() || p.src[p.pos] == '\n' {
+			return "", p.errorf("string is not terminated")
+		}
 
-			case ',':
-				s.deletecursors()
+		r := p.src[p.pos]
+		p.pos++
 
-			case 'd':
-				s.deleteselections()
+		if r == quote {
+			return sb.String(), nil
+		}
 
-			case 'o':
-				s.insertlinefromcursors(down)
-				newmode = insert
+		if r != '\\' || quote == '\'' {
+			sb.WriteRune(r)
+			continue
+		}
 
-			case 'O':
-				s.insertlinefromcursors(up)
-				newmode = insert
+		if p.eof() {
+			return "", p.errorf("string is not terminated")
+		}
 
-			case 'G':
-				if numinput {
-					s.movecursorstoline(num)
-				}
+		esc := p.src[p.pos]
+		p.pos++
+		switch esc {
+		case 'n':
+			sb.WriteRune('\n')
+		case 't':
+			sb.WriteRune('\t')
+		case 'r':
+			sb.WriteRune('\r')
+		case '"', '\\':
+			sb.WriteRune(esc)
+		case 'u', 'U':
+			n := 4
+			if esc == 'U' {
+				n = 8
+			}
+			if len(p.src) < p.pos+n {
+				return "", p.errorf("invalid escape \\%c", esc)
+			}
 
-			case 'p':
-				s.pastefromcursors()
+			code, err := strconv.ParseUint(string(p.src[p.pos:p.pos+n]), 16, 32)
+			if err != nil {
+				return "", p.errorf("invalid escape \\%c%v", esc, string(p.src[p.pos:p.pos+n]))
+			}
+			sb.WriteRune(rune(code))
+			p.pos += n
+		default:
+			return "", p.errorf("invalid escape \\%c", esc)
+		}
+	}
+}
 
-			/*
-			 * goto mode
-			 */
-			case 'g':
-				input2 := <-buffchan
-				switch input2.r {
-				case 'g':
-					s.movecursorstotopleft()
+/* tokenizer */
 
-				case 'e':
-					s.movecursorstobottomleft()
+type tokentype int
 
-				case 'l':
-					s.movecursorstolinebottom()
+const (
+	tk_unknown tokentype = iota
+	tk_ident
+	tk_keyword
+	tk_string
+	tk_multilinestring
+	tk_number
+	tk_operator
+	tk_symbol
+	tk_linecomment
+	tk_blockcomment
+	tk_whitespace
+	tk_nl
+)
 
-				case 's':
-					s.movecursorstononspacelinehead()
+func (t tokentype) String() string {
+	switch t {
+	case tk_unknown:
+		return "unknown"
+	case tk_ident:
+		return "ident"
+	case tk_keyword:
+		return "keyword"
+	case tk_string:
+		return "string"
+	case tk_multilinestring:
+		return "multilinestring"
+	case tk_number:
+		return "number"
+	case tk_operator:
+		return "operator"
+	case tk_symbol:
+		return "symbol"
+	case tk_linecomment:
+		return "linecomment"
+	case tk_blockcomment:
+		return "blockcomment"
+	case tk_whitespace:
+		return "whitespace"
+	case tk_nl:
+		return "nl"
+	default:
+		panic("unknown tokentype")
+	}
+}
 
-				case 'h':
-					s.movecursorstolinehead()
+type token struct {
+	typ        tokentype
+	start, end int
 
-				default:
-					// do nothing
-				}
+	blockcommentterminated bool
 
-			case 'f':
-				input2 := <-buffchan
-				if input2.special == _not_special_key {
-					s.movecursorstonextch(newcharacter(input2.r))
-				}
+	multilinestrterminated bool
+	multilinestrstart      []rune
+	multilinestrend        []rune
+}
 
-			case 'F':
-				input2 := <-buffchan
-				if input2.special == _not_special_key {
-					s.movecursorstoprevch(newcharacter(input2.r))
-				}
+func (t *token) String() string {
+	switch t.typ {
+	case tk_blockcomment:
+		return fmt.Sprintf("{%v (%v-%v) (terminated: %v)}", t.typ, t.start, t.end, t.blockcommentterminated)
+	case tk_multilinestring:
+		return fmt.Sprintf("{%v (%v-%v) (terminated: %v, quote: %v%v)}", t.typ, t.start, t.end, t.multilinestrterminated, t.multilinestrstart, t.multilinestrend)
+	default:
+		return fmt.Sprintf("{%v (%v-%v)}", t.typ, t.start, t.end)
+	}
+}
 
-			case 'r':
-				input2 := <-buffchan
-				if input2.special == _not_special_key {
-					s.replacecursorchar(newcharacter(input2.r))
-				}
+type clikelanglinetokenizer struct {
+	line *line
+	pos  int
 
-			case 'h':
-				s.movecursors(left, num)
+	// language setting
 
-			case 'j':
-				s.movecursors(down, num)
+	linecommentstart  []rune
+	blockcommentstart []rune
+	blockcommentend   []rune
 
-			case 'k':
-				s.movecursors(up, num)
+	stringstarts          [][]rune
+	stringends            [][]rune
+	rawstringstarts       [][]rune
+	rawstringends         [][]rune
+	multilinestringstarts [][]rune
+	multilinestringends   [][]rune
+
+	keywords   []string
+	symbols    []string
+	operators  []string // single character
+	operators2 []string // 2 characters
+	operators3 []string // 3 characters
+}
+
+func (t *clikelanglinetokenizer) tokenizeline(l *line, prevlinestate *lineattribute) ([]*token, *lineattribute) {
+	t.line = l
+	t.pos = 0
+
+	var tokens []*token
+	inmultilinecomment, inmultilinestring := prevlinestate.inblockcomment, prevlinestate.inmultilinestr
+	multilinestrstart, multilinestrend := prevlinestate.multilinestrstart, prevlinestate.multilinestrend
+	for t.pos < t.line.length()-1 {
+		var tk *token
+
+		switch {
+		case inmultilinecomment:
+			tk = t.readblockcomment(0, false)
+			inmultilinecomment = !tk.blockcommentterminated
+		case inmultilinestring:
+			tk = t.readmultilinestring(0, false, multilinestrstart, multilinestrend)
+			inmultilinestring = !tk.multilinestrterminated
+			multilinestrstart = tk.multilinestrstart
+			multilinestrend = tk.multilinestrend
+		default:
+			tk = t.nexttoken()
+			if tk.typ == tk_blockcomment {
+				inmultilinecomment = !tk.blockcommentterminated
+			} else if tk.typ == tk_multilinestring {
+				inmultilinestring = !tk.multilinestrterminated
+				multilinestrstart = tk.multilinestrstart
+				multilinestrend = tk.multilinestrend
+			}
+		}
+
+		tokens = append(tokens, tk)
+	}
+
+	tokens = append(tokens, &token{typ: tk_nl, start: t.line.length(), end: t.line.length() - 1})
+
+	return tokens, &lineattribute{
+		inblockcomment:    inmultilinecomment,
+		inmultilinestr:    inmultilinestring,
+		multilinestrstart: multilinestrstart,
+		multilinestrend:   multilinestrend,
+	}
+}
+
+func (t *clikelanglinetokenizer) nexttoken() *token {
+	start := t.pos
+	c := t.line.buffer[start]
+
+	if c.tab || unicode.IsSpace(c.r) {
+		return t.readwhitespace(start)
+	}
+
+	// comment
+	switch len(t.linecommentstart) {
+	case 1:
+		if c.r == t.linecommentstart[0] {
+			return t.readlinecomment(start)
+		}
+	case 2:
+		if c.r == t.linecommentstart[0] && t.peek().r == t.linecommentstart[1] {
+			return t.readlinecomment(start)
+		}
+	}
+
+	switch len(t.blockcommentstart) {
+	case 2:
+		if c.r == t.blockcommentstart[0] && t.peek().r == t.blockcommentstart[1] {
+			return t.readblockcomment(start, true)
+		}
+	}
+
+	for i, multilinestringstart := range t.multilinestringstarts {
+		switch len(multilinestringstart) {
+		case 1:
+			if c.r == multilinestringstart[0] {
+				return t.readmultilinestring(start, true, multilinestringstart, t.multilinestringends[i])
+			}
+		case 2:
+			if c.r == multilinestringstart[0] && t.peek().r == multilinestringstart[1] {
+				return t.readmultilinestring(start, true, multilinestringstart, t.multilinestringends[i])
+			}
+		case 3:
+			if c.r == multilinestringstart[0] && t.peek().r == multilinestringstart[1] && t.peek2().r == multilinestringstart[2] {
+				return t.readmultilinestring(start, true, multilinestringstart, t.multilinestringends[i])
+			}
+		}
+	}
+
+	for i, stringstart := range t.stringstarts {
+		switch len(stringstart) {
+		case 1:
+			if c.r == stringstart[0] {
+				return t.readstring(start, stringstart, t.stringends[i], true)
+			}
+		case 2:
+			if c.r == stringstart[0] && t.peek().r == stringstart[1] {
+				return t.readstring(start, stringstart, t.stringends[i], true)
+			}
+		case 3:
+			if c.r == stringstart[0] && t.peek().r == stringstart[1] && t.peek2().r == stringstart[2] {
+				return t.readstring(start, stringstart, t.stringends[i], true)
+			}
+		}
+	}
+
+	for i, rawstringstart := range t.rawstringstarts {
+		switch len(rawstringstart) {
+		case 1:
+			if c.r == rawstringstart[0] {
+				return t.readstring(start, rawstringstart, t.rawstringends[i], false)
+			}
+		case 2:
+			if c.r == rawstringstart[0] && t.peek().r == rawstringstart[1] {
+				return t.readstring(start, rawstringstart, t.rawstringends[i], false)
+			}
+		case 3:
+			if c.r == rawstringstart[0] && t.peek().r == rawstringstart[1] && t.peek2().r == rawstringstart[2] {
+				return t.readstring(start, rawstringstart, t.rawstringends[i], false)
+			}
+		}
+	}
+
+	if unicode.IsDigit(c.r) || (c.r == '.' && unicode.IsDigit(t.peek().r)) {
+		return t.readnumber(start)
+	}
+
+	if unicode.IsLetter(c.r) || c.r == '_' {
+		return t.readident(start)
+	}
+
+	return t.readsymbol(start)
+}
+
+func (t *clikelanglinetokenizer) peek() *character {
+	if t.line.length() <= t.pos+1 {
+		return &character{}
+	}
+	return t.line.buffer[t.pos+1]
+}
+
+func (t *clikelanglinetokenizer) peek2() *character {
+	if t.line.length() <= t.pos+2 {
+		return &character{}
+	}
+	return t.line.buffer[t.pos+2]
+}
+
+func (t *clikelanglinetokenizer) readwhitespace(start int) *token {
+	for t.pos < t.line.length()-1 && (unicode.IsSpace(t.line.buffer[t.pos].r) || t.line.buffer[t.pos].tab) {
+		t.pos++
+	}
+	return &token{typ: tk_whitespace, start: start, end: t.pos}
+}
+
+func (t *clikelanglinetokenizer) readlinecomment(start int) *token {
+	t.pos += len(t.linecommentstart)
+
+	for t.pos < t.line.length()-1 { // skip nl
+		t.pos++
+	}
+
+	return &token{typ: tk_linecomment, start: start, end: t.pos}
+}
+
+func (t *clikelanglinetokenizer) readblockcomment(start int, firstline bool) *token {
+	if firstline {
+		t.pos += len(t.blockcommentstart)
+	}
+
+	terminated := false
+	for t.pos < t.line.length()-1 { // skip nl
+		if t.line.length()-1 < t.pos+len(t.blockcommentend) {
+			t.pos++
+			continue
+		}
+
+		found := true
+		for i, commentchar := range t.blockcommentend {
+			if t.line.buffer[t.pos+i].r != commentchar {
+				found = false
+				break
+			}
+		}
+
+		if found {
+			t.pos += len(t.blockcommentend)
+			terminated = true
+			break
+		}
+
+		t.pos++
+	}
+
+	return &token{typ: tk_blockcomment, start: start, end: t.pos, blockcommentterminated: terminated}
+}
+
+func (t *clikelanglinetokenizer) readstring(start int, startquote, endquote []rune, considerescape bool) *token {
+	t.pos += len(startquote)
+
+	for t.pos < t.line.length()-1 { // skip nl
+		if t.line.length()-1 < t.pos+len(endquote) {
+			t.pos++
+			continue
+		}
+
+		found := true
+		for i, quotechar := range endquote {
+			if t.line.buffer[t.pos+i].r != quotechar {
+				found = false
+				break
+			}
+		}
+		if found {
+			t.pos += len(endquote)
+			break
+		}
+
+		if considerescape {
+			if t.line.buffer[t.pos].r == '\\' && t.pos+1 < t.line.length()-1 {
+				t.pos += 2
+			} else {
+				t.pos++
+			}
+		} else {
+			t.pos++
+		}
+	}
+
+	return &token{typ: tk_string, start: start, end: t.pos}
+}
+
+func (t *clikelanglinetokenizer) readmultilinestring(start int, firstline bool, startquote, endquote []rune) *token {
+	if firstline {
+		t.pos += len(startquote)
+	}
+
+	terminated := false
+	for t.pos < t.line.length()-1 { // skip nl
+		if t.line.length()-1 < t.pos+len(endquote) {
+			t.pos++
+			continue
+		}
+
+		found := true
+		for i, quotechar := range endquote {
+			if t.line.buffer[t.pos+i].r != quotechar {
+				found = false
+				break
+			}
+		}
+
+		if found {
+			t.pos += len(endquote)
+			terminated = true
+			break
+		}
+
+		t.pos++
+	}
+
+	return &token{typ: tk_multilinestring, start: start, end: t.pos, multilinestrterminated: terminated, multilinestrstart: startquote, multilinestrend: endquote}
+}
+
+func (t *clikelanglinetokenizer) readnumber(start int) *token {
+	for t.pos < t.line.length() && (unicode.IsDigit(t.line.buffer[t.pos].r) || t.line.buffer[t.pos].r == '_') {
+		t.pos++
+	}
+
+	if t.pos < t.line.length() && t.line.buffer[t.pos].r == '.' {
+		t.pos++
+		for t.pos < t.line.length() && (unicode.IsDigit(t.line.buffer[t.pos].r) || t.line.buffer[t.pos].r == '_') {
+			t.pos++
+		}
+	}
+
+	if t.pos < t.line.length() && (t.line.buffer[t.pos].r == 'e' || t.line.buffer[t.pos].r == 'E') {
+		t.pos++
+		if t.pos < t.line.length() && (t.line.buffer[t.pos].r == '+' || t.line.buffer[t.pos].r == '-') {
+			t.pos++
+		}
+		for t.pos < t.line.length() && (unicode.IsDigit(t.line.buffer[t.pos].r) || t.line.buffer[t.pos].r == '_') {
+			t.pos++
+		}
+	}
+
+	return &token{typ: tk_number, start: start, end: t.pos}
+}
+
+func (t *clikelanglinetokenizer) readident(start int) *token {
+	for t.pos < t.line.length() && (unicode.IsLetter(t.line.buffer[t.pos].r) || unicode.IsDigit(t.line.buffer[t.pos].r) || t.line.buffer[t.pos].r == '_') {
+		t.pos++
+	}
+
+	typ := tk_ident
+
+	s := t.line.substring(start, t.pos)
+	if slices.Contains(t.keywords, s) {
+		typ = tk_keyword
+	}
+
+	return &token{typ: typ, start: start, end: t.pos}
+}
+
+func (t *clikelanglinetokenizer) readsymbol(start int) *token {
+	if t.pos+3 < t.line.length()-1 {
+		threechars := t.line.substring(t.pos, t.pos+3)
+		if slices.Contains(t.operators3, threechars) {
+			t.pos += 3
+			return &token{typ: tk_operator, start: start, end: t.pos}
+		}
+	}
+
+	if t.pos+2 < t.line.length()-1 {
+		twochars := t.line.substring(t.pos, t.pos+2)
+		if slices.Contains(t.operators2, twochars) {
+			t.pos += 2
+			return &token{typ: tk_operator, start: start, end: t.pos}
+		}
+	}
+
+	char := string(t.line.buffer[t.pos].r)
+	if slices.Contains(t.operators, char) {
+		t.pos++
+		return &token{typ: tk_operator, start: start, end: t.pos}
+	}
+
+	if slices.Contains(t.symbols, char) {
+		t.pos++
+		return &token{typ: tk_symbol, start: start, end: t.pos}
+	}
+
+	t.pos++
+	return &token{typ: tk_unknown, start: start, end: t.pos}
+}
+
+/*
+ * buffer
+ */
+
+type file interface {
+	io.ReadCloser
+	Name() string
+}
+
+// buffer is the text loaded from a file. It can be shown in multiple screens,
+// each of which has its own cursors and scroll offsets.
+type buffer struct {
+	id          int
+	file        file
+	lines       []*line
+	lineattrs   []*lineattribute
+	highlighter highlighter
+	theme       *theme
+	semantic    *gosemantic // nil unless the semantic highlighting is enabled for Go
+	undotree    *undotree
+	dirty       bool
+	// incremented on every change of the lines and the line ending, to tell the buffer is changed without comparing the text
+	changes int
+
+	// how the file is encoded, kept to write it back in the same way
+	bom  bool // starts with the UTF-8 byte order mark
+	crlf bool // lines end with "\r\n"
+	eol  bool // the last line ends with the newline
+	// the file is empty. The text written in it gets the newline at the end like in a new file.
+	empty bool
+
+	// the swap file to write, "" if every candidate is used by others
+	swapfile string
+	// the changes written to the swap file lastly, -1 if not written.
+	// The undo tree node cannot tell it because the edits in insert mode are pending until Esc.
+	swapped int
+	// whether the swap file is written by this buffer
+	swapowned bool
+
+	// screens showing the buffer
+	views []*screen
+	// cursors of the screen lastly detached, restored when the buffer is shown again
+	lastcursors []*cursor
+}
+
+// newbuffer reads the file into the buffer. If semanticresults is given, Go files are highlighted semantically
+// and the results of parsing are sent to it.
+func newbuffer(id int, file file, theme *theme, semanticresults chan<- *semanticresult) *buffer {
+	b := &buffer{
+		id:       id,
+		file:     file,
+		theme:    theme,
+		undotree: newundotree(),
+		swapfile: swapname(file.Name()),
+		swapped:  -1,
+	}
+
+	// read file and initialize b.lines
+	data, err := io.ReadAll(file)
+	if err != nil {
+		debug(0, "read %v: %v", file.Name(), err)
+	}
+	b.load(data)
+
+	// initialize line attribute
+	b.lineattrs = make([]*lineattribute, len(b.lines))
+
+	b.highlighter = newhighlighter(file.Name(), b.lines[0], theme)
+	if semanticresults != nil && detectlanguage(file.Name(), b.lines[0].text()) == lang_go {
+		b.highlighter = gohighlighter{theme: theme}
+		b.semantic = newgosemantic(semanticresults)
+	}
+
+	for i := range b.lines {
+		prevlinestate := &lineattribute{}
+		if i != 0 {
+			prevlinestate = b.lineattrs[i-1]
+		}
+		b.lineattrs[i] = b.highlightline(i, prevlinestate)
+	}
+	b.requestsemantic()
+
+	return b
+}
+
+// start showing the buffer on the screen s.
+func (b *buffer) attach(s *screen) {
+	b.views = append(b.views, s)
+	if len(b.lastcursors) != 0 {
+		s.cursors = copycursors(b.lastcursors)
+		for _, c := range s.cursors {
+			c.y = min(c.y, len(b.lines)-1)
+		}
+	}
+}
+
+// stop showing the buffer on the screen s. Its cursors are remembered for the next screen.
+func (b *buffer) detach(s *screen) {
+	b.views = slices.DeleteFunc(b.views, func(v *screen) bool { return v == s })
+	b.lastcursors = copycursors(s.cursors)
+}
+
+/* file persistence */
+
+var utf8bom = []byte{0xef, 0xbb, 0xbf}
+
+// load the file content into b.lines, detecting the byte order mark, the line ending and
+// whether the last line ends with the newline.
+func (b *buffer) load(data []byte) {
+	b.bom = bytes.HasPrefix(data, utf8bom)
+	data = bytes.TrimPrefix(data, utf8bom)
+
+	// an empty file is a single empty line without the newline, so it is written back as empty.
+	// A file of "\n" is also a single empty line, but with the newline.
+	b.eol = bytes.HasSuffix(data, []byte("\n"))
+	b.empty = len(data) == 0
+	data = bytes.TrimSuffix(data, []byte("\n"))
+
+	// the file is dos format only when every line ends with "\r\n"
+	nlcnt := bytes.Count(data, []byte("\n"))
+	if b.eol {
+		nlcnt++
+	}
+	crlfcnt := bytes.Count(data, []byte("\r\n"))
+	if b.eol && bytes.HasSuffix(data, []byte("\r")) {
+		crlfcnt++
+	}
+	b.crlf = nlcnt != 0 && crlfcnt == nlcnt
+
+	b.lines = []*line{}
+	for l := range bytes.SplitSeq(data, []byte("\n")) {
+		if b.crlf {
+			l = bytes.TrimSuffix(l, []byte("\r"))
+		}
+		b.lines = append(b.lines, newline(string(l)))
+	}
+}
+
+// whether the last line is written with the newline.
+// The empty file stays empty until the text is written in it.
+func (b *buffer) endswithnewline() bool {
+	if b.empty {
+		return len(b.lines) != 1 || !b.lines[0].empty()
+	}
+	return b.eol
+}
+
+func (b *buffer) content() []byte {
+	buf := []byte{}
+	if b.bom {
+		buf = append(buf, utf8bom...)
+	}
+
+	eol := b.endswithnewline()
+	for y, line := range b.lines {
+		for _, ch := range line.buffer {
+			switch {
+			case ch.tab:
+				buf = append(buf, '\t')
+			case ch.nl:
+				if y == len(b.lines)-1 && !eol {
+					break
+				}
+				if b.crlf {
+					buf = append(buf, '\r')
+				}
+				buf = append(buf, '\n')
+			default:
+				buf = append(buf, []byte(string(ch.r))...)
+			}
+		}
+	}
+	return buf
+}
+
+// describe how the file is encoded, like "unix", "dos noeol" or "unix bom".
+func (b *buffer) fileformat() string {
+	ff := "unix"
+	if b.crlf {
+		ff = "dos"
+	}
+	if !b.eol && !b.empty {
+		ff += " noeol"
+	}
+	if b.bom {
+		ff += " bom"
+	}
+	return ff
+}
+
+// set the line ending used on save. It is a change to be saved but not an undoable edit.
+func (b *buffer) setfileformat(ff string) error {
+	switch ff {
+	case "unix":
+		if b.crlf {
+			b.changes++
+		}
+		b.dirty = b.dirty || b.crlf
+		b.crlf = false
+	case "dos":
+		if !b.crlf {
+			b.changes++
+		}
+		b.dirty = b.dirty || !b.crlf
+		b.crlf = true
+	default:
+		return fmt.Errorf("invalid fileformat: %v", ff)
+	}
+	return nil
+}
+
+// save writes the content into a temporary file in the same directory, then renames it over the original.
+// The original file is kept untouched until the new content is completely on the disk.
+// If backup is true, the original content is copied into "<file>~" before that.
+func (b *buffer) save(backup bool) error {
+	name := b.file.Name()
+
+	// write through the symlink instead of replacing it
+	target, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		target = name
+	}
+
+	perm := os.FileMode(0644)
+	if info, err := os.Stat(target); err == nil {
+		perm = info.Mode().Perm()
+
+		if backup {
+			original, err := os.ReadFile(target)
+			if err != nil {
+				return err
+			}
+			if err := writefilesync(target+"~", original, perm); err != nil {
+				return err
+			}
+		}
+	}
+
+	dir := filepath.Dir(target)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(target)+".*")
+	if err != nil {
+		return err
+	}
+
+	err = func() error {
+		if _, err := tmp.Write(b.content()); err != nil {
+			return err
+		}
+		if err := tmp.Sync(); err != nil {
+			return err
+		}
+		if err := tmp.Chmod(perm); err != nil {
+			return err
+		}
+		if err := tmp.Close(); err != nil {
+			return err
+		}
+		return os.Rename(tmp.Name(), target)
+	}()
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// make the rename durable. Some filesystems do not support syncing a directory, the error is ignored.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	// the opened file is the replaced one now, reopen the new one.
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	b.file.Close()
+	b.file = f
+
+	b.dirty = false
+	b.undotree.marksaved()
+	b.removeswap()
+	return nil
+}
+
+func (b *buffer) close() {
+	if b.semantic != nil {
+		b.semantic.close()
+	}
+	b.removeswap()
+	b.file.Close()
+}
+
+func writefilesync(name string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+/* swap file */
+
+// The swap file keeps the unsaved content and the cursors to recover them after a crash.
+// It is placed next to the file as ".<name>.swp", or ".<name>.swo" and so on if it is used by another editor.
+//
+//	turtle swap
+//	pid 1234
+//	cursors 0:3 10:0
+//	<content>
+
+const swapmagic = "turtle swap"
+
+type swap struct {
+	name    string
+	pid     int
+	modtime time.Time
+	cursors [][2]int // {y, character index}
+	content []byte
+}
+
+func swapname(name string) string {
+	return filepath.Join(filepath.Dir(name), "."+filepath.Base(name)+".swp")
+}
+
+// return the swap file name not used by others. Like vim, ".swp" is tried first, then ".swo", ".swn" and so on.
+// It returns "" if all of them are used.
+func freeswapname(name string) string {
+	for c := 'p'; c >= 'a'; c-- {
+		sn := filepath.Join(filepath.Dir(name), "."+filepath.Base(name)+".sw"+string(c))
+		if _, err := os.Lstat(sn); os.IsNotExist(err) {
+			return sn
+		}
+	}
+	return ""
+}
+
+// whether the process is running. The process of another user is running too though it cannot be signaled.
+func processrunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+func readswap(name string) (*swap, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	sw := &swap{name: name, modtime: info.ModTime()}
+	header := make([]string, 3)
+	for i := range header {
+		h, rest, ok := bytes.Cut(data, []byte("\n"))
+		if !ok {
+			return nil, fmt.Errorf("broken swap file: %v", name)
+		}
+		header[i], data = string(h), rest
+	}
+
+	if header[0] != swapmagic {
+		return nil, fmt.Errorf("not a swap file: %v", name)
+	}
+
+	if _, err := fmt.Sscanf(header[1], "pid %d", &sw.pid); err != nil {
+		return nil, fmt.Errorf("broken swap file: %v", name)
+	}
+
+	for pos := range strings.FieldsSeq(strings.TrimPrefix(header[2], "cursors")) {
+		var y, idx int
+		if _, err := fmt.Sscanf(pos, "%d:%d", &y, &idx); err != nil {
+			return nil, fmt.Errorf("broken swap file: %v", name)
+		}
+		sw.cursors = append(sw.cursors, [2]int{y, idx})
+	}
+
+	sw.content = data
+	return sw, nil
+}
+
+func (b *buffer) swapname() string {
+	return b.swapfile
+}
+
+// write the swap file if there is the change not written to the file nor the swap file yet.
+func (b *buffer) updateswap() error {
+	// the change is undone to the saved state
+	if !b.dirty {
+		b.removeswap()
+		return nil
+	}
+
+	if b.swapped == b.changes || b.swapfile == "" {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%v\npid %v\ncursors", swapmagic, os.Getpid())
+	cursors := b.lastcursors
+	if len(b.views) != 0 {
+		cursors = b.views[0].cursors
+	}
+	for _, c := range cursors {
+		l := b.lines[c.y]
+		fmt.Fprintf(&buf, " %v:%v", c.y, l.charidx(min(c.x, l.width()-1), 0))
+	}
+	buf.WriteByte('\n')
+	buf.Write(b.content())
+
+	if err := writefilesync(b.swapname(), buf.Bytes(), 0600); err != nil {
+		return err
+	}
+
+	b.swapped = b.changes
+	b.swapowned = true
+	return nil
+}
+
+// remove the swap file written by this buffer. The one left by another editor is kept.
+func (b *buffer) removeswap() {
+	if !b.swapowned {
+		return
+	}
+
+	os.Remove(b.swapname())
+	b.swapped = -1
+	b.swapowned = false
+}
+
+// describe the difference between the lines a and b.
+// The lines only in a are prefixed with "-", and only in b with "+". The common head and tail are omitted.
+func difflines(a, b []string) []string {
+	head := 0
+	for head < len(a) && head < len(b) && a[head] == b[head] {
+		head++
+	}
+
+	tail := 0
+	for tail < len(a)-head && tail < len(b)-head && a[len(a)-1-tail] == b[len(b)-1-tail] {
+		tail++
+	}
+
+	if head == len(a) && head == len(b) {
+		return nil
+	}
+
+	diff := []string{fmt.Sprintf("@@ line %v @@", head+1)}
+	for _, l := range a[head : len(a)-tail] {
+		diff = append(diff, "-"+l)
+	}
+	for _, l := range b[head : len(b)-tail] {
+		diff = append(diff, "+"+l)
+	}
+	return diff
+}
+
+/*
+ * screen
+ */
+
+type lineattribute struct {
+	colors            []int
+	inblockcomment    bool
+	inmultilinestr    bool
+	multilinestrstart []rune
+	multilinestrend   []rune
+
+	// fenced code block in markdown
+	fence     string         // the opening fence like "```". Empty if the line is not in the code block
+	fencelang *language      // the language of the code, nil if unknown
+	codeattr  *lineattribute // the line attribute given by the highlighter of the language
+}
+
+// whether the state carried over to the next line is the same. The colors are not compared.
+func (s *lineattribute) samestate(other *lineattribute) bool {
+	if s == nil || other == nil {
+		return s == other
+	}
+
+	return s.inblockcomment == other.inblockcomment &&
+		s.inmultilinestr == other.inmultilinestr &&
+		slices.Equal(s.multilinestrstart, other.multilinestrstart) &&
+		slices.Equal(s.multilinestrend, other.multilinestrend) &&
+		s.fence == other.fence &&
+		s.fencelang == other.fencelang &&
+		s.codeattr.samestate(other.codeattr)
+}
+
+func (s *lineattribute) String() string {
+	switch {
+	case s.fence != "":
+		return fmt.Sprintf("{code block line (fence: %v), code: %v}", s.fence, s.codeattr)
+	case s.inblockcomment:
+		return fmt.Sprintf("{block comment line, colors: %v}", s.colors)
+	case s.inmultilinestr:
+		return fmt.Sprintf("{multi-line string line (quote: %v%v), colors: %v}", string(s.multilinestrstart), string(s.multilinestrend), s.colors)
+	default:
+		return fmt.Sprintf("{normal line: colors: %v}", s.colors)
+	}
+}
+
+type cursor struct {
+	x         int
+	y         int
+	actualx   int
+	selection selection
+}
+
+func (c *cursor) String() string {
+	return fmt.Sprintf("{x: %v, y: %v, actualx: %v}", c.x, c.y, c.actualx)
+}
+
+type selection interface {
+	isselection()
+}
+
+type lineselection struct {
+	selection
+	lines []int
+}
+
+// charsselection is a range of characters from (startx, starty) to (endx, endy), both inclusive.
+// The start is where the selection began, and the end follows the cursor.
+// x is a character index on the line, not a width on the screen.
+type charsselection struct {
+	selection
+	startx int
+	starty int
+	endx   int
+	endy   int
+}
+
+// ordered returns the selection head and tail.
+func (sl *charsselection) ordered() (int, int, int, int) {
+	if sl.starty < sl.endy || (sl.starty == sl.endy && sl.startx <= sl.endx) {
+		return sl.startx, sl.starty, sl.endx, sl.endy
+	}
+	return sl.endx, sl.endy, sl.startx, sl.starty
+}
+
+// rangeon returns the selected character index range [from, to) on the line y.
+func (sl *charsselection) rangeon(y int, l *line) (int, int, bool) {
+	sx, sy, ex, ey := sl.ordered()
+	if y < sy || ey < y {
+		return 0, 0, false
+	}
+
+	from, to := 0, l.length()
+	if y == sy {
+		from = sx
+	}
+	if y == ey {
+		to = min(ex+1, l.length())
+	}
+	return from, to, true
+}
+
+type searchstate struct {
+	re       *regexp.Regexp
+	backward bool // true when searched by ?
+}
+
+type regtexttype int
+
+const (
+	regtext_lines regtexttype = iota + 1
+	regtext_chars
+)
+
+type regtext struct {
+	typ   regtexttype
+	lines []*line
+	chars []*character
+}
+
+// make regtext from the raw string. The text ending with newline is treated as lines.
+func newregtext(str string) *regtext {
+	if strings.HasSuffix(str, "\n") {
+		lines := []*line{}
+		for l := range strings.SplitSeq(strings.TrimSuffix(str, "\n"), "\n") {
+			lines = append(lines, newline(l))
+		}
+		return &regtext{typ: regtext_lines, lines: lines}
+	}
+
+	chars := []*character{}
+	for _, r := range str {
+		chars = append(chars, newcharacter(r))
+	}
+	return &regtext{typ: regtext_chars, chars: chars}
+}
+
+// return the lines representation of the text.
+func (t *regtext) aslines() []*line {
+	if t.typ == regtext_lines {
+		return t.lines
+	}
+
+	lines := []*line{{}}
+	for _, ch := range t.chars {
+		last := lines[len(lines)-1]
+		last.buffer = append(last.buffer, ch)
+		if ch.nl {
+			lines = append(lines, &line{})
+		}
+	}
+
+	last := lines[len(lines)-1]
+	if len(last.buffer) == 0 {
+		return lines[:len(lines)-1]
+	}
+
+	last.buffer = append(last.buffer, newcharacter('\n'))
+	return lines
+}
+
+// concat t and t2. When either is lines, the result is also lines.
+func (t *regtext) concat(t2 *regtext) *regtext {
+	if t.typ == regtext_chars && t2.typ == regtext_chars {
+		return &regtext{typ: regtext_chars, chars: slices.Concat(t.chars, t2.chars)}
+	}
+
+	return &regtext{typ: regtext_lines, lines: slices.Concat(t.aslines(), t2.aslines())}
+}
+
+// return the raw string of the text.
+func (t *regtext) String() string {
+	var sb strings.Builder
+	switch t.typ {
+	case regtext_lines:
+		for _, l := range t.lines {
+			sb.WriteString(l.text())
+			sb.WriteRune('\n')
+		}
+	case regtext_chars:
+		for _, ch := range t.chars {
+			sb.WriteRune(ch.raw())
+		}
+	}
+	return sb.String()
+}
+
+// register keeps the yanked texts. It is shared among all the screens.
+// Each cursor has its own slot, and each slot holds the texts by the register name.
+// Available names are:
+//   - ": unnamed register, always holds the latest yanked text.
+//   - a-z: named registers. A-Z appends the text to the corresponding a-z register.
+//   - +: clipboard register. The text is also sent to the terminal clipboard.
+//
+// The keyboard macro recorded by "q" is stored in the a-z register as the text like "dwix<ESC>",
+// so it can be pasted, edited and yanked back to be played.
+type register struct {
+	regs []map[string]*regtext
+}
+
+func newregister() *register {
+	return &register{}
+}
+
+func validregname(r rune) bool {
+	return r == '"' || r == '+' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z')
+}
+
+func (r *register) get(idx int, key string) (*regtext, bool) {
+	if len(r.regs) <= idx {
+		return nil, false
+	}
+
+	return r.regs[idx][key], true
+}
+
+func (r *register) set(idx int, key string, txt *regtext) {
+	for len(r.regs) <= idx {
+		r.regs = append(r.regs, make(map[string]*regtext))
+	}
+
+	r.regs[idx][key] = txt
+}
+
+// store txt to the register on the idx-th slot. The unnamed register is also updated.
+func (r *register) store(idx int, name string, txt *regtext) {
+	if unicode.IsUpper(rune(name[0])) {
+		name = strings.ToLower(name)
+		if prev, _ := r.get(idx, name); prev != nil {
+			txt = prev.concat(txt)
+		}
+	}
+
+	r.set(idx, name, txt)
+	if name != "\"" {
+		r.set(idx, "\"", txt)
+	}
+}
+
+// drop the texts of the register on the slots after from.
+// This is called after yanking with less cursors than before
+// so that the stale texts are not pasted.
+func (r *register) truncate(name string, from int) {
+	name = strings.ToLower(name)
+	for i := from; i < len(r.regs); i++ {
+		delete(r.regs[i], name)
+		if name != "\"" {
+			delete(r.regs[i], "\"")
+		}
+	}
+}
+
+// return the text to be sent to the clipboard.
+// The texts on multiple slots are joined by newline.
+func (r *register) clipboard() string {
+	texts := []string{}
+	for i := range r.regs {
+		if txt := r.regs[i]["+"]; txt != nil {
+			texts = append(texts, txt.String())
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// store the recorded macro. A-Z appends the inputs to the corresponding a-z register.
+// It is stored on the first slot only, and the unnamed register is not changed.
+func (r *register) storemacro(name string, inputs []*input) {
+	txt := newregtext(inputsstring(inputs))
+	if unicode.IsUpper(rune(name[0])) {
+		name = strings.ToLower(name)
+		if prev, _ := r.get(0, name); prev != nil {
+			txt = prev.concat(txt)
+		}
+	}
+
+	r.set(0, name, txt)
+	for i := 1; i < len(r.regs); i++ {
+		delete(r.regs[i], name)
+	}
+}
+
+// return the inputs of the macro in the register.
+func (r *register) macro(name string) []*input {
+	txt, _ := r.get(0, name)
+	if txt == nil {
+		return nil
+	}
+	return parseinputs(txt.String())
+}
+
+// set the text received from the terminal clipboard.
+func (r *register) setclipboard(str string) {
+	r.set(0, "+", newregtext(str))
+	// the unnamed register of every slot is kept, as it is not yanked
+	for i := 1; i < len(r.regs); i++ {
+		delete(r.regs[i], "+")
+	}
+}
+
+// return the register contents for display.
+func (r *register) list() []*line {
+	names := []string{"\""}
+	for c := 'a'; c <= 'z'; c++ {
+		names = append(names, string(c))
+	}
+	names = append(names, "+")
+
+	lines := []*line{}
+	for _, name := range names {
+		for i := range r.regs {
+			txt := r.regs[i][name]
+			if txt == nil {
+				continue
+			}
+
+			str := strings.NewReplacer("\n", "^J", "\t", "^I").Replace(txt.String())
+			if len(r.regs) == 1 {
+				lines = append(lines, newline(fmt.Sprintf("\"%v  %v", name, str)))
+			} else {
+				lines = append(lines, newline(fmt.Sprintf("\"%v[%v]  %v", name, i, str)))
+			}
+		}
+	}
+	return lines
+}
+
+// screen shows a buffer in a window. The text is shared with the other screens showing the same buffer.
+type screen struct {
+	*buffer
+
+	focused         bool
+	term            *screenterm
+	width           int
+	height          int
+	linenumberwidth int
+
+	register *register
+
+	// current search pattern, matches are highlighted
+	search *searchstate
+	// search pattern and cursors before starting the incremental search
+	searchsaved   *searchstate
+	searchcursors []*cursor
+
+	cursors []*cursor
+
+	xoffset int
+	yoffset int
+
+	scrolled              bool
+	linestoberendered     []int
+	highlightupdatedlines []int
+}
+
+func newscreen(term terminal, x, y, width, height int, buffer *buffer, register *register, focused bool) *screen {
+	s := &screen{
+		buffer:   buffer,
+		focused:  focused,
+		term:     &screenterm{term: term, width: width, x: x, y: y},
+		width:    width,
+		height:   height,
+		register: register,
+		cursors:  []*cursor{{0, 0, 0, nil}},
+		xoffset:  0,
+		yoffset:  0,
+	}
+	buffer.attach(s)
+
+	// calculate line number area width
+	s.updatelinenumberwidth()
+
+	return s
+}
+
+func (s *screen) focus() {
+	s.focused = true
+}
+
+func (s *screen) unfocus() {
+	s.focused = false
+}
+
+func (s *screen) updatelinenumberwidth() {
+	if len(s.lines) < 10000 {
+		s.linenumberwidth = 4
+		return
+	}
+
+	s.linenumberwidth = calcdigit(len(s.lines))
+}
+
+func calcdigit(n int) int {
+	digit := 0
+	for {
+		n /= 10
+		digit++
+		if n == 0 {
+			break
+		}
+	}
+	return digit
+}
+
+func (s *screen) statusline() []byte {
+	width := s.width - (s.linenumberwidth + 1)
+
+	// file name on the left, file format on the right
+	name := fmt.Sprintf(" %v", s.file.Name())
+	ff := fmt.Sprintf("[%v] ", s.fileformat())
+	pad := max(2, width-(newline(name).width()-1)-(newline(ff).width()-1))
+	l := newline(name + strings.Repeat(" ", pad) + ff)
+
+	var color []int
+	if s.focused {
+		color = slices.Repeat([]int{s.theme.colorstatusline}, len(l.buffer))
+	}
+
+	return []byte(l.cutandcolorize(0, s.width-(s.linenumberwidth+1), color, []int{}, []int{}))
+}
+
+func (s *screen) curline(c *cursor) *line {
+	return s.lines[c.y]
+}
+
+func (s *screen) render(force bool) {
+	maincursor := s.cursors[len(s.cursors)-1]
+
+	// when the x is too right, set x to the line tail.
+	// This must not change s.x because s.x should be kept when moving to another long line.
+	x := min(maincursor.x, s.curline(maincursor).width()-1)
+
+	/* scroll x */
+
+	var scrolled bool
+
+	// the padding is reduced on a small window like ypad
+	xpad := max(0, min(4, (s.width-(s.linenumberwidth+1)-1)/2))
+	xok := func() direction {
+		// too left, scroll left
+		if x-xpad < s.xoffset {
+			if x < xpad && s.xoffset <= x {
+				// too left but no enough space left
+				return 0
+			}
+			return left
+		}
+
+		// too right, scroll right
+		if s.xoffset+s.width-(s.linenumberwidth+1)-1 < x+xpad {
+			if s.curline(maincursor).width()-1 < x+xpad && x <= s.xoffset+s.width-(s.linenumberwidth+1)-1 {
+				// too right but no enough space right
+				return 0
+			}
+			return right
+		}
+
+		return 0
+	}
+
+	for {
+		dir := xok()
+		if dir == 0 {
+			break
+		}
+
+		if dir == left {
+			s.xoffset -= 1
+		} else {
+			s.xoffset += 1
+		}
+		scrolled = true
+	}
+
+	/* scroll y */
+
+	ypad := s.ypad()
+	yok := func() direction {
+		padup := maincursor.y - s.yoffset
+		paddown := (s.yoffset + s.height - 2) - maincursor.y
+
+		// cursor has up and down padding, it's ok
+		if padup >= ypad && paddown >= ypad {
+			return 0
+		}
+
+		// up scroll needed
+		if padup < ypad {
+			// if y cursor is not shown, scroll up. This happens after some goto cmd.
+			if padup < 0 {
+				return up
+			}
+
+			// no enough pad above but cannot scroll up more, stop.
+			if s.yoffset == 0 {
+				return 0
+			}
+
+			return up
+		}
+
+		if paddown < ypad {
+			if paddown < 0 {
+				return down
+			}
+
+			if s.yoffset+s.height-1 >= len(s.lines) {
+				return 0
+			}
+
+			return down
+		}
+
+		return 0
+	}
+
+	for {
+		dir := yok()
+		if dir == 0 {
+			break
+		}
+
+		if dir == up {
+			s.yoffset -= 1
+		} else {
+			s.yoffset += 1
+		}
+		scrolled = true
+	}
+
+	type _cursor struct {
+		c       *cursor
+		charidx int
+	}
+
+	_cursors := make([]*_cursor, len(s.cursors))
+
+	for i := range s.cursors {
+		x := min(s.cursors[i].x, s.curline(s.cursors[i]).width()-1)
+		s.cursors[i].actualx = x - s.xoffset + s.linenumberwidth + 1
+		_cursors[i] = &_cursor{c: s.cursors[i], charidx: s.curline(s.cursors[i]).charidx(x, 0)}
+	}
+
+	/* update texts */
+
+	displayline := func(y int) []byte {
+		line := s.lines[y]
+		linenumber := strings.Repeat(" ", s.linenumberwidth-calcdigit(y+1)) + colorize(strconv.Itoa(y+1), s.theme.colorlinenumber)
+
+		colors := s.lineattrs[y].colors
+		cursor := []int{}
+		selections := []int{}
+		paint := func(from, to, color int) {
+			if len(selections) == 0 {
+				selections = slices.Repeat([]int{-1}, line.length())
+			}
+			for i := from; i < to; i++ {
+				selections[i] = color
+			}
+		}
+		selectrange := func(from, to int) {
+			paint(from, to, s.theme.colorselection)
+		}
+
+		// highlight search matches
+		if s.search != nil {
+			for _, m := range line.matches(s.search.re) {
+				paint(m[0], m[1], s.theme.colorsearch)
+			}
+		}
+
+		if s.focused {
+			for _, c := range _cursors {
+				// configure cursor line
+				if c.c.y == y {
+					cursor = append(cursor, c.charidx)
+				}
+
+				// configure selected chars
+				switch sl := c.c.selection.(type) {
+				case *lineselection:
+					if slices.Contains(sl.lines, y) {
+						selectrange(0, line.length())
+					}
+				case *charsselection:
+					if from, to, ok := sl.rangeon(y, line); ok {
+						selectrange(from, to)
+					}
+				}
+			}
+		}
+		debug(0, "selections: %v", selections)
+		return []byte(linenumber + " " + line.cutandcolorize(s.xoffset, s.width-1-(s.linenumberwidth+1), colors, selections, cursor))
+	}
+
+	if scrolled || s.scrolled || force {
+		// update all lines
+		for i := range s.height - 1 {
+			s.term.clearline(i)
+			if s.yoffset+i < len(s.lines) {
+				s.term.write(displayline(s.yoffset + i))
+			}
+		}
+	} else if len(s.linestoberendered) != 0 || len(s.highlightupdatedlines) != 0 {
+		// udpate only changed lines
+		lines := slices.Concat(s.linestoberendered, s.highlightupdatedlines)
+		slices.Sort(lines)
+		lines = slices.Compact(lines)
+		for _, l := range lines {
+			// if changed line is not shown on the screen, skip
+			if l < s.yoffset || s.height-2 < l-s.yoffset {
+				continue
+			}
+
+			s.term.clearline(l - s.yoffset)
+
+			if l <= len(s.lines)-1 {
+				s.term.write(displayline(l))
+			}
+		}
+	}
+
+	// render status line
+	s.term.clearline(s.height - 1)
+	s.term.write(s.statusline())
+	s.term.flush()
+	s.linestoberendered = []int{}
+	s.highlightupdatedlines = []int{}
+	s.scrolled = false
+}
+
+// the lines kept above and below the main cursor on scrolling.
+// It is reduced on a small window, otherwise scrolling to make the padding on a side breaks the other.
+func (s *screen) ypad() int {
+	return max(0, min(4, (s.height-2)/2))
+}
+
+func (s *screen) highlightchangedlines() {
+	if len(s.linestoberendered) == 0 {
+		return
+	}
+
+	slices.Sort(s.linestoberendered)
+	s.linestoberendered = slices.Compact(s.linestoberendered)
+
+	for i := s.linestoberendered[0]; i < len(s.lines); i++ {
+		prevlinestate := &lineattribute{}
+		if i != 0 {
+			prevlinestate = s.lineattrs[i-1]
+		}
+
+		newlineattr := s.highlightline(i, prevlinestate)
+		curlineattr := s.lineattrs[i]
+		for _, v := range s.views {
+			v.highlightupdatedlines = append(v.highlightupdatedlines, i)
+		}
+
+		// when the line state is not changed, the rest lines must not be changed also, so break the loop
+		if s.linestoberendered[len(s.linestoberendered)-1] < i && curlineattr.samestate(newlineattr) {
+			s.lineattrs[i] = newlineattr
+			break
+		}
+
+		s.lineattrs[i] = newlineattr
+	}
+
+	s.requestsemantic()
+}
+
+// unify the cursors at the same position
+func (s *screen) cleanupcursors() {
+	slices.SortFunc(s.cursors, func(c1, c2 *cursor) int {
+		if c1.x == c2.x && c1.y == c2.y {
+			return 0
+		}
+
+		if c1.y != c2.y {
+			if c1.y > c2.y {
+				return 1
+			} else {
+				return -1
+			}
+		}
+
+		if c1.x > c2.x {
+			return 1
+		}
+
+		return -1
+	})
+	s.cursors = slices.CompactFunc(s.cursors, func(c1, c2 *cursor) bool {
+		return c1.x == c2.x && c1.y == c2.y
+	})
+}
+
+func (s *screen) handle(curmode mode, buff *input, stream *inputstream) mode {
+	// register name can be specified before the command like "ay
+	regname := "\""
+	if curmode != insert && buff.special == _not_special_key && buff.r == '"' {
+		input2 := stream.next()
+		if input2.special != _not_special_key || !validregname(input2.r) {
+			return curmode
+		}
+
+		regname = string(input2.r)
+		buff = stream.next()
+		// the reply to the query which timed out can arrive late
+		for buff.special == _clipboard {
+			s.register.setclipboard(buff.text)
+			buff = stream.next()
+		}
+	}
+
+	numinput := false
+	num := 1
+	isnum, n := buff.isnumber()
+	if (curmode == normal || curmode == charselect) && isnum {
+		numinput = true
+		num = n
+		for {
+			next := stream.next()
+			isnum2, n2 := next.isnumber()
+			if !isnum2 {
+				buff = next
+				break
+			}
+
+			num *= 10
+			num += n2
+		}
+	}
+
+	if num == 0 {
+		num = 1
+	}
+
+	// the terminal clipboard is asked only when it is pasted
+	if regname == "+" && curmode == normal && buff.special == _not_special_key && (buff.r == 'p' || buff.r == 'P') {
+		s.queryclipboard(stream)
+	}
+
+	// remember the cursor positions to restore them on undo
+	s.undotree.begin(s.cursors)
+
+	newmode := curmode
+
+	switch curmode {
+	case normal:
+		if s.handlemotion(buff, num, numinput, stream) {
+			break
+		}
+
+		switch buff.special {
+		case _ctrl_r:
+			s.redo(num)
+
+		case _paste:
+			s.insertcharsatcursors(newcharacters(buff.text))
+
+		case _not_special_key:
+			switch buff.r {
+			// case '\\':
+			// 	debug(0, "debug line (%v): '%v', attr: %v\n", s.y, s.curline(), s.lineattrs[s.y])
+			case 'C':
+				s.addcursorbelow()
+
+			case ',':
+				s.deletecursors()
+
+			case 'd', 'c', 'y', '>', '<':
+				newmode = s.handleoperator(buff.r, num, numinput, regname, stream)
+
+			case 'o':
+				s.insertlinefromcursors(down)
+				newmode = insert
+
+			case 'O':
+				s.insertlinefromcursors(up)
+				newmode = insert
+
+			case 'p':
+				s.pastefromcursors(regname, true)
+
+			case 'P':
+				s.pastefromcursors(regname, false)
+
+			case 'u':
+				s.undo(num)
+
+			case 'r':
+				input2 := stream.next()
+				if input2.special == _not_special_key {
+					s.replacecursorchar(newcharacter(input2.r))
+				}
+
+			case 'x':
+				s.selectline()
+				newmode = lineselect
+
+			case 'v':
+				s.selectchars()
+				newmode = charselect
+			}
+
+		}
+
+	case insert:
+		switch buff.special {
+		case _left:
+			s.movecursors(left, 1)
+
+		case _down:
+			s.movecursors(down, 1)
+
+		case _up:
+			s.movecursors(up, 1)
+
+		case _right:
+			s.movecursors(right, 1)
+
+		case _esc:
+			newmode = normal
+
+		case _cr:
+			s.splitcursorsline()
+
+		case _bs:
+			s.deletecursorprevchar()
+
+		case _tab:
+			s.insertcharsatcursors([]*character{newcharacter('\t')})
+
+		case _paste:
+			// the pasted text is inserted as it is
+			s.insertcharsatcursors(newcharacters(buff.text))
+
+		case _not_special_key:
+			s.insertcharsatcursors([]*character{newcharacter(buff.r)})
+		}
+
+	case lineselect:
+		switch buff.special {
+		case _esc:
+			s.unselectall()
+			newmode = normal
+
+		case _not_special_key:
+			switch buff.r {
+			case 'j':
+				s.moveandselectline(down, num)
+
+			case 'k':
+				s.moveandselectline(up, num)
+
+			case 'y':
+				s.yankselectedlines(regname)
+				s.unselectall()
+				newmode = normal
+
+			case 'd':
+				s.yankselectedlines(regname)
+				s.deleteselectedlines()
+				s.unselectall()
+				newmode = normal
+			}
+		}
+
+	case charselect:
+		if s.handlemotion(buff, num, numinput, stream) {
+			s.updatecharsselections()
+			break
+		}
+
+		switch buff.special {
+		case _esc:
+			s.unselectall()
+			newmode = normal
+
+		case _not_special_key:
+			switch buff.r {
+			case 'y':
+				s.yankselectedchars(regname)
+				s.unselectall()
+				newmode = normal
+
+			case 'd':
+				s.yankselectedchars(regname)
+				s.deleteselectedchars()
+				s.unselectall()
+				newmode = normal
+
+			case 'c':
+				s.yankselectedchars(regname)
+				s.deleteselectedchars()
+				s.unselectall()
+				newmode = insert
+			}
+		}
+
+	default:
+		panic(fmt.Sprintf("cannot handle mode %v", curmode))
+	}
+
+	s.highlightchangedlines()
+	s.cleanupcursors()
+
+	// the whole insert mode session is treated as one change,
+	// so it is committed after getting back from insert mode.
+	if newmode != insert {
+		s.undotree.commit(s.cursors)
+	}
+
+	return newmode
+}
+
+// handlemotion moves the cursors if the input is a motion key.
+// It returns false if the input is not a motion.
+func (s *screen) handlemotion(buff *input, num int, numinput bool, stream *inputstream) bool {
+	switch buff.special {
+	case _left:
+		s.movecursors(left, num)
+
+	case _down:
+		s.movecursors(down, num)
+
+	case _up:
+		s.movecursors(up, num)
+
+	case _right:
+		s.movecursors(right, num)
+
+	case _ctrl_u:
+		s.scrollhalf(up)
+
+	case _ctrl_d:
+		s.scrollhalf(down)
+
+	case _not_special_key:
+		switch buff.r {
+		case 'G':
+			if !numinput {
+				return false
+			}
+			s.movecursorstoline(num)
+
+		/*
+		 * goto mode
+		 */
+		case 'g':
+			input2 := stream.next()
+			switch input2.r {
+			case 'g':
+				s.movecursorstotopleft()
+
+			case 'e':
+				s.movecursorstobottomleft()
 
 			case 'l':
-				s.movecursors(right, num)
+				s.movecursorstolinebottom()
+
+			case 's':
+				s.movecursorstononspacelinehead()
+
+			case 'h':
+				s.movecursorstolinehead()
+
+			default:
+				// do nothing
+			}
+
+		case 'f':
+			input2 := stream.next()
+			if input2.special == _not_special_key {
+				s.movecursorstonextch(newcharacter(input2.r))
+			}
+
+		case 'F':
+			input2 := stream.next()
+			if input2.special == _not_special_key {
+				s.movecursorstoprevch(newcharacter(input2.r))
+			}
+
+		case 'h':
+			s.movecursors(left, num)
+
+		case 'j':
+			s.movecursors(down, num)
+
+		case 'k':
+			s.movecursors(up, num)
+
+		case 'l':
+			s.movecursors(right, num)
+
+		case 'w', 'W':
+			bigword := buff.r == 'W'
+			s.movecursorsrepeatedly(num, func(y, idx int) (int, int) {
+				return s.nextwordhead(y, idx, bigword)
+			})
+
+		case 'e', 'E':
+			bigword := buff.r == 'E'
+			s.movecursorsrepeatedly(num, func(y, idx int) (int, int) {
+				return s.nextwordtail(y, idx, bigword)
+			})
+
+		case 'b', 'B':
+			bigword := buff.r == 'B'
+			s.movecursorsrepeatedly(num, func(y, idx int) (int, int) {
+				return s.prevwordhead(y, idx, bigword)
+			})
+
+		case '}':
+			s.movecursorsrepeatedly(num, s.nextparagraph)
+
+		case '{':
+			s.movecursorsrepeatedly(num, s.prevparagraph)
+
+		case '$':
+			s.movecursorstolinebottom()
+
+		case 'n':
+			s.searchnext(false, num)
+
+		case 'N':
+			s.searchnext(true, num)
+
+		default:
+			return false
+		}
+
+	default:
+		return false
+	}
+
+	return true
+}
+
+func (s *screen) String() string {
+	return fmt.Sprintf("scr<%v (%v %v %v %v)>", s.file.Name(), s.term.x, s.term.y, s.width, s.height)
+}
+
+type direction int
+
+const (
+	up direction = iota + 1
+	down
+	left
+	right
+)
+
+func (d direction) String() string {
+	switch d {
+	case up:
+		return "up"
+	case down:
+		return "down"
+	case left:
+		return "left"
+	case right:
+		return "right"
+	case 0:
+		return "not_set"
+	default:
+		panic("unknown direction")
+	}
+}
+
+/* search */
+
+// start the incremental search. The cursors are restored if the search is cancelled.
+func (s *screen) beginsearch() {
+	s.searchsaved = s.search
+	s.searchcursors = copycursors(s.cursors)
+}
+
+// update the search pattern while it is being typed, and move cursors to the matches.
+func (s *screen) incsearch(pattern string, backward bool) {
+	s.restorecursors(s.searchcursors)
+
+	re, err := regexp.Compile(pattern)
+	if pattern == "" || err != nil {
+		s.setsearch(nil)
+		return
+	}
+
+	s.setsearch(&searchstate{re: re, backward: backward})
+	s.searchnext(false, 1)
+}
+
+// confirm the search. When the pattern is empty, the previous one is used.
+func (s *screen) finishsearch(pattern string, backward bool) error {
+	if pattern == "" {
+		if s.searchsaved == nil {
+			s.cancelsearch()
+			return fmt.Errorf("no previous pattern")
+		}
+
+		// search by the previous pattern
+		s.restorecursors(s.searchcursors)
+		s.setsearch(&searchstate{re: s.searchsaved.re, backward: backward})
+		s.searchnext(false, 1)
+	} else if _, err := regexp.Compile(pattern); err != nil {
+		s.cancelsearch()
+		return fmt.Errorf("invalid pattern: %v", err)
+	}
+
+	s.searchcursors = nil
+	if !s.searchnext(false, 0) {
+		return fmt.Errorf("pattern not found: %v", s.search.re)
+	}
+	return nil
+}
+
+func (s *screen) cancelsearch() {
+	s.restorecursors(s.searchcursors)
+	s.setsearch(s.searchsaved)
+	s.searchcursors = nil
+}
+
+func (s *screen) setsearch(search *searchstate) {
+	s.search = search
+	s.registervisiblelines()
+}
+
+// move every cursor to its next match cnt times.
+// When reverse is true, the direction is opposite to the search direction.
+// When cnt is 0, only checks the pattern exists.
+// It returns false if no match exists in the buffer.
+func (s *screen) searchnext(reverse bool, cnt int) bool {
+	if s.search == nil {
+		return false
+	}
+
+	backward := s.search.backward != reverse
+	found := false
+	s.movecursorsfunc(func(c *cursor) (int, int) {
+		y, idx := c.y, s.xidx(c)
+		for range cnt {
+			nexty, nextidx, ok := s.findmatch(y, idx, backward)
+			if !ok {
+				break
+			}
+			y, idx = nexty, nextidx
+		}
+
+		if _, _, ok := s.findmatch(y, idx, backward); ok {
+			found = true
+		}
+		return s.lines[y].widthto(idx), y
+	})
+	return found
+}
+
+// find the match next to (y, idx). The search wraps around the buffer.
+func (s *screen) findmatch(y, idx int, backward bool) (int, int, bool) {
+	for i := range len(s.lines) + 1 {
+		var cury int
+		if backward {
+			cury = ((y-i)%len(s.lines) + len(s.lines)) % len(s.lines)
+		} else {
+			cury = (y + i) % len(s.lines)
+		}
+
+		ms := s.lines[cury].matches(s.search.re)
+		if backward {
+			slices.Reverse(ms)
+		}
+
+		for _, m := range ms {
+			// on the cursor line, only the matches after (or before) the cursor are the candidates
+			// unless wrapped around.
+			if i == 0 && ((!backward && m[0] <= idx) || (backward && idx <= m[0])) {
+				continue
+			}
+			return cury, m[0], true
+		}
+	}
+
+	return 0, 0, false
+}
+
+/* substitute */
+
+type substitution struct {
+	re      *regexp.Regexp
+	repl    string
+	global  bool // replace all matches on the line, not only the first one
+	confirm bool // ask before each replacement
+}
+
+// substitute the matches on the given lines. All the replacements are one undo unit.
+// When sub.confirm is true, ask is called on each match and it returns one of
+// 'y' (replace), 'n' (skip), 'a' (replace this and all remaining) or 'q' (quit).
+// It returns the number of substitutions and lines changed.
+func (s *screen) substitute(ys []int, sub *substitution, ask func(y, from, to int) rune) (int, int) {
+	s.undotree.begin(s.cursors)
+
+	cnt, linecnt := 0, 0
+	shift := 0 // line count change by the replacement containing newline
+	quit := false
+	for _, y := range ys {
+		if quit {
+			break
+		}
+
+		y += shift
+		text := s.lines[y].text()
+		// the empty matches are replaced too, like "^" inserting the text at the line head
+		locs := s.lines[y].allmatches(sub.re)
+		submatches := sub.re.FindAllStringSubmatchIndex(text, -1)
+		if len(submatches) == 0 {
+			continue
+		}
+
+		var result []byte
+		last := 0
+		replaced := 0
+		for i, m := range submatches {
+			if !sub.global && 0 < i {
+				break
+			}
+
+			if sub.confirm {
+				answer := ask(y, locs[i][0], locs[i][1])
+				if answer == 'q' {
+					quit = true
+					break
+				}
+				if answer == 'a' {
+					sub.confirm = false
+				}
+				if answer == 'n' {
+					continue
+				}
+			}
+
+			result = append(result, text[last:m[0]]...)
+			result = sub.re.ExpandString(result, sub.repl, text, m)
+			last = m[1]
+			replaced++
+		}
+
+		if replaced == 0 {
+			continue
+		}
+
+		result = append(result, text[last:]...)
+		newlines := []*line{}
+		for l := range strings.SplitSeq(string(result), "\n") {
+			newlines = append(newlines, newline(l))
+		}
+		s.replacelines(y, 1, newlines)
+		shift += len(newlines) - 1
+
+		cnt += replaced
+		linecnt++
+	}
+
+	for _, c := range s.cursors {
+		c.y = min(c.y, len(s.lines)-1)
+	}
+
+	s.highlightchangedlines()
+	s.cleanupcursors()
+	s.undotree.commit(s.cursors)
+	return cnt, linecnt
+}
+
+// return the lines of every cursor.
+func (s *screen) cursorlines() []int {
+	ys := []int{}
+	for _, c := range s.cursors {
+		ys = append(ys, c.y)
+	}
+	slices.Sort(ys)
+	return slices.Compact(ys)
+}
+
+// return the lines selected by every cursor.
+func (s *screen) selectedlines() []int {
+	ys := []int{}
+	for _, c := range s.cursors {
+		switch sl := c.selection.(type) {
+		case *lineselection:
+			ys = append(ys, sl.lines...)
+		case *charsselection:
+			_, sy, _, ey := sl.ordered()
+			for y := sy; y <= ey; y++ {
+				ys = append(ys, y)
+			}
+		}
+	}
+	slices.Sort(ys)
+	return slices.Compact(ys)
+}
+
+/* scroll */
+
+func (s *screen) scrollhalf(direction direction) {
+	s.scrolled = true
+	move := (s.height - 1) / 2
+	switch direction {
+	case up:
+		s.yoffset = max(0, s.yoffset-move)
+		s.movecursorsfunc(func(c *cursor) (int, int) {
+			return c.x, max(0, c.y-move)
+		})
+
+	case down:
+		s.yoffset = min(len(s.lines)-1, s.yoffset+move)
+		s.movecursorsfunc(func(c *cursor) (int, int) {
+			return c.x, min(len(s.lines)-1, c.y+move)
+		})
+	default:
+		panic("invalid direction is passed")
+	}
+}
+
+// scroll the screen by n lines, up to where the last line is at the bottom.
+// Unlike scrollhalf, the cursors stay on their lines unless they go out of the screen.
+func (s *screen) scroll(direction direction, n int) {
+	s.scrolled = true
+	switch direction {
+	case up:
+		s.yoffset = max(0, s.yoffset-n)
+	case down:
+		s.yoffset = max(0, min(len(s.lines)-(s.height-1), s.yoffset+n))
+	default:
+		panic("invalid direction is passed")
+	}
+
+	// keep the padding which render scrolls to make
+	top, bottom := s.yoffset+s.ypad(), s.yoffset+s.height-2-s.ypad()
+	if s.yoffset == 0 {
+		top = 0
+	}
+	if len(s.lines) <= s.yoffset+s.height-1 {
+		bottom = len(s.lines) - 1
+	}
+	s.movecursorsfunc(func(c *cursor) (int, int) {
+		return c.x, min(max(c.y, top), bottom, len(s.lines)-1)
+	})
+}
+
+/* cursor movement */
+
+func (s *screen) movecursorsfunc(f func(c *cursor) (int, int)) {
+	for i := range s.cursors {
+		s.movecursorfunc(s.cursors[i], f)
+	}
+}
+
+func (s *screen) movecursorfunc(c *cursor, f func(c *cursor) (int, int)) {
+	cury := c.y
+	s.registerRenderLine(cury)
+	c.x, c.y = f(c)
+	if c.y != cury {
+		s.registerRenderLine(c.y)
+	}
+}
+
+func (s *screen) _movecursor(c *cursor, direction direction, cnt int) (int, int) {
+	switch direction {
+	case up:
+		return c.x, max(c.y-cnt, 0)
+
+	case down:
+		return c.x, min(c.y+cnt, len(s.lines)-1)
+
+	case left:
+		nextx := s.xidx(c) - cnt
+		if 0 <= nextx {
+			// move left if possible
+			return s.curline(c).widthto(nextx), c.y
+		}
+
+		// if no chars at leftside, move to above line tail
+		if c.y == 0 {
+			// if already at the top line, do nothing.
+			return c.x, c.y
+		}
+		return s.lines[c.y-1].width(), c.y - 1
+
+	case right:
+		nextx := s.xidx(c) + cnt
+		if nextx < s.curline(c).length() {
+			// move right if possible
+			return s.curline(c).widthto(nextx), c.y
+		}
+
+		// if no chars at rightside, move to below line head
+		if c.y == len(s.lines)-1 {
+			// if already at the bottom line, do nothing.
+			return c.x, c.y
+		}
+		return 0, c.y + 1
+
+	default:
+		panic("invalid direction is passed")
+	}
+}
+
+func (s *screen) movecursors(direction direction, cnt int) {
+	s.movecursorsfunc(func(c *cursor) (int, int) {
+		return s._movecursor(c, direction, cnt)
+	})
+}
+
+func (s *screen) movecursor(c *cursor, direction direction, cnt int) {
+	s.movecursorfunc(c, func(c *cursor) (int, int) {
+		return s._movecursor(c, direction, cnt)
+	})
+}
+
+func (s *screen) movecursorstonextch(ch *character) {
+	s.movecursorsfunc(func(c *cursor) (int, int) {
+		line := s.curline(c)
+		newx := c.x
+		for i := s.xidx(c) + 1; i < line.length(); i++ {
+			if line.buffer[i].equal(ch) {
+				newx = line.widthto(i)
+				break
+			}
+		}
+		// if ch is not found, newx is still the original x, so not moved
+		return newx, c.y
+	})
+}
+
+func (s *screen) movecursorstoprevch(ch *character) {
+	s.movecursorsfunc(func(c *cursor) (int, int) {
+		line := s.curline(c)
+		newx := c.x
+		for i := s.xidx(c) - 1; 0 <= i; i-- {
+			if line.buffer[i].equal(ch) {
+				newx = line.widthto(i)
+				break
+			}
+		}
+		// if ch is not found, newx is still the original x, so not moved
+		return newx, c.y
+	})
+}
+
+func (s *screen) movecursorstotopleft() {
+	s.movecursorsfunc(func(c *cursor) (int, int) {
+		return 0, 0
+	})
+}
+
+func (s *screen) movecursorstobottomleft() {
+	s.movecursorsfunc(func(c *cursor) (int, int) {
+		return 0, len(s.lines) - 1
+	})
+}
+
+func (s *screen) movecursorstolinebottom() {
+	s.movecursorsfunc(func(c *cursor) (int, int) {
+		return s.curline(c).width() - 1, c.y
+	})
+}
+
+func (s *screen) movecursorstononspacelinehead() {
+	s.movecursorsfunc(func(c *cursor) (int, int) {
+		x := 0
+		curline := s.curline(c)
+		for i := range curline.buffer {
+			if !curline.buffer[i].isspace() {
+				break
+			}
+			x += curline.buffer[i].width
+		}
+		return x, c.y
+	})
+}
+
+func (s *screen) movecursorstolinehead() {
+	s.movecursorsfunc(func(c *cursor) (int, int) {
+		return 0, c.y
+	})
+}
+
+func (s *screen) movecursorstoline(line int) {
+	if len(s.lines) < line {
+		line = len(s.lines)
+	}
+
+	s.movecursorsfunc(func(c *cursor) (int, int) {
+		return 0, line - 1
+	})
+}
+
+// move every cursor cnt times by f, which returns the next position from the line y and the character index idx.
+func (s *screen) movecursorsrepeatedly(cnt int, f func(y, idx int) (int, int)) {
+	s.movecursorsfunc(func(c *cursor) (int, int) {
+		y, idx := c.y, s.xidx(c)
+		for range cnt {
+			y, idx = f(y, idx)
+		}
+		return s.lines[y].widthto(idx), y
+	})
+}
+
+/* word and paragraph motions */
+
+type charclass int
+
+const (
+	class_space charclass = iota
+	class_emptyline
+	class_word
+	class_punct
+)
+
+// return the class of the character at (y, idx) to find word boundaries.
+// An empty line is a word by itself. If bigword is true, every non-space character is in the same class.
+func (s *screen) classat(y, idx int, bigword bool) charclass {
+	l := s.lines[y]
+	if l.empty() {
+		return class_emptyline
+	}
+
+	ch := l.buffer[idx]
+	switch {
+	case ch.nl, ch.isspace():
+		return class_space
+	case bigword, ch.r == '_', unicode.IsLetter(ch.r), unicode.IsDigit(ch.r):
+		return class_word
+	default:
+		return class_punct
+	}
+}
+
+// return the position of the next character over the lines. ok is false at the end of the text.
+func (s *screen) nextpos(y, idx int) (int, int, bool) {
+	if idx+1 < s.lines[y].length() {
+		return y, idx + 1, true
+	}
+	if y+1 < len(s.lines) {
+		return y + 1, 0, true
+	}
+	return y, idx, false
+}
+
+// return the position of the previous character over the lines. ok is false at the head of the text.
+func (s *screen) prevpos(y, idx int) (int, int, bool) {
+	if 0 < idx {
+		return y, idx - 1, true
+	}
+	if 0 < y {
+		return y - 1, s.lines[y-1].length() - 1, true
+	}
+	return y, idx, false
+}
+
+// return the head of the next word from (y, idx), like "w".
+func (s *screen) nextwordhead(y, idx int, bigword bool) (int, int) {
+	class := s.classat(y, idx, bigword)
+	ok := true
+
+	// skip the current word. An empty line is a single character word.
+	if class == class_emptyline {
+		y, idx, ok = s.nextpos(y, idx)
+	} else if class != class_space {
+		for ok && s.classat(y, idx, bigword) == class {
+			y, idx, ok = s.nextpos(y, idx)
+		}
+	}
+
+	for ok && s.classat(y, idx, bigword) == class_space {
+		y, idx, ok = s.nextpos(y, idx)
+	}
+
+	return y, idx
+}
+
+// return the tail of the word from (y, idx), like "e". If already at the tail, the next word's one.
+func (s *screen) nextwordtail(y, idx int, bigword bool) (int, int) {
+	y, idx, ok := s.nextpos(y, idx)
+	for ok && (s.classat(y, idx, bigword) == class_space || s.classat(y, idx, bigword) == class_emptyline) {
+		y, idx, ok = s.nextpos(y, idx)
+	}
+
+	class := s.classat(y, idx, bigword)
+	for {
+		ny, nidx, ok := s.nextpos(y, idx)
+		if !ok || s.classat(ny, nidx, bigword) != class {
+			return y, idx
+		}
+		y, idx = ny, nidx
+	}
+}
+
+// return the head of the word from (y, idx), like "b". If already at the head, the previous word's one.
+func (s *screen) prevwordhead(y, idx int, bigword bool) (int, int) {
+	y, idx, ok := s.prevpos(y, idx)
+	for ok && s.classat(y, idx, bigword) == class_space {
+		y, idx, ok = s.prevpos(y, idx)
+	}
+
+	class := s.classat(y, idx, bigword)
+	if class == class_emptyline {
+		return y, idx
+	}
+
+	for {
+		py, pidx, ok := s.prevpos(y, idx)
+		if !ok || s.classat(py, pidx, bigword) != class {
+			return y, idx
+		}
+		y, idx = py, pidx
+	}
+}
+
+// return the next empty line after the paragraph, like "}". If not found, the text tail.
+func (s *screen) nextparagraph(y, idx int) (int, int) {
+	last := len(s.lines) - 1
+	for y < last && s.lines[y].empty() {
+		y++
+	}
+	for y < last && !s.lines[y].empty() {
+		y++
+	}
+
+	if y == last && !s.lines[y].empty() {
+		return y, s.lines[y].length() - 1
+	}
+	return y, 0
+}
+
+// return the previous empty line before the paragraph, like "{". If not found, the text head.
+func (s *screen) prevparagraph(y, idx int) (int, int) {
+	for 0 < y && s.lines[y].empty() {
+		y--
+	}
+	for 0 < y && !s.lines[y].empty() {
+		y--
+	}
+	return y, 0
+}
+
+/* cursor manipulation */
+
+func (s *screen) addcursorbelow() {
+	lastcursor := s.cursors[len(s.cursors)-1]
+	for i := lastcursor.y + 1; i < len(s.lines); i++ {
+		if lastcursor.x < s.lines[i].width() {
+			s.cursors = append(s.cursors, &cursor{x: lastcursor.x, y: i, actualx: lastcursor.actualx})
+			s.registerRenderLine(i)
+			break
+		}
+	}
+}
+
+// return the cursor position of the text shown at (x, y) on the screen.
+// The position on the line number is taken as the line head, and the one below the last line as the last line.
+func (s *screen) textpos(x, y int) (int, int) {
+	// dragging out of the window gives the position above or below it
+	ty := min(max(0, s.yoffset+y), len(s.lines)-1)
+	l := s.lines[ty]
+	tx := min(max(0, x-(s.linenumberwidth+1))+s.xoffset, l.width()-1)
+	return l.widthto(l.charidx(tx, 0)), ty
+}
+
+// leave only the main cursor and put it at (x, y) on the screen.
+func (s *screen) putcursorat(x, y int) {
+	s.deletecursors()
+	tx, ty := s.textpos(x, y)
+	s.movecursorsfunc(func(c *cursor) (int, int) {
+		return tx, ty
+	})
+}
+
+// add the cursor at (x, y) on the screen.
+func (s *screen) addcursorat(x, y int) {
+	tx, ty := s.textpos(x, y)
+	s.cursors = append(s.cursors, &cursor{x: tx, y: ty})
+	s.registerRenderLine(ty)
+	s.cleanupcursors()
+}
+
+func (s *screen) deletecursors() {
+	for i, c := range s.cursors {
+		if i == len(s.cursors)-1 {
+			break
+		}
+		s.registerRenderLine(c.y)
+	}
+	s.cursors = slices.Delete(s.cursors, 0, len(s.cursors)-1)
+}
+
+/* selection */
+
+func (s *screen) selectline() {
+	for _, c := range s.cursors {
+		switch sl := c.selection.(type) {
+		case *lineselection:
+			sl.lines = append(sl.lines, c.y)
+
+		case *charsselection:
+			c.selection = &lineselection{lines: []int{c.y}}
+
+		default:
+			c.selection = &lineselection{lines: []int{c.y}}
+		}
+
+		// when selecting a line, move cursor to line tail
+		s.movecursorfunc(c, func(c *cursor) (int, int) {
+			return s.curline(c).width() - 1, c.y
+		})
+
+		s.linestoberendered = append(s.linestoberendered, c.y)
+	}
+}
+
+func (s *screen) moveandselectline(direction direction, cnt int) {
+	for _, c := range s.cursors {
+		// move to above/below line
+		s.movecursor(c, direction, cnt)
+		// move to line tail
+		s.movecursorfunc(c, func(c *cursor) (int, int) {
+			return s.curline(c).width() - 1, c.y
+		})
+		sl := c.selection.(*lineselection)
+		sl.lines = append(sl.lines, c.y)
+	}
+}
+
+func (s *screen) unselectall() {
+	for _, c := range s.cursors {
+		switch sl := c.selection.(type) {
+		case *lineselection:
+			for _, l := range sl.lines {
+				s.registerRenderLine(l)
+			}
+
+		case *charsselection:
+			_, sy, _, ey := sl.ordered()
+			for y := sy; y <= min(ey, len(s.lines)-1); y++ {
+				s.registerRenderLine(y)
+			}
+		}
+		c.selection = nil
+	}
+}
+
+func (s *screen) yankselectedlines(regname string) {
+	for i, c := range s.cursors {
+		ys := slices.Clone(c.selection.(*lineselection).lines)
+		slices.Sort(ys)
+		ys = slices.Compact(ys)
+
+		lines := make([]*line, len(ys))
+		for i := range ys {
+			lines[i] = s.lines[ys[i]].copy()
+		}
+		s.register.store(i, regname, &regtext{typ: regtext_lines, lines: lines})
+	}
+	s.yanked(regname)
+}
+
+func (s *screen) deleteselectedlines() {
+	// delete from the bottom so that the deletion does not affect the selections above
+	for i := len(s.cursors) - 1; 0 <= i; i-- {
+		ys := slices.Clone(s.cursors[i].selection.(*lineselection).lines)
+		slices.Sort(ys)
+		ys = slices.Compact(ys)
+		for j := len(ys) - 1; 0 <= j; j-- {
+			s.dellines(ys[j], 1)
+		}
+	}
+}
+
+func (s *screen) selectchars() {
+	for _, c := range s.cursors {
+		idx := s.xidx(c)
+		c.selection = &charsselection{startx: idx, starty: c.y, endx: idx, endy: c.y}
+		s.registerRenderLine(c.y)
+	}
+}
+
+// let the selection end follow the cursor after the cursor is moved.
+func (s *screen) updatecharsselections() {
+	for _, c := range s.cursors {
+		sl := c.selection.(*charsselection)
+
+		// lines between the old and new end must be re-rendered
+		for y := min(sl.endy, c.y); y <= max(sl.endy, c.y); y++ {
+			s.registerRenderLine(y)
+		}
+
+		sl.endx, sl.endy = s.xidx(c), c.y
+	}
+}
+
+func (s *screen) yankselectedchars(regname string) {
+	for i, c := range s.cursors {
+		sx, sy, ex, ey := c.selection.(*charsselection).ordered()
+		s.register.store(i, regname, &regtext{typ: regtext_chars, chars: s.gettext(sy, sx, ey, ex+1)})
+	}
+	s.yanked(regname)
+}
+
+// called after every cursor yanked the text.
+func (s *screen) yanked(regname string) {
+	s.register.truncate(regname, len(s.cursors))
+	if regname == "+" {
+		s.term.write(osc52(s.register.clipboard()))
+	}
+}
+
+func (s *screen) deleteselectedchars() {
+	// delete from the bottom so that the deletion does not affect the selections above
+	for i := len(s.cursors) - 1; 0 <= i; i-- {
+		sx, sy, ex, ey := s.cursors[i].selection.(*charsselection).ordered()
+		s.deltext(sy, sx, ey, ex+1)
+	}
+}
+
+/* operator */
+
+// textrange is the target of an operator for a cursor. The end (y2, idx2) is exclusive.
+// If linewise is true, the whole lines from y1 to y2 are the target and the indexes are not used.
+type textrange struct {
+	y1, idx1 int
+	y2, idx2 int
+	linewise bool
+}
+
+// return the range between the two positions in any order.
+// If inclusive is true, the character at the latter position is also in the range.
+func charrange(y1, idx1, y2, idx2 int, inclusive bool) *textrange {
+	if y2 < y1 || (y1 == y2 && idx2 < idx1) {
+		y1, idx1, y2, idx2 = y2, idx2, y1, idx1
+	}
+	if inclusive {
+		idx2++
+	}
+	return &textrange{y1: y1, idx1: idx1, y2: y2, idx2: idx2}
+}
+
+func linerange(y1, y2 int) *textrange {
+	return &textrange{y1: min(y1, y2), y2: max(y1, y2), linewise: true}
+}
+
+func (r *textrange) empty() bool {
+	return !r.linewise && r.y1 == r.y2 && r.idx1 == r.idx2
+}
+
+// handleoperator reads the motion or the text object following the operator op (d, c, y, > or <),
+// then applies the operator to the range of every cursor. It returns the next mode.
+func (s *screen) handleoperator(op rune, num int, numinput bool, regname string, stream *inputstream) mode {
+	// the count can be also given after the operator like "d3w", and it is multiplied with the first one.
+	buff := stream.next()
+	if isnum, n := buff.isnumber(); isnum && n != 0 {
+		cnt := n
+		for {
+			buff = stream.next()
+			isnum2, n2 := buff.isnumber()
+			if !isnum2 {
+				break
+			}
+			cnt = cnt*10 + n2
+		}
+		num *= cnt
+		numinput = true
+	}
+
+	starts := make([][2]int, len(s.cursors))
+	for i, c := range s.cursors {
+		starts[i] = [2]int{c.y, s.xidx(c)}
+	}
+
+	var ranges []*textrange
+	switch {
+	case buff.special == _not_special_key && buff.r == op:
+		// doubled operator like "dd" is applied to the lines
+		ranges = make([]*textrange, len(s.cursors))
+		for i, c := range s.cursors {
+			ranges[i] = linerange(c.y, min(c.y+num-1, len(s.lines)-1))
+		}
+
+	case buff.special == _not_special_key && (buff.r == 'i' || buff.r == 'a'):
+		obj := stream.next()
+		ranges = make([]*textrange, len(s.cursors))
+		if obj.special == _not_special_key {
+			for i, c := range s.cursors {
+				ranges[i] = s.textobject(c.y, s.xidx(c), buff.r == 'a', obj.r)
+			}
+		}
+
+	default:
+		ranges = s.motionranges(op, buff, num, numinput, starts, stream)
+	}
+
+	// the cursors moved by the motion get back to where the range starts
+	found := false
+	for i, c := range s.cursors {
+		y, idx := starts[i][0], starts[i][1]
+		if i < len(ranges) && ranges[i] != nil {
+			found = true
+			y = ranges[i].y1
+			if !ranges[i].linewise {
+				idx = ranges[i].idx1
+			} else if y != starts[i][0] {
+				idx = min(idx, s.lines[y].length()-1)
+			}
+		}
+		s.movecursorfunc(c, func(c *cursor) (int, int) {
+			return s.lines[y].widthto(idx), y
+		})
+	}
+
+	if !found {
+		return normal
+	}
+
+	return s.applyoperator(op, ranges, regname)
+}
+
+// move the cursors by the motion, then return the range from the start position to the moved one for each cursor.
+// nil is returned if the input is not a motion.
+func (s *screen) motionranges(op rune, buff *input, num int, numinput bool, starts [][2]int, stream *inputstream) []*textrange {
+	linewise, inclusive := false, false
+
+	switch buff.special {
+	case _up, _down, _ctrl_u, _ctrl_d:
+		linewise = true
+
+	case _not_special_key:
+		switch buff.r {
+		case 'j', 'k':
+			linewise = true
+
+		case 'G':
+			linewise = true
+
+		case 'e', 'E':
+			inclusive = true
+
+		case 'f':
+			inclusive = true
+
+		case 'g':
+			// the key following g is peeked to know the kind of the range
+			input2 := stream.next()
+			switch input2.r {
+			case 'g', 'e':
+				linewise = true
+			}
+			stream.unread(input2)
+		}
+	}
+
+	isword := buff.special == _not_special_key && (buff.r == 'w' || buff.r == 'W')
+
+	// "cw" on a word changes until the word tail like "ce", but only the last character on the word tail.
+	// Whether the cursor is on a word differs by the cursor, so the tails are found for every cursor first.
+	var wordtails [][2]int
+	if op == 'c' && isword {
+		bigword := buff.r == 'W'
+		cursors := copycursors(s.cursors)
+		for _, c := range s.cursors {
+			l := s.lines[c.y]
+			idx := s.xidx(c)
+			for idx+1 < l.length()-1 && s.classat(c.y, idx+1, bigword) == s.classat(c.y, idx, bigword) {
+				idx++
+			}
+			c.x = l.widthto(idx)
+		}
+		if 1 < num {
+			s.handlemotion(&input{special: _not_special_key, r: buff.r - 'w' + 'e'}, num-1, numinput, stream)
+		}
+		for _, c := range s.cursors {
+			wordtails = append(wordtails, [2]int{c.y, s.xidx(c)})
+		}
+		s.cursors = cursors
+	}
+
+	if buff.special == _not_special_key && buff.r == 'G' && !numinput {
+		// without the count, G is the text bottom
+		s.movecursorstobottomleft()
+	} else if !s.handlemotion(buff, num, numinput, stream) {
+		return nil
+	}
+
+	ranges := make([]*textrange, len(s.cursors))
+	for i, c := range s.cursors {
+		sy, sidx := starts[i][0], starts[i][1]
+		y, idx := c.y, s.xidx(c)
+		if class := s.classat(sy, sidx, buff.r == 'W'); wordtails != nil && class != class_space && class != class_emptyline {
+			ranges[i] = charrange(sy, sidx, wordtails[i][0], wordtails[i][1], true)
+			continue
+		}
+
+		switch {
+		case linewise:
+			ranges[i] = linerange(sy, y)
+
+		case inclusive && sy == y && sidx == idx:
+			// the motion failed like "f" not finding the character
+
+		default:
+			if isword && sy < y && s.beforefirstnonblank(y, idx) {
+				// the last word moved over ends its line, so the range does not join the next line like "dw" on the last word
+				y, idx = y-1, s.lines[y-1].length()-1
+			}
+			ranges[i] = charrange(sy, sidx, y, idx, inclusive)
+		}
+	}
+	return ranges
+}
+
+// whether only spaces are before idx on the line y.
+func (s *screen) beforefirstnonblank(y, idx int) bool {
+	for _, ch := range s.lines[y].buffer[:idx] {
+		if !ch.isspace() {
+			return false
+		}
+	}
+	return true
+}
+
+// return the range of the text object like "iw" or "a(" around (y, idx).
+// If around is true, the object includes the surrounding spaces, quotes or brackets.
+// nil is returned if the object is not found.
+func (s *screen) textobject(y, idx int, around bool, obj rune) *textrange {
+	switch obj {
+	case 'w', 'W':
+		return s.wordobject(y, idx, around, obj == 'W')
+	case '"', '\'', '`':
+		return s.quoteobject(y, idx, around, obj)
+	case '(', ')', 'b':
+		return s.bracketobject(y, idx, around, '(', ')')
+	case '[', ']':
+		return s.bracketobject(y, idx, around, '[', ']')
+	case '{', '}', 'B':
+		return s.bracketobject(y, idx, around, '{', '}')
+	case '<', '>':
+		return s.bracketobject(y, idx, around, '<', '>')
+	case 'p':
+		return s.paragraphobject(y, around)
+	}
+	return nil
+}
+
+// return the word (or the spaces) at (y, idx). "aw" includes the trailing spaces, or the leading ones if there are no trailing spaces.
+func (s *screen) wordobject(y, idx int, around, bigword bool) *textrange {
+	l := s.lines[y]
+	if l.empty() {
+		return nil
+	}
+
+	// the newline is not a part of the word
+	last := l.length() - 1
+	idx = min(idx, last-1)
+
+	class := s.classat(y, idx, bigword)
+	from, to := idx, idx+1
+	for 0 < from && s.classat(y, from-1, bigword) == class {
+		from--
+	}
+	for to < last && s.classat(y, to, bigword) == class {
+		to++
+	}
+
+	if !around {
+		return &textrange{y1: y, idx1: from, y2: y, idx2: to}
+	}
+
+	if class == class_space {
+		// spaces and the following word
+		if to < last {
+			next := s.classat(y, to, bigword)
+			for to < last && s.classat(y, to, bigword) == next {
+				to++
+			}
+		}
+		return &textrange{y1: y, idx1: from, y2: y, idx2: to}
+	}
+
+	if to < last && s.classat(y, to, bigword) == class_space {
+		for to < last && s.classat(y, to, bigword) == class_space {
+			to++
+		}
+	} else {
+		for 0 < from && s.classat(y, from-1, bigword) == class_space {
+			from--
+		}
+	}
+	return &textrange{y1: y, idx1: from, y2: y, idx2: to}
+}
+
+// return the quoted text on the line y around or after idx. "a" object includes the quotes.
+// Quotes escaped by backslash are ignored.
+func (s *screen) quoteobject(y, idx int, around bool, q rune) *textrange {
+	l := s.lines[y]
+	quotes := []int{}
+	for i, ch := range l.buffer {
+		if ch.r == q && !(0 < i && l.buffer[i-1].r == '\\') {
+			quotes = append(quotes, i)
+		}
+	}
+
+	for i := 0; i+1 < len(quotes); i += 2 {
+		open, close := quotes[i], quotes[i+1]
+		if idx <= close {
+			if around {
+				return &textrange{y1: y, idx1: open, y2: y, idx2: close + 1}
+			}
+			return &textrange{y1: y, idx1: open + 1, y2: y, idx2: close}
+		}
+	}
+	return nil
+}
+
+// return the text enclosed by the innermost brackets around (y, idx). The brackets can be on different lines.
+// "a" object includes the brackets.
+func (s *screen) bracketobject(y, idx int, around bool, left, right rune) *textrange {
+	// find the unmatched left bracket backward. The cursor on the right bracket is inside of it.
+	ly, lidx := y, idx
+	depth := 0
+	for {
+		ch := s.lines[ly].buffer[lidx]
+		if ch.r == right && (ly != y || lidx != idx) {
+			depth++
+		} else if ch.r == left {
+			if depth == 0 {
+				break
+			}
+			depth--
+		}
+
+		var ok bool
+		ly, lidx, ok = s.prevpos(ly, lidx)
+		if !ok {
+			return nil
+		}
+	}
+
+	// then its pair forward
+	ry, ridx := ly, lidx
+	depth = 0
+	for {
+		var ok bool
+		ry, ridx, ok = s.nextpos(ry, ridx)
+		if !ok {
+			return nil
+		}
+
+		ch := s.lines[ry].buffer[ridx]
+		if ch.r == left {
+			depth++
+		} else if ch.r == right {
+			if depth == 0 {
+				break
+			}
+			depth--
+		}
+	}
+
+	if around {
+		return &textrange{y1: ly, idx1: lidx, y2: ry, idx2: ridx + 1}
+	}
+	return &textrange{y1: ly, idx1: lidx + 1, y2: ry, idx2: ridx}
+}
+
+// return the lines of the paragraph (or the empty lines) at y. "ap" includes the following empty lines (or the following paragraph).
+func (s *screen) paragraphobject(y int, around bool) *textrange {
+	blank := s.lines[y].empty()
+	y1, y2 := y, y
+	for 0 < y1 && s.lines[y1-1].empty() == blank {
+		y1--
+	}
+	for y2 < len(s.lines)-1 && s.lines[y2+1].empty() == blank {
+		y2++
+	}
+
+	if around {
+		for y2 < len(s.lines)-1 && s.lines[y2+1].empty() != blank {
+			y2++
+		}
+	}
+	return linerange(y1, y2)
+}
+
+// apply the operator to the ranges of the cursors. nil range is skipped.
+func (s *screen) applyoperator(op rune, ranges []*textrange, regname string) mode {
+	if op == 'y' || op == 'd' || op == 'c' {
+		for i, r := range ranges {
+			s.register.store(i, regname, s.rangetext(r))
+		}
+		s.yanked(regname)
+	}
+
+	switch op {
+	case 'd', 'c':
+		// the ranges of the cursors must not overlap not to delete the text twice
+		var prev *textrange
+		for i, r := range ranges {
+			if r == nil {
+				continue
+			}
+			if prev != nil {
+				switch {
+				case r.linewise && r.y1 <= prev.y2:
+					r.y1 = prev.y2 + 1
+					if r.y2 < r.y1 {
+						ranges[i] = nil
+						continue
+					}
+				case !r.linewise && (r.y1 < prev.y2 || (r.y1 == prev.y2 && r.idx1 < prev.idx2)):
+					r.y1, r.idx1 = prev.y2, prev.idx2
+					if r.y2 < r.y1 || (r.y1 == r.y2 && r.idx2 <= r.idx1) {
+						ranges[i] = nil
+						continue
+					}
+				}
+			}
+			prev = r
+		}
+
+		// delete from the bottom so that the deletion does not affect the ranges above
+		for i := len(ranges) - 1; 0 <= i; i-- {
+			r := ranges[i]
+			switch {
+			case r == nil:
+
+			case r.linewise && op == 'd':
+				s.dellines(r.y1, r.y2-r.y1+1)
+
+			case r.linewise:
+				// an empty line is left to type the new text
+				s.deltext(r.y1, 0, r.y2, s.lines[r.y2].length()-1)
+
+			default:
+				s.deltext(r.y1, r.idx1, r.y2, r.idx2)
+			}
+		}
+
+		if op == 'c' {
+			return insert
+		}
+
+	case '>', '<':
+		ys := []int{}
+		for _, r := range ranges {
+			if r == nil {
+				continue
+			}
+			for y := r.y1; y <= r.y2; y++ {
+				ys = append(ys, y)
+			}
+		}
+		slices.Sort(ys)
+		for _, y := range slices.Compact(ys) {
+			s.shiftline(y, op == '>')
+		}
+		s.movecursorstononspacelinehead()
+	}
+
+	return normal
+}
+
+// return the copy of the text in the range to be stored in the register.
+func (s *screen) rangetext(r *textrange) *regtext {
+	switch {
+	case r == nil:
+		return &regtext{typ: regtext_chars}
+	case r.linewise:
+		return &regtext{typ: regtext_lines, lines: copylines(s.lines[r.y1 : r.y2+1])}
+	default:
+		return &regtext{typ: regtext_chars, chars: s.gettext(r.y1, r.idx1, r.y2, r.idx2)}
+	}
+}
+
+// indent the line y by a tab. If right is false, unindent it by a tab or up to 4 spaces.
+// Empty lines are not indented.
+func (s *screen) shiftline(y int, right bool) {
+	l := s.lines[y]
+	if right {
+		if !l.empty() {
+			s.instext(y, 0, []*character{newcharacter('\t')})
+		}
+		return
+	}
+
+	n := 0
+	if l.buffer[0].tab {
+		n = 1
+	} else {
+		for n < 4 && l.buffer[n].r == ' ' {
+			n++
+		}
+	}
+	if n != 0 {
+		s.deltext(y, 0, y, n)
+	}
+}
+
+/* text modification */
+
+func (s *screen) insertcharsatcursors(chars []*character) {
+	for _, c := range s.cursors {
+		s.instext(c.y, s.xidx(c), chars)
+	}
+}
+
+func (s *screen) deletecursorprevchar() {
+	for _, c := range s.cursors {
+		idx := s.xidx(c)
+		switch idx {
+		case 0:
+			if c.y != 0 {
+				// join current and above line.
+				// the cursor is moved to the right edge on the above line.
+				s.deltext(c.y-1, s.lines[c.y-1].length()-1, c.y, 0)
+			}
+
+		default:
+			s.deltext(c.y, idx-1, c.y, idx)
+		}
+	}
+}
+
+func (s *screen) insertlinefromcursors(direction direction) {
+	for _, c := range s.cursors {
+		y := c.y
+		switch direction {
+		case up:
+			s.inslines(y, []*line{newemptyline()})
+		case down:
+			y++
+			s.inslines(y, []*line{newemptyline()})
+		default:
+			panic("invalid direction is passed")
+		}
+
+		s.movecursorfunc(c, func(c *cursor) (int, int) {
+			return 0, y
+		})
+	}
+}
+
+func (s *screen) replacecursorchar(ch *character) {
+	for _, c := range s.cursors {
+		// newline cannot be replaced
+		if s.atlinetail(c) {
+			continue
+		}
+
+		idx := s.xidx(c)
+		s.modifyline(c.y, func(l *line) {
+			l.replacech(ch.copy(), idx)
+		})
+	}
+}
+
+func (s *screen) splitcursorsline() {
+	for _, c := range s.cursors {
+		s.instext(c.y, s.xidx(c), []*character{newcharacter('\n')})
+	}
+}
+
+// ask the terminal the clipboard content and wait for the reply to paste it.
+// The terminal not supporting the query does not reply, then the content received last is pasted.
+func (s *screen) queryclipboard(stream *inputstream) {
+	s.term.write([]byte(osc52query))
+	s.term.flush()
+	if text, ok := stream.waitclipboard(clipboardtimeout); ok {
+		s.register.setclipboard(text)
+	}
+}
+
+// paste the yanked text after (or before) the cursors.
+// Each cursor pastes the text in its own register slot.
+func (s *screen) pastefromcursors(regname string, after bool) {
+	regname = strings.ToLower(regname)
+	for i, c := range s.cursors {
+		txt, _ := s.register.get(i, regname)
+		if txt == nil {
+			// the text yanked by the single cursor is pasted at every cursor
+			txt, _ = s.register.get(0, regname)
+		}
+		if txt == nil {
+			break
+		}
+
+		switch txt.typ {
+		case regtext_lines:
+			y := c.y
+			if after {
+				y++
+			}
+			s.inslines(y, copylines(txt.lines))
+			last := y + len(txt.lines) - 1
+			s.movecursorfunc(c, func(c *cursor) (int, int) {
+				return s.lines[last].width() - 1, last
+			})
+
+		case regtext_chars:
+			if len(txt.chars) == 0 {
+				continue
+			}
+
+			y, idx := c.y, s.xidx(c)
+			// nothing can be put after the newline, so paste before it
+			if after && !s.atlinetail(c) {
+				idx++
+			}
+
+			s.instext(y, idx, txt.chars)
+
+			// move the cursor onto the last pasted character
+			lasty, lastidx := y, idx
+			for _, ch := range txt.chars[:len(txt.chars)-1] {
+				if ch.nl {
+					lasty, lastidx = lasty+1, 0
+				} else {
+					lastidx++
+				}
+			}
+			s.movecursorfunc(c, func(c *cursor) (int, int) {
+				return s.lines[lasty].widthto(lastidx), lasty
+			})
+		}
+	}
+}
+
+/* primitive edits */
+
+// All the text modification must be done via the functions below.
+// They record the change to the undo tree and keep every cursor pointing
+// the same character even after the text around it is changed.
+
+// replace lines[y:y+n] with the given lines, and record it as a change.
+func (s *screen) replacelines(y, n int, after []*line) {
+	s.undotree.record(&change{y: y, before: copylines(s.lines[y : y+n]), after: copylines(after)})
+	s.setlines(y, n, after)
+}
+
+// replace lines[y:y+n] with the given lines without recording the change.
+func (s *screen) setlines(y, n int, lines []*line) {
+	attrs := make([]*lineattribute, len(lines))
+	for i := range attrs {
+		attrs[i] = &lineattribute{}
+	}
+
+	s.lines = slices.Replace(s.lines, y, y+n, lines...)
+	s.lineattrs = slices.Replace(s.lineattrs, y, y+n, attrs...)
+
+	// every screen showing the buffer must be updated
+	for _, v := range s.views {
+		if n == len(lines) {
+			for i := range n {
+				v.registerRenderLine(y + i)
+			}
+		} else {
+			// line count is changed, so every line after y must be re-rendered
+			v.registerRenderLineAfter(y)
+		}
+		v.updatelinenumberwidth()
+	}
+
+	s.changes++
+	s.dirty = true
+}
+
+// modify the line y by f. Cursors are not moved.
+func (s *screen) modifyline(y int, f func(l *line)) {
+	l := s.lines[y].copy()
+	f(l)
+	s.replacelines(y, 1, []*line{l})
+}
+
+// insert chars before the idx-th character on the line y.
+// When chars contain newlines, the line is split.
+func (s *screen) instext(y, idx int, chars []*character) {
+	if len(chars) == 0 {
+		return
+	}
+
+	idxs := s.cursoridxs(y)
+
+	cur := s.lines[y]
+	newlines := []*line{{buffer: slices.Clone(cur.buffer[:idx])}}
+	for _, ch := range chars {
+		last := newlines[len(newlines)-1]
+		last.buffer = append(last.buffer, ch.copy())
+		if ch.nl {
+			newlines = append(newlines, &line{})
+		}
+	}
+	last := newlines[len(newlines)-1]
+	lastlen := len(last.buffer)
+	last.buffer = append(last.buffer, cur.buffer[idx:]...)
+
+	s.replacelines(y, 1, newlines)
+
+	added := len(newlines) - 1
+	for _, c := range s.allcursors() {
+		switch {
+		case y < c.y:
+			c.y += added
+
+		case y == c.y && idx <= idxs[c]:
+			nexty, nextidx := y+added, idxs[c]+len(chars)
+			if added != 0 {
+				nextidx = lastlen + idxs[c] - idx
+			}
+			s.movecursorfunc(c, func(c *cursor) (int, int) {
+				return s.lines[nexty].widthto(nextidx), nexty
+			})
+		}
+	}
+}
+
+// delete characters from (y1, idx1) to (y2, idx2). The end is exclusive.
+// When the range contains newlines, the lines are joined.
+func (s *screen) deltext(y1, idx1, y2, idx2 int) {
+	// the end beyond the newline points the next line head.
+	if s.lines[y2].length() <= idx2 {
+		if y2+1 < len(s.lines) {
+			y2, idx2 = y2+1, 0
+		} else {
+			// the last newline cannot be deleted
+			idx2 = s.lines[y2].length() - 1
+		}
+	}
+
+	if y2 < y1 || (y1 == y2 && idx2 <= idx1) {
+		return
+	}
+
+	idxs := make(map[*cursor]int)
+	for y := y1; y <= y2; y++ {
+		maps.Copy(idxs, s.cursoridxs(y))
+	}
+
+	joined := &line{buffer: slices.Concat(s.lines[y1].buffer[:idx1], s.lines[y2].buffer[idx2:])}
+	s.replacelines(y1, y2-y1+1, []*line{joined})
+
+	for _, c := range s.allcursors() {
+		switch {
+		case y2 < c.y:
+			c.y -= y2 - y1
+
+		case c.y == y2 && idx2 <= idxs[c]:
+			nextidx := idx1 + idxs[c] - idx2
+			s.movecursorfunc(c, func(c *cursor) (int, int) {
+				return s.lines[y1].widthto(nextidx), y1
+			})
+
+		case y1 < c.y || (c.y == y1 && idx1 <= idxs[c]):
+			// the cursor was in the deleted range
+			s.movecursorfunc(c, func(c *cursor) (int, int) {
+				return s.lines[y1].widthto(idx1), y1
+			})
+		}
+	}
+}
+
+// return the copy of characters from (y1, idx1) to (y2, idx2). The end is exclusive.
+func (s *screen) gettext(y1, idx1, y2, idx2 int) []*character {
+	chars := []*character{}
+	for y := y1; y <= y2; y++ {
+		from, to := 0, s.lines[y].length()
+		if y == y1 {
+			from = idx1
+		}
+		if y == y2 {
+			to = min(idx2, to)
+		}
+		for i := from; i < to; i++ {
+			chars = append(chars, s.lines[y].buffer[i].copy())
+		}
+	}
+	return chars
+}
+
+// insert lines before the line y.
+func (s *screen) inslines(y int, lines []*line) {
+	s.replacelines(y, 0, lines)
+
+	for _, c := range s.allcursors() {
+		if y <= c.y {
+			c.y += len(lines)
+		}
+	}
+}
+
+// delete n lines from the line y.
+func (s *screen) dellines(y, n int) {
+	if n == len(s.lines) {
+		// at least one line must be remaining
+		s.replacelines(0, n, []*line{newemptyline()})
+	} else {
+		s.replacelines(y, n, []*line{})
+	}
+
+	for _, c := range s.allcursors() {
+		switch {
+		case y+n <= c.y:
+			c.y -= n
+		case y <= c.y:
+			s.movecursorfunc(c, func(c *cursor) (int, int) {
+				return 0, min(y, len(s.lines)-1)
+			})
+		}
+	}
+}
+
+// return the cursors of every screen showing the buffer.
+func (s *screen) allcursors() []*cursor {
+	cursors := []*cursor{}
+	for _, v := range s.views {
+		cursors = append(cursors, v.cursors...)
+	}
+	return cursors
+}
+
+// return the character index of each cursor on the line y.
+func (s *screen) cursoridxs(y int) map[*cursor]int {
+	idxs := make(map[*cursor]int)
+	for _, c := range s.allcursors() {
+		if c.y == y {
+			idxs[c] = s.xidx(c)
+		}
+	}
+	return idxs
+}
+
+func copylines(lines []*line) []*line {
+	copied := make([]*line, len(lines))
+	for i := range lines {
+		copied[i] = lines[i].copy()
+	}
+	return copied
+}
+
+/* undo */
+
+func (s *screen) undo(cnt int) {
+	for range cnt {
+		n := s.undotree.undo()
+		if n == nil {
+			break
+		}
+
+		for i := len(n.changes) - 1; 0 <= i; i-- {
+			ch := n.changes[i]
+			s.setlines(ch.y, len(ch.after), copylines(ch.before))
+		}
+		s.restorecursors(n.cursorsbefore)
+	}
+
+	s.clampviewcursors()
+	s.dirty = !s.undotree.atsaved()
+}
+
+func (s *screen) redo(cnt int) {
+	for range cnt {
+		n := s.undotree.redo()
+		if n == nil {
+			break
+		}
+
+		for _, ch := range n.changes {
+			s.setlines(ch.y, len(ch.before), copylines(ch.after))
+		}
+		s.restorecursors(n.cursorsafter)
+	}
+
+	s.clampviewcursors()
+	s.dirty = !s.undotree.atsaved()
+}
+
+// keep the cursors of the other screens on the existing lines after undo or redo.
+func (s *screen) clampviewcursors() {
+	for _, v := range s.views {
+		for _, c := range v.cursors {
+			c.y = min(c.y, len(s.lines)-1)
+		}
+	}
+}
+
+func (s *screen) restorecursors(cursors []*cursor) {
+	for _, c := range s.cursors {
+		s.registerRenderLine(c.y)
+	}
+
+	s.cursors = copycursors(cursors)
+	for _, c := range s.cursors {
+		c.y = min(c.y, len(s.lines)-1)
+		s.registerRenderLine(c.y)
+	}
+}
+
+/* helpers */
+
+func (s *screen) atlinetail(c *cursor) bool {
+	return s.xidx(c) == s.curline(c).length()-1
+}
+
+// return x character index from the current cursor position.
+// when x is too right, it points the line tail.
+func (s *screen) xidx(c *cursor) int {
+	return s.curline(c).charidx(min(c.x, s.curline(c).width()-1), 0)
+}
+
+// ensure current s.x is pointing on the correct character position.
+// if x is too right after up/down move, fix x position.
+// if x is not aligning to the multi length character head, align there.
+func (s *screen) alignx(c *cursor) {
+	c.x = s.curline(c).widthto(s.xidx(c))
+}
+
+func (s *screen) registerRenderLine(y int) {
+	s.linestoberendered = append(s.linestoberendered, y)
+}
+
+func (s *screen) registervisiblelines() {
+	for i := s.yoffset; i < min(s.yoffset+s.height-1, len(s.lines)); i++ {
+		s.linestoberendered = append(s.linestoberendered, i)
+	}
+}
+
+func (s *screen) registerRenderLineAfter(after int) {
+	for i := after; i < len(s.lines); i++ {
+		s.linestoberendered = append(s.linestoberendered, i)
+	}
+}
+
+/* swap recovery */
+
+// replace the content with the one in the swap file. It can be undone.
+func (s *screen) recover(sw *swap) {
+	recovered := &buffer{}
+	recovered.load(sw.content)
+
+	s.undotree.begin(s.cursors)
+	s.replacelines(0, len(s.lines), recovered.lines)
+	s.bom, s.crlf, s.eol, s.empty = recovered.bom, recovered.crlf, recovered.eol, recovered.empty
+
+	cursors := []*cursor{}
+	for _, pos := range sw.cursors {
+		y := min(pos[0], len(s.lines)-1)
+		idx := min(pos[1], s.lines[y].length()-1)
+		cursors = append(cursors, &cursor{x: s.lines[y].widthto(idx), y: y})
+	}
+	if len(cursors) != 0 {
+		s.cursors = cursors
+	}
+	s.undotree.commit(s.cursors)
+
+	// the swap file has the same content now, it is overwritten by the next change
+	s.swapped = s.changes
+	s.swapowned = true
+}
+
+/*
+ * undo tree
+ */
+
+// change is a reversible modification on the lines.
+// lines[y:y+len(before)] are replaced with after.
+type change struct {
+	y      int
+	before []*line
+	after  []*line
+}
+
+// undonode is a unit of undo. It holds the changes made by a single command
+// (or a single insert mode session) and the cursor positions before/after it.
+type undonode struct {
+	parent        *undonode
+	children      []*undonode
+	changes       []*change
+	cursorsbefore []*cursor
+	cursorsafter  []*cursor
+}
+
+type undotree struct {
+	root    *undonode
+	current *undonode
+	saved   *undonode
+
+	// changes which are not committed to the tree yet
+	pending []*change
+	// cursor positions when the pending changes started
+	pendingcursors []*cursor
+}
+
+func newundotree() *undotree {
+	root := &undonode{}
+	return &undotree{root: root, current: root, saved: root}
+}
+
+// begin remembers the cursor positions before the next change.
+// This is no-op while there are pending changes.
+func (u *undotree) begin(cursors []*cursor) {
+	if len(u.pending) != 0 {
+		return
+	}
+	u.pendingcursors = copycursors(cursors)
+}
+
+func (u *undotree) record(ch *change) {
+	// successive modifications on the same single line are merged into one change
+	// to save memory. This happens a lot in insert mode.
+	if len(u.pending) != 0 {
+		last := u.pending[len(u.pending)-1]
+		if last.y == ch.y && len(last.before) == 1 && len(last.after) == 1 && len(ch.before) == 1 && len(ch.after) == 1 {
+			last.after = ch.after
+			return
+		}
+	}
+
+	u.pending = append(u.pending, ch)
+}
+
+// commit makes the pending changes as a new node of the tree.
+func (u *undotree) commit(cursors []*cursor) {
+	if len(u.pending) == 0 {
+		return
+	}
 
-			case 'x':
-				s.selectline()
-				newmode = lineselect
+	node := &undonode{
+		parent:        u.current,
+		changes:       u.pending,
+		cursorsbefore: u.pendingcursors,
+		cursorsafter:  copycursors(cursors),
+	}
+	u.current.children = append(u.current.children, node)
+	u.current = node
+	u.pending = nil
+	u.pendingcursors = nil
+}
+
+// undo returns the node to be reverted, or nil if nothing to undo.
+func (u *undotree) undo() *undonode {
+	if u.current == u.root {
+		return nil
+	}
+
+	n := u.current
+	u.current = n.parent
+	return n
+}
+
+// redo returns the node to be re-applied, or nil if nothing to redo.
+// When the current node has several branches, the latest one is chosen.
+func (u *undotree) redo() *undonode {
+	if len(u.current.children) == 0 {
+		return nil
+	}
+
+	n := u.current.children[len(u.current.children)-1]
+	u.current = n
+	return n
+}
+
+func (u *undotree) marksaved() {
+	u.saved = u.current
+}
+
+func (u *undotree) atsaved() bool {
+	return u.current == u.saved
+}
+
+func copycursors(cursors []*cursor) []*cursor {
+	copied := make([]*cursor, len(cursors))
+	for i, c := range cursors {
+		copied[i] = &cursor{x: c.x, y: c.y, actualx: c.actualx}
+	}
+	return copied
+}
+
+/*
+ * window
+ */
+
+type window struct {
+	x         int
+	y         int
+	width     int
+	height    int
+	parent    *window
+	children  []*window
+	screen    *screen
+	direction direction // down or right
+}
+
+func newleafwindow(term terminal, x, y, width, height int, buffer *buffer, register *register) *window {
+	return &window{
+		x:      x,
+		y:      y,
+		width:  width,
+		height: height,
+		screen: newscreen(term, x, y, width, height, buffer, register, false),
+	}
+}
+
+func (w *window) isroot() bool {
+	return w.parent == nil
+}
+
+func (w *window) isleaf() bool {
+	return len(w.children) == 0
+}
+
+func (w *window) split(term terminal, direction direction, buffer *buffer, register *register) *window {
+	// when the given directions is the same with parent window, add new window as sibling of w.
+	if w.parent != nil && w.parent.direction == direction {
+		return w.parent.inschildafter(w, term, buffer, register)
+	}
+
+	// when no parent exists (= w is root) or exists but direction is different,
+	// make the leaf window w to inner window, then add new window as child.
+	w.toinner(direction)
+	return w.inschildafter(w.children[0], term, buffer, register)
+}
+
+func (w *window) toinner(direction direction) {
+	// make leaf node to inner node
+	if !w.isleaf() {
+		panic("toinner is called on non-leaf window")
+	}
+
+	w.direction = direction
+	w.children = []*window{{parent: w, screen: w.screen}}
+	w.screen = nil
+}
+
+func (w *window) inschildafter(after *window, term terminal, buffer *buffer, register *register) *window {
+	// insert a child node after $after then do resize.
+	newwin := newleafwindow(term, 0, 0, 0, 0, buffer, register)
+	newwin.parent = w
+	idx := slices.Index(w.children, after)
+	if idx == -1 {
+		panic("cannot find a given child node in the children")
+	}
+
+	w.children = slices.Insert(w.children, idx+1, newwin)
+	w.resizechildren()
+	return newwin
+}
+
+func (w *window) resizechildren() {
+	// divide the $total into $count items so that they are all the same length
+	// as much as possible. This considers splitter sign (| or -).
+	//
+	// suppose total is 30, count is 4, then
+	//    7   |   7   |   7   |   6   (7 + 7 + 7 + 6 + 3(splitter) = 30)
+	// AAAAAAA|BBBBBBB|CCCCCCC|DDDDDD
+	// is expected (| sign is window splitter).
+	f := func(total, count int) []int {
+		total -= count - 1
+		result := make([]int, count)
+		for i := range count {
+			_mod := total % (count - i)
+			_div := total / (count - i)
+			if _mod == 0 {
+				result[i] = _div
+				total -= _div
+			} else {
+				result[i] = _div + 1
+				total -= _div + 1
 			}
+		}
+		return result
+	}
 
+	sum := func(ints []int) int {
+		s := 0
+		for i := range ints {
+			s += ints[i]
 		}
+		return s
+	}
 
-	case insert:
-		switch buff.special {
-		case _left:
-			s.movecursors(left, 1)
+	switch w.direction {
+	case right:
+		widths := f(w.width, len(w.children))
+		for i := range w.children {
+			w.children[i].changesize(w.x+sum(widths[:i])+1*i, w.y, widths[i], w.height)
+		}
 
-		case _down:
-			s.movecursors(down, 1)
+	case down:
+		heights := f(w.height, len(w.children))
+		for i := range w.children {
+			w.children[i].changesize(w.x, w.y+sum(heights[:i])+1*i, w.width, heights[i])
+		}
 
-		case _up:
-			s.movecursors(up, 1)
+	default:
+		panic("unexpected split direction")
+	}
+}
 
-		case _right:
-			s.movecursors(right, 1)
+func (w *window) changesize(x, y, width, height int) {
+	w.x = x
+	w.y = y
+	w.width = width
+	w.height = height
 
-		case _esc:
-			newmode = normal
+	if w.isleaf() {
+		w.screen.width = width
+		w.screen.height = height
+		w.screen.term.x = x
+		w.screen.term.y = y
+		w.screen.term.width = width
+	} else {
+		// when parent node size is changed, children size must be changed accordingly
+		w.resizechildren()
+	}
+}
 
-		case _cr:
-			s.splitcursorsline()
+func (w *window) render(term *screenterm, first bool) {
+	if w.isleaf() {
+		w.screen.render(first)
+		return
+	}
 
-		case _bs:
-			s.deletecursorprevchar()
+	for i, child := range w.children {
+		child.render(term, first)
 
-		case _tab:
-			s.insertcharsatcursors([]*character{newcharacter('\t')})
+		// add splitter line on non last window
+		if i != len(w.children)-1 {
+			if w.direction == right {
+				for j := range child.height {
+					term.putcursor(child.x+child.width, child.y+j)
+					term.write([]byte("|"))
+				}
+			} else {
+				for j := range child.width {
+					term.putcursor(child.x+j, child.y+child.height)
+					term.write([]byte("-"))
+				}
+			}
+		}
+	}
+}
+
+func (w *window) actualcursor() (int, int) {
+	return w.x + w.screen.cursors[0].actualx, w.y + w.screen.cursors[0].y - w.screen.yoffset
+}
+
+func (w *window) getallleaves() []*window {
+	if w.isleaf() {
+		return []*window{w}
+	}
+
+	leaves := []*window{}
+	for _, child := range w.children {
+		if w.isleaf() {
+			leaves = append(leaves, child)
+			continue
+		}
+
+		leaves = append(leaves, child.getallleaves()...)
+	}
+
+	return leaves
+}
+
+func (w *window) close() *window {
+	if w.isroot() {
+		return nil
+	}
+
+	parent := w.parent
+	next := w.parent.removechild(w)
+	if len(parent.children) != 1 {
+		return next
+	}
+
+	// when only 1 children exists, the tree rebalance is required.
+	parent.toleaf()
+	if parent.isleaf() {
+		return parent
+	}
+
+	return parent.firstleaf()
+}
+
+func (w *window) toleaf() {
+	w.x = w.children[0].x
+	w.y = w.children[0].y
+	w.width = w.children[0].width
+	w.height = w.children[0].height
+	w.screen = w.children[0].screen
+	w.direction = w.children[0].direction
+	w.children = w.children[0].children // must be at bottom
+	for _, child := range w.children {
+		child.parent = w
+	}
+}
+
+func (w *window) removechild(child *window) *window {
+	idx := slices.Index(w.children, child)
+	if idx == -1 {
+		panic("cannot find a given child node to remove in the children")
+	}
+	w.children = slices.Delete(w.children, idx, idx+1)
+	w.resizechildren()
+
+	idx = max(0, idx-1)
+
+	if w.children[idx].isleaf() {
+		return w.children[idx]
+	}
 
-		case _not_special_key:
-			s.insertcharsatcursors([]*character{newcharacter(buff.r)})
-		}
+	return w.children[idx].firstleaf()
+}
 
-	case lineselect:
-		switch buff.special {
-		case _esc:
-			s.unselectalllines()
-			newmode = normal
+// return the leaf window at (x, y) on the terminal, or nil.
+func (w *window) windowat(x, y int) *window {
+	if x < w.x || w.x+w.width <= x || y < w.y || w.y+w.height <= y {
+		return nil
+	}
 
-		case _not_special_key:
-			switch buff.r {
-			case 'j':
-				s.moveandselectline(down, num)
+	if w.isleaf() {
+		return w
+	}
 
-			case 'k':
-				s.moveandselectline(up, num)
+	for _, child := range w.children {
+		if found := child.windowat(x, y); found != nil {
+			return found
+		}
+	}
+	return nil
+}
 
-			case 'y':
-				s.yankselectedlines()
-				s.unselectalllines()
-				newmode = normal
+// return the window whose splitter (| or -) to the next window is at (x, y) on the terminal, or nil.
+func (w *window) splitterat(x, y int) *window {
+	for i, child := range w.children {
+		if i != len(w.children)-1 {
+			if w.direction == right && x == child.x+child.width && child.y <= y && y < child.y+child.height {
+				return child
+			}
+			if w.direction == down && y == child.y+child.height && child.x <= x && x < child.x+child.width {
+				return child
 			}
 		}
 
-	default:
-		panic(fmt.Sprintf("cannot handle mode %v", curmode))
+		if found := child.splitterat(x, y); found != nil {
+			return found
+		}
 	}
-
-	s.highlightchangedlines()
-	s.cleanupcursors()
-	return newmode
-}
-
-func (s *screen) String() string {
-	return fmt.Sprintf("scr<%v (%v %v %v %v)>", s.file.Name(), s.term.x, s.term.y, s.width, s.height)
+	return nil
 }
 
-type direction int
-
+// the minimum window size when resized by dragging the splitter
 const (
-	up direction = iota + 1
-	down
-	left
-	right
+	minwinwidth  = 8
+	minwinheight = 2 // a line and the status line
 )
 
-func (d direction) String() string {
-	switch d {
-	case up:
-		return "up"
-	case down:
-		return "down"
-	case left:
-		return "left"
+// move the splitter after w to (x, y) on the terminal, resizing w and the next window.
+func (w *window) dragsplitter(x, y int) {
+	idx := slices.Index(w.parent.children, w)
+	next := w.parent.children[idx+1]
+
+	switch w.parent.direction {
 	case right:
-		return "right"
-	case 0:
-		return "not_set"
-	default:
-		panic("unknown direction")
+		width := min(max(minwinwidth, x-w.x), w.width+next.width-minwinwidth)
+		if width < minwinwidth || width == w.width {
+			return
+		}
+		next.changesize(w.x+width+1, next.y, next.width-(width-w.width), next.height)
+		w.changesize(w.x, w.y, width, w.height)
+
+	case down:
+		height := min(max(minwinheight, y-w.y), w.height+next.height-minwinheight)
+		if height < minwinheight || height == w.height {
+			return
+		}
+		next.changesize(next.x, w.y+height+1, next.width, next.height-(height-w.height))
+		w.changesize(w.x, w.y, w.width, height)
 	}
 }
 
-/* scroll */
-
-func (s *screen) scrollhalf(direction direction) {
-	s.scrolled = true
-	move := (s.height - 1) / 2
-	switch direction {
-	case up:
-		s.yoffset = max(0, s.yoffset-move)
-		s.movecursorsfunc(func(c *cursor) (int, int) {
-			return c.x, max(0, c.y-move)
-		})
-
-	case down:
-		s.yoffset = min(len(s.lines)-1, s.yoffset+move)
-		s.movecursorsfunc(func(c *cursor) (int, int) {
-			return c.x, min(len(s.lines)-1, c.y+move)
-		})
-	default:
-		panic("invalid direction is passed")
+func (w *window) firstleaf() *window {
+	if w.children[0].isleaf() {
+		return w.children[0]
 	}
+	return w.children[0].firstleaf()
 }
 
-/* cursor movement */
+func (w *window) String() string {
+	return w.string(0)
+}
 
-func (s *screen) movecursorsfunc(f func(c *cursor) (int, int)) {
-	for i := range s.cursors {
-		s.movecursorfunc(s.cursors[i], f)
+func (w *window) string(depth int) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("win<%p %v (%v %v %v %v) %p %v>\n", w, w.direction, w.x, w.y, w.width, w.height, w.parent, w.screen))
+	if len(w.children) != 0 {
+		for _, child := range w.children {
+			sb.WriteString(fmt.Sprintf(strings.Repeat("  ", depth+1)+"└ %s", child.string(depth+1)))
+		}
 	}
+	return sb.String()
 }
 
-func (s *screen) movecursorfunc(c *cursor, f func(c *cursor) (int, int)) {
-	cury := c.y
-	s.registerRenderLine(cury)
-	c.x, c.y = f(c)
-	if c.y != cury {
-		s.registerRenderLine(c.y)
+/*
+ * command line parsing
+ */
+
+// parse the line range at the head of the command, then return the lines (0-indexed) and the rest.
+// Supported ranges are:
+//   - (empty): the lines where the cursors are
+//   - %: every line
+//   - '<,'>: the selected lines
+//   - N or N,M: the line N (to M). N and M can be a number, . (current line) or $ (last line).
+func parserange(cmd string, s *screen) ([]int, string, error) {
+	seq := func(from, to int) []int {
+		ys := []int{}
+		for y := from; y <= to; y++ {
+			ys = append(ys, y)
+		}
+		return ys
 	}
-}
 
-func (s *screen) _movecursor(c *cursor, direction direction, cnt int) (int, int) {
-	switch direction {
-	case up:
-		return c.x, max(c.y-cnt, 0)
+	switch {
+	case strings.HasPrefix(cmd, "%"):
+		return seq(0, len(s.lines)-1), cmd[1:], nil
 
-	case down:
-		return c.x, min(c.y+cnt, len(s.lines)-1)
+	case strings.HasPrefix(cmd, "'<,'>"):
+		return s.selectedlines(), cmd[len("'<,'>"):], nil
+	}
 
-	case left:
-		nextx := s.xidx(c) - cnt
-		if 0 <= nextx {
-			// move left if possible
-			return s.curline(c).widthto(nextx), c.y
-		}
+	// returns -1 if no address found
+	parseaddr := func(cmd string) (int, string, error) {
+		switch {
+		case strings.HasPrefix(cmd, "."):
+			return s.cursors[len(s.cursors)-1].y, cmd[1:], nil
 
-		// if no chars at leftside, move to above line tail
-		if c.y == 0 {
-			// if already at the top line, do nothing.
-			return c.x, c.y
+		case strings.HasPrefix(cmd, "$"):
+			return len(s.lines) - 1, cmd[1:], nil
 		}
-		return s.lines[c.y-1].width(), c.y - 1
 
-	case right:
-		nextx := s.xidx(c) + cnt
-		if nextx < s.curline(c).length() {
-			// move right if possible
-			return s.curline(c).widthto(nextx), c.y
+		i := 0
+		for i < len(cmd) && '0' <= cmd[i] && cmd[i] <= '9' {
+			i++
+		}
+		if i == 0 {
+			return -1, cmd, nil
 		}
 
-		// if no chars at rightside, move to below line head
-		if c.y == len(s.lines)-1 {
-			// if already at the bottom line, do nothing.
-			return c.x, c.y
+		n, _ := strconv.Atoi(cmd[:i])
+		if n < 1 || len(s.lines) < n {
+			return 0, "", fmt.Errorf("invalid range: %v", n)
 		}
-		return 0, c.y + 1
+		return n - 1, cmd[i:], nil
+	}
 
-	default:
-		panic("invalid direction is passed")
+	from, rest, err := parseaddr(cmd)
+	if err != nil {
+		return nil, "", err
+	}
+	if from == -1 {
+		return s.cursorlines(), cmd, nil
 	}
-}
 
-func (s *screen) movecursors(direction direction, cnt int) {
-	s.movecursorsfunc(func(c *cursor) (int, int) {
-		return s._movecursor(c, direction, cnt)
-	})
-}
+	if !strings.HasPrefix(rest, ",") {
+		return []int{from}, rest, nil
+	}
 
-func (s *screen) movecursor(c *cursor, direction direction, cnt int) {
-	s.movecursorfunc(c, func(c *cursor) (int, int) {
-		return s._movecursor(c, direction, cnt)
-	})
+	to, rest, err := parseaddr(rest[1:])
+	if err != nil {
+		return nil, "", err
+	}
+	if to == -1 {
+		return nil, "", fmt.Errorf("invalid range")
+	}
+	if to < from {
+		from, to = to, from
+	}
+	return seq(from, to), rest, nil
 }
 
-func (s *screen) movecursorstonextch(ch *character) {
-	s.movecursorsfunc(func(c *cursor) (int, int) {
-		line := s.curline(c)
-		newx := c.x
-		for i := s.xidx(c) + 1; i < line.length(); i++ {
-			if line.buffer[i].equal(ch) {
-				newx = line.widthto(i)
-				break
+// parse the substitute command body like "s/pat/repl/flags".
+// In the pattern and the replacement, the delimiter can be escaped by backslash.
+// In the replacement, \n is a newline, \t is a tab, and $1 or ${name} refers the capture group.
+func parsesubstitute(cmd string) (*substitution, error) {
+	if !strings.HasPrefix(cmd, "s") || len(cmd) < 2 {
+		return nil, fmt.Errorf("unknown command!")
+	}
+
+	delim, _ := utf8.DecodeRuneInString(cmd[1:])
+	if delim == '\\' || unicode.IsLetter(delim) || unicode.IsDigit(delim) || unicode.IsSpace(delim) {
+		return nil, fmt.Errorf("unknown command!")
+	}
+
+	// split the body by the delimiter
+	parts := []string{""}
+	escaped := false
+	for _, r := range cmd[1+utf8.RuneLen(delim):] {
+		last := len(parts) - 1
+		switch {
+		case escaped:
+			escaped = false
+			if r != delim {
+				parts[last] += "\\"
 			}
+			parts[last] += string(r)
+		case r == '\\':
+			escaped = true
+		case r == delim && len(parts) < 3:
+			parts = append(parts, "")
+		default:
+			parts[last] += string(r)
 		}
-		// if ch is not found, newx is still the original x, so not moved
-		return newx, c.y
-	})
-}
+	}
+	if escaped {
+		parts[len(parts)-1] += "\\"
+	}
 
-func (s *screen) movecursorstoprevch(ch *character) {
-	s.movecursorsfunc(func(c *cursor) (int, int) {
-		line := s.curline(c)
-		newx := c.x
-		for i := s.xidx(c) - 1; 0 <= i; i-- {
-			if line.buffer[i].equal(ch) {
-				newx = line.widthto(i)
-				break
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("replacement is not specified")
+	}
+
+	re, err := regexp.Compile(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %v", err)
+	}
+
+	sub := &substitution{
+		re:   re,
+		repl: strings.NewReplacer("\\n", "\n", "\\t", "\t", "\\\\", "\\").Replace(parts[1]),
+	}
+
+	if len(parts) == 3 {
+		for _, flag := range parts[2] {
+			switch flag {
+			case 'g':
+				sub.global = true
+			case 'c':
+				sub.confirm = true
+			default:
+				return nil, fmt.Errorf("unknown flag: %v", string(flag))
 			}
 		}
-		// if ch is not found, newx is still the original x, so not moved
-		return newx, c.y
-	})
-}
+	}
 
-func (s *screen) movecursorstotopleft() {
-	s.movecursorsfunc(func(c *cursor) (int, int) {
-		return 0, 0
-	})
+	return sub, nil
 }
 
-func (s *screen) movecursorstobottomleft() {
-	s.movecursorsfunc(func(c *cursor) (int, int) {
-		return 0, len(s.lines) - 1
-	})
-}
+/*
+ * editor
+ */
 
-func (s *screen) movecursorstolinebottom() {
-	s.movecursorsfunc(func(c *cursor) (int, int) {
-		return s.curline(c).width() - 1, c.y
-	})
+type editor struct {
+	term               *screenterm
+	theme              *theme
+	backup             bool
+	register           *register
+	buffers            []*buffer
+	lastbufferid       int
+	rootwin            *window
+	activewin          *window
+	windowchanged      bool
+	jumpedwindowbefore *window
+	jumpedwindowafter  *window
+	width              int
+	height             int
+	mode               mode
+	cmdline            *line
+	cmdx               int
+	searchbackward     bool
+	msg                *line
+	errmsg             *line
+	msglines           []*line // multi-line message shown over the windows until the next input
+
+	// the screen asking how to handle the swap file found on open, and the swap file
+	swapscreen *screen
+	swap       *swap
+
+	// the inputs of the last change to be repeated by ".",
+	// and the inputs of the change being made in insert mode
+	lastchange []*input
+	changing   []*input
+
+	// the register name and the inputs of the macro being recorded by "q"
+	recording string
+	macro     []*input
+	// the last macro played by "@", and the macros being played to prevent the recursion
+	lastmacro string
+	playing   []string
+	// the depth of replaying the inputs by "." or "@". The replayed inputs are not recorded.
+	replaying int
+
+	// the inputs read ahead while handling the previous input, to be handled next
+	readahead []*input
+
+	// the results of parsing Go in the background. nil if the semantic highlighting is disabled.
+	semanticresults chan *semanticresult
+
+	// true when Ctrl-z is typed to suspend the editor
+	suspending bool
+
+	// the window where the mouse button is pressed to select by dragging,
+	// or the window whose splitter is being dragged
+	mousewin      *window
+	mousesplitter *window
 }
 
-func (s *screen) movecursorstononspacelinehead() {
-	s.movecursorsfunc(func(c *cursor) (int, int) {
-		x := 0
-		curline := s.curline(c)
-		for i := range curline.buffer {
-			if !curline.buffer[i].isspace() {
-				break
-			}
-			x += curline.buffer[i].width
-		}
-		return x, c.y
-	})
+func (e *editor) changemode(mode mode) {
+	e.mode = mode
 }
 
-func (s *screen) movecursorstolinehead() {
-	s.movecursorsfunc(func(c *cursor) (int, int) {
-		return 0, c.y
-	})
+func (e *editor) vsplit(filename string) {
+	e.split(filename, right)
 }
 
-func (s *screen) movecursorstoline(line int) {
-	if len(s.lines) < line {
-		line = len(s.lines)
-	}
-
-	s.movecursorsfunc(func(c *cursor) (int, int) {
-		return 0, line - 1
-	})
+func (e *editor) hsplit(filename string) {
+	e.split(filename, down)
 }
 
-/* cursor manipulation */
+func (e *editor) split(filename string, direction direction) {
+	if direction != down && direction != right {
+		panic("unexpected direction to split")
+	}
 
-func (s *screen) shiftcursors(direction direction, from, amount int) {
-	for i := from; i < len(s.cursors); i++ {
-		s.registerRenderLine(s.cursors[i].y)
-		switch direction {
-		case up:
-			s.cursors[i].y -= amount
-		case down:
-			s.cursors[i].y += amount
-		default:
-			panic("invalid direction passed")
-		}
-		s.registerRenderLine(s.cursors[i].y)
+	buffer, opened, err := e.openbuffer(filename)
+	if err != nil {
+		e.errmsg = newline(err.Error())
+		e.changemode(normal)
+		return
 	}
-}
 
-func (s *screen) addcursorbelow() {
-	lastcursor := s.cursors[len(s.cursors)-1]
-	for i := lastcursor.y + 1; i < len(s.lines); i++ {
-		if lastcursor.x < s.lines[i].width() {
-			s.cursors = append(s.cursors, &cursor{x: lastcursor.x, y: i, actualx: lastcursor.actualx})
-			s.registerRenderLine(i)
-			break
-		}
+	e.activewin.screen.unfocus()
+	e.activewin = e.activewin.split(e.term.term, direction, buffer, e.register)
+	e.activewin.screen.focus()
+	e.windowchanged = true
+	if opened {
+		e.checkswap(e.activewin.screen)
 	}
 }
 
-func (s *screen) deletecursors() {
-	for i, c := range s.cursors {
-		if i == len(s.cursors)-1 {
-			break
-		}
-		s.registerRenderLine(c.y)
+/* buffer list */
+
+// return the buffer of the file, opening the file if no buffer has it yet.
+// opened reports whether the file is newly opened.
+func (e *editor) openbuffer(filename string) (buffer *buffer, opened bool, err error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, false, fmt.Errorf("file not found: '%v'", filename)
 	}
-	s.cursors = slices.Delete(s.cursors, 0, len(s.cursors)-1)
-}
 
-/* selection */
+	for _, b := range e.buffers {
+		if binfo, err := os.Stat(b.file.Name()); err == nil && os.SameFile(info, binfo) {
+			return b, false, nil
+		}
+	}
 
-func (s *screen) selectline() {
-	for _, c := range s.cursors {
-		switch sl := c.selection.(type) {
-		case *lineselection:
-			sl.lines = append(sl.lines, c.y)
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot open: '%v'", filename)
+	}
 
-		case *charsselection:
-			c.selection = &lineselection{lines: []int{c.y}}
+	return e.addbuffer(file), true, nil
+}
 
-		default:
-			c.selection = &lineselection{lines: []int{c.y}}
-		}
+func (e *editor) addbuffer(file file) *buffer {
+	e.lastbufferid++
+	b := newbuffer(e.lastbufferid, file, e.theme, e.semanticresults)
+	e.buffers = append(e.buffers, b)
+	return b
+}
 
-		// when selecting a line, move cursor to line tail
-		s.movecursorfunc(c, func(c *cursor) (int, int) {
-			return s.curline(c).width() - 1, c.y
-		})
+// open the file in the active window. The buffer shown before is kept hidden even if it has unsaved changes.
+func (e *editor) edit(filename string) {
+	buffer, opened, err := e.openbuffer(filename)
+	if err != nil {
+		e.errmsg = newline(err.Error())
+		return
+	}
 
-		s.linestoberendered = append(s.linestoberendered, c.y)
+	e.showbuffer(buffer)
+	if opened {
+		e.checkswap(e.activewin.screen)
 	}
 }
 
-func (s *screen) moveandselectline(direction direction, cnt int) {
-	for _, c := range s.cursors {
-		// move to above/below line
-		s.movecursor(c, direction, cnt)
-		// move to line tail
-		s.movecursorfunc(c, func(c *cursor) (int, int) {
-			return s.curline(c).width() - 1, c.y
-		})
-		sl := c.selection.(*lineselection)
-		sl.lines = append(sl.lines, c.y)
+// show the buffer in the active window.
+func (e *editor) showbuffer(buffer *buffer) {
+	w := e.activewin
+	if w.screen.buffer == buffer {
+		return
 	}
+
+	w.screen.buffer.detach(w.screen)
+	w.screen = newscreen(e.term.term, w.x, w.y, w.width, w.height, buffer, e.register, true)
+	e.windowchanged = true
 }
 
-func (s *screen) unselectalllines() {
-	for _, c := range s.cursors {
-		sl := c.selection.(*lineselection)
-		for _, l := range sl.lines {
-			s.registerRenderLine(l)
+// show the n-th next buffer in the list on the active window. Negative n means previous.
+func (e *editor) cyclebuffer(n int) {
+	idx := slices.Index(e.buffers, e.activewin.screen.buffer)
+	l := len(e.buffers)
+	e.showbuffer(e.buffers[((idx+n)%l+l)%l])
+}
+
+func (e *editor) switchbuffer(id string) {
+	for _, b := range e.buffers {
+		if strconv.Itoa(b.id) == id {
+			e.showbuffer(b)
+			return
 		}
-		c.selection = nil
 	}
+
+	e.errmsg = newline(fmt.Sprintf("buffer not found: %v", id))
 }
 
-func (s *screen) yankselectedlines() {
-	for i, c := range s.cursors {
-		sl := c.selection.(*lineselection)
-		lines := make([]*line, len(sl.lines))
-		for i := range sl.lines {
-			lines[i] = s.lines[sl.lines[i]].copy()
+// show the buffer list, like:
+//
+//	1 %a   "main.go"
+//	2  h + "README.md"
+//
+// "%" is the buffer in the active window, "a" is shown in some window, "h" is hidden, "+" has unsaved changes.
+func (e *editor) showbuffers() {
+	lines := []*line{newline("--- buffers ---")}
+	for _, b := range e.buffers {
+		current := " "
+		if b == e.activewin.screen.buffer {
+			current = "%"
+		}
+		state := "h"
+		if len(b.views) != 0 {
+			state = "a"
 		}
-		s.register.set(i, "\"", &regtext{typ: regtext_lines, lines: lines})
+		modified := " "
+		if b.dirty {
+			modified = "+"
+		}
+		lines = append(lines, newline(fmt.Sprintf("%3d %v%v %v \"%v\"", b.id, current, state, modified, b.file.Name())))
 	}
-}
 
-/* text modification */
+	e.showlines(lines)
+}
 
-func (s *screen) insertcharsatcursors(chars []*character) {
-	for _, c := range s.cursors {
-		s.alignx(c)
-		s.curline(c).inschars(chars, s.xidx(c))
-		s.movecursors(right, len(chars))
-		s.registerRenderLine(c.y)
+// forget the closed screen. The buffer no longer shown anywhere is closed.
+func (e *editor) dropscreen(s *screen) {
+	s.buffer.detach(s)
+	if len(s.buffer.views) != 0 {
+		return
 	}
+
+	s.buffer.close()
+	e.buffers = slices.DeleteFunc(e.buffers, func(b *buffer) bool { return b == s.buffer })
 }
 
-func (s *screen) deleteselections() {
-	for i, c := range s.cursors {
-		if s.atlinetail(c) && c.y+1 < len(s.lines) {
-			// when removing nl, concat current and next line
-			s.joinlines(c.y, c.y+1)
-			s.shiftcursors(up, i+1, 1)
-		} else {
-			s.curline(c).delchar(s.xidx(c))
-			s.dirty = true
-			s.registerRenderLine(c.y)
+func (e *editor) jumpwin(direction direction) {
+	// cursor
+	x, y := e.activewin.actualcursor()
+	leaves := e.rootwin.getallleaves()
+
+	var candidate *window
+	for _, leaf := range leaves {
+		if leaf == e.activewin {
+			continue
 		}
-	}
-}
 
-func (s *screen) deletecursorprevchar() {
-	for i, c := range s.cursors {
-		switch s.xidx(c) {
-		case 0:
-			if c.y != 0 {
-				s.registerRenderLineAfter(c.y)
-				// join current and above line
-				// next x is right edge on the above line
-				nextx := s.lines[c.y-1].width() - 1
-				s.joinlines(c.y-1, c.y)
-				s.movecursor(c, up, 1)
-				c.x = nextx
-				s.shiftcursors(up, i, 1)
+		switch direction {
+		case left:
+			if x < leaf.x || y < leaf.y || leaf.y+leaf.height < y {
+				continue
 			}
 
-		default:
-			// just delete the char
+			if candidate == nil || candidate.x < leaf.x {
+				candidate = leaf
+			}
 
-			// move cursor before deleting char to prevent
-			// the cursor points nowhere after deleting the rightmost char.
-			s.movecursor(c, left, 1)
-			s.curline(c).delchar(s.xidx(c) - 1)
-			s.registerRenderLine(c.y)
-		}
-	}
-}
+		case right:
+			if leaf.x+leaf.width < x || y < leaf.y || leaf.y+leaf.height < y {
+				continue
+			}
 
-func (s *screen) insertlinefromcursors(direction direction) {
-	for i, c := range s.cursors {
-		s.insline(c, direction)
-		s.shiftcursors(down, i+1, 1)
-		s.movecursor(c, direction, 1)
-	}
-}
+			if candidate == nil || leaf.x < candidate.x {
+				candidate = leaf
+			}
 
-func (s *screen) insline(c *cursor, direction direction) {
-	switch direction {
-	case up:
-		s.lines = slices.Insert(s.lines, c.y, newemptyline())
-		s.lineattrs = slices.Insert(s.lineattrs, c.y, &lineattribute{})
-	case down:
-		s.lines = slices.Insert(s.lines, c.y+1, newemptyline())
-		s.lineattrs = slices.Insert(s.lineattrs, c.y+1, &lineattribute{})
-	default:
-		panic("invalid direction is passed")
-	}
+		case up:
+			if y < leaf.y || x < leaf.x || leaf.x+leaf.width < x {
+				continue
+			}
 
-	s.registerRenderLineAfter(c.y)
-	s.dirty = true
-	s.updatelinenumberwidth()
-}
+			if candidate == nil || candidate.y < leaf.y {
+				candidate = leaf
+			}
 
-func (s *screen) delline(y int) {
-	s.registerRenderLineAfter(y)
-	s.lines = slices.Delete(s.lines, y, y+1)
-	s.lineattrs = slices.Delete(s.lineattrs, y, y+1)
-	s.updatelinenumberwidth()
-}
+		case down:
+			if leaf.y+leaf.height < y || x < leaf.x || leaf.x+leaf.width < x {
+				continue
+			}
 
-func (s *screen) replacecursorchar(ch *character) {
-	for _, c := range s.cursors {
-		s.curline(c).replacech(ch, s.xidx(c))
-		s.registerRenderLine(c.y)
+			if candidate == nil || leaf.y < candidate.y {
+				candidate = leaf
+			}
+		}
 	}
-	s.dirty = true
-}
 
-// from, to both inclusive
-func (s *screen) joinlines(from, to int) {
-	// first, append lines to the base line
-	for i := from + 1; i <= to; i++ {
-		s.lines[from].delnl()
-		s.lines[from].buffer = append(s.lines[from].buffer, s.lines[i].buffer...)
+	if candidate == nil {
+		return
 	}
 
-	// then, delete joined lines
-	for i := from + 1; i <= to; i++ {
-		s.delline(i)
-	}
+	e.focuswin(candidate)
+}
 
-	s.registerRenderLineAfter(from)
-	s.dirty = true
-	s.updatelinenumberwidth()
+func (e *editor) focuswin(w *window) {
+	e.jumpedwindowbefore = e.activewin
+	e.activewin.screen.unfocus()
+	e.activewin = w
+	e.jumpedwindowafter = e.activewin
+	e.activewin.screen.focus()
 }
 
-func (s *screen) splitcursorsline() {
-	for i, c := range s.cursors {
-		s.registerRenderLineAfter(c.y)
+/* mouse */
+
+// the number of lines scrolled by a wheel step
+const wheelscroll = 3
 
-		curline := s.curline(c).copy()
-		nextline := s.curline(c).copy()
-		curidx := s.xidx(c)
+func (e *editor) handlemouse(in *input) {
+	switch in.special {
+	case _wheelup, _wheeldown:
+		w := e.rootwin.windowat(in.x, in.y)
+		if w == nil {
+			return
+		}
 
-		s.curline(c).clear()
-		s.curline(c).inschars(curline.buffer[:curidx], 0)
+		if in.special == _wheelup {
+			w.screen.scroll(up, wheelscroll)
+		} else {
+			w.screen.scroll(down, wheelscroll)
+		}
+		if w != e.activewin {
+			e.windowchanged = true
+		}
 
-		s.insline(c, down)
-		s.movecursor(c, down, 1)
-		s.curline(c).inschars(nextline.buffer[curidx:len(nextline.buffer)-1], 0)
-		c.x = 0
+	case _mousepress:
+		e.mousewin, e.mousesplitter = nil, nil
+		if e.mode == command || e.mode == search {
+			return
+		}
 
-		s.shiftcursors(down, i+1, 1)
-	}
-	s.dirty = true
-}
+		if sp := e.rootwin.splitterat(in.x, in.y); sp != nil {
+			e.mousesplitter = sp
+			return
+		}
 
-func (s *screen) pastefromcursors() {
-	for i, c := range s.cursors {
-		txt, ok := s.register.get(i, "\"")
-		if !ok {
-			break
+		w := e.rootwin.windowat(in.x, in.y)
+		if w == nil {
+			return
 		}
 
-		if txt.typ == regtext_lines {
-			for i := range txt.lines {
-				s.insline(c, down)
-				s.movecursor(c, down, 1)
-				s.lines[c.y] = txt.lines[i]
-				c.x = s.lines[c.y].width() - 1
-				s.registerRenderLine(c.y)
-				s.shiftcursors(down, i+1, 1)
-			}
-		} else {
+		// the click finishes the selection, and the insert mode in the other window
+		if e.mode == lineselect || e.mode == charselect || (e.mode == insert && w != e.activewin) {
+			e.replay([]*input{{special: _esc}})
+		}
 
+		if w != e.activewin {
+			e.focuswin(w)
 		}
-	}
-	s.dirty = true
-}
 
-/* helpers */
+		// the status line
+		if in.y-w.y == w.height-1 {
+			return
+		}
 
-func (s *screen) atlinetail(c *cursor) bool {
-	return s.xidx(c) == s.curline(c).length()-1
-}
+		if in.mod&mod_alt != 0 && e.mode == normal {
+			w.screen.addcursorat(in.x-w.x, in.y-w.y)
+			return
+		}
 
-// return x character index from the current cursor position on screen
-func (s *screen) xidx(c *cursor) int {
-	return s.curline(c).charidx(c.actualx-s.linenumberwidth-1, s.xoffset)
-}
+		w.screen.putcursorat(in.x-w.x, in.y-w.y)
+		e.mousewin = w
 
-// ensure current s.x is pointing on the correct character position.
-// if x is too right after up/down move, fix x position.
-// if x is not aligning to the multi length character head, align there.
-func (s *screen) alignx(c *cursor) {
-	c.x = s.curline(c).widthto(s.xidx(c))
-}
+	case _mousedrag:
+		if e.mousesplitter != nil {
+			e.mousesplitter.dragsplitter(in.x, in.y)
+			e.windowchanged = true
+			return
+		}
 
-func (s *screen) registerRenderLine(y int) {
-	s.linestoberendered = append(s.linestoberendered, y)
-}
+		if e.mousewin != e.activewin || (e.mode != normal && e.mode != charselect) {
+			return
+		}
 
-func (s *screen) registerRenderLineAfter(after int) {
-	for i := after; i < len(s.lines); i++ {
-		s.linestoberendered = append(s.linestoberendered, i)
+		s := e.activewin.screen
+		x, y := s.textpos(in.x-e.activewin.x, in.y-e.activewin.y)
+		if e.mode == normal {
+			if c := s.cursors[0]; c.x == x && c.y == y {
+				return
+			}
+			s.selectchars()
+			e.changemode(charselect)
+		}
+		s.movecursorsfunc(func(c *cursor) (int, int) {
+			return x, y
+		})
+		s.updatecharsselections()
+
+	case _mouserelease:
+		e.mousewin, e.mousesplitter = nil, nil
 	}
 }
 
-/* file persistence */
+func (e *editor) closewin() {
+	s := e.activewin.screen
 
-func (s *screen) content() []byte {
-	buf := []byte{}
-	for _, line := range s.lines {
-		for _, ch := range line.buffer {
-			switch {
-			case ch.tab:
-				buf = append(buf, '\t')
-			case ch.nl:
-				buf = append(buf, '\n')
-			default:
-				buf = append(buf, []byte(string(ch.r))...)
+	// the change is lost if no other window shows the buffer
+	if s.dirty && len(s.views) == 1 {
+		e.errmsg = newline(fmt.Sprintf("unsaved change remaining: '%v'", s.file.Name()))
+		return
+	}
+
+	// closing the last window finishes the editor, hidden buffers must be saved too
+	if e.activewin.isroot() {
+		for _, b := range e.buffers {
+			if b.dirty {
+				e.errmsg = newline(fmt.Sprintf("unsaved change remaining: '%v'", b.file.Name()))
+				return
 			}
 		}
 	}
-	return buf
+
+	s.unfocus()
+	e.activewin = e.activewin.close()
+	e.dropscreen(s)
+	if e.activewin != nil {
+		e.activewin.screen.focus()
+	}
+	e.windowchanged = true
 }
 
-func (s *screen) save() {
-	content := s.content()
-	s.file.Truncate(0)
-	s.file.Seek(0, 0)
-	_, err := s.file.Write([]byte(content))
-	if err != nil {
-		panic(err)
-	}
-	s.dirty = false
+func (e *editor) closewinforce() {
+	s := e.activewin.screen
+	e.activewin = e.activewin.close()
+	e.dropscreen(s)
+	e.windowchanged = true
 }
 
-/*
- * window
- */
+func (e *editor) movecmdcursor(direction direction) {
+	switch direction {
+	case left:
+		nextx := max(0, e.cmdxidx()-1)
+		e.cmdx = e.cmdline.widthto(nextx)
+	case right:
+		nextx := min(e.cmdline.length()-1, e.cmdxidx()+1)
+		e.cmdx = e.cmdline.widthto(nextx)
+	default:
+		panic("invalid direction is passed")
+	}
+}
 
-type window struct {
-	x         int
-	y         int
-	width     int
-	height    int
-	parent    *window
-	children  []*window
-	screen    *screen
-	direction direction // down or right
+func (e *editor) cmdxidx() int {
+	return e.cmdline.charidx(e.cmdx, 0)
 }
 
-func newleafwindow(term terminal, x, y, width, height int, file file, theme *theme) *window {
-	return &window{
-		x:      x,
-		y:      y,
-		width:  width,
-		height: height,
-		screen: newscreen(term, x, y, width, height, file, theme, false),
+func (e *editor) commandline() *line {
+	switch e.mode {
+	case command:
+		return newline(fmt.Sprintf(":%v", e.cmdline))
+	case search:
+		if e.searchbackward {
+			return newline(fmt.Sprintf("?%v", e.cmdline))
+		}
+		return newline(fmt.Sprintf("/%v", e.cmdline))
+	default:
+		return newemptyline()
 	}
 }
 
-func (w *window) isroot() bool {
-	return w.parent == nil
-}
+// edit the command line by the input. It returns false if the input is not for editing.
+func (e *editor) editcmdline(buff *input) bool {
+	switch buff.special {
+	case _left:
+		e.movecmdcursor(left)
 
-func (w *window) isleaf() bool {
-	return len(w.children) == 0
-}
+	case _right:
+		e.movecmdcursor(right)
 
-func (w *window) split(term terminal, direction direction, file file, theme *theme) *window {
-	// when the given directions is the same with parent window, add new window as sibling of w.
-	if w.parent != nil && w.parent.direction == direction {
-		return w.parent.inschildafter(w, term, file, theme)
-	}
+	case _bs:
+		if 0 < e.cmdx {
+			e.movecmdcursor(left)
+			e.cmdline.delchar(e.cmdxidx())
+		}
 
-	// when no parent exists (= w is root) or exists but direction is different,
-	// make the leaf window w to inner window, then add new window as child.
-	w.toinner(direction)
-	return w.inschildafter(w.children[0], term, file, theme)
-}
+	case _not_special_key:
+		e.cmdline.inschars([]*character{newcharacter(buff.r)}, e.cmdxidx())
+		e.movecmdcursor(right)
 
-func (w *window) toinner(direction direction) {
-	// make leaf node to inner node
-	if !w.isleaf() {
-		panic("toinner is called on non-leaf window")
+	case _paste:
+		// the command line is a single line
+		text, _, _ := strings.Cut(buff.text, "\n")
+		chars := newcharacters(text)
+		idx := e.cmdxidx()
+		e.cmdline.inschars(chars, idx)
+		e.cmdx = e.cmdline.widthto(idx + len(chars))
+
+	default:
+		return false
 	}
 
-	w.direction = direction
-	w.children = []*window{{parent: w, screen: w.screen}}
-	w.screen = nil
+	return true
 }
 
-func (w *window) inschildafter(after *window, term terminal, file file, theme *theme) *window {
-	// insert a child node after $after then do resize.
-	newwin := newleafwindow(term, 0, 0, 0, 0, file, theme)
-	newwin.parent = w
-	idx := slices.Index(w.children, after)
-	if idx == -1 {
-		panic("cannot find a given child node in the children")
-	}
-
-	w.children = slices.Insert(w.children, idx+1, newwin)
-	w.resizechildren()
-	return newwin
+func (e *editor) startsearch(backward bool) {
+	e.searchbackward = backward
+	e.activewin.screen.beginsearch()
+	e.changemode(search)
 }
 
-func (w *window) resizechildren() {
-	// divide the $total into $count items so that they are all the same length
-	// as much as possible. This considers splitter sign (| or -).
-	//
-	// suppose total is 30, count is 4, then
-	//    7   |   7   |   7   |   6   (7 + 7 + 7 + 6 + 3(splitter) = 30)
-	// AAAAAAA|BBBBBBB|CCCCCCC|DDDDDD
-	// is expected (| sign is window splitter).
-	f := func(total, count int) []int {
-		total -= count - 1
-		result := make([]int, count)
-		for i := range count {
-			_mod := total % (count - i)
-			_div := total / (count - i)
-			if _mod == 0 {
-				result[i] = _div
-				total -= _div
-			} else {
-				result[i] = _div + 1
-				total -= _div + 1
+func (e *editor) render(first bool) {
+	// to prevent cursor flickering
+	e.term.flush()
+
+	/* update command line */
+	e.term.clearline(e.height - 1)
+	if !e.errmsg.empty() {
+		red := slices.Repeat([]int{e.theme.colorerror}, len(e.errmsg.buffer))
+		e.term.write([]byte(e.errmsg.cutandcolorize(0, e.width, red, []int{}, []int{})))
+	} else if !e.msg.empty() {
+		e.term.write([]byte(e.msg.cutandcolorize(0, e.width, []int{}, []int{}, []int{})))
+	} else if e.mode == command || e.mode == search {
+		cursor := []int{e.cmdx + 1}
+		cl := e.commandline()
+		cl.delnl()
+		e.term.write([]byte(cl.cutandcolorize(0, e.width, []int{}, []int{}, cursor)))
+	} else if e.recording != "" {
+		e.term.write([]byte(newline("recording @"+e.recording).cutandcolorize(0, e.width, []int{}, []int{}, []int{})))
+	}
+
+	if e.windowchanged {
+		e.rootwin.render(e.term, true)
+		e.activewin.screen.render(first)
+	} else if e.jumpedwindowbefore != nil {
+		// force re-render to apply status line and cursor visibility
+		e.jumpedwindowbefore.screen.render(true)
+		e.jumpedwindowafter.screen.render(true)
+	} else {
+		// the other screens showing the same buffer may have the changed lines
+		for _, v := range e.activewin.screen.views {
+			if v != e.activewin.screen {
+				v.render(false)
 			}
 		}
-		return result
+		e.activewin.render(e.term, first)
 	}
 
-	sum := func(ints []int) int {
-		s := 0
-		for i := range ints {
-			s += ints[i]
+	if len(e.msglines) != 0 {
+		// show the last lines if the message is too long
+		lines := e.msglines[max(0, len(e.msglines)-(e.height-1)):]
+		top := e.height - 1 - len(lines)
+		for i, l := range lines {
+			e.term.clearline(top + i)
+			e.term.write([]byte(l.cutandcolorize(0, e.width, []int{}, []int{}, []int{})))
 		}
-		return s
 	}
 
-	switch w.direction {
-	case right:
-		widths := f(w.width, len(w.children))
-		for i := range w.children {
-			w.children[i].changesize(w.x+sum(widths[:i])+1*i, w.y, widths[i], w.height)
-		}
+	e.term.flush()
 
-	case down:
-		heights := f(w.height, len(w.children))
-		for i := range w.children {
-			w.children[i].changesize(w.x, w.y+sum(heights[:i])+1*i, w.width, heights[i])
-		}
+	e.windowchanged = false
+	e.jumpedwindowbefore = nil
+	e.jumpedwindowafter = nil
+}
 
-	default:
-		panic("unexpected split direction")
+// show the multi-line message over the windows. It is dismissed by the next keypress.
+func (e *editor) showlines(lines []*line) {
+	e.msglines = lines
+	e.msg = newline("press any key to continue")
+}
+
+func (e *editor) showregisters() {
+	lines := e.register.list()
+	if len(lines) == 0 {
+		e.msg = newline("no registers")
+		return
 	}
+
+	e.showlines(slices.Concat([]*line{newline("--- registers ---")}, lines))
 }
 
-func (w *window) changesize(x, y, width, height int) {
-	w.x = x
-	w.y = y
-	w.width = width
-	w.height = height
+func (e *editor) resetcmd() {
+	e.cmdline = newcommandline()
+	e.cmdx = 0
 
-	if w.isleaf() {
-		w.screen.width = width
-		w.screen.height = height
-		w.screen.term.x = x
-		w.screen.term.y = y
-		w.screen.term.width = width
-	} else {
-		// when parent node size is changed, children size must be changed accordingly
-		w.resizechildren()
+	// the command might be typed from the selection mode
+	if e.activewin != nil {
+		e.activewin.screen.unselectall()
 	}
 }
 
-func (w *window) render(term *screenterm, first bool) {
-	if w.isleaf() {
-		w.screen.render(first)
+// run the command line which is not a fixed command, like ":%s/a/b/g".
+func (e *editor) runcmd(cmd string, stream *inputstream) {
+	scr := e.activewin.screen
+	ys, rest, err := parserange(cmd, scr)
+	if err != nil {
+		e.errmsg = newline(err.Error())
 		return
 	}
 
-	for i, child := range w.children {
-		child.render(term, first)
+	sub, err := parsesubstitute(rest)
+	if err != nil {
+		e.errmsg = newline(err.Error())
+		return
+	}
 
-		// add splitter line on non last window
-		if i != len(w.children)-1 {
-			if w.direction == right {
-				for j := range child.height {
-					term.putcursor(child.x+child.width, child.y+j)
-					term.write([]byte("|"))
-				}
-			} else {
-				for j := range child.width {
-					term.putcursor(child.x+j, child.y+child.height)
-					term.write([]byte("-"))
-				}
+	// the selection is not needed anymore after the lines are resolved
+	scr.unselectall()
+
+	// the cursors are put back after each answer, so they stay where they were after the command
+	cursors := copycursors(scr.cursors)
+	ask := func(y, from, to int) rune {
+		// show the match as selected by the single cursor. The empty match is shown on the character at it.
+		scr.restorecursors([]*cursor{{x: scr.lines[y].widthto(from), y: y}})
+		scr.cursors[0].selection = &charsselection{startx: from, starty: y, endx: max(from, to-1), endy: y}
+		e.msg = newline(fmt.Sprintf("replace with '%v'? (y/n/a/q)", sub.repl))
+		e.render(false)
+		defer func() {
+			scr.unselectall()
+			scr.restorecursors(cursors)
+		}()
+
+		for {
+			in := stream.next()
+			if in.special == _esc {
+				return 'q'
+			}
+			if slices.Contains([]rune{'y', 'n', 'a', 'q'}, in.r) {
+				return in.r
 			}
 		}
 	}
-}
 
-func (w *window) actualcursor() (int, int) {
-	return w.x + w.screen.cursors[0].actualx, w.y + w.screen.cursors[0].y - w.screen.yoffset
+	found := slices.ContainsFunc(ys, func(y int) bool {
+		return len(scr.lines[y].allmatches(sub.re)) != 0
+	})
+	if !found {
+		e.errmsg = newline(fmt.Sprintf("pattern not found: %v", sub.re))
+		return
+	}
+
+	cnt, linecnt := scr.substitute(ys, sub, ask)
+
+	e.msg = newline(fmt.Sprintf("%v substitutions on %v lines", cnt, linecnt))
 }
 
-func (w *window) getallleaves() []*window {
-	if w.isleaf() {
-		return []*window{w}
-	}
+/* swap file */
 
-	leaves := []*window{}
-	for _, child := range w.children {
-		if w.isleaf() {
-			leaves = append(leaves, child)
-			continue
+// ask how to handle the swap file if it is left for the screen.
+func (e *editor) checkswap(s *screen) {
+	sw, err := readswap(swapname(s.file.Name()))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			e.errmsg = newline(fmt.Sprintf("cannot read swap file: %v", err))
 		}
-
-		leaves = append(leaves, child.getallleaves()...)
+		return
 	}
 
-	return leaves
+	e.swapscreen = s
+	e.swap = sw
+	e.promptswap(nil)
 }
 
-func (w *window) close() *window {
-	if w.isroot() {
-		w.screen.file.Close()
-		return nil
+func (e *editor) promptswap(detail []string) {
+	// another editor might be editing the file now
+	running := ""
+	if processrunning(e.swap.pid) {
+		running = " (still running)"
 	}
 
-	parent := w.parent
-	w.screen.file.Close()
-	next := w.parent.removechild(w)
-	if len(parent.children) != 1 {
-		return next
+	lines := []*line{
+		newline("--- swap file found ---"),
+		newline(fmt.Sprintf("  %v", e.swap.name)),
+		newline(fmt.Sprintf("  written by pid %v%v at %v", e.swap.pid, running, e.swap.modtime.Format(time.DateTime))),
 	}
 
-	// when only 1 children exists, the tree rebalance is required.
-	parent.toleaf()
-	if parent.isleaf() {
-		return parent
+	choices := []*line{newline("[r]ecover [d]elete [v]iew diff [i]gnore")}
+
+	// keep the choices visible even if the detail is long
+	room := max(0, e.height-1-len(lines)-len(choices))
+	if room < len(detail) {
+		detail = append(detail[:max(0, room-1)], "...")
+	}
+	for _, d := range detail {
+		lines = append(lines, newline(d))
 	}
 
-	return parent.firstleaf()
+	e.msglines = slices.Concat(lines, choices)
+	e.msg = newline("how to handle the swap file? [r/d/v/i]")
+	e.windowchanged = true
 }
 
-func (w *window) toleaf() {
-	w.x = w.children[0].x
-	w.y = w.children[0].y
-	w.width = w.children[0].width
-	w.height = w.children[0].height
-	w.screen = w.children[0].screen
-	w.direction = w.children[0].direction
-	w.children = w.children[0].children // must be at bottom
-	for _, child := range w.children {
-		child.parent = w
-	}
-}
+func (e *editor) answerswap(buff *input) {
+	s := e.swapscreen
+
+	switch {
+	case buff.r == 'r':
+		s.recover(e.swap)
+		e.msg = newline("recovered, save to keep it")
+
+	case buff.r == 'd':
+		if err := os.Remove(e.swap.name); err != nil {
+			e.errmsg = newline(fmt.Sprintf("cannot delete swap file: %v", err))
+		} else {
+			e.msg = newline("swap file deleted")
+		}
+
+	case buff.r == 'v':
+		recovered := &buffer{}
+		recovered.load(e.swap.content)
+
+		current := []string{}
+		for _, l := range s.lines {
+			current = append(current, l.text())
+		}
+		swapped := []string{}
+		for _, l := range recovered.lines {
+			swapped = append(swapped, l.text())
+		}
 
-func (w *window) removechild(child *window) *window {
-	idx := slices.Index(w.children, child)
-	if idx == -1 {
-		panic("cannot find a given child node to remove in the children")
-	}
-	w.children = slices.Delete(w.children, idx, idx+1)
-	w.resizechildren()
+		diff := difflines(current, swapped)
+		if len(diff) == 0 {
+			diff = []string{"(no difference)"}
+		}
+		e.promptswap(diff)
+		return
 
-	idx = max(0, idx-1)
+	case buff.r == 'i', buff.special == _esc:
+		// the swap file is kept for the editor which wrote it, and this one writes another
+		s.swapfile = freeswapname(s.file.Name())
 
-	if w.children[idx].isleaf() {
-		return w.children[idx]
+	default:
+		e.promptswap(nil)
+		return
 	}
 
-	return w.children[idx].firstleaf()
+	e.swapscreen = nil
+	e.swap = nil
+	e.msglines = nil
+	e.windowchanged = true
 }
 
-func (w *window) firstleaf() *window {
-	if w.children[0].isleaf() {
-		return w.children[0]
+// write the swap files of every buffer having unsaved changes.
+func (e *editor) updateswaps() {
+	for _, b := range e.buffers {
+		if err := b.updateswap(); err != nil {
+			e.errmsg = newline(fmt.Sprintf("cannot write swap file: %v", err))
+		}
 	}
-	return w.children[0].firstleaf()
 }
 
-func (w *window) String() string {
-	return w.string(0)
+// close every buffer on finish.
+func (e *editor) close() {
+	for _, b := range e.buffers {
+		b.close()
+	}
+	e.buffers = nil
 }
 
-func (w *window) string(depth int) string {
-	var sb strings.Builder
-	sb.WriteString(fmt.Sprintf("win<%p %v (%v %v %v %v) %p %v>\n", w, w.direction, w.x, w.y, w.width, w.height, w.parent, w.screen))
-	if len(w.children) != 0 {
-		for _, child := range w.children {
-			sb.WriteString(fmt.Sprintf(strings.Repeat("  ", depth+1)+"└ %s", child.string(depth+1)))
+// set the option given like ":set ff=dos".
+func (e *editor) setoption(opt string) {
+	name, value, _ := strings.Cut(opt, "=")
+	switch name {
+	case "ff", "fileformat":
+		if err := e.activewin.screen.setfileformat(value); err != nil {
+			e.errmsg = newline(err.Error())
 		}
+	default:
+		e.errmsg = newline(fmt.Sprintf("unknown option: %v", name))
 	}
-	return sb.String()
 }
 
-/*
- * editor
- */
-
-type editor struct {
-	term               *screenterm
-	theme              *theme
-	rootwin            *window
-	activewin          *window
-	windowchanged      bool
-	jumpedwindowbefore *window
-	jumpedwindowafter  *window
-	width              int
-	height             int
-	mode               mode
-	cmdline            *line
-	cmdx               int
-	msg                *line
-	errmsg             *line
+// save the active screen. It returns false and shows the error if failed.
+func (e *editor) save() bool {
+	if err := e.activewin.screen.save(e.backup); err != nil {
+		e.errmsg = newline(fmt.Sprintf("cannot save: %v", err))
+		return false
+	}
+	return true
 }
 
-func (e *editor) changemode(mode mode) {
-	e.mode = mode
+func (e *editor) resize(width, height int) {
+	e.width = width
+	e.height = height
+	e.term.width = width
+	e.rootwin.changesize(e.rootwin.x, e.rootwin.y, width, height-1)
+	e.windowchanged = true
 }
 
-func (e *editor) vsplit(filename string) {
-	e.split(filename, right)
+func (e *editor) String() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("edt<%v (%v %v %v %v) ':%v' %p>\n", e.mode, e.term.x, e.term.y, e.width, e.height, strings.TrimSuffix(e.cmdline.String(), " "), e.activewin))
+	sb.WriteString(fmt.Sprintf("  └ %v", e.rootwin.string(1)))
+	return sb.String()
 }
 
-func (e *editor) hsplit(filename string) {
-	e.split(filename, down)
+func (e *editor) debug() {
+	debug(2, "%v", e)
 }
 
-func (e *editor) split(filename string, direction direction) {
-	if direction != down && direction != right {
-		panic("unexpected direction to split")
+// handle the input. It returns false when the editor should be finished.
+func (e *editor) handleinput(buff *input, buffchan <-chan *input) (ok bool) {
+	stream := newinputstream(buff, buffchan)
+	// the inputs read ahead while handling the previous input are read first,
+	// and the ones left unread, like the keys typed while waiting for the clipboard, are handled next.
+	stream.pending, e.readahead = e.readahead, nil
+	defer func() {
+		if ok && len(stream.pending) != 0 {
+			e.readahead = stream.pending[1:]
+			ok = e.handleinput(stream.pending[0], buffchan)
+		}
+	}()
+
+	// the mouse events are not recorded into the macro nor repeated
+	if buff.ismouse() {
+		if e.swapscreen == nil && len(e.msglines) == 0 {
+			e.handlemouse(buff)
+			e.render(false)
+		}
+		return true
 	}
 
-	_, err := os.Stat(filename)
-	if err != nil {
-		e.errmsg = newline(fmt.Sprintf("file not found: '%v'", filename))
-		e.changemode(normal)
-		return
+	if buff.special == _clipboard {
+		e.register.setclipboard(buff.text)
+		return true
 	}
-	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		e.errmsg = newline(fmt.Sprintf("cannot open: '%v'", filename))
-		e.changemode(normal)
-		return
+
+	// nothing is bound to Alt + character. The terminal sends it as Esc followed by the character,
+	// so it is handled as they are typed separately, like leaving insert mode by Alt + j then moving down.
+	if buff.special == _not_special_key && buff.mod&mod_alt != 0 {
+		stream.pending = append([]*input{{r: buff.r}}, stream.pending...)
+		buff = &input{special: _esc}
+		stream.consumed[0] = buff
 	}
 
-	e.activewin.screen.unfocus()
-	e.activewin = e.activewin.split(e.term.term, direction, file, e.theme)
-	e.activewin.screen.focus()
-	e.windowchanged = true
-}
+	// every input is recorded into the macro while recording except "q" to stop it.
+	// The clipboard content sent from the terminal is not a keypress, so it is not recorded.
+	if e.recording != "" && e.replaying == 0 {
+		defer func() {
+			if e.recording != "" {
+				for _, in := range stream.consumed {
+					if in.special != _clipboard {
+						e.macro = append(e.macro, in)
+					}
+				}
+			}
+		}()
+	}
 
-func (e *editor) jumpwin(direction direction) {
-	// cursor
-	x, y := e.activewin.actualcursor()
-	leaves := e.rootwin.getallleaves()
+	// reset message
+	// this keeps showing the message just until the next input
+	e.msg = newemptyline()
+	e.errmsg = newemptyline()
 
-	var candidate *window
-	for _, leaf := range leaves {
-		if leaf == e.activewin {
-			continue
-		}
+	if e.swapscreen != nil {
+		e.answerswap(buff)
+		e.render(false)
+		return true
+	}
 
-		switch direction {
-		case left:
-			if x < leaf.x || y < leaf.y || leaf.y+leaf.height < y {
-				continue
-			}
+	// the keypress to dismiss the multi-line message is consumed
+	if len(e.msglines) != 0 {
+		e.msglines = nil
+		e.windowchanged = true
+		e.render(false)
+		return true
+	}
 
-			if candidate == nil || candidate.x < leaf.x {
-				candidate = leaf
-			}
+	// to know if the input makes a change to be repeated
+	prevmode := e.mode
+	undonode := e.activewin.screen.undotree.current
+	nchildren := len(undonode.children)
+	replayed := false
 
-		case right:
-			if leaf.x+leaf.width < x || y < leaf.y || leaf.y+leaf.height < y {
-				continue
-			}
+	switch e.mode {
+	case command:
+		switch buff.special {
+		case _esc:
+			e.resetcmd()
+			e.changemode(normal)
 
-			if candidate == nil || leaf.x < candidate.x {
-				candidate = leaf
-			}
+		case _cr:
+			switch {
+			case e.cmdline.equal("q"):
+				e.resetcmd()
+				e.changemode(normal)
+				e.closewin()
+				if e.activewin == nil {
+					return false
+				}
 
-		case up:
-			if y < leaf.y || x < leaf.x || leaf.x+leaf.width < x {
-				continue
+			case e.cmdline.equal("q!"):
+				e.resetcmd()
+				e.changemode(normal)
+				e.closewinforce()
+				if e.activewin == nil {
+					return false
+				}
+
+			case e.cmdline.hasprefix("vs "):
+				filename := e.cmdline.trimprefix("vs ")
+				e.vsplit(filename)
+				e.resetcmd()
+				e.changemode(normal)
+
+			case e.cmdline.hasprefix("hs"):
+				filename := e.cmdline.trimprefix("hs ")
+				e.hsplit(filename)
+				e.resetcmd()
+				e.changemode(normal)
+
+			case e.cmdline.equal("w"):
+				if e.save() {
+					e.msg = newline("saved!")
+				}
+				e.resetcmd()
+				e.changemode(normal)
+
+			case e.cmdline.hasprefix("e "):
+				e.edit(e.cmdline.trimprefix("e "))
+				e.resetcmd()
+				e.changemode(normal)
+
+			case e.cmdline.equal("ls"), e.cmdline.equal("buffers"):
+				e.showbuffers()
+				e.resetcmd()
+				e.changemode(normal)
+
+			case e.cmdline.equal("bn"), e.cmdline.equal("bnext"):
+				e.cyclebuffer(1)
+				e.resetcmd()
+				e.changemode(normal)
+
+			case e.cmdline.equal("bp"), e.cmdline.equal("bprevious"):
+				e.cyclebuffer(-1)
+				e.resetcmd()
+				e.changemode(normal)
+
+			case e.cmdline.hasprefix("b "):
+				e.switchbuffer(e.cmdline.trimprefix("b "))
+				e.resetcmd()
+				e.changemode(normal)
+
+			case e.cmdline.hasprefix("set "):
+				e.setoption(e.cmdline.trimprefix("set "))
+				e.resetcmd()
+				e.changemode(normal)
+
+			case e.cmdline.equal("reg"), e.cmdline.equal("registers"):
+				e.showregisters()
+				e.resetcmd()
+				e.changemode(normal)
+
+			case e.cmdline.equal("wq"):
+				saved := e.save()
+				e.resetcmd()
+				if saved {
+					return false
+				}
+				e.changemode(normal)
+
+			default:
+				e.runcmd(e.cmdline.text(), stream)
+				e.resetcmd()
+				e.changemode(normal)
 			}
 
-			if candidate == nil || candidate.y < leaf.y {
-				candidate = leaf
+		default:
+			e.editcmdline(buff)
+		}
+
+	case search:
+		switch buff.special {
+		case _esc:
+			e.activewin.screen.cancelsearch()
+			e.resetcmd()
+			e.changemode(normal)
+
+		case _cr:
+			if err := e.activewin.screen.finishsearch(e.cmdline.text(), e.searchbackward); err != nil {
+				e.errmsg = newline(err.Error())
 			}
+			e.resetcmd()
+			e.changemode(normal)
 
-		case down:
-			if leaf.y+leaf.height < y || x < leaf.x || leaf.x+leaf.width < x {
-				continue
+		default:
+			if e.editcmdline(buff) {
+				e.activewin.screen.incsearch(e.cmdline.text(), e.searchbackward)
 			}
+		}
 
-			if candidate == nil || leaf.y < candidate.y {
-				candidate = leaf
+	case normal:
+		switch buff.special {
+		case _ctrl_z:
+			e.suspending = true
+		case _ctrl_w:
+			input2 := stream.next()
+			switch {
+			case input2.r == 'h', input2.special == _ctrl_h, input2.special == _left:
+				e.jumpwin(left)
+			case input2.r == 'j', input2.special == _ctrl_j, input2.special == _down:
+				e.jumpwin(down)
+			case input2.r == 'k', input2.special == _ctrl_k, input2.special == _up:
+				e.jumpwin(up)
+			case input2.r == 'l', input2.special == _ctrl_l, input2.special == _right:
+				e.jumpwin(right)
+			default:
+				// do nothing
 			}
+		case _not_special_key:
+			// the count before "." and "@" is read here as they are handled by the editor
+			cmd, cnt := e.readcount(buff, stream)
+
+			switch cmd.r {
+			case ':':
+				e.changemode(command)
+			case '/':
+				e.startsearch(false)
+			case '?':
+				e.startsearch(true)
+			case 'i':
+				e.changemode(insert)
+			case 'q':
+				e.togglerecording(stream)
+			case '.':
+				replayed = true
+				if !e.repeat(cnt) {
+					return false
+				}
+			case '@':
+				replayed = true
+				if !e.playmacro(stream.next(), max(cnt, 1)) {
+					return false
+				}
+			default:
+				newmode := e.activewin.screen.handle(e.mode, buff, stream)
+				e.changemode(newmode)
+			}
+		default:
+			newmode := e.activewin.screen.handle(e.mode, buff, stream)
+			e.changemode(newmode)
+		}
+
+	case insert:
+		newmode := e.activewin.screen.handle(e.mode, buff, stream)
+		e.changemode(newmode)
+
+	case lineselect, charselect:
+		if buff.special == _not_special_key && buff.r == ':' {
+			// the command is executed on the selected lines
+			e.cmdline = newline("'<,'>")
+			e.cmdx = e.cmdline.width() - 1
+			e.changemode(command)
+			break
 		}
+
+		newmode := e.activewin.screen.handle(e.mode, buff, stream)
+		e.changemode(newmode)
+
+	default:
+		panic("unknown mode")
 	}
 
-	if candidate == nil {
-		return
+	if !replayed {
+		e.recordchange(prevmode, undonode, nchildren, stream.consumed)
 	}
 
-	e.jumpedwindowbefore = e.activewin
-	e.activewin.screen.unfocus()
-	e.activewin = candidate
-	e.jumpedwindowafter = e.activewin
-	e.activewin.screen.focus()
+	e.debug()
+	e.render(false)
+
+	return true
 }
 
-func (e *editor) closewin() {
-	if e.activewin.screen.dirty {
-		e.errmsg = newline(fmt.Sprintf("unsaved change remaining: '%v'", e.activewin.screen.file.Name()))
-		return
-	}
+// remember the inputs to repeat them by "." if they made a change in normal mode.
+// The change entering insert mode like "o" or "cw" is remembered with the inputs in insert mode
+// when getting back to normal mode.
+func (e *editor) recordchange(prevmode mode, undonode *undonode, nchildren int, inputs []*input) {
+	switch {
+	case prevmode == normal && e.mode == insert:
+		e.changing = slices.Clone(inputs)
+
+	case prevmode == insert && e.changing != nil:
+		e.changing = append(e.changing, inputs...)
+		if e.mode != insert {
+			e.lastchange = e.changing
+			e.changing = nil
+		}
 
-	e.activewin.screen.unfocus()
-	e.activewin = e.activewin.close()
-	if e.activewin != nil {
-		e.activewin.screen.focus()
+	case prevmode == normal && nchildren < len(undonode.children):
+		// the input is committed to the undo tree as a new change
+		e.lastchange = slices.Clone(inputs)
 	}
-	e.windowchanged = true
 }
 
-func (e *editor) closewinforce() {
-	e.activewin = e.activewin.close()
-	e.windowchanged = true
-}
+// read the count typed before "." or "@", and return the command and the count.
+// For the other commands, the inputs read are pushed back to the stream and the count is 0.
+func (e *editor) readcount(buff *input, stream *inputstream) (*input, int) {
+	isnum, cnt := buff.isnumber()
+	if !isnum || cnt == 0 {
+		return buff, 0
+	}
 
-func (e *editor) movecmdcursor(direction direction) {
-	switch direction {
-	case left:
-		nextx := max(0, e.cmdxidx()-1)
-		e.cmdx = e.cmdline.widthto(nextx)
-	case right:
-		nextx := min(e.cmdline.length()-1, e.cmdxidx()+1)
-		e.cmdx = e.cmdline.widthto(nextx)
-	default:
-		panic("invalid direction is passed")
+	read := []*input{}
+	for {
+		next := stream.next()
+		read = append(read, next)
+
+		isnum, n := next.isnumber()
+		if !isnum {
+			if next.special == _not_special_key && (next.r == '.' || next.r == '@') {
+				return next, cnt
+			}
+			stream.unread(read...)
+			return buff, 0
+		}
+		cnt = cnt*10 + n
 	}
 }
 
-func (e *editor) cmdxidx() int {
-	return e.cmdline.charidx(e.cmdx, 0)
+// repeat replays the last change at the current cursors.
+// If cnt is not 0, it replaces the count typed before the change.
+// It returns false if the editor is finished.
+func (e *editor) repeat(cnt int) bool {
+	inputs := e.lastchange
+	if cnt != 0 {
+		// skip the register name and the count
+		i := 0
+		if 2 <= len(inputs) && inputs[0].special == _not_special_key && inputs[0].r == '"' {
+			i = 2
+		}
+		head := i
+		for i < len(inputs) {
+			if isnum, _ := inputs[i].isnumber(); !isnum {
+				break
+			}
+			i++
+		}
+
+		count := []*input{}
+		for _, r := range strconv.Itoa(cnt) {
+			count = append(count, &input{special: _not_special_key, r: r})
+		}
+
+		// the count typed after the operator like "d2w" is replaced too. It does not start with "0" as in handleoperator.
+		var op []*input
+		if i < len(inputs) && inputs[i].special == _not_special_key && strings.ContainsRune("dcy><", inputs[i].r) {
+			op = inputs[i : i+1]
+			i++
+			if i < len(inputs) {
+				if _, n := inputs[i].isnumber(); n != 0 {
+					for i < len(inputs) {
+						if isnum, _ := inputs[i].isnumber(); !isnum {
+							break
+						}
+						i++
+					}
+				}
+			}
+		}
+		inputs = slices.Concat(inputs[:head], count, op, inputs[i:])
+	}
+
+	return e.replay(inputs)
 }
 
-func (e *editor) commandline() *line {
-	if e.mode != command {
-		return newemptyline()
+// start recording the macro into the register typed after "q", or stop recording.
+func (e *editor) togglerecording(stream *inputstream) {
+	if e.recording != "" {
+		e.register.storemacro(e.recording, e.macro)
+		e.recording, e.macro = "", nil
+		return
 	}
 
-	return newline(fmt.Sprintf(":%v", e.cmdline))
+	name := stream.next()
+	if name.special != _not_special_key || !(('a' <= name.r && name.r <= 'z') || ('A' <= name.r && name.r <= 'Z')) {
+		return
+	}
+	e.recording, e.macro = string(name.r), []*input{}
 }
 
-func (e *editor) render(first bool) {
-	// to prevent cursor flickering
-	e.term.flush()
+// play the macro in the register cnt times. "@@" plays the last played macro.
+// It returns false if the editor is finished.
+func (e *editor) playmacro(name *input, cnt int) bool {
+	if name.special != _not_special_key {
+		return true
+	}
 
-	/* update command line */
-	e.term.clearline(e.height - 1)
-	if !e.errmsg.empty() {
-		red := slices.Repeat([]int{1}, len(e.errmsg.buffer))
-		e.term.write([]byte(e.errmsg.cutandcolorize(0, e.width, red, []int{}, []int{})))
-	} else if !e.msg.empty() {
-		e.term.write([]byte(e.msg.cutandcolorize(0, e.width, []int{}, []int{}, []int{})))
-	} else if e.mode == command {
-		cursor := []int{e.cmdx + 1}
-		cl := e.commandline()
-		cl.delnl()
-		e.term.write([]byte(cl.cutandcolorize(0, e.width, []int{}, []int{}, cursor)))
+	reg := strings.ToLower(string(name.r))
+	if name.r == '@' {
+		reg = e.lastmacro
 	}
 
-	if e.windowchanged {
-		e.rootwin.render(e.term, true)
-		e.activewin.screen.render(first)
-	} else if e.jumpedwindowbefore != nil {
-		// force re-render to apply status line and cursor visibility
-		e.jumpedwindowbefore.screen.render(true)
-		e.jumpedwindowafter.screen.render(true)
-	} else {
-		e.activewin.render(e.term, first)
+	inputs := e.register.macro(reg)
+	if len(inputs) == 0 || slices.Contains(e.playing, reg) {
+		return true
 	}
 
-	e.term.flush()
+	e.lastmacro = reg
+	e.playing = append(e.playing, reg)
+	defer func() {
+		e.playing = e.playing[:len(e.playing)-1]
+	}()
 
-	e.windowchanged = false
-	e.jumpedwindowbefore = nil
-	e.jumpedwindowafter = nil
+	for range cnt {
+		if !e.replay(inputs) {
+			return false
+		}
+	}
+	return true
 }
 
-func (e *editor) resetcmd() {
-	e.cmdline = newcommandline()
-	e.cmdx = 0
-}
+// handle the inputs as if they are typed. It returns false if the editor is finished.
+func (e *editor) replay(inputs []*input) bool {
+	e.replaying++
+	defer func() {
+		e.replaying--
+	}()
 
-func (e *editor) save() {
-	e.activewin.screen.save()
-}
+	ch := make(chan *input, len(inputs))
+	for _, in := range inputs {
+		ch <- in
+	}
+	// the command lacking the following keys is cancelled
+	close(ch)
 
-func (e *editor) resize(width, height int) {
-	e.width = width
-	e.height = height
-	e.term.width = width
-	e.rootwin.changesize(e.rootwin.x, e.rootwin.y, width, height-1)
-	e.windowchanged = true
+	for len(ch) != 0 {
+		if !e.handleinput(<-ch, ch) {
+			return false
+		}
+	}
+	return true
 }
 
-func (e *editor) String() string {
-	var sb strings.Builder
-	sb.WriteString(fmt.Sprintf("edt<%v (%v %v %v %v) ':%v' %p>\n", e.mode, e.term.x, e.term.y, e.width, e.height, strings.TrimSuffix(e.cmdline.String(), " "), e.activewin))
-	sb.WriteString(fmt.Sprintf("  └ %v", e.rootwin.string(1)))
-	return sb.String()
+func neweditor(term terminal, file file, opts *options, width, height int) *editor {
+	e := &editor{
+		term:     newscreenterm(term, 0, 0, width),
+		theme:    opts.theme,
+		backup:   opts.backup,
+		register: newregister(),
+		width:    width,
+		height:   height,
+		mode:     normal,
+		cmdline:  newemptyline(),
+		cmdx:     0,
+		msg:      newemptyline(),
+		errmsg:   newemptyline(),
+	}
+
+	if opts.semantic {
+		e.semanticresults = make(chan *semanticresult)
+	}
+
+	e.rootwin = newleafwindow(e.term.term, 0, 0, e.width, e.height-1, e.addbuffer(file), e.register)
+	e.activewin = e.rootwin
+	e.activewin.screen.focus()
+	e.checkswap(e.activewin.screen)
+
+	// the swap file prompt is prioritized over the startup errors
+	if len(opts.errs) != 0 && e.swapscreen == nil && e.errmsg.empty() {
+		msg := opts.errs[0].Error()
+		if 1 < len(opts.errs) {
+			msg += fmt.Sprintf(" (and %v more errors)", len(opts.errs)-1)
+		}
+		e.errmsg = newline(msg)
+	}
+	return e
 }
 
-func (e *editor) debug() {
-	debug(2, "%v", e)
+// the interval to write the swap files
+const swapinterval = 4 * time.Second
+
+// options are the editor settings given via the command line flags.
+type options struct {
+	theme    *theme
+	backup   bool    // keep the original content as "<file>~" on save
+	semantic bool    // highlight Go files by parsing them
+	errs     []error // errors found on startup like invalid syntax files, shown when the editor starts
+	escdelay time.Duration
 }
 
-func start(term terminal, in io.Reader, file file, theme *theme) {
+func start(term terminal, in io.Reader, file file, opts *options) {
 	fin, err := term.init()
 	if err != nil {
 		fin()
 		panic(err)
 	}
 
+	// this runs on panic too, so the terminal is not left in raw mode
 	defer func() {
-		fin()
-		term.refresh()
-		term.putcursor(0, 0)
 		term.showcursor()
 		term.flush()
+		fin()
 	}()
 
 	term.refresh()
@@ -2679,30 +8149,38 @@ func start(term terminal, in io.Reader, file file, theme *theme) {
 		}
 	}()
 
-	e := &editor{
-		term:    newscreenterm(term, 0, 0, width),
-		theme:   theme,
-		width:   width,
-		height:  height,
-		mode:    normal,
-		cmdline: newemptyline(),
-		cmdx:    0,
-		msg:     newemptyline(),
-		errmsg:  newemptyline(),
-	}
-
-	e.rootwin = newleafwindow(e.term.term, 0, 0, e.width, e.height-1, file, e.theme)
-	e.activewin = e.rootwin
-	e.activewin.screen.focus()
+	// the terminal is restored when the editor is killed or the terminal is closed.
+	// The swap files are kept to recover the unsaved changes.
+	terminated := make(chan os.Signal, 1)
+	signal.Notify(terminated, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(terminated)
+
+	// notified when the editor is resumed after suspended
+	continued := make(chan os.Signal, 1)
+	signal.Notify(continued, syscall.SIGCONT)
+	defer signal.Stop(continued)
+	suspended := false
+
+	e := neweditor(term, file, opts, width, height)
 	e.render(true)
 
 	/*
 	 * start editor main routine
 	 */
 
-	reader := &reader{r: bufio.NewReader(in)}
+	swapticker := time.NewTicker(swapinterval)
+	defer swapticker.Stop()
+
+	reader := newreader(in, opts.escdelay)
 	buffchan := make(chan *input, 1)
+	panics := make(chan any, 1)
 	go func() {
+		// the panic is raised again on this routine to restore the terminal
+		defer func() {
+			if r := recover(); r != nil {
+				panics <- fmt.Sprintf("%v\n\n%s", r, runtimedebug.Stack())
+			}
+		}()
 		reader.tryread(buffchan)
 	}()
 
@@ -2716,157 +8194,86 @@ func start(term terminal, in io.Reader, file file, theme *theme) {
 			e.resize(width, height)
 			e.render(true)
 
-		case buff := <-buffchan:
-			// reset message
-			// this keeps showing the message just until the next input
-			e.msg = newemptyline()
-			e.errmsg = newemptyline()
-
-			switch e.mode {
-			case command:
-				switch buff.special {
-				case _left:
-					e.movecmdcursor(left)
-
-				case _right:
-					e.movecmdcursor(right)
-
-				case _esc:
-					e.resetcmd()
-					e.changemode(normal)
-
-				case _bs:
-					if 0 < e.cmdx {
-						e.movecmdcursor(left)
-						e.cmdline.delchar(e.cmdxidx())
-					}
-
-				case _cr:
-					switch {
-					case e.cmdline.equal("q"):
-						e.resetcmd()
-						e.changemode(normal)
-						e.closewin()
-						if e.activewin == nil {
-							goto finish
-						}
-
-					case e.cmdline.equal("q!"):
-						e.resetcmd()
-						e.changemode(normal)
-						e.closewinforce()
-						if e.activewin == nil {
-							goto finish
-						}
+		case <-swapticker.C:
+			e.updateswaps()
+			e.render(false)
 
-					case e.cmdline.hasprefix("vs "):
-						filename := e.cmdline.trimprefix("vs ")
-						e.vsplit(filename)
-						e.resetcmd()
-						e.changemode(normal)
-
-					case e.cmdline.hasprefix("hs"):
-						filename := e.cmdline.trimprefix("hs ")
-						e.hsplit(filename)
-						e.resetcmd()
-						e.changemode(normal)
-
-					case e.cmdline.equal("w"):
-						e.save()
-						e.msg = newline("saved!")
-						e.resetcmd()
-						e.changemode(normal)
-
-					case e.cmdline.equal("wq"):
-						e.save()
-						e.resetcmd()
-						goto finish
-
-					default:
-						e.errmsg = newline("unknown command!")
-						e.resetcmd()
-						e.changemode(normal)
-					}
+		case res := <-e.semanticresults:
+			res.buffer.applysemantic(res.lines)
+			e.render(false)
 
-				case _not_special_key:
-					e.cmdline.inschars([]*character{newcharacter(buff.r)}, e.cmdxidx())
-					e.movecmdcursor(right)
+		case sig := <-terminated:
+			debug(1, "start: terminated by %v", sig)
+			e.updateswaps()
+			return
+
+		case <-continued:
+			// the terminal was restored on suspending, so it's initialized again.
+			// When the editor is stopped by others, the terminal is still initialized.
+			if suspended {
+				suspended = false
+				fin, err = term.init()
+				if err != nil {
+					panic(err)
 				}
+			}
 
-			case normal:
-				switch buff.special {
-				case _ctrl_w:
-					input2 := <-buffchan
-					switch {
-					case input2.r == 'h', input2.special == _ctrl_h, input2.special == _left:
-						e.jumpwin(left)
-					case input2.r == 'j', input2.special == _ctrl_j, input2.special == _down:
-						e.jumpwin(down)
-					case input2.r == 'k', input2.special == _ctrl_k, input2.special == _up:
-						e.jumpwin(up)
-					case input2.r == 'l', input2.special == _ctrl_l, input2.special == _right:
-						e.jumpwin(right)
-					default:
-						// do nothing
-					}
-				case _not_special_key:
-					switch buff.r {
-					case ':':
-						e.changemode(command)
-					case 'i':
-						e.changemode(insert)
-					default:
-						newmode := e.activewin.screen.handle(e.mode, buff, buffchan)
-						e.changemode(newmode)
-					}
-				default:
-					newmode := e.activewin.screen.handle(e.mode, buff, buffchan)
-					e.changemode(newmode)
-				}
+			// the window size might be changed while suspended
+			width, height, err := term.windowsize()
+			if err != nil {
+				panic(err)
+			}
+			term.refresh()
+			term.hidecursor()
+			e.resize(width, height)
+			e.render(true)
 
-			case insert:
-				switch buff.special {
-				case _esc:
-					e.changemode(normal)
-				default:
-					newmode := e.activewin.screen.handle(e.mode, buff, buffchan)
-					e.changemode(newmode)
-				}
+		case p := <-panics:
+			panic(p)
 
-			case lineselect:
-				newmode := e.activewin.screen.handle(e.mode, buff, buffchan)
-				e.changemode(newmode)
+		case buff, ok := <-buffchan:
+			// the terminal is gone. The swap files are kept like on SIGHUP.
+			if !ok {
+				debug(1, "start: input is closed")
+				e.updateswaps()
+				return
+			}
 
-			default:
-				panic("unknown mode")
+			if !e.handleinput(buff, buffchan) {
+				e.close()
+				return
 			}
 
-			e.debug()
-			e.render(false)
+			if e.suspending {
+				e.suspending = false
+				suspended = true
+				term.showcursor()
+				term.flush()
+				fin()
+				term.suspend()
+			}
 		}
 	}
-
-finish:
 }
 
 func main() {
 	var (
-		_theme = flag.String("theme", "doraemon", "theme name, choose from [doraemon, nobita, shizuka, suneo, gian]")
+		_theme    = flag.String("theme", "doraemon", "theme name, choose from [doraemon, nobita, shizuka, suneo, gian] or the ones in the theme file")
+		_backup   = flag.Bool("backup", false, "keep the original content as \"<file>~\" on save")
+		_semantic = flag.Bool("semantic", false, "highlight Go files by parsing them to color packages, types, functions and fields")
+		_escdelay = flag.Duration("escdelay", defaultescdelay, "how long to wait for the rest of the escape sequence after Esc")
 	)
 	flag.Parse()
 
-	theme := theme_doraemon
-	switch *_theme {
-	case "doraemon":
+	var errs []error
+	if dir := configdir(); dir != "" {
+		errs = slices.Concat(loadsyntaxfiles(filepath.Join(dir, "syntax")), loadthemes(dir, truecolorsupported()))
+	}
+
+	theme, ok := themes[*_theme]
+	if !ok {
+		errs = append(errs, fmt.Errorf("unknown theme: %v", *_theme))
 		theme = theme_doraemon
-	case "nobita":
-		theme = theme_nobita
-	case "shizuka":
-		theme = theme_shizuka
-	case "suneo":
-		theme = theme_suneo
-	case "gian":
-		theme = theme_gian
 	}
 
 	args := flag.Args()
@@ -2887,7 +8294,7 @@ func main() {
 		panic(err)
 	}
 
-	start(&unixVT100term{}, os.Stdin, file, theme)
+	start(&unixVT100term{}, os.Stdin, file, &options{theme: theme, backup: *_backup, semantic: *_semantic, errs: errs, escdelay: *_escdelay})
 }
 
 /*
@@ -2897,6 +8304,90 @@ func main() {
 type input struct {
 	r       rune
 	special key
+	mod     modifier
+	text    string // clipboard content for _clipboard, pasted text for _paste
+
+	// the position on the terminal for the mouse event, 0-indexed
+	x int
+	y int
+}
+
+// modifier is the modifier keys pressed with the key.
+type modifier int
+
+const (
+	mod_shift modifier = 1 << iota
+	mod_alt
+	mod_ctrl
+)
+
+// return the prefix like "C-S-" for the modifiers.
+func (m modifier) String() string {
+	var sb strings.Builder
+	if m&mod_ctrl != 0 {
+		sb.WriteString("C-")
+	}
+	if m&mod_alt != 0 {
+		sb.WriteString("A-")
+	}
+	if m&mod_shift != 0 {
+		sb.WriteString("S-")
+	}
+	return sb.String()
+}
+
+// inputstream is the inputs following the one being handled.
+// A command which needs more keys like "dw" reads them from here.
+// Every input read is recorded in consumed so that the command can be replayed.
+type inputstream struct {
+	ch       <-chan *input
+	pending  []*input // inputs pushed back by unread, read before ch
+	consumed []*input
+}
+
+func newinputstream(first *input, ch <-chan *input) *inputstream {
+	return &inputstream{ch: ch, consumed: []*input{first}}
+}
+
+func (st *inputstream) next() *input {
+	var in *input
+	if len(st.pending) != 0 {
+		in, st.pending = st.pending[0], st.pending[1:]
+	} else if i, ok := <-st.ch; ok {
+		in = i
+	} else {
+		// no more inputs to replay
+		in = &input{special: _esc}
+	}
+	st.consumed = append(st.consumed, in)
+	return in
+}
+
+// push back the inputs just read so that they are read again.
+func (st *inputstream) unread(ins ...*input) {
+	st.consumed = st.consumed[:len(st.consumed)-len(ins)]
+	st.pending = append(slices.Clone(ins), st.pending...)
+}
+
+// wait for the clipboard content sent from the terminal up to timeout.
+// The other inputs arriving in the meantime are kept to be read later.
+func (st *inputstream) waitclipboard(timeout time.Duration) (string, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case in, ok := <-st.ch:
+			if !ok {
+				return "", false
+			}
+			if in.special == _clipboard {
+				return in.text, true
+			}
+			st.pending = append(st.pending, in)
+		case <-timer.C:
+			return "", false
+		}
+	}
 }
 
 func (i *input) isnumber() (bool, int) {
@@ -2912,11 +8403,97 @@ func (i *input) isnumber() (bool, int) {
 	return true, n
 }
 
+// return the inputs like "dw<ESC>". "<" is written as "<lt>", and the pasted text is written as it is.
+// parseinputs reads it back.
+func inputsstring(inputs []*input) string {
+	var sb strings.Builder
+	for _, in := range inputs {
+		switch {
+		case in.special == _not_special_key && in.mod == 0 && in.r == '<':
+			sb.WriteString("<lt>")
+		case in.special == _not_special_key && in.mod == 0:
+			sb.WriteRune(in.r)
+		case in.special == _not_special_key:
+			sb.WriteString("<" + in.mod.String() + string(in.r) + ">")
+		case in.special == _paste:
+			// enclosed to be read back as the single paste, not as the keys
+			sb.WriteString("<Paste>" + strings.ReplaceAll(in.text, "<", "<lt>") + "</Paste>")
+		default:
+			sb.WriteString("<" + in.mod.String() + in.special.String() + ">")
+		}
+	}
+	return sb.String()
+}
+
+// parse the inputs written by inputsstring. The newline and the tab are taken as Enter and Tab keys,
+// so the lines yanked into the register can be played too. "<" not starting a key name is the character.
+func parseinputs(str string) []*input {
+	inputs := []*input{}
+	for len(str) != 0 {
+		// "<" in the pasted text is escaped, so the first "</Paste>" ends it
+		if rest, ok := strings.CutPrefix(str, "<Paste>"); ok {
+			if text, rest, ok := strings.Cut(rest, "</Paste>"); ok {
+				inputs = append(inputs, &input{special: _paste, text: strings.ReplaceAll(text, "<lt>", "<")})
+				str = rest
+				continue
+			}
+		}
+
+		if str[0] == '<' {
+			if end := strings.IndexByte(str, '>'); end != -1 {
+				if in := parsekeyname(str[1:end]); in != nil {
+					inputs = append(inputs, in)
+					str = str[end+1:]
+					continue
+				}
+			}
+		}
+
+		r, n := utf8.DecodeRuneInString(str)
+		switch r {
+		case '\n':
+			inputs = append(inputs, &input{special: _cr})
+		case '\t':
+			inputs = append(inputs, &input{special: _tab})
+		default:
+			inputs = append(inputs, &input{r: r})
+		}
+		str = str[n:]
+	}
+	return inputs
+}
+
+// parse the key name like "C-A-x" or "ESC" written between "<" and ">". nil is returned for an unknown name.
+func parsekeyname(name string) *input {
+	if name == "lt" {
+		return &input{r: '<'}
+	}
+
+	var mod modifier
+	for _, m := range []modifier{mod_ctrl, mod_alt, mod_shift} {
+		if rest, ok := strings.CutPrefix(name, m.String()); ok && rest != "" {
+			mod |= m
+			name = rest
+		}
+	}
+
+	if r, n := utf8.DecodeRuneInString(name); n == len(name) && mod != 0 {
+		return &input{r: r, mod: mod}
+	}
+
+	for k := _lf; k <= _ctrl_z; k++ {
+		if k.String() == name {
+			return &input{special: k, mod: mod}
+		}
+	}
+	return nil
+}
+
 func (i *input) String() string {
 	if i.special == _not_special_key {
-		return fmt.Sprintf("%v", string(i.r))
+		return fmt.Sprintf("%v%v", i.mod, string(i.r))
 	}
-	return fmt.Sprintf("%v", i.special)
+	return fmt.Sprintf("%v%v", i.mod, i.special)
 }
 
 type key int
@@ -2957,6 +8534,30 @@ func (k key) String() string {
 		return "PageUp"
 	case _pagedown:
 		return "PageDown"
+	case _f1:
+		return "F1"
+	case _f2:
+		return "F2"
+	case _f3:
+		return "F3"
+	case _f4:
+		return "F4"
+	case _f5:
+		return "F5"
+	case _f6:
+		return "F6"
+	case _f7:
+		return "F7"
+	case _f8:
+		return "F8"
+	case _f9:
+		return "F9"
+	case _f10:
+		return "F10"
+	case _f11:
+		return "F11"
+	case _f12:
+		return "F12"
 	case _ctrl_a:
 		return "Ctrl+a"
 	case _ctrl_b:
@@ -3009,6 +8610,20 @@ func (k key) String() string {
 		return "Ctrl+y"
 	case _ctrl_z:
 		return "Ctrl+z"
+	case _clipboard:
+		return "Clipboard"
+	case _paste:
+		return "Paste"
+	case _mousepress:
+		return "MousePress"
+	case _mousedrag:
+		return "MouseDrag"
+	case _mouserelease:
+		return "MouseRelease"
+	case _wheelup:
+		return "WheelUp"
+	case _wheeldown:
+		return "WheelDown"
 	default:
 		panic("unknown key")
 	}
@@ -3036,6 +8651,19 @@ const (
 	_pageup
 	_pagedown
 
+	_f1
+	_f2
+	_f3
+	_f4
+	_f5
+	_f6
+	_f7
+	_f8
+	_f9
+	_f10
+	_f11
+	_f12
+
 	_ctrl_a
 	_ctrl_b
 	_ctrl_c
@@ -3062,13 +8690,79 @@ const (
 	_ctrl_x
 	_ctrl_y
 	_ctrl_z
+
+	// not a keypress, but the clipboard content sent from the terminal
+	_clipboard
+	// the text pasted to the terminal, which is inserted literally
+	_paste
+
+	// the mouse events. Only the left button is handled.
+	_mousepress
+	_mousedrag
+	_mouserelease
+	_wheelup
+	_wheeldown
 )
 
+func (i *input) ismouse() bool {
+	return _mousepress <= i.special && i.special <= _wheeldown
+}
+
+// reader decodes the bytes from the terminal into the inputs one by one.
+// The bytes arriving at once (fast typing, or a key sequence glued with the following keys) are split into each key.
 type reader struct {
-	r *bufio.Reader
+	chunks <-chan []byte // the bytes read from the terminal at once
+	buf    []byte        // the bytes received but not decoded yet
+	err    error         // the error which finished reading, set before chunks is closed
+
+	// how long to wait for the rest of the escape sequence after Esc.
+	// A sequence can arrive split across the reads especially over SSH.
+	escdelay time.Duration
+
+	dbg []byte // bytes of the input being read, for the debug log
+}
+
+// the default escdelay. This is long enough for the split sequence and short enough for Esc not to feel slow.
+const defaultescdelay = 25 * time.Millisecond
+
+func newreader(in io.Reader, escdelay time.Duration) *reader {
+	chunks := make(chan []byte, 16)
+	r := &reader{chunks: chunks, escdelay: escdelay}
+	go func() {
+		defer close(chunks)
+		for {
+			buf := make([]byte, 4096)
+			n, err := in.Read(buf)
+			if n != 0 {
+				chunks <- buf[:n]
+			}
+			if err != nil {
+				r.err = err
+				return
+			}
+		}
+	}()
+	return r
+}
+
+// inputclosed is raised in the reader to stop reading when the input reaches EOF or fails.
+type inputclosed struct {
+	err error
 }
 
+// read the inputs and send them to c. c is closed when the input is closed.
 func (r *reader) tryread(c chan<- *input) {
+	defer func() {
+		if p := recover(); p != nil {
+			closed, ok := p.(inputclosed)
+			if !ok {
+				panic(p)
+			}
+			debug(1, "tryread: input is closed: %v", closed.err)
+			close(c)
+		}
+	}()
+
 	for {
 		// block
 		i := r.read()
@@ -3076,151 +8770,322 @@ func (r *reader) tryread(c chan<- *input) {
 	}
 }
 
-func (r *reader) read() (i *input) {
-	var dbg []byte
+func (r *reader) readbyte() byte {
+	for len(r.buf) == 0 {
+		chunk, ok := <-r.chunks
+		if !ok {
+			panic(inputclosed{err: r.err})
+		}
+		r.buf = chunk
+	}
+
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	r.dbg = append(r.dbg, b)
+	return b
+}
+
+// whether the next byte arrives within escdelay. This tells the escape sequence from the single Esc keypress.
+func (r *reader) hasnext() bool {
+	// without the delay, only the bytes read together with Esc are checked
+	if len(r.buf) != 0 || r.escdelay <= 0 {
+		return len(r.buf) != 0
+	}
+
+	timer := time.NewTimer(r.escdelay)
+	defer timer.Stop()
+	select {
+	case chunk, ok := <-r.chunks:
+		r.buf = chunk
+		return ok
+	case <-timer.C:
+		return false
+	}
+}
 
+func (r *reader) read() (i *input) {
+	r.dbg = r.dbg[:0]
 	defer func() {
-		if i.special == _unknown {
-			debug(1, "read: unknown input detected: %v", string(dbg))
+		if i != nil && i.special == _unknown {
+			debug(1, "read: unknown input detected: %q", r.dbg)
 		}
 	}()
 
-	first, err := r.r.ReadByte()
-	if err != nil {
-		panic(err)
+	first := r.readbyte()
+	if first != 0x1b {
+		return r.readchar(first)
+	}
+
+	// when first byte is 0x1b but no more bytes follow, it's just esc key.
+	if !r.hasnext() {
+		return &input{special: _esc}
 	}
 
-	dbg = append(dbg, first)
+	second := r.readbyte()
+	switch {
+	case second == '[' && r.hasnext():
+		return r.readcsi()
+	case second == 'O' && r.hasnext():
+		return r.readss3()
+	case second == ']' && r.hasnext():
+		return r.readosc([]byte{second})
+	case second == 0x1b:
+		return &input{special: _esc, mod: mod_alt}
+	default:
+		// Alt + key is sent as esc followed by the key
+		in := r.readchar(second)
+		in.mod |= mod_alt
+		return in
+	}
+}
 
-	buffered := r.r.Buffered()
+// read the character starting with the byte b.
+func (r *reader) readchar(b byte) *input {
+	buf := []byte{b}
+	for !utf8.FullRune(buf) {
+		buf = append(buf, r.readbyte())
+	}
+	c, _ := utf8.DecodeRune(buf)
 
-	if first != 0x1b {
-		buf := make([]byte, buffered)
-		if buffered != 0 {
-			_, err := r.r.Read(buf)
-			if err != nil {
-				panic(err)
+	switch {
+	case c == '\r':
+		return &input{special: _cr}
+	case c == '\t':
+		return &input{special: _tab}
+	case c == 127:
+		return &input{special: _bs}
+	case 1 <= c && c <= 26:
+		return &input{special: _ctrl_a + key(c-1)}
+	default:
+		return &input{r: c}
+	}
+}
+
+// read the CSI sequence after "ESC [": the parameters, then the final byte.
+// The modifier is given as the second parameter like "ESC [ 1 ; 5 C" (Ctrl + right).
+func (r *reader) readcsi() *input {
+	var params []byte
+	for {
+		b := r.readbyte()
+		if 0x40 <= b && b <= 0x7e {
+			if string(params) == "200" && b == '~' {
+				return r.readpaste()
 			}
+			if strings.HasPrefix(string(params), "<") {
+				return mouseinput(string(params[1:]), b)
+			}
+			return csiinput(string(params), b)
 		}
+		params = append(params, b)
 
-		dbg = append(dbg, buf...)
-		r, _ := utf8.DecodeRune(append([]byte{first}, buf...))
+		// too long to be a key
+		if 32 < len(params) {
+			return &input{special: _unknown}
+		}
+	}
+}
 
-		switch r {
-		case '\r':
-			return &input{special: _cr}
-		case '\t':
-			return &input{special: _tab}
-		case 127:
-			return &input{special: _bs}
-		default:
-			if r < 32 {
-				switch r {
-				case 1:
-					return &input{special: _ctrl_a}
-				case 2:
-					return &input{special: _ctrl_b}
-				case 3:
-					return &input{special: _ctrl_c}
-				case 4:
-					return &input{special: _ctrl_d}
-				case 5:
-					return &input{special: _ctrl_e}
-				case 6:
-					return &input{special: _ctrl_f}
-				case 7:
-					return &input{special: _ctrl_g}
-				case 8:
-					return &input{special: _ctrl_h}
-				case 9:
-					return &input{special: _ctrl_i}
-				case 10:
-					return &input{special: _ctrl_j}
-				case 11:
-					return &input{special: _ctrl_k}
-				case 12:
-					return &input{special: _ctrl_l}
-				case 13:
-					return &input{special: _ctrl_m}
-				case 14:
-					return &input{special: _ctrl_n}
-				case 15:
-					return &input{special: _ctrl_o}
-				case 16:
-					return &input{special: _ctrl_p}
-				case 17:
-					return &input{special: _ctrl_q}
-				case 18:
-					return &input{special: _ctrl_r}
-				case 19:
-					return &input{special: _ctrl_s}
-				case 20:
-					return &input{special: _ctrl_t}
-				case 21:
-					return &input{special: _ctrl_u}
-				case 22:
-					return &input{special: _ctrl_v}
-				case 23:
-					return &input{special: _ctrl_w}
-				case 24:
-					return &input{special: _ctrl_x}
-				case 25:
-					return &input{special: _ctrl_y}
-				case 26:
-					return &input{special: _ctrl_z}
-				}
+// return the key of the CSI sequence like "1;5C".
+func csiinput(params string, final byte) *input {
+	nums := []int{}
+	if params != "" {
+		for p := range strings.SplitSeq(params, ";") {
+			n, err := strconv.Atoi(p)
+			if err != nil {
+				return &input{special: _unknown}
 			}
-			return &input{r: r}
+			nums = append(nums, n)
 		}
 	}
 
-	// when first byte is 0x1b but no more bytes buffered,
-	// it's just [0x1b] input which is esc key.
-	if buffered == 0 {
-		return &input{special: _esc}
+	var mod modifier
+	if 2 <= len(nums) {
+		mod = csimodifier(nums[1])
 	}
 
-	// escape sequence
-	buf := make([]byte, buffered)
-	n, err := r.r.Read(buf)
-	if err != nil {
-		panic(err)
+	if final == '~' {
+		if len(nums) == 0 {
+			return &input{special: _unknown}
+		}
+		k, ok := tildekeys[nums[0]]
+		if !ok {
+			return &input{special: _unknown}
+		}
+		return &input{special: k, mod: mod}
 	}
-	dbg = append(dbg, buf...)
 
-	if buf[0] == '[' {
-		switch n {
-		case 2:
-			switch buf[1] {
-			case 'A':
-				return &input{special: _up}
-			case 'B':
-				return &input{special: _down}
-			case 'C':
-				return &input{special: _right}
-			case 'D':
-				return &input{special: _left}
-			case 'H':
-				return &input{special: _home}
-			case 'F':
-				return &input{special: _end}
-			}
+	if final == 'Z' {
+		return &input{special: _tab, mod: mod_shift}
+	}
 
-		case 3:
-			switch {
-			case buf[1] == '2' && buf[2] == '~':
-				return &input{special: _insert}
-			case buf[1] == '3' && buf[2] == '~':
-				return &input{special: _del}
-			case buf[1] == '5' && buf[2] == '~':
-				return &input{special: _pageup}
-			case buf[1] == '6' && buf[2] == '~':
-				return &input{special: _pagedown}
-			}
+	k, ok := finalkeys[final]
+	if !ok {
+		return &input{special: _unknown}
+	}
+	return &input{special: k, mod: mod}
+}
+
+// return the mouse event of the SGR mouse sequence like "ESC [ < 0 ; 10 ; 5 M".
+// The parameters are the button, x and y (1-indexed), and the final byte is "M" for press/motion and "m" for release.
+func mouseinput(params string, final byte) *input {
+	nums := []int{}
+	for p := range strings.SplitSeq(params, ";") {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return &input{special: _unknown}
+		}
+		nums = append(nums, n)
+	}
+	if len(nums) != 3 {
+		return &input{special: _unknown}
+	}
+
+	button, x, y := nums[0], nums[1]-1, nums[2]-1
+
+	var mod modifier
+	if button&4 != 0 {
+		mod |= mod_shift
+	}
+	if button&8 != 0 {
+		mod |= mod_alt
+	}
+	if button&16 != 0 {
+		mod |= mod_ctrl
+	}
+	button &^= 4 | 8 | 16
+
+	var k key
+	switch {
+	case button == 64:
+		k = _wheelup
+	case button == 65:
+		k = _wheeldown
+	case button == 0 && final == 'm':
+		k = _mouserelease
+	case button == 0:
+		k = _mousepress
+	case button == 32:
+		// motion while the left button is pressed
+		k = _mousedrag
+	default:
+		return &input{special: _unknown}
+	}
+	return &input{special: k, mod: mod, x: x, y: y}
+}
+
+// read the SS3 sequence after "ESC O", which some terminals send for the arrows and F1-F4.
+func (r *reader) readss3() *input {
+	var mod modifier
+	b := r.readbyte()
+	if '1' <= b && b <= '9' {
+		// the modifier like "ESC O 5 P"
+		mod = csimodifier(int(b - '0'))
+		b = r.readbyte()
+	}
+
+	k, ok := finalkeys[b]
+	if !ok {
+		return &input{special: _unknown}
+	}
+	return &input{special: k, mod: mod}
+}
+
+// read the text pasted between "ESC [ 200 ~" and "ESC [ 201 ~" (bracketed paste).
+// The newlines are unified into "\n".
+func (r *reader) readpaste() *input {
+	end := []byte("\x1b[201~")
+	var buf []byte
+	for !bytes.HasSuffix(buf, end) {
+		buf = append(buf, r.readbyte())
+	}
+
+	text := string(bytes.TrimSuffix(buf, end))
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	return &input{special: _paste, text: strings.ToValidUTF8(text, string(utf8.RuneError))}
+}
+
+// the keys by the final byte of the CSI or SS3 sequence
+var finalkeys = map[byte]key{
+	'A': _up,
+	'B': _down,
+	'C': _right,
+	'D': _left,
+	'H': _home,
+	'F': _end,
+	'P': _f1,
+	'Q': _f2,
+	'R': _f3,
+	'S': _f4,
+}
+
+// the keys by the first parameter of the CSI sequence ending with "~"
+var tildekeys = map[int]key{
+	1:  _home,
+	2:  _insert,
+	3:  _del,
+	4:  _end,
+	5:  _pageup,
+	6:  _pagedown,
+	7:  _home,
+	8:  _end,
+	11: _f1,
+	12: _f2,
+	13: _f3,
+	14: _f4,
+	15: _f5,
+	17: _f6,
+	18: _f7,
+	19: _f8,
+	20: _f9,
+	21: _f10,
+	23: _f11,
+	24: _f12,
+}
+
+// convert the modifier parameter of the CSI sequence, which is 1 + the bits of shift (1), alt (2) and ctrl (4).
+func csimodifier(n int) modifier {
+	var mod modifier
+	bits := n - 1
+	if bits&1 != 0 {
+		mod |= mod_shift
+	}
+	if bits&2 != 0 {
+		mod |= mod_alt
+	}
+	if bits&4 != 0 {
+		mod |= mod_ctrl
+	}
+	return mod
+}
+
+// the longest OSC sequence to be read, which is large enough for the clipboard content.
+// Without the limit, the broken sequence lacking the terminator swallows all the following keys.
+const maxosclen = 1 << 20
+
+// read the OSC (operating system command) sequence which is sent from the terminal
+// as a reply of the clipboard query. buf is the sequence already read after ESC.
+func (r *reader) readosc(buf []byte) *input {
+	for !bytes.HasSuffix(buf, []byte{0x07}) && !bytes.HasSuffix(buf, []byte{0x1b, '\\'}) {
+		if len(buf) >= maxosclen {
+			return &input{special: _unknown}
 		}
+		buf = append(buf, r.readbyte())
+	}
+
+	// the body is "52;c;<base64 encoded content>"
+	body := strings.TrimSuffix(strings.TrimSuffix(string(buf[1:]), "\x07"), "\x1b\\")
+	parts := strings.SplitN(body, ";", 3)
+	if len(parts) != 3 || parts[0] != "52" {
+		return &input{special: _unknown}
 	}
 
-	return &input{special: _unknown}
+	content, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return &input{special: _unknown}
+	}
+
+	return &input{special: _clipboard, text: string(content)}
 }
 
 func debug(level int, format string, a ...any) (int, error) {
@@ -3295,6 +9160,17 @@ func (st *screenterm) flush() {
  * generic terminal
  */
 
+// OSC 52 sequence to query the terminal clipboard content.
+const osc52query = "\x1b]52;c;?\x07"
+
+// how long to wait for the reply to osc52query.
+const clipboardtimeout = 300 * time.Millisecond
+
+// return OSC 52 sequence to set the terminal clipboard content.
+func osc52(str string) []byte {
+	return fmt.Appendf(nil, "\x1b]52;c;%v\x07", base64.StdEncoding.EncodeToString([]byte(str)))
+}
+
 type terminal interface {
 	init() (func(), error)
 	windowsize() (int, int, error)
@@ -3309,6 +9185,9 @@ type terminal interface {
 
 	// flushes the buffer
 	flush()
+
+	// stop the process until the shell resumes it
+	suspend()
 }
 
 type unixVT100term struct {
@@ -3323,7 +9202,23 @@ func (t *unixVT100term) init() (func(), error) {
 	if err != nil {
 		return func() {}, err
 	}
-	return func() { term.Restore(int(os.Stdin.Fd()), oldstate) }, nil
+
+	// switch to the alternate screen not to wipe the shell scrollback,
+	// enable bracketed paste so that the pasted text is not taken as the keypresses,
+	// and the mouse reporting of the button and the drag in SGR format
+	t.w.Write([]byte("\x1b[?1049h\x1b[?2004h\x1b[?1002h\x1b[?1006h"))
+	return func() {
+		// the cursor shape is reset to the terminal default
+		t.w.Write([]byte("\x1b[?1006l\x1b[?1002l\x1b[?2004l\x1b[0 q\x1b[?1049l"))
+		term.Restore(int(os.Stdin.Fd()), oldstate)
+	}, nil
+}
+
+func (t *unixVT100term) suspend() {
+	// sent to the process group like the terminal does on Ctrl-z in cooked mode
+	if err := syscall.Kill(0, syscall.SIGTSTP); err != nil {
+		debug(1, "suspend: %v", err)
+	}
 }
 
 func (t *unixVT100term) windowsize() (int, int, error) {
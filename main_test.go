@@ -0,0 +1,2533 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
+	"unicode"
+)
+
+func TestRender(t *testing.T) {
+	te := newtesteditor(t, "abc\n\tdef\nあいう\n")
+	te.assertscreen(
+		"   1 abc",
+		"   2     def",
+		"   3 あいう",
+		"",
+	)
+
+	// the cursor is rendered as inverted cell
+	if got := te.term.screen.inverted(0); !slices.Equal(got, []int{5}) {
+		t.Errorf("cursor position mismatch: %v", got)
+	}
+
+	te.typ("jl")
+	if got := te.term.screen.inverted(1); !slices.Equal(got, []int{9}) {
+		t.Errorf("cursor position mismatch: %v", got)
+	}
+}
+
+// the screen scrolls to keep the cursor shown with the padding, which is reduced on a small window.
+func TestScroll(t *testing.T) {
+	t.Run("short window", func(t *testing.T) {
+		te := newtesteditor(t, strings.Repeat("a\n", 30))
+		te.typ("15j")
+		te.assertcursors([2]int{15, 0})
+		if te.screen().yoffset != 11 {
+			t.Errorf("yoffset mismatch: %v", te.screen().yoffset)
+		}
+	})
+
+	t.Run("narrow window", func(t *testing.T) {
+		te := newtesteditorfile(t, "test.txt", "abcdefghijklmnopqrstuvwxyz\n", 12, 10)
+		te.typ("$")
+		te.assertcursors([2]int{0, 26})
+		te.assertscreen("   1 uvwxyz")
+	})
+
+	t.Run("line end", func(t *testing.T) {
+		te := newtesteditorfile(t, "test.txt", strings.Repeat("abcdefghijklmnopqrstuvwxyz0123456789\n", 20), 40, 20)
+		te.typ("19j$")
+		te.assertcursors([2]int{19, 36})
+		te.assertscreen("   3 cdefghijklmnopqrstuvwxyz0123456789")
+	})
+}
+
+func TestMotion(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		keys    string
+		want    [2]int
+	}{
+		{"hjkl", "abc\ndef\nghi\n", "jjlkh", [2]int{1, 0}},
+		{"count", "abc\ndef\nghi\n", "2j2l", [2]int{2, 2}},
+		{"arrow", "abc\ndef\nghi\n", "<Down><Right><Right><Up><Left>", [2]int{0, 1}},
+		{"right wraps to next line", "ab\ncd\n", "lll", [2]int{1, 0}},
+		{"left wraps to previous line", "ab\ncd\n", "jh", [2]int{0, 2}},
+		{"keep x on short line", "abcd\na\nabcd\n", "3ljj", [2]int{2, 3}},
+		{"gg", "abc\ndef\nghi\n", "jjlgg", [2]int{0, 0}},
+		{"ge", "abc\ndef\nghi\n", "lge", [2]int{2, 0}},
+		{"gl", "abc\ndef\n", "gl", [2]int{0, 3}},
+		{"gh", "abc\ndef\n", "llgh", [2]int{0, 0}},
+		{"gs", "  abc\n", "gs", [2]int{0, 2}},
+		{"G", "abc\ndef\nghi\n", "2G", [2]int{1, 0}},
+		{"f", "abcabc\n", "fcfc", [2]int{0, 5}},
+		{"F", "abcabc\n", "glFaFa", [2]int{0, 0}},
+		{"f not found", "abc\n", "fz", [2]int{0, 0}},
+		{"w", "foo bar.baz\n", "w", [2]int{0, 4}},
+		{"w punctuation", "foo bar.baz\n", "ww", [2]int{0, 7}},
+		{"w count", "foo bar.baz\n", "3w", [2]int{0, 8}},
+		{"w next line", "foo\n  bar\n", "w", [2]int{1, 2}},
+		{"w empty line", "foo\n\n\nbar\n", "ww", [2]int{2, 0}},
+		{"w at the end", "foo bar\n", "5w", [2]int{0, 7}},
+		{"W", "foo bar.baz qux\n", "2W", [2]int{0, 12}},
+		{"e", "foo bar.baz\n", "e", [2]int{0, 2}},
+		{"e at the tail", "foo bar.baz\n", "ee", [2]int{0, 6}},
+		{"e next line", "foo\n\n  bar\n", "ee", [2]int{2, 4}},
+		{"E", "foo bar.baz\n", "2E", [2]int{0, 10}},
+		{"b", "foo bar.baz\n", "glb", [2]int{0, 8}},
+		{"b count", "foo bar.baz\n", "gl3b", [2]int{0, 4}},
+		{"b previous line", "foo\n  bar\n", "jb", [2]int{0, 0}},
+		{"b empty line", "foo\n\nbar\n", "jjb", [2]int{1, 0}},
+		{"B", "foo bar.baz\n", "glB", [2]int{0, 4}},
+		{"word with multibyte", "あいう abc\n", "w", [2]int{0, 4}},
+		{"}", "a\nb\n\nc\n\nd\n", "}", [2]int{2, 0}},
+		{"} count", "a\nb\n\nc\n\nd\n", "2}", [2]int{4, 0}},
+		{"} at the end", "a\nbc\n", "}", [2]int{1, 2}},
+		{"} from empty lines", "a\n\n\nb\n\n", "j}", [2]int{4, 0}},
+		{"{", "a\n\nb\nc\n", "ge{", [2]int{1, 0}},
+		{"{ at the head", "a\nb\n", "j{", [2]int{0, 0}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			te := newtesteditor(t, tc.content)
+			te.typ(tc.keys)
+			te.assertcursors(tc.want)
+		})
+	}
+
+	t.Run("multi cursor", func(t *testing.T) {
+		te := newtesteditor(t, "foo bar\nfoo bar\n")
+		te.typ("Cw")
+		te.assertcursors([2]int{0, 4}, [2]int{1, 4})
+		te.typ("b")
+		te.assertcursors([2]int{0, 0}, [2]int{1, 0})
+	})
+}
+
+func TestEdit(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		keys    string
+		want    []string
+		cursors [][2]int
+	}{
+		{"insert", "abc\n", "lixy<Esc>", []string{"axybc"}, [][2]int{{0, 3}}},
+		{"insert tab", "abc\n", "i<Tab><Esc>", []string{"\tabc"}, [][2]int{{0, 1}}},
+		{"split line", "abcd\n", "llix<CR>y<Esc>", []string{"abx", "ycd"}, [][2]int{{1, 1}}},
+		{"backspace", "abc\n", "llli<BS><BS><Esc>", []string{"a"}, [][2]int{{0, 1}}},
+		{"backspace joins lines", "abc\ndef\n", "ji<BS><Esc>", []string{"abcdef"}, [][2]int{{0, 3}}},
+		{"o", "abc\ndef\n", "ox<Esc>", []string{"abc", "x", "def"}, [][2]int{{1, 1}}},
+		{"O", "abc\ndef\n", "jOx<Esc>", []string{"abc", "x", "def"}, [][2]int{{1, 1}}},
+		{"dl", "abc\n", "ldl", []string{"ac"}, [][2]int{{0, 1}}},
+		{"dl at line tail joins lines", "abc\ndef\n", "gldl", []string{"abcdef"}, [][2]int{{0, 3}}},
+		{"dl at the last newline", "abc\n", "gldl", []string{"abc"}, [][2]int{{0, 3}}},
+		{"r", "abc\n", "lrx", []string{"axc"}, [][2]int{{0, 1}}},
+		{"multi cursor insert", "abc\ndef\n", "Clix<Esc>", []string{"axbc", "dxef"}, [][2]int{{0, 2}, {1, 2}}},
+		{"multi cursor split", "abc\ndef\n", "Cli<CR><Esc>", []string{"a", "bc", "d", "ef"}, [][2]int{{1, 0}, {3, 0}}},
+		{"multi cursor backspace", "abc\ndef\n", "Ci<BS><Esc>", []string{"abcdef"}, [][2]int{{0, 0}, {0, 3}}},
+		{"multi cursor o", "abc\ndef\n", "Cox<Esc>", []string{"abc", "x", "def", "x"}, [][2]int{{1, 1}, {3, 1}}},
+		{"close cursors", "abc\ndef\n", "C,ix<Esc>", []string{"abc", "xdef"}, [][2]int{{1, 1}}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			te := newtesteditor(t, tc.content)
+			te.typ(tc.keys)
+			te.assertlines(tc.want...)
+			te.assertcursors(tc.cursors...)
+			te.assertmode(normal)
+		})
+	}
+}
+
+func TestOperator(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		keys    string
+		want    []string
+		cursors [][2]int
+	}{
+		{"dw", "abc def\n", "dw", []string{"def"}, [][2]int{{0, 0}}},
+		{"count after operator", "a b c d\n", "d3w", []string{"d"}, [][2]int{{0, 0}}},
+		{"counts are multiplied", "a b c d e\n", "2d2w", []string{"e"}, [][2]int{{0, 0}}},
+		{"dw on the last word", "abc def\nghi\n", "wdw", []string{"abc ", "ghi"}, [][2]int{{0, 4}}},
+		{"d3w over the lines", "a b\nc d e\n", "d3w", []string{"d e"}, [][2]int{{0, 0}}},
+		{"d2w until the line end", "a b\nc d e\n", "d2w", []string{"", "c d e"}, [][2]int{{0, 0}}},
+		{"d2w to the indented line", "a b\n  c d\n", "d2w", []string{"", "  c d"}, [][2]int{{0, 0}}},
+		{"de", "abc def\n", "de", []string{" def"}, [][2]int{{0, 0}}},
+		{"db", "abc def\n", "wdb", []string{"def"}, [][2]int{{0, 0}}},
+		{"d$", "abc def\n", "wd$", []string{"abc "}, [][2]int{{0, 4}}},
+		{"df", "abc,def\n", "df,", []string{"def"}, [][2]int{{0, 0}}},
+		{"dF", "abc,def\n", "gldF,", []string{"abc"}, [][2]int{{0, 3}}},
+		{"df not found", "abc\n", "ldfx", []string{"abc"}, [][2]int{{0, 1}}},
+		{"dd", "abc\ndef\nghi\n", "jdd", []string{"abc", "ghi"}, [][2]int{{1, 0}}},
+		{"dd with count over the bottom", "abc\ndef\n", "j3dd", []string{"abc"}, [][2]int{{0, 0}}},
+		{"dj", "abc\ndef\nghi\n", "dj", []string{"ghi"}, [][2]int{{0, 0}}},
+		{"dk", "abc\ndef\nghi\n", "jdk", []string{"ghi"}, [][2]int{{0, 0}}},
+		{"dG", "abc\ndef\nghi\n", "jdG", []string{"abc"}, [][2]int{{0, 0}}},
+		{"dgg", "abc\ndef\nghi\n", "jdgg", []string{"ghi"}, [][2]int{{0, 0}}},
+		{"cancel", "abc\n", "d<Esc>", []string{"abc"}, [][2]int{{0, 0}}},
+		{"yw", "abc def\n", "ywP", []string{"abc abc def"}, [][2]int{{0, 3}}},
+		{"yb moves the cursor to the head", "abc def\n", "wyb", []string{"abc def"}, [][2]int{{0, 0}}},
+		{"y$", "abc def\n", "wy$P", []string{"abc defdef"}, [][2]int{{0, 6}}},
+		{"yy", "abc\ndef\n", "yyjp", []string{"abc", "def", "abc"}, [][2]int{{2, 3}}},
+		{"cw", "abc def\n", "cwxy<Esc>", []string{"xy def"}, [][2]int{{0, 2}}},
+		{"cw on spaces", "a  b\n", "lcwx<Esc>", []string{"axb"}, [][2]int{{0, 2}}},
+		{"cw on a word and spaces", "a  b\nab c\n", "lCcwx<Esc>", []string{"axb", "ax c"}, [][2]int{{0, 2}, {1, 2}}},
+		{"cw on spaces and a word", "ab c\na  b\n", "lCcwx<Esc>", []string{"ax c", "axb"}, [][2]int{{0, 2}, {1, 2}}},
+		{"cw on a single character word", "a b\n", "cwx<Esc>", []string{"x b"}, [][2]int{{0, 1}}},
+		{"cw on an empty line", "\nabc\n", "cwx<Esc>", []string{"x", "abc"}, [][2]int{{0, 1}}},
+		{"c2w", "ab cd ef\n", "c2wx<Esc>", []string{"x ef"}, [][2]int{{0, 1}}},
+		{"c2j", "abc\ndef\nghi\njkl\n", "c2jx<Esc>", []string{"x", "jkl"}, [][2]int{{0, 1}}},
+		{"cc", "abc\ndef\n", "ccx<Esc>", []string{"x", "def"}, [][2]int{{0, 1}}},
+		{"diw", "abc def ghi\n", "wldiw", []string{"abc  ghi"}, [][2]int{{0, 4}}},
+		{"daw", "abc def ghi\n", "wldaw", []string{"abc ghi"}, [][2]int{{0, 4}}},
+		{"daw on the last word", "abc def\n", "wdaw", []string{"abc"}, [][2]int{{0, 3}}},
+		{"ciw", "foo_bar.baz\n", "ciwx<Esc>", []string{"x.baz"}, [][2]int{{0, 1}}},
+		{"di\"", "say \"hello\" now\n", "di\"", []string{"say \"\" now"}, [][2]int{{0, 5}}},
+		{"da\"", "say \"hello\" now\n", "fhda\"", []string{"say  now"}, [][2]int{{0, 4}}},
+		{"di(", "f(a, (b))\n", "fadi(", []string{"f()"}, [][2]int{{0, 2}}},
+		{"da( nested", "f(a, (b))\n", "fbda(", []string{"f(a, )"}, [][2]int{{0, 5}}},
+		{"di{ across lines", "if {\n\tx\n}\n", "jdi{", []string{"if {}"}, [][2]int{{0, 4}}},
+		{"di( not found", "abc\n", "di(", []string{"abc"}, [][2]int{{0, 0}}},
+		{"dip", "a\nb\n\nc\n", "jdip", []string{"", "c"}, [][2]int{{0, 0}}},
+		{"dap", "a\nb\n\nc\n", "dap", []string{"c"}, [][2]int{{0, 0}}},
+		{">>", "abc\n", ">>", []string{"\tabc"}, [][2]int{{0, 1}}},
+		{"<lt><lt>", "\tabc\n  def\n", "<lt><lt>j<lt><lt>", []string{"abc", "def"}, [][2]int{{1, 0}}},
+		{">j skips empty lines", "abc\n\ndef\n", ">2j", []string{"\tabc", "", "\tdef"}, [][2]int{{0, 1}}},
+		{"multi cursor dw", "abc def\nghi jkl\n", "Cdw", []string{"def", "jkl"}, [][2]int{{0, 0}, {1, 0}}},
+		{"multi cursor overlapping ranges", "a\nb\nc\nd\n", "C2dd", []string{"d"}, [][2]int{{0, 0}}},
+		{"undo", "abc def\n", "wdbu", []string{"abc def"}, [][2]int{{0, 4}}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			te := newtesteditor(t, tc.content)
+			te.typ(tc.keys)
+			te.assertlines(tc.want...)
+			te.assertcursors(tc.cursors...)
+			te.assertmode(normal)
+		})
+	}
+
+	t.Run("register", func(t *testing.T) {
+		te := newtesteditor(t, "abc def\n")
+		te.typ("\"adwgl\"ap")
+		te.assertlines("defabc ")
+
+		// lines are pasted as lines
+		te.typ("\"byyP")
+		te.assertlines("defabc ", "defabc ")
+	})
+
+	t.Run("change is one undo unit", func(t *testing.T) {
+		te := newtesteditor(t, "abc def\n")
+		te.typ("cwxyz<Esc>")
+		te.assertlines("xyz def")
+		te.typ("u")
+		te.assertlines("abc def")
+	})
+}
+
+func TestRepeat(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		keys    string
+		want    []string
+		cursors [][2]int
+	}{
+		{"dw", "a b c d\n", "dw.", []string{"c d"}, [][2]int{{0, 0}}},
+		{"dd", "a\nb\nc\n", "dd.", []string{"c"}, [][2]int{{0, 0}}},
+		{"count is kept", "a b c d e f\n", "2dw.", []string{"e f"}, [][2]int{{0, 0}}},
+		{"count overrides", "a b c d e f g\n", "2dw3.", []string{"f g"}, [][2]int{{0, 0}}},
+		{"count overrides the count after the operator", "a b c d e f g h i\n", "d2w3.", []string{"f g h i"}, [][2]int{{0, 0}}},
+		{"count overrides both counts", "a b c d e f g h i\n", "2d2w3.", []string{"h i"}, [][2]int{{0, 0}}},
+		{"count without the original count", "a b c d e\n", "dw2.", []string{"d e"}, [][2]int{{0, 0}}},
+		{"insert session", "abc\n", "ixy<Esc>.", []string{"xyxyabc"}, [][2]int{{0, 4}}},
+		{"o", "abc\n", "ofoo<Esc>.", []string{"abc", "foo", "foo"}, [][2]int{{2, 3}}},
+		{"cw", "abc def\n", "cwxy<Esc>w.", []string{"xy xy"}, [][2]int{{0, 5}}},
+		{"paste", "abc\n", "vyp.", []string{"aaabc"}, [][2]int{{0, 2}}},
+		{"at every cursor", "a1\nb2\nc3\n", "dljC.", []string{"1", "2", "3"}, [][2]int{{1, 0}, {2, 0}}},
+		{"yank is not a change", "abc def ghi\n", "dwyw.", []string{"ghi"}, [][2]int{{0, 0}}},
+		{"undo", "a b c\n", "dw.u", []string{"b c"}, [][2]int{{0, 0}}},
+		{"nothing to repeat", "abc\n", ".", []string{"abc"}, [][2]int{{0, 0}}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			te := newtesteditor(t, tc.content)
+			te.typ(tc.keys)
+			te.assertlines(tc.want...)
+			te.assertcursors(tc.cursors...)
+			te.assertmode(normal)
+		})
+	}
+
+	t.Run("register", func(t *testing.T) {
+		te := newtesteditor(t, "abc def\n")
+		te.typ("\"adw.")
+		te.assertlines("")
+		te.typ("\"ap")
+		te.assertlines("def")
+	})
+}
+
+func TestMacro(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		keys    string
+		want    []string
+	}{
+		{"record and play", "a\nb\nc\n", "qaghix<Esc>jq@a", []string{"xa", "xb", "c"}},
+		{"count", "a\nb\nc\n", "qaghix<Esc>jq2@a", []string{"xa", "xb", "xc"}},
+		{"@@", "a\nb\nc\n", "qaghix<Esc>jq@a@@", []string{"xa", "xb", "xc"}},
+		{"command mode", "a\na\n", "qa:s/a/b/<CR>jq@a", []string{"b", "b"}},
+		{"append", "abcdef\n", "qadlqqAdlq@a", []string{"ef"}},
+		{"repeat in macro", "a b c d e\n", "qadw.q@a", []string{"e"}},
+		{"recursion is ignored", "abc\n", "qadl@aq@a", []string{"c"}},
+		{"empty register", "abc\n", "@b", []string{"abc"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			te := newtesteditor(t, tc.content)
+			te.typ(tc.keys)
+			te.assertlines(tc.want...)
+			te.assertmode(normal)
+		})
+	}
+
+	t.Run("recording message", func(t *testing.T) {
+		te := newtesteditor(t, "abc\n")
+		te.typ("qa")
+		te.assertmsg("recording @a")
+		te.typ("q")
+		te.assertmsg("")
+	})
+
+	t.Run("list", func(t *testing.T) {
+		te := newtesteditor(t, "abc def\n")
+		te.typ("qadwix<Esc>q:reg<CR>")
+		if !slices.Contains(te.term.screen.rows(), `"a  dwix<ESC>`) {
+			t.Errorf("macro is not listed:\n%v", fmtrows(te.term.screen.rows()))
+		}
+	})
+
+	// the macro is the text in the register, so it can be pasted, edited and yanked back to be played
+	t.Run("register", func(t *testing.T) {
+		te := newtesteditor(t, "a\nb\nc\n")
+		te.typ("qaghix<Esc>jq")
+		te.typ("j\"ap")
+		te.assertlines("xa", "b", "cghix<ESC>j")
+
+		te.typ("Fxry")
+		te.typ("Fg\"by$gg@b")
+		te.assertlines("yxa", "b", "cghiy<ESC>j")
+	})
+
+	// the clipboard content sent from the terminal while recording is not a keypress
+	t.Run("clipboard", func(t *testing.T) {
+		te := newtesteditor(t, "abc\n")
+		inputs := slices.Concat(keys("qa\"+"), []*input{{special: _clipboard, text: "xy"}}, keys("pq"))
+		ch := make(chan *input, len(inputs))
+		for _, in := range inputs {
+			ch <- in
+		}
+		close(ch)
+		for len(ch) != 0 {
+			te.e.handleinput(<-ch, ch)
+		}
+		te.assertlines("axybc")
+		if got := te.e.register.macro("a"); inputsstring(got) != `"+p` {
+			t.Errorf("macro mismatch: %q", inputsstring(got))
+		}
+	})
+
+	// the pasted text is played as the paste, not as the keys
+	t.Run("paste", func(t *testing.T) {
+		te := newtesteditor(t, "abc\ndef\n")
+		te.typ("qa")
+		te.send(&input{special: _paste, text: "dd\n<x>"})
+		te.typ("q")
+		te.assertlines("dd", "<x>abc", "def")
+
+		te.typ("jgh@a")
+		te.assertlines("dd", "<x>abc", "dd", "<x>def")
+	})
+}
+
+func TestInputsString(t *testing.T) {
+	tests := []struct {
+		inputs []*input
+		want   string
+		parsed string // the string of the inputs parsed back
+	}{
+		{keys("dwix<Esc>"), "dwix<ESC>", "dwix<ESC>"},
+		{keys("i<lt>a><CR><Esc>"), "i<lt>a><CR><ESC>", "i<lt>a><CR><ESC>"},
+		{keys("<C-r><Up>"), "<Ctrl+r><up>", "<Ctrl+r><up>"},
+		{[]*input{{r: 'x', mod: mod_alt}, {special: _right, mod: mod_ctrl | mod_shift}}, "<A-x><C-S-right>", "<A-x><C-S-right>"},
+		{[]*input{{r: 'i'}, {special: _paste, text: "a<b\nc"}}, "i<Paste>a<lt>b\nc</Paste>", "i<Paste>a<lt>b\nc</Paste>"},
+		{[]*input{{special: _paste, text: "<lt></Paste>"}}, "<Paste><lt>lt><lt>/Paste></Paste>", "<Paste><lt>lt><lt>/Paste></Paste>"},
+		// not terminated paste is the characters
+		{keys("<lt>Paste>a"), "<lt>Paste>a", "<lt>Paste>a"},
+	}
+
+	for _, tc := range tests {
+		got := inputsstring(tc.inputs)
+		if got != tc.want {
+			t.Errorf("want %q, got %q", tc.want, got)
+		}
+		if parsed := inputsstring(parseinputs(got)); parsed != tc.parsed {
+			t.Errorf("%q is parsed into %q", got, parsed)
+		}
+	}
+
+	// the newline and the tab in the register are Enter and Tab
+	if got := parseinputs("a\n\t<foo>"); inputsstring(got) != "a<CR><TAB><lt>foo>" {
+		t.Errorf("unexpected inputs: %q", inputsstring(got))
+	}
+}
+
+func TestUndo(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		keys    string
+		want    []string
+		cursors [][2]int
+	}{
+		{"insert session is one unit", "abc\n", "ix<CR>y<BS>z<Esc>u", []string{"abc"}, [][2]int{{0, 0}}},
+		{"each command is one unit", "abcd\n", "dldldlu", []string{"cd"}, [][2]int{{0, 0}}},
+		{"count", "abcd\n", "dldldl2u", []string{"bcd"}, [][2]int{{0, 0}}},
+		{"redo", "abcd\n", "dldldl2u<C-r>", []string{"cd"}, [][2]int{{0, 0}}},
+		{"redo restores cursors", "abc\n", "lixy<Esc>u<C-r>", []string{"axybc"}, [][2]int{{0, 3}}},
+		{"multi cursor", "abc\ndef\n", "Clix<Esc>u", []string{"abc", "def"}, [][2]int{{0, 1}, {1, 1}}},
+		{"o", "abc\ndef\n", "Cox<Esc>u", []string{"abc", "def"}, [][2]int{{0, 0}, {1, 0}}},
+		{"nothing to undo", "abc\n", "uu", []string{"abc"}, [][2]int{{0, 0}}},
+		{"nothing to redo", "abc\n", "dl<C-r>", []string{"bc"}, [][2]int{{0, 0}}},
+		{"new branch", "abc\n", "dludldl<C-r>u", []string{"bc"}, [][2]int{{0, 0}}},
+		{"redo follows the latest branch", "abcd\n", "dluldlu<C-r>", []string{"acd"}, [][2]int{{0, 1}}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			te := newtesteditor(t, tc.content)
+			te.typ(tc.keys)
+			te.assertlines(tc.want...)
+			te.assertcursors(tc.cursors...)
+		})
+	}
+
+	t.Run("dirty flag", func(t *testing.T) {
+		te := newtesteditor(t, "abc\n")
+		te.typ("dl")
+		if !te.screen().dirty {
+			t.Errorf("must be dirty after change")
+		}
+		te.typ("u")
+		if te.screen().dirty {
+			t.Errorf("must not be dirty after undo to the saved state")
+		}
+	})
+}
+
+func TestSelection(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		keys    string
+		want    []string
+		cursors [][2]int
+	}{
+		{"yank lines", "abc\ndef\n", "xyp", []string{"abc", "abc", "def"}, [][2]int{{1, 3}}},
+		{"yank lines upward", "abc\ndef\nghi\n", "jjxkkygep", []string{"abc", "def", "ghi", "abc", "def", "ghi"}, [][2]int{{5, 3}}},
+		{"delete lines", "abc\ndef\nghi\n", "xjd", []string{"ghi"}, [][2]int{{0, 0}}},
+		{"delete all lines", "abc\n", "xd", []string{""}, [][2]int{{0, 0}}},
+		{"yank chars", "abcd\n", "lvly", []string{"abcd"}, [][2]int{{0, 2}}},
+		{"delete chars", "abcd\n", "lvld", []string{"ad"}, [][2]int{{0, 1}}},
+		{"delete chars backward", "abcd\n", "llvhd", []string{"ad"}, [][2]int{{0, 1}}},
+		{"delete chars across lines", "abc\ndef\n", "lvjd", []string{"af"}, [][2]int{{0, 1}}},
+		{"change chars", "abc\n", "vlcxy<Esc>", []string{"xyc"}, [][2]int{{0, 2}}},
+		{"multi cursor delete", "abcd\nefgh\n", "Clvld", []string{"ad", "eh"}, [][2]int{{0, 1}, {1, 1}}},
+		{"undo chars change", "abc\n", "vlcxy<Esc>u", []string{"abc"}, [][2]int{{0, 1}}},
+		{"cancel", "abc\n", "vl<Esc>dl", []string{"ac"}, [][2]int{{0, 1}}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			te := newtesteditor(t, tc.content)
+			te.typ(tc.keys)
+			te.assertlines(tc.want...)
+			te.assertcursors(tc.cursors...)
+			te.assertmode(normal)
+		})
+	}
+
+	t.Run("highlight", func(t *testing.T) {
+		te := newtesteditor(t, "abcd\n")
+		te.typ("lvl")
+		te.assertmode(charselect)
+		cells := te.term.screen.cells[0]
+		for x := 5; x < 9; x++ {
+			selected := cells[x].bg == 3 || cells[x].inverse
+			if selected != (x == 6 || x == 7) {
+				t.Errorf("selection highlight mismatch at %v: %+v", x, cells[x])
+			}
+		}
+	})
+}
+
+func TestPaste(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		keys    string
+		want    []string
+		cursors [][2]int
+	}{
+		{"chars after", "abc\n", "vlyp", []string{"ababc"}, [][2]int{{0, 3}}},
+		{"chars before", "abc\n", "lvlyP", []string{"abbcc"}, [][2]int{{0, 3}}},
+		{"chars at line tail", "abc\n", "vyglp", []string{"abca"}, [][2]int{{0, 3}}},
+		{"chars with newline", "abc\ndef\n", "lvjyp", []string{"abc", "debc", "def"}, [][2]int{{2, 1}}},
+		{"lines above", "abc\ndef\n", "jxyP", []string{"abc", "def", "def"}, [][2]int{{1, 3}}},
+		{"deleted char", "abc\n", "dlp", []string{"bac"}, [][2]int{{0, 1}}},
+		{"to every cursor", "abc\ndef\n", "vyCp", []string{"aabc", "daef"}, [][2]int{{0, 1}, {1, 1}}},
+		{"per cursor", "abc\ndef\n", "Cvyglp", []string{"abca", "defd"}, [][2]int{{0, 3}, {1, 3}}},
+		{"undo", "abc\n", "vlypu", []string{"abc"}, [][2]int{{0, 1}}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			te := newtesteditor(t, tc.content)
+			te.typ(tc.keys)
+			te.assertlines(tc.want...)
+			te.assertcursors(tc.cursors...)
+		})
+	}
+}
+
+func TestRegister(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		keys    string
+		want    []string
+	}{
+		{"named", "abc\n", "v\"ayldl\"ap", []string{"aca"}},
+		{"unnamed has the latest", "abc\n", "v\"aylv\"byp", []string{"abbc"}},
+		{"append", "abc\n", "v\"ayl<Esc>lv\"Ay\"aP", []string{"abacc"}},
+		{"append lines to chars", "abc\ndef\n", "v\"ayjx\"Ay\"ap", []string{"abc", "def", "a", "def"}},
+		{"delete to register", "abc\n", "\"xdl\"xp", []string{"bac"}},
+		{"invalid register", "abc\n", "\"!dl", []string{"bc"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			te := newtesteditor(t, tc.content)
+			te.typ(tc.keys)
+			te.assertlines(tc.want...)
+		})
+	}
+
+	// the clipboard content received does not drop the yanks of the cursors
+	t.Run("clipboard with cursors", func(t *testing.T) {
+		te := newtesteditor(t, "abc\ndef\n")
+		te.typ("Cvy")
+		te.send(&input{special: _clipboard, text: "xy"})
+		te.typ("p")
+		te.assertlines("aabc", "ddef")
+	})
+
+	t.Run("clipboard", func(t *testing.T) {
+		te := newtesteditor(t, "abc\n")
+		te.typ("vl\"+y")
+		if te.term.screen.clipboard != "ab" {
+			t.Errorf("clipboard mismatch: %q", te.term.screen.clipboard)
+		}
+
+		// the clipboard is not asked on yank
+		if te.term.screen.clipboardqueries != 0 {
+			t.Errorf("clipboard must not be asked on yank")
+		}
+
+		// the clipboard content sent from the terminal as the reply is pasted,
+		// and the keys typed before the reply are handled after the paste
+		inputs := keys("\"+pdl")
+		inputs = append(inputs, &input{special: _clipboard, text: "xy"})
+		ch := make(chan *input, len(inputs))
+		for _, in := range inputs {
+			ch <- in
+		}
+		te.e.handleinput(<-ch, ch)
+		if te.term.screen.clipboardqueries != 1 {
+			t.Errorf("clipboard must be asked once on paste: %v", te.term.screen.clipboardqueries)
+		}
+		te.assertlines("abxc")
+
+		// without the reply, the content received last is pasted
+		inputs = keys("\"+P")
+		ch = make(chan *input, len(inputs))
+		for _, in := range inputs {
+			ch <- in
+		}
+		te.e.handleinput(<-ch, ch)
+		te.assertlines("abxxyc")
+	})
+
+	t.Run("list", func(t *testing.T) {
+		te := newtesteditor(t, "abc\ndef\n")
+		te.typ("v\"ay:reg<CR>")
+		te.assertmsg("press any key to continue")
+		rows := te.term.screen.rows()
+		if !slices.Contains(rows, `""  a`) || !slices.Contains(rows, `"a  a`) {
+			t.Errorf("registers are not listed:\n%v", fmtrows(rows))
+		}
+
+		// dismissed by the keypress
+		te.typ("j")
+		te.assertcursors([2]int{0, 0})
+		te.assertscreen("   1 abc", "   2 def")
+	})
+}
+
+func TestLanguage(t *testing.T) {
+	tests := []struct {
+		filename  string
+		firstline string
+		want      string
+	}{
+		{"main.go", "", "go"},
+		{"a.py", "", "python"},
+		{"a.c", "", "c"},
+		{"a.h", "", "c"},
+		{"a.hpp", "", "cpp"},
+		{"a.js", "", "javascript"},
+		{"a.tsx", "", "typescript"},
+		{"lib.rs", "", "rust"},
+		{"A.java", "", "java"},
+		{"run.sh", "", "shell"},
+		{".bashrc", "", "shell"},
+		{"a.json", "", "json"},
+		{"Makefile", "", "make"},
+		{"sub/Dockerfile", "", "dockerfile"},
+		{"README.md", "", "markdown"},
+		{"script", "#!/bin/bash", "shell"},
+		{"script", "#!/usr/bin/env python3", "python"},
+		{"script", "#!/usr/bin/env -S python3.12 -u", "python"},
+		{"script", "#!/usr/bin/env node", "javascript"},
+		{"a.py", "#!/bin/sh", "python"},
+		{"README.txt", "", ""},
+		{"script", "#!/usr/bin/unknown", ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.filename+" "+tc.firstline, func(t *testing.T) {
+			got := ""
+			if lang := detectlanguage(tc.filename, tc.firstline); lang != nil {
+				got = lang.name
+			}
+			if got != tc.want {
+				t.Errorf("language mismatch\n  want: %q\n  got:  %q", tc.want, got)
+			}
+		})
+	}
+
+	t.Run("highlight", func(t *testing.T) {
+		te := newtesteditorfile(t, "a.json", "{\"a\": 1}\n", 40, 10)
+		colors := te.screen().lineattrs[0].colors
+		if colors[1] != theme_doraemon.colorstring || colors[6] != theme_doraemon.colornumber {
+			t.Errorf("unexpected colors: %v", colors)
+		}
+	})
+
+	t.Run("highlight by shebang", func(t *testing.T) {
+		te := newtesteditorfile(t, "script", "#!/bin/sh\n# comment\n", 40, 10)
+		if colors := te.screen().lineattrs[1].colors; colors[0] != theme_doraemon.colorlinecomment {
+			t.Errorf("unexpected colors: %v", colors)
+		}
+	})
+}
+
+func TestSyntaxFile(t *testing.T) {
+	t.Run("toml", func(t *testing.T) {
+		tests := []struct {
+			name string
+			src  string
+			want string // JSON form of the parsed values
+			err  string
+		}{
+			{"string", `a = "x\ty\u3042" # comment`, `{"a":"x\tyあ"}`, ""},
+			{"literal string", `a = 'C:\dir'`, `{"a":"C:\\dir"}`, ""},
+			{"integer and bool", "a = -1_000\nb = true\nc = false", `{"a":-1000,"b":true,"c":false}`, ""},
+			{"array", "a = [\n  \"x\", # first\n  'y',\n]\nb = []", `{"a":["x","y"],"b":[]}`, ""},
+			{"table", "a = 1\n[t.u]\nb = 2\n[t]\nc = 3", `{"a":1,"t":{"c":3,"u":{"b":2}}}`, ""},
+			{"quoted key", `"a b" = 1`, `{"a b":1}`, ""},
+			{"missing equal", "\na 1", "", "line 2: = is expected after a"},
+			{"duplicated", "a = 1\na = 2", "", "line 2: a is already defined"},
+			{"unterminated string", `a = "x`, "", "line 1: string is not terminated"},
+			{"invalid escape", `a = "\x"`, "", `line 1: invalid escape \x`},
+			{"invalid value", "a = yes", "", "line 1: invalid value"},
+			{"trailing garbage", "a = 1 2", "", "line 1: unexpected character '2'"},
+			{"unterminated array", "a = [1\n2]", "", "line 2: , or ] is expected in the array"},
+			{"float", "a = 1\nb = 1.5", "", "line 2: float is not supported"},
+			{"exponent", "a = 1e3", "", "line 1: float is not supported"},
+			{"inf", "a = inf", "", "line 1: float is not supported"},
+			{"date", "a = 1979-05-27", "", "line 1: date and time is not supported"},
+			{"inline table", "a = { b = 1 }", "", "line 1: inline table is not supported"},
+			{"multi-line string", "a = \"\"\"\nx\"\"\"", "", "line 1: multi-line string is not supported"},
+			{"multi-line literal string", "a = '''x'''", "", "line 1: multi-line string is not supported"},
+			{"dotted key", "a.b . c = 1", "", "line 1: dotted key a.b.c is not supported"},
+		}
+
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				values, err := parsetoml(tc.src)
+				if tc.err != "" {
+					if err == nil || err.Error() != tc.err {
+						t.Fatalf("error mismatch\n  want: %q\n  got:  %v", tc.err, err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				got, err := json.Marshal(values)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != tc.want {
+					t.Errorf("values mismatch\n  want: %v\n  got:  %v", tc.want, string(got))
+				}
+			})
+		}
+	})
+
+	// the loaded languages are registered globally, so they are removed after the test
+	loadtemp := func(t *testing.T, files map[string]string) []error {
+		t.Helper()
+
+		orig := slices.Clone(languages)
+		t.Cleanup(func() { languages = orig })
+
+		dir := t.TempDir()
+		for name, content := range files {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return loadsyntaxfiles(dir)
+	}
+
+	t.Run("load", func(t *testing.T) {
+		errs := loadtemp(t, map[string]string{
+			"pipeline.toml": `
+name = "pipeline"
+extensions = ["pl", "go"] # overrides go
+filenames = ["Pipefile"]
+shebangs = ["pipe"]
+line_comment = "--"
+block_comment_start = "{-"
+block_comment_end = "-}"
+string_starts = ['"']
+multiline_string_starts = ["'''"]
+keywords = ["stage", "run"]
+symbols = ["(", ")"]
+operators = ["|", "->", "==>"]
+`,
+			"query.json": `{"name": "query", "extensions": ["q"], "line_comment": "#", "keywords": ["select"]}`,
+			"notes.txt":  "ignored",
+		})
+		if len(errs) != 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+
+		for _, tc := range []struct{ filename, firstline, want string }{
+			{"a.pl", "", "pipeline"},
+			{"a.go", "", "pipeline"},
+			{"Pipefile", "", "pipeline"},
+			{"run", "#!/usr/bin/env pipe", "pipeline"},
+			{"a.q", "", "query"},
+			{"a.py", "", "python"},
+		} {
+			got := ""
+			if lang := detectlanguage(tc.filename, tc.firstline); lang != nil {
+				got = lang.name
+			}
+			if got != tc.want {
+				t.Errorf("language of %v mismatch\n  want: %q\n  got:  %q", tc.filename, tc.want, got)
+			}
+		}
+
+		syntax := detectlanguage("a.pl", "").syntax
+		if !slices.Equal(syntax.operators, []string{"|"}) || !slices.Equal(syntax.operators2, []string{"->"}) || !slices.Equal(syntax.operators3, []string{"==>"}) {
+			t.Errorf("operators are not sorted by the length: %v %v %v", syntax.operators, syntax.operators2, syntax.operators3)
+		}
+		if len(syntax.stringends) != 1 || string(syntax.stringends[0]) != `"` {
+			t.Errorf("string ends must default to the starts: %q", syntax.stringends)
+		}
+
+		te := newtesteditorfile(t, "a.pl", "stage -- x\n", 40, 10)
+		colors := te.screen().lineattrs[0].colors
+		if colors[0] != theme_doraemon.colorkeyword || colors[6] != theme_doraemon.colorlinecomment {
+			t.Errorf("unexpected colors: %v", colors)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		errs := loadtemp(t, map[string]string{
+			"a.toml": `extensions = ["a"]`,
+			"b.json": `{"name": "b", "keyword": ["x"]}`,
+			"c.toml": "name = \"c\"\nline_comment = \"///\"",
+			"d.toml": "name = \"d\"\nstring_starts = ['\"']\nstring_ends = []",
+			"e.toml": "name = \"e\"\noperators = [\"====\"]",
+			"f.toml": "name = 1",
+			"g.toml": "name = \"g\"\nblock_comment_start = \"/*\"",
+			"h.json": `{"name": "h", "extensions": ["h2"]}`,
+		})
+
+		want := []string{
+			"syntax file a.toml: name is required",
+			`syntax file b.json: json: unknown field "keyword"`,
+			`syntax file c.toml: line_comment must be 1 or 2 characters: "///"`,
+			"syntax file d.toml: string_starts and string_ends must have the same number of quotes",
+			`syntax file e.toml: operator must be 1 to 3 characters: "===="`,
+			"syntax file f.toml: json: cannot unmarshal number into Go struct field syntaxdef.name of type string",
+			"syntax file g.toml: block_comment_start and block_comment_end must be given together",
+		}
+		got := []string{}
+		for _, err := range errs {
+			got = append(got, err.Error())
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("errors mismatch\n  want: %q\n  got:  %q", want, got)
+		}
+
+		// the valid file is still loaded
+		if lang := detectlanguage("a.h2", ""); lang == nil || lang.name != "h" {
+			t.Errorf("valid syntax file is not loaded: %v", lang)
+		}
+	})
+
+	t.Run("startup error", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "test.txt")
+		if err := os.WriteFile(filename, []byte(""), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		errs := []error{fmt.Errorf("syntax file a.toml: name is required"), fmt.Errorf("syntax file b.toml: line 1: invalid value")}
+		te := opentesteditoropts(t, filename, 60, 10, &options{theme: theme_doraemon, errs: errs})
+		te.assertmsg("syntax file a.toml: name is required (and 1 more errors)")
+	})
+}
+
+func TestTheme(t *testing.T) {
+	t.Run("color", func(t *testing.T) {
+		tests := []struct {
+			name      string
+			v         any
+			truecolor bool
+			want      int
+			err       string
+		}{
+			{"index", float64(12), false, 12, ""},
+			{"default", float64(-1), false, -1, ""},
+			{"rgb", "#ff8000", true, rgbcolor(255, 128, 0), ""},
+			{"rgb fallback", "#ff0000", false, 196, ""},
+			{"rgb fallback black", "#000000", false, 16, ""},
+			{"rgb fallback gray", "#808080", false, 244, ""},
+			{"out of range", float64(256), false, 0, "color must be -1 to 255: 256"},
+			{"fraction", 1.5, false, 0, "color must be -1 to 255: 1.5"},
+			{"name", "red", true, 0, `color must be like "#rrggbb": "red"`},
+			{"bad hex", "#ggffff", true, 0, `color must be like "#rrggbb": "#ggffff"`},
+			{"bool", true, true, 0, `color must be a number or "#rrggbb": true`},
+		}
+
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				got, err := parsecolor(tc.v, tc.truecolor)
+				if tc.err != "" {
+					if err == nil || err.Error() != tc.err {
+						t.Fatalf("error mismatch\n  want: %q\n  got:  %v", tc.err, err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != tc.want {
+					t.Errorf("color mismatch\n  want: %v\n  got:  %v", tc.want, got)
+				}
+			})
+		}
+	})
+
+	// the loaded themes are registered globally, so they are removed after the test
+	loadtemp := func(t *testing.T, name, content string, truecolor bool) []error {
+		t.Helper()
+
+		orig := maps.Clone(themes)
+		t.Cleanup(func() { themes = orig })
+
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return loadthemes(dir, truecolor)
+	}
+
+	t.Run("load", func(t *testing.T) {
+		errs := loadtemp(t, "themes.toml", `
+[night]
+base = "gian"
+keyword = "#ff8000"
+statusline = 33
+
+[night-dim]
+base = "night"
+linenumber = -1
+
+[doraemon]
+base = "doraemon"
+error = 9
+`, true)
+		if len(errs) != 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+
+		night := themes["night"]
+		if night == nil || night.colorkeyword != rgbcolor(255, 128, 0) || night.colorstatusline != 33 || night.colorident != theme_gian.colorident {
+			t.Errorf("unexpected theme: %+v", night)
+		}
+		dim := themes["night-dim"]
+		if dim == nil || dim.colorkeyword != rgbcolor(255, 128, 0) || dim.colorlinenumber != -1 {
+			t.Errorf("unexpected theme: %+v", dim)
+		}
+		if themes["doraemon"].colorerror != 9 || themes["doraemon"].colorident != theme_doraemon.colorident {
+			t.Errorf("built-in theme is not overridden: %+v", themes["doraemon"])
+		}
+	})
+
+	t.Run("load json", func(t *testing.T) {
+		errs := loadtemp(t, "themes.json", `{"mono": {"string": "#ff0000", "number": 7}}`, false)
+		if len(errs) != 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+		if mono := themes["mono"]; mono == nil || mono.colorstring != 196 || mono.colornumber != 7 {
+			t.Errorf("unexpected theme: %+v", mono)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			content string
+			err     string
+		}{
+			{"unknown color", "[a]\nkeywords = 1", "theme file themes.toml: a: unknown color: keywords"},
+			{"unknown base", "[a]\nbase = \"b\"", "theme file themes.toml: a: unknown base theme: b"},
+			{"loop", "[a]\nbase = \"b\"\n[b]\nbase = \"a\"", "theme file themes.toml: a: base theme loops"},
+			{"invalid color", "[a]\nerror = \"#12\"", `theme file themes.toml: a: error: color must be like "#rrggbb": "#12"`},
+			{"syntax", "[a\n", "theme file themes.toml: line 1: ] is expected after the table name"},
+		}
+
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				errs := loadtemp(t, "themes.toml", tc.content, true)
+				if len(errs) != 1 || errs[0].Error() != tc.err {
+					t.Fatalf("errors mismatch\n  want: %q\n  got:  %v", tc.err, errs)
+				}
+				if _, ok := themes["a"]; ok {
+					t.Errorf("invalid theme is loaded")
+				}
+			})
+		}
+	})
+
+	t.Run("render", func(t *testing.T) {
+		th := *theme_doraemon
+		th.colorstatusline = rgbcolor(1, 2, 3)
+		th.colorlinenumber = 100
+		th.colorselection = 200
+		th.colorerror = rgbcolor(255, 0, 0)
+
+		filename := filepath.Join(t.TempDir(), "test.txt")
+		if err := os.WriteFile(filename, []byte("abc\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		te := opentesteditoropts(t, filename, 40, 10, &options{theme: &th})
+		te.typ("vl")
+
+		cells := te.term.screen.cells
+		if c := cells[0][3]; c.fg != 100 {
+			t.Errorf("line number color mismatch: %+v", c)
+		}
+		if c := cells[0][5]; c.bg != 200 {
+			t.Errorf("selection color mismatch: %+v", c)
+		}
+		if c := cells[8][1]; c.fg != rgbcolor(1, 2, 3) {
+			t.Errorf("status line color mismatch: %+v", c)
+		}
+
+		te.typ("<Esc>:unknown<CR>")
+		if c := te.term.screen.cells[9][0]; c.fg != rgbcolor(255, 0, 0) {
+			t.Errorf("error color mismatch: %+v", c)
+		}
+	})
+}
+
+func TestGoHighlight(t *testing.T) {
+	// each character of the mask tells the expected color of the character:
+	// k: keyword, i: ident, n: number, s: string, m: multi-line string, l: line comment, b: block comment,
+	// y: symbol, o: operator, .: none
+	maskcolors := map[rune]int{
+		'k': theme_nobita.colorkeyword,
+		'i': theme_nobita.colorident,
+		'n': theme_nobita.colornumber,
+		's': theme_nobita.colorstring,
+		'm': theme_nobita.colormultilinestring,
+		'l': theme_nobita.colorlinecomment,
+		'b': theme_nobita.colorblockcomment,
+		'y': theme_nobita.colorsymbol,
+		'o': theme_nobita.coloroperator,
+		'.': -1,
+	}
+
+	tests := []struct {
+		name string
+		prev *lineattribute
+		text string
+		mask string
+		next *lineattribute
+	}{
+		{"tokens", &lineattribute{}, "x := 1.5i + 'a' // c", "i.oo.nnnn.o.sss.llll", &lineattribute{}},
+		{"keyword", &lineattribute{}, "func f() {}", "kkkk.iyy.yy", &lineattribute{}},
+		{"rune", &lineattribute{}, `'\''`, "ssss", &lineattribute{}},
+		{"multi-byte", &lineattribute{}, `"あ"+x`, "sssoi", &lineattribute{}},
+		{"raw string start", &lineattribute{}, "s := `a", "i.oo.mm", &lineattribute{inmultilinestr: true}},
+		{"raw string", &lineattribute{inmultilinestr: true}, "a", "m", &lineattribute{inmultilinestr: true}},
+		{"raw string end", &lineattribute{inmultilinestr: true}, "a` + x", "mm.o.i", &lineattribute{}},
+		{"block comment start", &lineattribute{}, "x /* a", "i.bbbb", &lineattribute{inblockcomment: true}},
+		{"block comment end", &lineattribute{inblockcomment: true}, "a */ x", "bbbb.i", &lineattribute{}},
+		{"block comment in line", &lineattribute{}, "/* a */ x", "bbbbbbb.i", &lineattribute{}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			attr := gohighlighter{theme: theme_nobita}.highlightline(newline(tc.text), tc.prev)
+
+			want := []int{}
+			for _, r := range tc.mask {
+				want = append(want, maskcolors[r])
+			}
+			if got := attr.colors[:len(want)]; !slices.Equal(got, want) {
+				t.Errorf("colors mismatch\n  want: %v\n  got:  %v", want, got)
+			}
+			if !attr.samestate(tc.next) {
+				t.Errorf("state mismatch\n  want: %v\n  got:  %v", tc.next, attr)
+			}
+		})
+	}
+}
+
+func TestSemantic(t *testing.T) {
+	src := strings.Join([]string{
+		"package main",
+		"",
+		`import (`,
+		`	"encoding/json"`,
+		`	yaml "gopkg.in/yaml.v3"`,
+		`	"github.com/a/b/v2"`,
+		`)`,
+		"",
+		"type point struct{ x, y int }",
+		"",
+		"func (p *point) add(o point) point {",
+		"	return point{x: p.x + o.x, y: p.y + o.y}",
+		"}",
+		"",
+		"func main() {",
+		"	index, list := 0, []string{}",
+		"	json.Marshal(list)",
+		"	var json = b.Thing{}",
+		"	_ = json.field",
+		"	println(len(list), index, yaml.Node{}, string(rune(1)))",
+		"}",
+	}, "\n")
+
+	lines := parsegosemantic(src)
+
+	tests := []struct {
+		y     int
+		name  string
+		nth   int // n-th appearance of the name on the line
+		class semanticclass
+	}{
+		{4, "yaml", 0, sc_package},
+		{8, "point", 0, sc_type},
+		{8, "x", 0, sc_field},
+		{8, "int", 0, sc_type},
+		{10, "point", 0, sc_type},
+		{10, "add", 0, sc_function},
+		{10, "point", 2, sc_type},
+		{11, "point", 0, sc_type},
+		{11, "x", 0, sc_field},
+		{11, "x", 1, sc_field},
+		{11, "y", 2, sc_field},
+		{15, "index", 0, 0},
+		{15, "list", 0, 0},
+		{15, "string", 0, sc_type},
+		{16, "json", 0, sc_package},
+		{16, "Marshal", 0, sc_function},
+		{16, "list", 0, 0},
+		{17, "json", 0, 0},
+		{17, "b", 0, sc_package},
+		{17, "Thing", 0, sc_type},
+		{18, "json", 0, 0},
+		{18, "field", 0, sc_field},
+		{19, "println", 0, sc_function},
+		{19, "len", 0, sc_function},
+		{19, "yaml", 0, sc_package},
+		{19, "Node", 0, sc_type},
+		{19, "string", 0, sc_type},
+		{19, "rune", 0, sc_type},
+	}
+
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("%v %v %v", tc.y, tc.name, tc.nth), func(t *testing.T) {
+			// find the position of the n-th identifier of the name
+			start := -1
+			runes := []rune(lines[tc.y].text)
+			for i, n := 0, 0; i+len(tc.name) <= len(runes); i++ {
+				isident := func(j int) bool {
+					return 0 <= j && j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_')
+				}
+				if string(runes[i:i+len(tc.name)]) == tc.name && !isident(i-1) && !isident(i+len(tc.name)) {
+					if n == tc.nth {
+						start = i
+						break
+					}
+					n++
+				}
+			}
+			if start == -1 {
+				t.Fatalf("%v is not found on the line %q", tc.name, lines[tc.y].text)
+			}
+
+			var got semanticclass
+			for _, tk := range lines[tc.y].tokens {
+				if tk.start == start {
+					got = tk.class
+					if tk.end != start+len(tc.name) {
+						t.Errorf("token end mismatch: %v", tk)
+					}
+				}
+			}
+			if got != tc.class {
+				t.Errorf("class mismatch\n  want: %v\n  got:  %v", tc.class, got)
+			}
+		})
+	}
+
+	t.Run("editor", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "a.go")
+		if err := os.WriteFile(filename, []byte("package main\nimport \"fmt\"\nfunc f() {\n\tfmt.Println()\n}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		te := opentesteditoropts(t, filename, 60, 10, &options{theme: theme_doraemon, semantic: true})
+		colors := func(y int) []int { return te.screen().lineattrs[y].colors }
+
+		// before parsing, the identifiers have the color of the tokenizer
+		if colors(3)[1] != theme_doraemon.colorident {
+			t.Errorf("unexpected color before parsing: %v", colors(3))
+		}
+
+		te.waitsemantic()
+		if colors(2)[5] != theme_doraemon.colorfunction || colors(3)[1] != theme_doraemon.colorpackage || colors(3)[5] != theme_doraemon.colorfunction {
+			t.Errorf("unexpected color after parsing: %v %v", colors(2), colors(3))
+		}
+
+		// the moved line loses the tokens until the next result
+		te.typ("jjjOfmt := 0<Esc>")
+		te.assertlines("package main", "import \"fmt\"", "func f() {", "fmt := 0", "\tfmt.Println()", "}")
+		if colors(4)[1] != theme_doraemon.colorident {
+			t.Errorf("stale tokens are applied: %v", colors(4))
+		}
+
+		// fmt is a local variable now
+		te.waitsemantic()
+		if colors(3)[0] != theme_doraemon.colorident || colors(4)[1] != theme_doraemon.colorident || colors(4)[5] != theme_doraemon.colorfunction {
+			t.Errorf("unexpected color after parsing again: %v %v", colors(3), colors(4))
+		}
+
+		// not parsed again until the text is changed
+		te.typ("jl")
+		if te.screen().semantic.running {
+			t.Errorf("parsed without change")
+		}
+		te.typ("u")
+		if !te.screen().semantic.running {
+			t.Errorf("not parsed after undo")
+		}
+		te.waitsemantic()
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "a.go")
+		if err := os.WriteFile(filename, []byte("package main\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		base := runtime.NumGoroutine()
+		te := opentesteditoropts(t, filename, 60, 10, &options{theme: theme_doraemon, semantic: true})
+		if !te.screen().semantic.running {
+			t.Fatalf("not parsed on open")
+		}
+
+		// nobody receives the result, but the parse finishes once the buffer is closed
+		te.e.close()
+		deadline := time.Now().Add(5 * time.Second)
+		for base < runtime.NumGoroutine() {
+			if time.Now().After(deadline) {
+				t.Fatalf("the parse is not finished after the buffer is closed")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+func TestMarkdown(t *testing.T) {
+	// each character of the mask tells the expected color of the character:
+	// h: heading, e: emphasis, c: code, l: link, m: list marker, .: none
+	maskcolors := map[rune]int{
+		'h': theme_doraemon.colorheading,
+		'e': theme_doraemon.coloremphasis,
+		'c': theme_doraemon.colorcode,
+		'l': theme_doraemon.colorlink,
+		'm': theme_doraemon.colorlistmarker,
+		'.': -1,
+	}
+
+	tests := []struct {
+		text string
+		mask string
+	}{
+		{"# Title", "hhhhhhh"},
+		{"   ## a", "hhhhhhh"},
+		{"#Title", "......"},
+		{"####### a", "........."},
+		{"- item", "m....."},
+		{"  * item", "..m....."},
+		{"10. item", "mmm....."},
+		{"-item", "....."},
+		{"> quote", "m......"},
+		{"> - a", "m.m.."},
+		{"a *em* b", "..eeee.."},
+		{"a **strong** b", "..eeeeeeeeee.."},
+		{"_a_ b", "eee.."},
+		{"snake_case_name", "..............."},
+		{"a * b * c", "........."},
+		{"* not *closed", "m............"},
+		{`\*a\*`, "....."},
+		{"use `x*y*z` here", "....ccccccc....."},
+		{"``a ` b``", "ccccccccc"},
+		{"`open", "....."},
+		{"[a](http://x) ![i](p.png)", "lllllllllllll.lllllllllll"},
+		{"[a][ref]", "llllllll"},
+		{"[not a link]", "............"},
+		{"<https://a.b> <b>", "lllllllllllll...."},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.text, func(t *testing.T) {
+			h := newmarkdownhighlighter(theme_doraemon)
+			attr := h.highlightline(newline(tc.text), &lineattribute{})
+
+			want := []int{}
+			for _, r := range tc.mask {
+				want = append(want, maskcolors[r])
+			}
+			if got := attr.colors[:len(want)]; !slices.Equal(got, want) {
+				t.Errorf("colors mismatch\n  want: %v\n  got:  %v", want, got)
+			}
+		})
+	}
+
+	t.Run("fenced code", func(t *testing.T) {
+		te := newtesteditorfile(t, "a.md", "```go\nfunc main() {}\n```\n~~~~ unknown\n*a*\n~~~\n~~~~\n*a*\n", 40, 10)
+		attrs := te.screen().lineattrs
+
+		code := theme_doraemon.colorcode
+		if attrs[0].colors[0] != code || attrs[0].fencelang != lang_go {
+			t.Errorf("unexpected opening fence: %v", attrs[0])
+		}
+		if colors := attrs[1].colors; colors[5] != theme_doraemon.colorident || colors[12] != theme_doraemon.colorsymbol {
+			t.Errorf("code is not highlighted as go: %v", colors)
+		}
+		if attrs[2].colors[0] != code || attrs[2].fence != "" {
+			t.Errorf("unexpected closing fence: %v", attrs[2])
+		}
+
+		// the code in the unknown language, and the fence shorter than the opening one does not close the block
+		for _, y := range []int{4, 5} {
+			if attrs[y].colors[0] != code || attrs[y].fence != "~~~~" {
+				t.Errorf("line %v is not in the code block: %v", y, attrs[y])
+			}
+		}
+		if attrs[7].colors[0] != theme_doraemon.coloremphasis {
+			t.Errorf("line after the block is not highlighted: %v", attrs[7])
+		}
+	})
+
+	t.Run("edit fence", func(t *testing.T) {
+		te := newtesteditorfile(t, "a.md", "a\n*b*\nc\n", 40, 10)
+
+		te.typ("ggO```<Esc>")
+		te.assertlines("```", "a", "*b*", "c")
+		if colors := te.screen().lineattrs[2].colors; colors[0] != theme_doraemon.colorcode {
+			t.Errorf("line is not in the code block after opening the fence: %v", colors)
+		}
+
+		te.typ("ggdd")
+		if colors := te.screen().lineattrs[1].colors; colors[0] != theme_doraemon.coloremphasis {
+			t.Errorf("line is still in the code block after deleting the fence: %v", colors)
+		}
+	})
+
+	t.Run("fence language", func(t *testing.T) {
+		for name, want := range map[string]*language{"go": lang_go, "Python": lang_python, "py": lang_python, "bash": lang_shell, "md": lang_markdown, "": nil, "cobol": nil} {
+			if got := findlanguage(name); got != want {
+				t.Errorf("language of %q mismatch: %v", name, got)
+			}
+		}
+	})
+}
+
+func TestSearch(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		keys    string
+		cursors [][2]int
+	}{
+		{"forward", "abc\nabc\n", "/b<CR>", [][2]int{{0, 1}}},
+		{"next", "abc\nabc\n", "/b<CR>n", [][2]int{{1, 1}}},
+		{"wrap", "abc\nabc\n", "/b<CR>nn", [][2]int{{0, 1}}},
+		{"previous", "abc\nabc\n", "/b<CR>N", [][2]int{{1, 1}}},
+		{"backward", "abc\nabc\n", "j?b<CR>", [][2]int{{0, 1}}},
+		{"backward next", "abc\nabc\n", "j?b<CR>n", [][2]int{{1, 1}}},
+		{"regexp", "abc\na12\n", "/[0-9]+<CR>", [][2]int{{1, 1}}},
+		{"count", "ab ab ab ab\n", "/b<CR>2n", [][2]int{{0, 7}}},
+		{"cancel", "abc\nabc\n", "/c<Esc>", [][2]int{{0, 0}}},
+		{"last pattern", "abc\nabc\n", "/c<CR>gg/<CR>", [][2]int{{0, 2}}},
+		{"multi cursor", "abc\nabc\nabc\n", "C/c<CR>", [][2]int{{0, 2}, {1, 2}}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			te := newtesteditor(t, tc.content)
+			te.typ(tc.keys)
+			te.assertcursors(tc.cursors...)
+			te.assertmode(normal)
+		})
+	}
+
+	t.Run("incremental", func(t *testing.T) {
+		te := newtesteditor(t, "abc\nxbc\n")
+		te.typ("/x")
+		te.assertmode(search)
+		te.assertmsg("/x")
+		te.assertcursors([2]int{1, 0})
+
+		te.typ("<BS>c")
+		te.assertcursors([2]int{0, 2})
+
+		// the match not under the cursor is highlighted
+		if te.term.screen.cells[1][7].bg != 24 {
+			t.Errorf("match is not highlighted")
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		te := newtesteditor(t, "abc\n")
+		te.typ("/z<CR>")
+		te.assertmsg("pattern not found: z")
+	})
+}
+
+func TestSubstitute(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		keys    string
+		want    []string
+		msg     string
+	}{
+		{"current line", "aa\naa\n", ":s/a/b/<CR>", []string{"ba", "aa"}, "1 substitutions on 1 lines"},
+		{"global", "aa\naa\n", ":s/a/b/g<CR>", []string{"bb", "aa"}, "2 substitutions on 1 lines"},
+		{"whole", "aa\naa\n", ":%s/a/b/g<CR>", []string{"bb", "bb"}, "4 substitutions on 2 lines"},
+		{"range", "a\na\na\n", ":2,3s/a/b/<CR>", []string{"a", "b", "b"}, "2 substitutions on 2 lines"},
+		{"range with $", "a\na\na\n", ":2,$s/a/b/<CR>", []string{"a", "b", "b"}, "2 substitutions on 2 lines"},
+		{"capture group", "ab\n", ":s/(a)(b)/$2$1/<CR>", []string{"ba"}, "1 substitutions on 1 lines"},
+		{"newline", "ab\n", ":s/a/x\\ny/<CR>", []string{"x", "yb"}, "1 substitutions on 1 lines"},
+		{"delimiter", "a/b\n", ":s|/|-|<CR>", []string{"a-b"}, "1 substitutions on 1 lines"},
+		{"selection", "a\na\na\n", "jxj:s/a/b/<CR>", []string{"a", "b", "b"}, "2 substitutions on 2 lines"},
+		{"multi cursor", "a\na\na\n", "C:s/a/b/<CR>", []string{"b", "b", "a"}, "2 substitutions on 2 lines"},
+		{"not found", "a\n", ":s/z/b/<CR>", []string{"a"}, "pattern not found: z"},
+		{"invalid range", "a\n", ":5s/a/b/<CR>", []string{"a"}, "invalid range: 5"},
+		{"unknown command", "a\n", ":foo<CR>", []string{"a"}, "unknown command!"},
+		{"confirm", "a a a\n", ":s/a/b/gc<CR>yny", []string{"b a b"}, "2 substitutions on 1 lines"},
+		{"confirm all", "a a a\n", ":s/a/b/gc<CR>na", []string{"a b b"}, "2 substitutions on 1 lines"},
+		{"confirm quit", "a a a\n", ":s/a/b/gc<CR>yq", []string{"b a a"}, "1 substitutions on 1 lines"},
+		{"line head", "a\nb\n", ":%s/^/# /<CR>", []string{"# a", "# b"}, "2 substitutions on 2 lines"},
+		{"line end", "a\nb\n", ":%s/$/;/<CR>", []string{"a;", "b;"}, "2 substitutions on 2 lines"},
+		{"empty line", "\n", ":s/^/x/<CR>", []string{"x"}, "1 substitutions on 1 lines"},
+		{"empty matches", "axb\n", ":s/x*/-/g<CR>", []string{"-a-b-"}, "3 substitutions on 1 lines"},
+		{"confirm empty match", "a\nb\n", ":%s/$/;/c<CR>ny", []string{"a", "b;"}, "1 substitutions on 1 lines"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			te := newtesteditor(t, tc.content)
+			te.typ(tc.keys)
+			te.assertlines(tc.want...)
+			te.assertmsg(tc.msg)
+			te.assertmode(normal)
+		})
+	}
+
+	t.Run("undo", func(t *testing.T) {
+		te := newtesteditor(t, "aa\naa\n")
+		te.typ(":%s/a/b/g<CR>u")
+		te.assertlines("aa", "aa")
+	})
+
+	// the cursors moved to show the matches are put back
+	t.Run("confirm keeps cursors", func(t *testing.T) {
+		tests := []struct {
+			name string
+			keys string
+			want []string
+		}{
+			{"finished", "$C:%s/a/b/gc<CR>ynyn", []string{"b a", "b a"}},
+			{"cancelled", "$C:%s/a/b/gc<CR>y<Esc>", []string{"b a", "a a"}},
+		}
+
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				te := newtesteditor(t, "a a\na a\n")
+				te.typ(tc.keys)
+				te.assertlines(tc.want...)
+				te.assertcursors([2]int{0, 3}, [2]int{1, 3})
+			})
+		}
+	})
+}
+
+func TestFileFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		lines   []string
+		format  string
+	}{
+		{"unix", "a\nb\n", []string{"a", "b"}, "unix"},
+		{"noeol", "a\nb", []string{"a", "b"}, "unix noeol"},
+		{"dos", "a\r\nb\r\n", []string{"a", "b"}, "dos"},
+		{"dos noeol", "a\r\nb", []string{"a", "b"}, "dos noeol"},
+		{"mixed", "a\r\nb\n", []string{"a\r", "b"}, "unix"},
+		{"bom", "\xef\xbb\xbfa\n", []string{"a"}, "unix bom"},
+		{"empty", "", []string{""}, "unix"},
+		{"newline", "\n", []string{""}, "unix"},
+		{"empty line", "\n\n", []string{"", ""}, "unix"},
+		{"long line", strings.Repeat("a", 100000) + "\n", []string{strings.Repeat("a", 100000)}, "unix"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			te := newtesteditor(t, tc.content)
+			te.assertlines(tc.lines...)
+			if got := te.screen().fileformat(); got != tc.format {
+				t.Errorf("format mismatch: %v", got)
+			}
+
+			// written back unchanged
+			te.typ(":w<CR>")
+			te.assertfile(tc.content)
+		})
+	}
+
+	// the text written in the empty file ends with the newline, and it is empty again after deleted
+	t.Run("write in empty", func(t *testing.T) {
+		te := newtesteditor(t, "")
+		te.typ("ia<Esc>:w<CR>")
+		te.assertfile("a\n")
+		te.typ("u:w<CR>")
+		te.assertfile("")
+	})
+
+	t.Run("statusline", func(t *testing.T) {
+		te := newtesteditorfile(t, "test.txt", "a\r\nb", 200, 10)
+		if row := te.term.screen.row(8); !strings.HasSuffix(row, " [dos noeol]") {
+			t.Errorf("format is not shown in the status line: %q", row)
+		}
+	})
+
+	t.Run("convert", func(t *testing.T) {
+		te := newtesteditor(t, "a\nb\n")
+		te.typ(":set ff=dos<CR>")
+		if !te.screen().dirty {
+			t.Errorf("must be dirty after conversion")
+		}
+		te.typ(":w<CR>")
+		te.assertfile("a\r\nb\r\n")
+
+		te.typ(":set fileformat=unix<CR>:w<CR>")
+		te.assertfile("a\nb\n")
+
+		te.typ(":set ff=mac<CR>")
+		te.assertmsg("invalid fileformat: mac")
+		te.typ(":set foo<CR>")
+		te.assertmsg("unknown option: foo")
+	})
+
+	t.Run("control character", func(t *testing.T) {
+		te := newtesteditor(t, "a\r\nb\n")
+		te.assertscreen("   1 a^M", "   2 b")
+	})
+}
+
+func TestSwap(t *testing.T) {
+	exists := func(name string) bool {
+		_, err := os.Stat(name)
+		return err == nil
+	}
+
+	t.Run("written while dirty", func(t *testing.T) {
+		te := newtesteditor(t, "abc\n")
+		swap := swapname(te.file.Name())
+
+		te.e.updateswaps()
+		if exists(swap) {
+			t.Fatalf("swap file must not be written for the clean buffer")
+		}
+
+		te.typ("ldl")
+		te.e.updateswaps()
+		sw, err := readswap(swap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(sw.content) != "ac\n" || !slices.Equal(sw.cursors, [][2]int{{0, 1}}) {
+			t.Errorf("swap file mismatch: %q %v", sw.content, sw.cursors)
+		}
+
+		// removed on save
+		te.typ(":w<CR>")
+		if exists(swap) {
+			t.Errorf("swap file must be removed on save")
+		}
+	})
+
+	// the edits in insert mode are written before leaving insert mode
+	t.Run("written in insert mode", func(t *testing.T) {
+		te := newtesteditor(t, "abc\n")
+		swap := swapname(te.file.Name())
+		content := func() string {
+			t.Helper()
+			sw, err := readswap(swap)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return string(sw.content)
+		}
+
+		te.typ("ix")
+		te.e.updateswaps()
+		if got := content(); got != "xabc\n" {
+			t.Errorf("swap content mismatch: %q", got)
+		}
+
+		te.typ("yz")
+		te.assertmode(insert)
+		te.e.updateswaps()
+		if got := content(); got != "xyzabc\n" {
+			t.Errorf("swap content mismatch: %q", got)
+		}
+	})
+
+	t.Run("written on line ending change", func(t *testing.T) {
+		te := newtesteditor(t, "abc\n")
+		te.typ("dl")
+		te.e.updateswaps()
+		te.typ(":set ff=dos<CR>")
+		te.e.updateswaps()
+		sw, err := readswap(swapname(te.file.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(sw.content) != "bc\r\n" {
+			t.Errorf("swap content mismatch: %q", sw.content)
+		}
+	})
+
+	t.Run("removed on undo", func(t *testing.T) {
+		te := newtesteditor(t, "abc\n")
+		te.typ("dl")
+		te.e.updateswaps()
+		te.typ("u")
+		te.e.updateswaps()
+		if exists(swapname(te.file.Name())) {
+			t.Errorf("swap file must be removed when the change is undone")
+		}
+	})
+
+	t.Run("removed on close", func(t *testing.T) {
+		te := newtesteditor(t, "abc\n")
+		te.typ("dl")
+		te.e.updateswaps()
+		te.typ(":q!<CR>")
+		if exists(swapname(te.file.Name())) {
+			t.Errorf("swap file must be removed on close")
+		}
+	})
+
+	// the editor crashed after the change, then the file is opened again
+	crashed := func(t *testing.T) *testeditor {
+		te := newtesteditor(t, "abc\ndef\n")
+		te.typ("jlix<Esc>")
+		te.e.updateswaps()
+		return opentesteditor(t, te.file.Name(), 40, 10)
+	}
+
+	t.Run("recover", func(t *testing.T) {
+		te := crashed(t)
+		te.assertmsg("how to handle the swap file? [r/d/v/i]")
+
+		te.typ("r")
+		te.assertlines("abc", "dxef")
+		te.assertcursors([2]int{1, 2})
+		te.assertmsg("recovered, save to keep it")
+		if !te.screen().dirty {
+			t.Errorf("must be dirty after recovery")
+		}
+
+		te.typ("u")
+		te.assertlines("abc", "def")
+
+		te.typ("<C-r>:w<CR>")
+		te.assertfile("abc\ndxef\n")
+		if exists(swapname(te.file.Name())) {
+			t.Errorf("swap file must be removed on save")
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		te := crashed(t)
+		te.typ("d")
+		te.assertlines("abc", "def")
+		te.assertmsg("swap file deleted")
+		if exists(swapname(te.file.Name())) {
+			t.Errorf("swap file must be deleted")
+		}
+	})
+
+	t.Run("view diff", func(t *testing.T) {
+		te := crashed(t)
+		te.typ("v")
+		rows := te.term.screen.rows()
+		if !slices.Contains(rows, "@@ line 2 @@") || !slices.Contains(rows, "-def") || !slices.Contains(rows, "+dxef") {
+			t.Errorf("difference is not shown:\n%v", fmtrows(rows))
+		}
+
+		// still asking
+		te.assertmsg("how to handle the swap file? [r/d/v/i]")
+		te.typ("i")
+		te.assertlines("abc", "def")
+		if !exists(swapname(te.file.Name())) {
+			t.Errorf("swap file must be kept on ignore")
+		}
+	})
+
+	// the editor which wrote the swap file is still running, it is the one in this test
+	t.Run("running", func(t *testing.T) {
+		te := crashed(t)
+		want := fmt.Sprintf("  written by pid %v (still running) at ", os.Getpid())
+		if got := te.e.msglines[2].text(); !strings.HasPrefix(got, want) {
+			t.Errorf("running editor is not shown: %q", got)
+		}
+	})
+
+	t.Run("not running", func(t *testing.T) {
+		te := newtesteditor(t, "abc\n")
+		swap := "turtle swap\npid 2147483647\ncursors 0:0\nabc\n"
+		if err := os.WriteFile(swapname(te.file.Name()), []byte(swap), 0600); err != nil {
+			t.Fatal(err)
+		}
+		te = opentesteditor(t, te.file.Name(), 40, 10)
+		te.assertmsg("how to handle the swap file? [r/d/v/i]")
+		if got := te.e.msglines[2].text(); strings.Contains(got, "(still running)") {
+			t.Errorf("finished editor must not be shown as running: %q", got)
+		}
+	})
+
+	// the ignored swap file is neither overwritten nor removed, another one is written instead
+	t.Run("ignore", func(t *testing.T) {
+		te := crashed(t)
+		swap := swapname(te.file.Name())
+		other := strings.TrimSuffix(swap, ".swp") + ".swo"
+
+		te.typ("iix<Esc>")
+		te.e.updateswaps()
+		sw, err := readswap(other)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(sw.content) != "xabc\ndef\n" {
+			t.Errorf("swap file mismatch: %q", sw.content)
+		}
+
+		te.typ(":q!<CR>")
+		if exists(other) {
+			t.Errorf("swap file written by the editor must be removed on close")
+		}
+		sw, err = readswap(swap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(sw.content) != "abc\ndxef\n" {
+			t.Errorf("ignored swap file must be kept: %q", sw.content)
+		}
+	})
+
+	t.Run("broken", func(t *testing.T) {
+		te := newtesteditor(t, "abc\n")
+		if err := os.WriteFile(swapname(te.file.Name()), []byte("garbage"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		te = opentesteditor(t, te.file.Name(), 200, 10)
+		if msg := te.term.screen.row(9); !strings.HasPrefix(msg, "cannot read swap file: ") {
+			t.Errorf("error is not shown: %q", msg)
+		}
+	})
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		a, b []string
+		want []string
+	}{
+		{[]string{"a", "b"}, []string{"a", "b"}, nil},
+		{[]string{"a", "b", "c"}, []string{"a", "x", "c"}, []string{"@@ line 2 @@", "-b", "+x"}},
+		{[]string{"a"}, []string{"a", "b"}, []string{"@@ line 2 @@", "+b"}},
+		{[]string{"a", "b"}, []string{"b"}, []string{"@@ line 1 @@", "-a"}},
+		{[]string{"a", "a"}, []string{"a", "a", "a"}, []string{"@@ line 3 @@", "+a"}},
+	}
+
+	for _, tc := range tests {
+		if got := difflines(tc.a, tc.b); !slices.Equal(got, tc.want) {
+			t.Errorf("difflines(%q, %q): want %q, got %q", tc.a, tc.b, tc.want, got)
+		}
+	}
+}
+
+func TestCommand(t *testing.T) {
+	t.Run("save", func(t *testing.T) {
+		te := newtesteditor(t, "abc\n")
+		te.typ("ix<Esc>:w<CR>")
+		te.assertfile("xabc\n")
+		te.assertmsg("saved!")
+		if te.screen().dirty {
+			t.Errorf("must not be dirty after save")
+		}
+	})
+
+	t.Run("save keeps the permission", func(t *testing.T) {
+		te := newtesteditor(t, "abc\n")
+		if err := os.Chmod(te.file.Name(), 0600); err != nil {
+			t.Fatal(err)
+		}
+		te.typ("dl:w<CR>")
+		te.assertfile("bc\n")
+
+		info, err := os.Stat(te.file.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("permission mismatch: %v", info.Mode().Perm())
+		}
+
+		// no temporary file is left
+		entries, err := os.ReadDir(filepath.Dir(te.file.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Errorf("unexpected files are left: %v", entries)
+		}
+
+		// the file is saved again after reopen
+		te.typ("dl:w<CR>")
+		te.assertfile("c\n")
+	})
+
+	t.Run("save through symlink", func(t *testing.T) {
+		te := newtesteditor(t, "abc\n")
+		link := filepath.Join(t.TempDir(), "link.txt")
+		if err := os.Symlink(te.file.Name(), link); err != nil {
+			t.Fatal(err)
+		}
+		file, err := os.Open(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		te.screen().file = file
+
+		te.typ("dl:w<CR>")
+		te.assertfile("bc\n")
+		if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("symlink is replaced: %v", err)
+		}
+	})
+
+	t.Run("backup", func(t *testing.T) {
+		te := newtesteditor(t, "abc\n")
+		te.e.backup = true
+		te.typ("dl:w<CR>")
+		te.assertfile("bc\n")
+
+		got, err := os.ReadFile(te.file.Name() + "~")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "abc\n" {
+			t.Errorf("backup content mismatch: %q", string(got))
+		}
+	})
+
+	t.Run("save failure", func(t *testing.T) {
+		te := newtesteditorfile(t, "test.txt", "abc\n", 200, 10)
+		if err := os.RemoveAll(filepath.Dir(te.file.Name())); err != nil {
+			t.Fatal(err)
+		}
+
+		te.typ("dl:wq<CR>")
+		if te.quit {
+			t.Errorf("editor must not be finished")
+		}
+		if msg := te.term.screen.row(9); !strings.HasPrefix(msg, "cannot save: ") {
+			t.Errorf("error is not shown: %q", msg)
+		}
+		if !te.screen().dirty {
+			t.Errorf("must be dirty after failure")
+		}
+	})
+
+	t.Run("quit", func(t *testing.T) {
+		te := newtesteditor(t, "abc\n")
+		te.typ(":q<CR>")
+		if !te.quit {
+			t.Errorf("editor must be finished")
+		}
+	})
+
+	t.Run("quit with unsaved change", func(t *testing.T) {
+		te := newtesteditorfile(t, "test.txt", "abc\n", 200, 10)
+		te.typ("dl:q<CR>")
+		if te.quit {
+			t.Errorf("editor must not be finished")
+		}
+		te.assertmsg("unsaved change remaining: '" + te.file.Name() + "'")
+
+		te.typ(":q!<CR>")
+		if !te.quit {
+			t.Errorf("editor must be finished")
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		te := newtesteditor(t, "abc\n")
+		te.typ(":q<Esc>")
+		te.assertmode(normal)
+		if te.quit {
+			t.Errorf("editor must not be finished")
+		}
+	})
+}
+
+func TestWindow(t *testing.T) {
+	other := filepath.Join(t.TempDir(), "other.txt")
+	if err := os.WriteFile(other, []byte("xyz\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	te := newtesteditorfile(t, "test.txt", "abc\n", 41, 10)
+	te.typ(":vs " + other + "<CR>")
+	te.assertlines("xyz")
+	te.assertscreen("   1 abc            |   1 xyz")
+
+	te.typ("<C-w>h")
+	te.assertlines("abc")
+
+	te.typ(":hs " + other + "<CR>")
+	te.assertlines("xyz")
+
+	te.typ(":vs notfound<CR>")
+	te.assertmsg("file not found: 'notfound'")
+
+	te.typ(":q<CR>:q<CR>")
+	te.assertlines("xyz")
+	te.typ(":q<CR>")
+	if !te.quit {
+		t.Errorf("editor must be finished")
+	}
+}
+
+func TestBuffer(t *testing.T) {
+	// open the editor with test.txt, and prepare other.txt in the same directory
+	setup := func(t *testing.T) (*testeditor, string) {
+		te := newtesteditorfile(t, "test.txt", "abc\n", 200, 10)
+		other := filepath.Join(filepath.Dir(te.file.Name()), "other.txt")
+		if err := os.WriteFile(other, []byte("xyz\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return te, other
+	}
+
+	t.Run("edit", func(t *testing.T) {
+		te, other := setup(t)
+		te.typ("ldl:e " + other + "<CR>")
+		te.assertlines("xyz")
+
+		// the modified buffer is kept hidden
+		te.typ(":ls<CR>")
+		rows := te.term.screen.rows()
+		want1 := fmt.Sprintf(`  1  h + "%v"`, filepath.Join(filepath.Dir(other), "test.txt"))
+		want2 := fmt.Sprintf(`  2 %%a   "%v"`, other)
+		if !slices.Contains(rows, want1) || !slices.Contains(rows, want2) {
+			t.Errorf("buffers are not listed:\n%v", fmtrows(rows))
+		}
+
+		// the cursor is restored
+		te.typ("<Esc>:bp<CR>")
+		te.assertlines("ac")
+		te.assertcursors([2]int{0, 1})
+
+		te.typ(":e notfound<CR>")
+		te.assertmsg("file not found: 'notfound'")
+	})
+
+	t.Run("switch", func(t *testing.T) {
+		te, other := setup(t)
+		te.typ(":e " + other + "<CR>:bn<CR>")
+		te.assertlines("abc")
+		te.typ(":bn<CR>")
+		te.assertlines("xyz")
+		te.typ(":bp<CR>:bp<CR>")
+		te.assertlines("xyz")
+		te.typ(":b 1<CR>")
+		te.assertlines("abc")
+		te.typ(":b 3<CR>")
+		te.assertmsg("buffer not found: 3")
+
+		// opening the same file again does not add a buffer
+		te.typ(":e " + other + "<CR>")
+		if len(te.e.buffers) != 2 {
+			t.Errorf("buffer count mismatch: %v", len(te.e.buffers))
+		}
+	})
+
+	t.Run("quit with hidden change", func(t *testing.T) {
+		te, other := setup(t)
+		te.typ("dl:e " + other + "<CR>:q<CR>")
+		if te.quit {
+			t.Errorf("editor must not be finished")
+		}
+		te.assertmsg("unsaved change remaining: '" + filepath.Join(filepath.Dir(other), "test.txt") + "'")
+
+		te.typ(":b 1<CR>:w<CR>:q<CR>")
+		if !te.quit {
+			t.Errorf("editor must be finished")
+		}
+	})
+
+	t.Run("shared", func(t *testing.T) {
+		te := newtesteditorfile(t, "test.txt", "abc\ndef\n", 41, 10)
+		te.typ("j:vs " + te.file.Name() + "<CR>")
+		if len(te.e.buffers) != 1 {
+			t.Fatalf("buffer must be shared")
+		}
+
+		// the change is shown on both windows, and the cursors are independent
+		te.typ("Ox<Esc>")
+		te.assertscreen(
+			"   1 x              |   1 x",
+			"   2 abc            |   2 abc",
+			"   3 def            |   3 def",
+		)
+		te.assertcursors([2]int{0, 1})
+		te.typ("<C-w>h")
+		te.assertcursors([2]int{2, 0})
+		if !te.screen().dirty {
+			t.Errorf("the change must be shared")
+		}
+
+		// the change can be undone from any window
+		te.typ("u")
+		te.assertlines("abc", "def")
+		te.assertcursors([2]int{0, 0})
+
+		// closing one of the windows keeps the change
+		te.typ("jdl:q<CR>")
+		te.assertlines("abc", "ef")
+		te.typ(":q<CR>")
+		if te.quit {
+			t.Errorf("editor must not be finished")
+		}
+	})
+}
+
+func TestReader(t *testing.T) {
+	tests := []struct {
+		in   string
+		want *input
+	}{
+		{"a", &input{r: 'a'}},
+		{"あ", &input{r: 'あ'}},
+		{"\r", &input{special: _cr}},
+		{"\t", &input{special: _tab}},
+		{"\x7f", &input{special: _bs}},
+		{"\x1b", &input{special: _esc}},
+		{"\x12", &input{special: _ctrl_r}},
+		{"\x1b[A", &input{special: _up}},
+		{"\x1b[D", &input{special: _left}},
+		{"\x1b[3~", &input{special: _del}},
+		{"\x1b[99~", &input{special: _unknown}},
+		{"\x1b]52;c;YWI=\x07", &input{special: _clipboard, text: "ab"}},
+		{"\x1b[1;5C", &input{special: _right, mod: mod_ctrl}},
+		{"\x1b[1;2A", &input{special: _up, mod: mod_shift}},
+		{"\x1b[3;3~", &input{special: _del, mod: mod_alt}},
+		{"\x1b[Z", &input{special: _tab, mod: mod_shift}},
+		{"\x1bOA", &input{special: _up}},
+		{"\x1bOP", &input{special: _f1}},
+		{"\x1bO5S", &input{special: _f4, mod: mod_ctrl}},
+		{"\x1b[15~", &input{special: _f5}},
+		{"\x1b[24;6~", &input{special: _f12, mod: mod_shift | mod_ctrl}},
+		{"\x1bx", &input{r: 'x', mod: mod_alt}},
+		{"\x1b\x1b", &input{special: _esc, mod: mod_alt}},
+		{"\x1b[200~a\r\nb\rc\x1b[201~", &input{special: _paste, text: "a\nb\nc"}},
+		{"\x1b[200~\x1b[A\x1b[201~", &input{special: _paste, text: "\x1b[A"}},
+		{"\x1b[<0;5;3M", &input{special: _mousepress, x: 4, y: 2}},
+		{"\x1b[<8;1;1M", &input{special: _mousepress, mod: mod_alt}},
+		{"\x1b[<32;6;3M", &input{special: _mousedrag, x: 5, y: 2}},
+		{"\x1b[<0;6;3m", &input{special: _mouserelease, x: 5, y: 2}},
+		{"\x1b[<64;10;20M", &input{special: _wheelup, x: 9, y: 19}},
+		{"\x1b[<65;10;20M", &input{special: _wheeldown, x: 9, y: 19}},
+		{"\x1b[<2;1;1M", &input{special: _unknown}},
+	}
+
+	for _, tc := range tests {
+		r := newreader(strings.NewReader(tc.in), defaultescdelay)
+		if got := r.read(); *got != *tc.want {
+			t.Errorf("%q: want %v, got %v", tc.in, tc.want, got)
+		}
+	}
+
+	// multiple keys arriving at once are split into each input
+	t.Run("multiple", func(t *testing.T) {
+		tests := []struct {
+			in   string
+			want []*input
+		}{
+			{"ab", []*input{{r: 'a'}, {r: 'b'}}},
+			{"aあ\r", []*input{{r: 'a'}, {r: 'あ'}, {special: _cr}}},
+			{"\x1b[A\x1b[1;5Dx", []*input{{special: _up}, {special: _left, mod: mod_ctrl}, {r: 'x'}}},
+			{"\x1bOPq\x7f", []*input{{special: _f1}, {r: 'q'}, {special: _bs}}},
+			{"i\x1b[200~x\ny\x1b[201~\x1b", []*input{{r: 'i'}, {special: _paste, text: "x\ny"}, {special: _esc}}},
+		}
+
+		for _, tc := range tests {
+			r := newreader(strings.NewReader(tc.in), defaultescdelay)
+			got := []*input{}
+			for range tc.want {
+				got = append(got, r.read())
+			}
+			if !slices.EqualFunc(got, tc.want, func(a, b *input) bool { return *a == *b }) {
+				t.Errorf("%q: want %v, got %v", tc.in, tc.want, got)
+			}
+		}
+	})
+
+	// the sequence split across the reads is reassembled when the rest arrives within escdelay
+	t.Run("split", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			chunks   []string
+			escdelay time.Duration
+			want     []*input
+		}{
+			{"esc and rest", []string{"\x1b", "[A"}, time.Second, []*input{{special: _up}}},
+			{"in parameters", []string{"\x1b[1;", "5C"}, time.Second, []*input{{special: _right, mod: mod_ctrl}}},
+			{"alt", []string{"\x1b", "x"}, time.Second, []*input{{r: 'x', mod: mod_alt}}},
+			{"lone esc", []string{"\x1b"}, 10 * time.Millisecond, []*input{{special: _esc}}},
+			{"no delay", []string{"\x1b", "[A"}, 0, []*input{{special: _esc}, {r: '['}, {r: 'A'}}},
+		}
+
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				pr, pw := io.Pipe()
+				defer pw.Close()
+				go func() {
+					for _, chunk := range tc.chunks {
+						pw.Write([]byte(chunk))
+						time.Sleep(50 * time.Millisecond)
+					}
+				}()
+
+				r := newreader(pr, tc.escdelay)
+				got := []*input{}
+				for range tc.want {
+					got = append(got, r.read())
+				}
+				if !slices.EqualFunc(got, tc.want, func(a, b *input) bool { return *a == *b }) {
+					t.Errorf("want %v, got %v", tc.want, got)
+				}
+			})
+		}
+	})
+
+	// the OSC sequence lacking the terminator does not swallow the following keys forever
+	t.Run("long osc", func(t *testing.T) {
+		in := "\x1b]52;c;" + strings.Repeat("A", maxosclen) + "\x07"
+		r := newreader(strings.NewReader(in), defaultescdelay)
+		if got := r.read(); got.special != _unknown {
+			t.Errorf("want unknown, got %v", got)
+		}
+	})
+
+	// the inputs channel is closed when the input reaches EOF or fails
+	t.Run("closed", func(t *testing.T) {
+		for _, in := range []io.Reader{strings.NewReader("a"), io.MultiReader(strings.NewReader("a"), iotest.ErrReader(errors.New("broken")))} {
+			c := make(chan *input, 2)
+			newreader(in, defaultescdelay).tryread(c)
+			if got := <-c; *got != (input{r: 'a'}) {
+				t.Errorf("want a, got %v", got)
+			}
+			if got, ok := <-c; ok {
+				t.Errorf("channel must be closed, got %v", got)
+			}
+		}
+	})
+}
+
+func TestMouse(t *testing.T) {
+	press := func(x, y int) *input { return &input{special: _mousepress, x: x, y: y} }
+	drag := func(x, y int) *input { return &input{special: _mousedrag, x: x, y: y} }
+	release := func(x, y int) *input { return &input{special: _mouserelease, x: x, y: y} }
+
+	t.Run("click", func(t *testing.T) {
+		tests := []struct {
+			name string
+			x, y int
+			want [2]int
+		}{
+			{"char", 6, 1, [2]int{1, 1}},
+			{"line number", 1, 2, [2]int{2, 0}},
+			{"below last line", 7, 7, [2]int{2, 2}},
+			{"after line tail", 30, 0, [2]int{0, 3}},
+		}
+
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				te := newtesteditor(t, "abc\ndef\nghi\n")
+				te.typ("C")
+				te.send(press(tc.x, tc.y))
+				te.send(release(tc.x, tc.y))
+				te.assertcursors(tc.want)
+			})
+		}
+	})
+
+	t.Run("scrolled", func(t *testing.T) {
+		te := newtesteditor(t, strings.Repeat("abcdefghijklmnopqrstuvwxyz0123456789\n", 20))
+		te.typ("19j$")
+		yoffset, xoffset := te.screen().yoffset, te.screen().xoffset
+		if yoffset == 0 || xoffset == 0 {
+			t.Fatalf("screen must be scrolled: %v, %v", yoffset, xoffset)
+		}
+		te.send(press(5, 0))
+		te.assertcursors([2]int{yoffset, xoffset})
+	})
+
+	t.Run("drag", func(t *testing.T) {
+		te := newtesteditor(t, "abc\ndef\nghi\n")
+		te.send(press(5, 0))
+		te.send(drag(5, 0))
+		te.assertmode(normal)
+
+		te.send(drag(6, 1))
+		te.send(release(6, 1))
+		te.assertmode(charselect)
+		te.typ("d")
+		te.assertlines("f", "ghi")
+
+		// clicking finishes the selection
+		te.typ("v")
+		te.send(press(6, 1))
+		te.assertmode(normal)
+		te.assertcursors([2]int{1, 1})
+	})
+
+	t.Run("drag above window", func(t *testing.T) {
+		te := newtesteditor(t, "abc\ndef\nghi\n")
+		te.typ(":hs " + te.file.Name() + "<CR>")
+		lower := te.e.rootwin.children[1]
+		te.send(press(6, lower.y+1))
+		te.send(drag(6, 0))
+		te.send(release(6, 0))
+		if te.e.activewin != lower {
+			t.Fatalf("the lower window must be active")
+		}
+		te.assertmode(charselect)
+		te.assertcursors([2]int{0, 1})
+	})
+
+	t.Run("alt click", func(t *testing.T) {
+		te := newtesteditor(t, "abc\ndef\nghi\n")
+		te.send(&input{special: _mousepress, mod: mod_alt, x: 6, y: 2})
+		te.assertcursors([2]int{0, 0}, [2]int{2, 1})
+		te.typ("dl")
+		te.assertlines("bc", "def", "gi")
+	})
+
+	t.Run("wheel", func(t *testing.T) {
+		te := newtesteditorfile(t, "test.txt", strings.Repeat("a\n", 30), 40, 20)
+		// the cursor going out of the screen is moved into it
+		te.send(&input{special: _wheeldown, x: 5, y: 5})
+		if te.screen().yoffset != 3 {
+			t.Errorf("yoffset mismatch: %v", te.screen().yoffset)
+		}
+		te.assertcursors([2]int{7, 0})
+
+		te.typ("9j")
+		te.send(&input{special: _wheelup, x: 5, y: 5})
+		if te.screen().yoffset != 0 {
+			t.Errorf("yoffset mismatch: %v", te.screen().yoffset)
+		}
+		te.assertcursors([2]int{13, 0})
+
+		// not beyond the last line
+		for range 20 {
+			te.send(&input{special: _wheeldown, x: 5, y: 5})
+		}
+		if te.screen().yoffset != 30-18 {
+			t.Errorf("yoffset mismatch: %v", te.screen().yoffset)
+		}
+	})
+
+	// the window made small by dragging the splitter can scroll without the padding fighting each other
+	t.Run("small window", func(t *testing.T) {
+		te := newtesteditor(t, strings.Repeat("a\n", 20))
+		te.typ(":hs " + te.file.Name() + "<CR>")
+		te.send(press(0, 4))
+		te.send(drag(0, 2))
+		if h := te.e.activewin.height; h != 6 {
+			t.Fatalf("window height mismatch: %v", h)
+		}
+		te.typ("19jkkkkkk")
+		te.assertcursors([2]int{13, 0})
+	})
+
+	t.Run("window", func(t *testing.T) {
+		other := filepath.Join(t.TempDir(), "other.txt")
+		if err := os.WriteFile(other, []byte("xyz\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		te := newtesteditorfile(t, "test.txt", "abc\n", 41, 10)
+		te.typ(":vs " + other + "<CR>i")
+
+		// clicking the other window focuses it and finishes the insert mode
+		te.send(press(6, 0))
+		te.assertmode(normal)
+		te.assertlines("abc")
+		te.assertcursors([2]int{0, 1})
+
+		// clicking the status line only focuses the window
+		te.send(press(30, 8))
+		te.assertlines("xyz")
+		te.assertcursors([2]int{0, 0})
+
+		// dragging the splitter resizes the windows
+		left, right := te.e.rootwin.children[0], te.e.rootwin.children[1]
+		te.send(press(20, 3))
+		te.send(drag(25, 3))
+		te.send(release(25, 3))
+		if left.width != 25 || right.x != 26 || right.width != 15 {
+			t.Errorf("window size mismatch: %v", te.e.rootwin)
+		}
+		te.assertscreen("   1 abc                 |   1 xyz")
+
+		// the windows keep the minimum width
+		te.send(press(25, 3))
+		te.send(drag(40, 3))
+		if left.width != 32 || right.width != minwinwidth {
+			t.Errorf("window size mismatch: %v", te.e.rootwin)
+		}
+	})
+}
+
+func TestBracketedPaste(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		script  string
+		paste   string
+		want    []string
+	}{
+		{"insert", "ab", "li", "x\n  y", []string{"ax", "  yb"}},
+		{"normal", "ab", "", "{\n", []string{"{", "ab"}},
+		{"tab", "", "", "\tz", []string{"\tz"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			te := newtesteditor(t, tc.content)
+			te.typ(tc.script)
+			te.send(&input{special: _paste, text: tc.paste})
+			te.assertlines(tc.want...)
+		})
+	}
+
+	t.Run("cmdline", func(t *testing.T) {
+		te := newtesteditor(t, "abc")
+		te.typ(":")
+		te.send(&input{special: _paste, text: "s/b/x/\nq"})
+		te.typ("<CR>")
+		te.assertlines("axc")
+	})
+
+	t.Run("alt", func(t *testing.T) {
+		// handled as Esc followed by the character
+		te := newtesteditor(t, "abc\ndef")
+		te.typ("ix")
+		te.send(&input{r: 'j', mod: mod_alt})
+		te.assertmode(normal)
+		te.assertlines("xabc", "def")
+		te.assertcursors([2]int{1, 1})
+
+		// recorded as they are typed separately
+		te.typ("qa")
+		te.typ("iy")
+		te.send(&input{r: 'k', mod: mod_alt})
+		te.typ("q")
+		te.assertlines("xabc", "dyef")
+		te.assertcursors([2]int{0, 2})
+		if got := inputsstring(te.e.register.macro("a")); got != "iy<ESC>k" {
+			t.Errorf("unexpected macro: %q", got)
+		}
+	})
+}
+
+// run the whole editor through start() with the fake terminal and the piped input.
+func TestStart(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.txt")
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	term := newtestterm(40, 10)
+	r, w := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		start(term, r, file, &options{theme: theme_doraemon})
+		close(done)
+	}()
+
+	// each write is read as a single keypress
+	for _, seq := range keyseqs("ihello<Esc>:wq<CR>") {
+		if _, err := w.Write(seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("editor is not finished")
+	}
+
+	got, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello\n" {
+		t.Errorf("file content mismatch: %q", string(got))
+	}
+
+	if !term.screen.cursorvisible {
+		t.Errorf("cursor must be shown after finish")
+	}
+}
+
+// Ctrl-z restores the terminal and suspends the editor, then it's initialized again on resume.
+func TestStartSuspend(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.txt")
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	term := newtestterm(40, 10)
+	term.initialized = make(chan struct{}, 2)
+	r, w := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		start(term, r, file, &options{theme: theme_doraemon})
+		close(done)
+	}()
+
+	write := func(script string) {
+		for _, seq := range keyseqs(script) {
+			if _, err := w.Write(seq); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	wait := func(c <-chan struct{}, what string) {
+		select {
+		case <-c:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v timed out", what)
+		}
+	}
+
+	wait(term.initialized, "start")
+	write("ihello<Esc><C-z>")
+	wait(term.initialized, "resume")
+	write(":wq<CR>")
+	wait(done, "finish")
+
+	if term.inits != 2 || term.fins != 2 {
+		t.Errorf("terminal must be initialized and restored twice: %v, %v", term.inits, term.fins)
+	}
+
+	got, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello\n" {
+		t.Errorf("file content mismatch: %q", string(got))
+	}
+}
+
+// closing the input finishes the editor without the panic, and the terminal is restored.
+func TestStartEOF(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.txt")
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	term := newtestterm(40, 10)
+	r, w := io.Pipe()
+	recovered := make(chan any)
+	go func() {
+		defer func() {
+			recovered <- recover()
+		}()
+		start(term, r, file, &options{theme: theme_doraemon})
+	}()
+
+	w.Close()
+
+	select {
+	case p := <-recovered:
+		if p != nil {
+			t.Errorf("unexpected panic: %v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("editor is not finished")
+	}
+
+	if !term.screen.cursorvisible || term.fins != 1 {
+		t.Errorf("terminal must be restored after the input is closed")
+	}
+}
+
+// the terminal is restored on panic.
+func TestStartPanic(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.txt")
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	term := newtestterm(40, 10)
+	r, w := io.Pipe()
+	defer w.Close()
+	recovered := make(chan any)
+	go func() {
+		defer func() {
+			recovered <- recover()
+		}()
+		start(term, r, file, &options{theme: theme_doraemon})
+	}()
+
+	// the write returns once the editor reads the input, where the signals are already handled
+	if _, err := w.Write([]byte("l")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the editor panics on getting the window size on resume
+	term.nosize.Store(true)
+	syscall.Kill(os.Getpid(), syscall.SIGCONT)
+
+	select {
+	case p := <-recovered:
+		if p == nil || !strings.Contains(fmt.Sprint(p), "window size is not available") {
+			t.Errorf("unexpected panic: %v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("editor is not finished")
+	}
+
+	if !term.screen.cursorvisible {
+		t.Errorf("cursor must be shown after panic")
+	}
+}